@@ -66,7 +66,9 @@ const Form = (props) => {
             <ul>{['rewrite_ip_address',
                 'rewrite_domain_name',
                 'rewrite_A',
-                'rewrite_AAAA']
+                'rewrite_AAAA',
+                'rewrite_no_A',
+                'rewrite_no_AAAA']
                 .map((str) => <li key={str}>
                     <Trans components={[<code key="0">text</code>]}>{str}</Trans>
                 </li>)
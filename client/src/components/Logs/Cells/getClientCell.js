@@ -11,9 +11,12 @@ const getClientCell = ({
     row, t, isDetailed, toggleBlocking, autoClients, processingRules,
 }) => {
     const {
-        reason, client, domain, info: { name, whois_info },
+        reason, client, client_name, domain, info: { name: infoName, whois_info },
     } = row.original;
 
+    // the name of the client at the time of the query is used if the client is unknown now
+    const name = infoName || client_name;
+
     const autoClient = autoClients.find((autoClient) => autoClient.name === client);
     const source = autoClient?.source;
     const whoisAvailable = whois_info && Object.keys(whois_info).length > 0;
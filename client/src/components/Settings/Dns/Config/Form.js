@@ -11,8 +11,8 @@ import {
 } from '../../../../helpers/form';
 import {
     validateBiggerOrEqualZeroValue,
-    validateIpv4,
-    validateIpv6,
+    validateIpv4List,
+    validateIpv6List,
     validateRequiredValue,
 } from '../../../../helpers/validators';
 import { BLOCKING_MODES, FORM_NAME } from '../../../../helpers/constants';
@@ -39,12 +39,12 @@ const customIps = [
     {
         description: 'blocking_ipv4_desc',
         name: 'blocking_ipv4',
-        validateIp: validateIpv4,
+        validateIp: validateIpv4List,
     },
     {
         description: 'blocking_ipv6_desc',
         name: 'blocking_ipv6',
-        validateIp: validateIpv6,
+        validateIp: validateIpv6List,
     },
 ];
 
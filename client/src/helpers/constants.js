@@ -290,6 +290,7 @@ export const BLOCKING_MODES = {
     nxdomain: 'nxdomain',
     null_ip: 'null_ip',
     custom_ip: 'custom_ip',
+    refused: 'refused',
 };
 
 export const WHOIS_ICONS = {
@@ -322,6 +323,11 @@ export const FILTERED_STATUS = {
     FILTERED_SAFE_SEARCH: 'FilteredSafeSearch',
     FILTERED_SAFE_BROWSING: 'FilteredSafeBrowsing',
     FILTERED_PARENTAL: 'FilteredParental',
+    FILTERED_REBINDING: 'FilteredRebinding',
+    FILTERED_DEFAULT_DENY: 'FilteredDefaultDeny',
+    FILTERED_BLOCKED_IP: 'FilteredBlockedIP',
+    // not a server reason: the request matched by filters in dry-run mode
+    WOULD_BLOCK: 'WouldBlock',
 };
 
 export const RESPONSE_FILTER = {
@@ -361,6 +367,10 @@ export const RESPONSE_FILTER = {
         query: 'safe_search',
         label: 'safe_search',
     },
+    WOULD_BLOCK: {
+        query: 'would_block',
+        label: 'would_block',
+    },
 };
 
 export const RESPONSE_FILTER_QUERIES = Object.values(RESPONSE_FILTER)
@@ -370,6 +380,10 @@ export const RESPONSE_FILTER_QUERIES = Object.values(RESPONSE_FILTER)
     }, {});
 
 export const FILTERED_STATUS_TO_META_MAP = {
+    [FILTERED_STATUS.WOULD_BLOCK]: {
+        label: RESPONSE_FILTER.WOULD_BLOCK.label,
+        color: 'white',
+    },
     [FILTERED_STATUS.NOT_FILTERED_WHITE_LIST]: {
         label: RESPONSE_FILTER.ALLOWED.label,
         color: 'green',
@@ -406,6 +420,18 @@ export const FILTERED_STATUS_TO_META_MAP = {
         label: RESPONSE_FILTER.BLOCKED_ADULT_WEBSITES.label,
         color: 'yellow',
     },
+    [FILTERED_STATUS.FILTERED_REBINDING]: {
+        label: RESPONSE_FILTER.BLOCKED.label,
+        color: 'red',
+    },
+    [FILTERED_STATUS.FILTERED_DEFAULT_DENY]: {
+        label: RESPONSE_FILTER.BLOCKED.label,
+        color: 'red',
+    },
+    [FILTERED_STATUS.FILTERED_BLOCKED_IP]: {
+        label: RESPONSE_FILTER.BLOCKED.label,
+        color: 'red',
+    },
 };
 
 export const DEFAULT_TIME_FORMAT = 'HH:mm:ss';
@@ -443,6 +469,7 @@ export const BLOCK_ACTIONS = {
 export const SCHEME_TO_PROTOCOL_MAP = {
     doh: 'dns_over_https',
     dot: 'dns_over_tls',
+    internal: 'internal_dns',
     '': 'plain_dns',
 };
 
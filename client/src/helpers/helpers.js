@@ -64,6 +64,7 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         answer,
         answer_dnssec,
         client,
+        client_name,
         client_proto,
         elapsedMs,
         question,
@@ -75,6 +76,7 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         service_name,
         original_answer,
         upstream,
+        dry_run,
     } = log;
 
     const { host: domain, type } = question;
@@ -89,8 +91,9 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         domain,
         type,
         response: processResponse(answer),
-        reason,
+        reason: dry_run ? FILTERED_STATUS.WOULD_BLOCK : reason,
         client,
+        client_name,
         client_proto,
         filterId,
         rule,
@@ -84,6 +84,28 @@ export const validateIpv6 = (value) => {
     return undefined;
 };
 
+/**
+ * @param value {string} comma-separated list of IPv4 addresses
+ * @returns {undefined|string}
+ */
+export const validateIpv4List = (value) => {
+    if (value && value.split(',').some((ip) => !R_IPV4.test(ip.trim()))) {
+        return <Trans>form_error_ip4_format</Trans>;
+    }
+    return undefined;
+};
+
+/**
+ * @param value {string} comma-separated list of IPv6 addresses
+ * @returns {undefined|string}
+ */
+export const validateIpv6List = (value) => {
+    if (value && value.split(',').some((ip) => !R_IPV6.test(ip.trim()))) {
+        return <Trans>form_error_ip6_format</Trans>;
+    }
+    return undefined;
+};
+
 /**
  * @param value {string}
  * @returns {undefined|string}
@@ -10,6 +10,7 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -39,6 +40,12 @@ type RequestFilteringSettings struct {
 	ClientTags []string
 
 	ServicesRules []ServiceEntry
+
+	// Blocking mode for this client; empty: use the server's setting.
+	// BlockingIPv4 and BlockingIPv6 are used with "custom_ip" mode.
+	BlockingMode string
+	BlockingIPv4 []net.IP
+	BlockingIPv6 []net.IP
 }
 
 // Config allows you to configure DNS filtering with New() or just change variables directly.
@@ -96,6 +103,8 @@ type Dnsfilter struct {
 	filteringEngine      *urlfilter.DNSEngine
 	rulesStorageWhite    *filterlist.RuleStorage
 	filteringEngineWhite *urlfilter.DNSEngine
+	blockIPs             map[int64]blockIPs // filter list ID -> addresses for the blocked hosts
+	loadedFilters        []loadedFilter     // the lists loaded into the filtering engines
 	engineLock           sync.RWMutex
 
 	parentalServer       string // access via methods
@@ -116,6 +125,34 @@ type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
 	Data     []byte `yaml:"-"` // List of rules divided by '\n'
 	FilePath string `yaml:"-"` // Path to a filtering rules file
+
+	// Addresses returned for the hosts blocked by this list instead of the global blocking mode.
+	// The address of a hosts-syntax rule takes precedence.
+	BlockIPv4 string `yaml:"block_ipv4,omitempty"`
+	BlockIPv6 string `yaml:"block_ipv6,omitempty"`
+}
+
+// loadedFilter - a filter list loaded into a filtering engine
+type loadedFilter struct {
+	id       int64
+	filePath string
+	allow    bool
+	loadedAt time.Time
+}
+
+// FilterListStats - information about a filter list loaded into the filtering engine
+type FilterListStats struct {
+	ID          int64
+	Allow       bool      // true for the allowlists
+	RulesCount  int       // number of the rules loaded from the list
+	LastUpdated time.Time // modification time of the list file;  zero if the list isn't loaded from a file
+	LoadedAt    time.Time // time when the list has been loaded into the filtering engine
+}
+
+// blockIPs - parsed Filter.BlockIPv4 and Filter.BlockIPv6
+type blockIPs struct {
+	ipv4 net.IP
+	ipv6 net.IP
 }
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -151,6 +188,15 @@ const (
 
 	// RewriteEtcHosts - rewrite by /etc/hosts rule
 	RewriteEtcHosts
+
+	// FilteredRebinding - the response contains a private IP address for a public host name (DNS rebinding)
+	FilteredRebinding
+
+	// FilteredDefaultDeny - the host isn't allowed by any whitelist rule while "default deny" mode is enabled
+	FilteredDefaultDeny
+
+	// FilteredBlockedIP - the response contains an IP address from a blocked range
+	FilteredBlockedIP
 )
 
 var reasonNames = []string{
@@ -167,6 +213,10 @@ var reasonNames = []string{
 
 	"Rewrite",
 	"RewriteEtcHosts",
+
+	"FilteredRebinding",
+	"FilteredDefaultDeny",
+	"FilteredBlockedIP",
 }
 
 func (r Reason) String() string {
@@ -286,8 +336,24 @@ type Result struct {
 	// for ReasonRewrite & RewriteEtcHosts:
 	IPList []net.IP `json:",omitempty"` // list of IP addresses
 
+	// for ReasonRewrite: the response has no records of the requested type ("-A" or "-AAAA" rewrite)
+	NoData bool `json:",omitempty"`
+
 	// for FilteredBlockedService:
 	ServiceName string `json:",omitempty"` // Name of the blocked service
+
+	// for FilteredSafeSearch:
+	SafeSearchProvider SafeSearchProvider `json:",omitempty"` // Search engine which enforced safe search
+
+	// CNAME target matched by a rule while the question host isn't blocked (CNAME cloaking)
+	CloakedHost string `json:",omitempty"`
+
+	// Address of the filter list for this query type which must be returned instead of the global blocking mode
+	BlockIP net.IP `json:",omitempty"`
+
+	// The request would be blocked, but the filtering is in dry-run mode: it has been resolved as usual.
+	// IsFiltered is false, Reason and Rule are of the matched rule.
+	DryRun bool `json:",omitempty"`
 }
 
 // Matched can be used to see if any match at all was found, no matter filtered or not
@@ -431,10 +497,22 @@ func (d *Dnsfilter) processRewrites(host string, qtype uint16) Result {
 		rr = findRewrites(d.Rewrites, host)
 	}
 
+	noDataOnly := len(rr) != 0
 	for _, r := range rr {
+		if !r.isNoData() {
+			noDataOnly = false
+		}
+
 		if (r.Type == dns.TypeA && qtype == dns.TypeA) ||
 			(r.Type == dns.TypeAAAA && qtype == dns.TypeAAAA) {
 
+			if r.isNoData() {
+				log.Debug("Rewrite: no %s records for %s", dns.TypeToString[qtype], host)
+				res.NoData = true
+				res.IPList = nil
+				return res
+			}
+
 			if r.IP == nil { // IP exception
 				res.Reason = 0
 				return res
@@ -445,6 +523,11 @@ func (d *Dnsfilter) processRewrites(host string, qtype uint16) Result {
 		}
 	}
 
+	if noDataOnly && len(res.CanonName) == 0 {
+		// only the records of another type are suppressed: resolve as usual
+		res.Reason = 0
+	}
+
 	return res
 }
 
@@ -547,6 +630,15 @@ func (d *Dnsfilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	d.filteringEngine = filteringEngine
 	d.rulesStorageWhite = rulesStorageWhite
 	d.filteringEngineWhite = filteringEngineWhite
+	d.blockIPs = parseBlockIPs(blockFilters)
+	d.loadedFilters = nil
+	now := time.Now()
+	for _, f := range blockFilters {
+		d.loadedFilters = append(d.loadedFilters, loadedFilter{id: f.ID, filePath: f.FilePath, loadedAt: now})
+	}
+	for _, f := range allowFilters {
+		d.loadedFilters = append(d.loadedFilters, loadedFilter{id: f.ID, filePath: f.FilePath, allow: true, loadedAt: now})
+	}
 
 	// Make sure that the OS reclaims memory as soon as possible
 	debug.FreeOSMemory()
@@ -555,6 +647,95 @@ func (d *Dnsfilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	return nil
 }
 
+// FilterStats returns the information about the filter lists loaded into the filtering engines.
+// The rules are counted on each call, so it shouldn't be called often.
+func (d *Dnsfilter) FilterStats() []FilterListStats {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	blockCounts := countRules(d.rulesStorage)
+	allowCounts := countRules(d.rulesStorageWhite)
+
+	stats := []FilterListStats{}
+	for _, f := range d.loadedFilters {
+		st := FilterListStats{
+			ID:       f.id,
+			Allow:    f.allow,
+			LoadedAt: f.loadedAt,
+		}
+		if f.allow {
+			st.RulesCount = allowCounts[f.id]
+		} else {
+			st.RulesCount = blockCounts[f.id]
+		}
+		if len(f.filePath) != 0 {
+			fi, err := os.Stat(f.filePath)
+			if err == nil {
+				st.LastUpdated = fi.ModTime()
+			}
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// countRules returns the number of rules of each filter list in the storage
+func countRules(storage *filterlist.RuleStorage) map[int64]int {
+	counts := map[int64]int{}
+	if storage == nil {
+		return counts
+	}
+	scan := storage.NewRuleStorageScanner()
+	for scan.Scan() {
+		r, _ := scan.Rule()
+		counts[int64(r.GetFilterListID())]++
+	}
+	return counts
+}
+
+// parseBlockIPs returns the addresses of the filter lists which have them
+func parseBlockIPs(filters []Filter) map[int64]blockIPs {
+	m := map[int64]blockIPs{}
+	for _, f := range filters {
+		ips := blockIPs{}
+		if len(f.BlockIPv4) != 0 {
+			ips.ipv4 = net.ParseIP(f.BlockIPv4).To4()
+			if ips.ipv4 == nil {
+				log.Error("filter %d: invalid block_ipv4: %s", f.ID, f.BlockIPv4)
+			}
+		}
+		if len(f.BlockIPv6) != 0 {
+			ips.ipv6 = net.ParseIP(f.BlockIPv6)
+			if ips.ipv6 == nil || ips.ipv6.To4() != nil {
+				log.Error("filter %d: invalid block_ipv6: %s", f.ID, f.BlockIPv6)
+				ips.ipv6 = nil
+			}
+		}
+		if ips.ipv4 != nil || ips.ipv6 != nil {
+			m[f.ID] = ips
+		}
+	}
+	return m
+}
+
+// setBlockIP sets the address of the filter list for a blocked host.
+// The caller must hold engineLock.
+func (d *Dnsfilter) setBlockIP(res *Result, qtype uint16) {
+	if !res.IsFiltered || len(res.IP) != 0 {
+		return
+	}
+	ips, ok := d.blockIPs[res.FilterID]
+	if !ok {
+		return
+	}
+	switch qtype {
+	case dns.TypeA:
+		res.BlockIP = ips.ipv4
+	case dns.TypeAAAA:
+		res.BlockIP = ips.ipv6
+	}
+}
+
 // matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
 func (d *Dnsfilter) matchHost(host string, qtype uint16, setts RequestFilteringSettings) (Result, error) {
 	d.engineLock.RLock()
@@ -604,6 +785,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 			reason = NotFilteredWhiteList
 		}
 		res := makeResult(rr.NetworkRule, reason)
+		d.setBlockIP(&res, qtype)
 		return res, nil
 	}
 
@@ -638,6 +820,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16, setts RequestFilteringS
 			host, rule.Text(), rule.GetFilterListID())
 		res := makeResult(rule, FilteredBlackList)
 		res.IP = net.IP{}
+		d.setBlockIP(&res, qtype)
 		return res, nil
 	}
 
@@ -2,6 +2,7 @@ package dnsfilter
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -232,6 +233,28 @@ func TestCheckHostSafeSearchGoogle(t *testing.T) {
 	}
 }
 
+func TestSafeSearchProvider(t *testing.T) {
+	// every replacement host belongs to a known search engine
+	for host, safeHost := range safeSearchDomains {
+		assert.NotEqual(t, SafeSearchNone, safeSearchProviders[safeHost], host)
+	}
+	assert.Equal(t, SafeSearchGoogle, safeSearchProviders[safeSearchDomains["www.google.co.uk"]])
+	assert.Equal(t, "google", SafeSearchGoogle.String())
+	assert.Equal(t, "", SafeSearchNone.String())
+
+	d := NewForTest(&Config{SafeSearchEnabled: true}, nil)
+	defer d.Close()
+	result, err := d.CheckHost("yandex.ru", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, FilteredSafeSearch, result.Reason)
+	assert.Equal(t, SafeSearchYandex, result.SafeSearchProvider)
+
+	// the provider is kept in cache
+	result, err = d.CheckHost("yandex.ru", dns.TypeA, &setts)
+	assert.Nil(t, err)
+	assert.Equal(t, SafeSearchYandex, result.SafeSearchProvider)
+}
+
 func TestSafeSearchCacheYandex(t *testing.T) {
 	d := NewForTest(nil, nil)
 	defer d.Close()
@@ -458,6 +481,45 @@ func TestWhitelist(t *testing.T) {
 
 }
 
+func TestFilterStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsfilter")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fn := path.Join(dir, "10.txt")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("||host1^\n! comment\n||host2^\n0.0.0.0 host3 host4\n"), 0644))
+
+	filters := []Filter{
+		{ID: 0, Data: []byte("||host5^\n")},
+		{ID: 10, FilePath: fn},
+	}
+	whiteFilters := []Filter{
+		{ID: 0, Data: []byte("@@||host1^\n@@||host2^\n")},
+	}
+	d := NewForTest(nil, nil)
+	defer d.Close()
+	assert.Nil(t, d.SetFilters(filters, whiteFilters, false))
+
+	stats := d.FilterStats()
+	assert.Equal(t, 3, len(stats))
+
+	assert.Equal(t, int64(0), stats[0].ID)
+	assert.Equal(t, 1, stats[0].RulesCount)
+	assert.True(t, stats[0].LastUpdated.IsZero())
+	assert.False(t, stats[0].LoadedAt.IsZero())
+
+	fi, err := os.Stat(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), stats[1].ID)
+	assert.False(t, stats[1].Allow)
+	assert.Equal(t, 3, stats[1].RulesCount)
+	assert.Equal(t, fi.ModTime(), stats[1].LastUpdated)
+
+	assert.Equal(t, int64(0), stats[2].ID)
+	assert.True(t, stats[2].Allow)
+	assert.Equal(t, 2, stats[2].RulesCount)
+}
+
 // CLIENT SETTINGS
 
 func applyClientSettings(setts *RequestFilteringSettings) {
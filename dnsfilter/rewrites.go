@@ -16,7 +16,7 @@ import (
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
 	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
+	Answer string `yaml:"answer"` // IP address, canonical name or a special value: "A", "AAAA", "-A", "-AAAA"
 	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
 	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
 }
@@ -68,12 +68,15 @@ func (a rewritesArray) Less(i, j int) bool {
 }
 
 // Prepare entry for use
+// "A" and "AAAA" are the exceptions: the records of this type are received from upstream.
+// "-A" and "-AAAA" suppress the records of this type: the response is empty.
 func (r *RewriteEntry) prepare() {
-	if r.Answer == "AAAA" {
+	switch r.Answer {
+	case "AAAA", "-AAAA":
 		r.IP = nil
 		r.Type = dns.TypeAAAA
 		return
-	} else if r.Answer == "A" {
+	case "A", "-A":
 		r.IP = nil
 		r.Type = dns.TypeA
 		return
@@ -95,6 +98,11 @@ func (r *RewriteEntry) prepare() {
 	}
 }
 
+// isNoData returns TRUE if the entry suppresses the records of its type
+func (r *RewriteEntry) isNoData() bool {
+	return r.IP == nil && strings.HasPrefix(r.Answer, "-")
+}
+
 func (d *Dnsfilter) prepareRewrites() {
 	for i := range d.Rewrites {
 		d.Rewrites[i].prepare()
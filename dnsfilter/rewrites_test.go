@@ -213,3 +213,43 @@ func TestRewritesExceptionIP(t *testing.T) {
 	assert.Equal(t, ReasonRewrite, r.Reason)
 	assert.Equal(t, 0, len(r.IPList))
 }
+
+func TestRewritesNoData(t *testing.T) {
+	d := Dnsfilter{}
+	d.Rewrites = []RewriteEntry{
+		{Domain: "host.com", Answer: "-AAAA"},
+		{Domain: "host2.com", Answer: "1.2.3.4"},
+		{Domain: "host2.com", Answer: "-AAAA"},
+		{Domain: "alias.com", Answer: "host.com"},
+	}
+	d.prepareRewrites()
+
+	// the suppressed type
+	r := d.processRewrites("host.com", dns.TypeAAAA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.NoData)
+	assert.Equal(t, 0, len(r.IPList))
+
+	// the other type is resolved as usual
+	r = d.processRewrites("host.com", dns.TypeA)
+	assert.Equal(t, NotFilteredNotFound, r.Reason)
+	assert.False(t, r.NoData)
+
+	// along with an address
+	r = d.processRewrites("host2.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "1.2.3.4", r.IPList[0].String())
+	r = d.processRewrites("host2.com", dns.TypeAAAA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.True(t, r.NoData)
+
+	// CNAME to a host with suppressed records
+	r = d.processRewrites("alias.com", dns.TypeAAAA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "host.com", r.CanonName)
+	assert.True(t, r.NoData)
+	r = d.processRewrites("alias.com", dns.TypeA)
+	assert.Equal(t, ReasonRewrite, r.Reason)
+	assert.Equal(t, "host.com", r.CanonName)
+	assert.False(t, r.NoData)
+}
@@ -63,6 +63,47 @@ func getCachedResult(cache cache.Cache, host string) (Result, bool) {
 	return r, true
 }
 
+// SafeSearchProvider - the search engine for which safe search is enforced
+type SafeSearchProvider int
+
+// Supported search engines
+const (
+	SafeSearchNone SafeSearchProvider = iota
+	SafeSearchGoogle
+	SafeSearchBing
+	SafeSearchYandex
+	SafeSearchDuckDuckGo
+	SafeSearchYouTube
+	SafeSearchPixabay
+)
+
+var safeSearchProviderNames = []string{
+	"",
+	"google",
+	"bing",
+	"yandex",
+	"duckduckgo",
+	"youtube",
+	"pixabay",
+}
+
+func (p SafeSearchProvider) String() string {
+	if uint(p) >= uint(len(safeSearchProviderNames)) {
+		return ""
+	}
+	return safeSearchProviderNames[p]
+}
+
+// safeSearchProviders - the search engines by their safe search replacement hosts from safeSearchDomains
+var safeSearchProviders = map[string]SafeSearchProvider{
+	"forcesafesearch.google.com":   SafeSearchGoogle,
+	"strict.bing.com":              SafeSearchBing,
+	"213.180.193.56":               SafeSearchYandex,
+	"safe.duckduckgo.com":          SafeSearchDuckDuckGo,
+	"restrictmoderate.youtube.com": SafeSearchYouTube,
+	"safesearch.pixabay.com":       SafeSearchPixabay,
+}
+
 // SafeSearchDomain returns replacement address for search engine
 func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
 	val, ok := safeSearchDomains[host]
@@ -88,7 +129,7 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 		return Result{}, nil
 	}
 
-	res := Result{IsFiltered: true, Reason: FilteredSafeSearch}
+	res := Result{IsFiltered: true, Reason: FilteredSafeSearch, SafeSearchProvider: safeSearchProviders[safeHost]}
 	if ip := net.ParseIP(safeHost); ip != nil {
 		res.IP = ip
 		valLen := d.setCacheResult(gctx.safeSearchCache, host, res)
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
@@ -23,6 +24,10 @@ type accessCtx struct {
 	disallowedClientsIPNet []net.IPNet // CIDRs of clients that should be blocked
 
 	blockedHostsEngine *urlfilter.DNSEngine // finds hosts that should be blocked
+
+	// domain suffixes without the leading dot, in lower case (e.g. "zip", "co.uk"):
+	//  the names ending in these labels are blocked
+	blockedSuffixes map[string]bool
 }
 
 func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []string) error {
@@ -36,8 +41,15 @@ func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []strin
 		return err
 	}
 
+	a.blockedSuffixes = map[string]bool{}
 	buf := strings.Builder{}
 	for _, s := range blockedHosts {
+		// ".zip" blocks all names in the TLD
+		if suffix := strings.TrimPrefix(s, "."); len(suffix) != len(s) && len(suffix) != 0 &&
+			!strings.ContainsAny(suffix, "*|^/$") {
+			a.blockedSuffixes[strings.ToLower(strings.TrimSuffix(suffix, "."))] = true
+			continue
+		}
 		buf.WriteString(s)
 		buf.WriteString("\n")
 	}
@@ -59,13 +71,15 @@ func (a *accessCtx) Init(allowedClients, disallowedClients, blockedHosts []strin
 }
 
 // Split array of IP or CIDR into 2 containers for fast search
+// IP addresses are stored in their canonical form
 func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
 	*dst = make(map[string]bool)
 
 	for _, s := range src {
+		s = strings.TrimSpace(s)
 		ip := net.ParseIP(s)
 		if ip != nil {
-			(*dst)[s] = true
+			(*dst)[ip.String()] = true
 			continue
 		}
 
@@ -84,38 +98,33 @@ func (a *accessCtx) IsBlockedIP(ip string) bool {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
+	ipAddr := net.ParseIP(ip)
+	if ipAddr != nil {
+		ip = ipAddr.String()
+	}
+
 	if len(a.allowedClients) != 0 || len(a.allowedClientsIPNet) != 0 {
-		_, ok := a.allowedClients[ip]
-		if ok {
-			return false
-		}
+		return !matchIPCIDR(a.allowedClients, a.allowedClientsIPNet, ip, ipAddr)
+	}
 
-		if len(a.allowedClientsIPNet) != 0 {
-			ipAddr := net.ParseIP(ip)
-			for _, ipnet := range a.allowedClientsIPNet {
-				if ipnet.Contains(ipAddr) {
-					return false
-				}
-			}
-		}
+	return matchIPCIDR(a.disallowedClients, a.disallowedClientsIPNet, ip, ipAddr)
+}
 
+// matchIPCIDR returns TRUE if the IP address is in the map or in one of the subnets
+// CIDR list is checked only if there's no exact match
+func matchIPCIDR(ips map[string]bool, nets []net.IPNet, ip string, ipAddr net.IP) bool {
+	if ips[ip] {
 		return true
 	}
 
-	_, ok := a.disallowedClients[ip]
-	if ok {
-		return true
+	if ipAddr == nil {
+		return false
 	}
-
-	if len(a.disallowedClientsIPNet) != 0 {
-		ipAddr := net.ParseIP(ip)
-		for _, ipnet := range a.disallowedClientsIPNet {
-			if ipnet.Contains(ipAddr) {
-				return true
-			}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ipAddr) {
+			return true
 		}
 	}
-
 	return false
 }
 
@@ -124,7 +133,25 @@ func (a *accessCtx) IsBlockedDomain(host string) bool {
 	a.lock.Lock()
 	_, ok := a.blockedHostsEngine.Match(host)
 	a.lock.Unlock()
-	return ok
+	if ok || len(a.blockedSuffixes) == 0 {
+		return ok
+	}
+	return a.hasBlockedSuffix(host)
+}
+
+// hasBlockedSuffix returns true if the host name or one of its parent domains is in blockedSuffixes
+func (a *accessCtx) hasBlockedSuffix(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for {
+		if a.blockedSuffixes[host] {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
 }
 
 type accessListJSON struct {
@@ -152,6 +179,7 @@ func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
 
 func checkIPCIDRArray(src []string) error {
 	for _, s := range src {
+		s = strings.TrimSpace(s)
 		ip := net.ParseIP(s)
 		if ip != nil {
 			continue
@@ -201,3 +229,51 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Access: updated lists: %d, %d, %d",
 		len(j.AllowedClients), len(j.DisallowedClients), len(j.BlockedHosts))
 }
+
+// Reasons of the access control decisions
+const (
+	accessAllowed          = ""
+	accessBlockedIP        = "ip"
+	accessBlockedDomain    = "domain"
+	accessBlockedRatelimit = "ratelimit"
+)
+
+// isAccessAuditLevelValid returns true if the level of the access audit messages is supported
+func isAccessAuditLevelValid(level string) bool {
+	switch level {
+	case "", "info", "debug":
+		return true
+	}
+	return false
+}
+
+// formatAccessDecision returns the access control decision in key=value format
+func formatAccessDecision(client, qname, reason string) string {
+	if len(qname) == 0 {
+		qname = "-"
+	}
+	if reason == accessAllowed {
+		return fmt.Sprintf("DNS: access: decision=allowed client=%s qname=%s", client, qname)
+	}
+	return fmt.Sprintf("DNS: access: decision=blocked reason=%s client=%s qname=%s", reason, client, qname)
+}
+
+// auditAccess logs the access control decision for the request if the access audit is enabled.
+// reason is empty if the request is allowed.
+func (s *Server) auditAccess(d *proxy.DNSContext, reason string) {
+	level := s.conf.AccessAuditLevel
+	if len(level) == 0 {
+		return
+	}
+
+	qname := ""
+	if len(d.Req.Question) == 1 {
+		qname = d.Req.Question[0].Name
+	}
+	msg := formatAccessDecision(ipFromAddr(d.Addr), qname, reason)
+	if level == "debug" {
+		log.Debug("%s", msg)
+	} else {
+		log.Info("%s", msg)
+	}
+}
@@ -0,0 +1,58 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// parseBlockedNets parses the list of IP addresses and CIDR ranges.
+// A single address is a range with the full-length mask.
+func parseBlockedNets(list []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("DNS: blocked_response_ips: invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("DNS: blocked_response_ips: %s", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkBlockedIP returns a non-nil result if the address from the response is in a blocked range
+func (s *Server) checkBlockedIP(ip net.IP) *dnsfilter.Result {
+	for _, n := range s.blockedNets {
+		if n.Contains(ip) {
+			log.Debug("DNSFwd: %s is in the blocked range %s", ip, n)
+			return &dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredBlockedIP,
+				Rule:       n.String(),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dnsforward
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// parseBlockedNameRegexps compiles the list of regular expressions for the question names
+func parseBlockedNameRegexps(list []string) ([]*regexp.Regexp, error) {
+	res := []*regexp.Regexp{}
+	for _, s := range list {
+		if len(s) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("DNS: blocked_name_regexps: %s", err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// checkBlockedName returns a non-nil result if the question name matches a blocked regular expression.
+// The name is matched in lower case without the trailing dot.
+func (s *Server) checkBlockedName(name string) *dnsfilter.Result {
+	if len(s.blockedNames) == 0 {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, re := range s.blockedNames {
+		if re.MatchString(host) {
+			log.Debug("DNSFwd: %s matches the blocked name regexp %s", host, re)
+			return &dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredBlackList,
+				Rule:       re.String(),
+			}
+		}
+	}
+	return nil
+}
+
+// Block the requests whose names match the blocked regular expressions
+func processBlockedNames(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	s.RLock()
+	res := s.checkBlockedName(d.Req.Question[0].Name)
+	if res != nil {
+		ctx.result = res
+		d.Res = s.genDNSFilterMessage(d, nil, res)
+	}
+	s.RUnlock()
+	return resultDone
+}
@@ -0,0 +1,430 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Default max. time (in seconds) after the expiration during which the stale responses may be served
+const defaultServeStaleMax = 24 * 60 * 60
+
+// TTL of the stale responses (in seconds) as recommended by RFC 8767
+const staleTTL = 30
+
+// Default netmasks of the client's subnet which is sent to upstream servers (the same as in dnsproxy)
+const (
+	ecsCacheMaskV4 = 24
+	ecsCacheMaskV6 = 56
+)
+
+// CacheStats - the counters of the DNS cache
+type CacheStats struct {
+	Hits      uint64 // number of requests answered from cache
+	Misses    uint64 // number of requests sent to upstream servers
+	Evictions uint64 // number of entries removed to free space for the new ones
+	Entries   int    // current number of entries
+	Size      int    // current size of entries (in bytes)
+}
+
+// responseCache keeps the responses of the upstream servers for the main proxy.
+// It's used instead of dnsproxy's cache which doesn't expose the counters and can't be flushed.
+// The zero value is a disabled cache.
+type responseCache struct {
+	lock  sync.Mutex
+	items glcache.Cache // nil if the cache is disabled
+
+	// glcache.Cache.Stats() reads the counters without locking,
+	//  so the modifications are locked for reading and Stats() is locked for writing
+	statsLock sync.RWMutex
+
+	// the expired responses are kept during this time to be served when upstream servers fail;
+	//  0: the expired responses are removed
+	staleMax   time.Duration
+	refreshing map[string]bool // keys of the stale responses being refreshed
+
+	// the responses are kept at least minTTL and at most maxTTL seconds (cache_ttl_min, cache_ttl_max);
+	//  0: no limit
+	minTTL uint32
+	maxTTL uint32
+
+	hits      uint64 // atomic
+	misses    uint64 // atomic
+	evictions uint64 // atomic
+}
+
+// reset recreates the cache with the new size (in bytes);  0 disables the cache.
+// staleMax is the time during which the expired responses may be served.
+// minTTL and maxTTL override the TTL of the responses (in seconds).
+// The counters are kept.
+func (c *responseCache) reset(size uint32, staleMax time.Duration, minTTL, maxTTL uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.staleMax = staleMax
+	c.minTTL = minTTL
+	c.maxTTL = maxTTL
+	c.refreshing = map[string]bool{}
+	if size == 0 {
+		c.items = nil
+		return
+	}
+	c.items = glcache.New(glcache.Config{
+		MaxSize:   uint(size),
+		EnableLRU: true,
+		OnDelete: func(_, _ []byte) {
+			atomic.AddUint64(&c.evictions, 1)
+		},
+	})
+}
+
+func (c *responseCache) get() glcache.Cache {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.items
+}
+
+// flush removes all entries
+func (c *responseCache) flush() {
+	items := c.get()
+	if items != nil {
+		c.statsLock.RLock()
+		items.Clear()
+		c.statsLock.RUnlock()
+	}
+}
+
+// stats returns the current counters
+func (c *responseCache) stats() CacheStats {
+	st := CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	items := c.get()
+	if items != nil {
+		c.statsLock.Lock()
+		is := items.Stats()
+		c.statsLock.Unlock()
+		st.Entries = is.Count
+		st.Size = is.Size
+	}
+	return st
+}
+
+// lookup returns the cached response to the request with TTL values decreased by the time spent in cache.
+// subnet is the client's subnet if the responses are cached per subnet.
+func (c *responseCache) lookup(req *dns.Msg, subnet *net.IPNet, now time.Time) *dns.Msg {
+	items := c.get()
+	if items == nil || len(req.Question) != 1 {
+		return nil
+	}
+
+	key := cacheKey(req, subnet)
+	data := items.Get(key)
+	var resp *dns.Msg
+	if data != nil {
+		expire := cachedExpire(data)
+		if expire > now.Unix() {
+			resp = unpackCachedResponse(data, req, uint32(expire-now.Unix()))
+			if resp == nil {
+				c.del(items, key)
+			}
+		} else if expire+int64(c.getStaleMax()/time.Second) <= now.Unix() {
+			c.del(items, key)
+		}
+	}
+
+	if resp == nil {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return resp
+}
+
+// lookupStale returns the expired response to the request with TTL set to staleTTL.
+// Returns nil if there is no such response or it has expired more than staleMax ago.
+func (c *responseCache) lookupStale(req *dns.Msg, subnet *net.IPNet, now time.Time) *dns.Msg {
+	items := c.get()
+	if items == nil || len(req.Question) != 1 {
+		return nil
+	}
+
+	data := items.Get(cacheKey(req, subnet))
+	if data == nil || cachedExpire(data)+int64(c.getStaleMax()/time.Second) <= now.Unix() {
+		return nil
+	}
+	return unpackCachedResponse(data, req, staleTTL)
+}
+
+func (c *responseCache) getStaleMax() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.staleMax
+}
+
+// startRefresh returns false if the response to the request is already being refreshed
+func (c *responseCache) startRefresh(req *dns.Msg, subnet *net.IPNet) bool {
+	key := string(cacheKey(req, subnet))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.refreshing == nil {
+		c.refreshing = map[string]bool{}
+	}
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *responseCache) finishRefresh(req *dns.Msg, subnet *net.IPNet) {
+	key := string(cacheKey(req, subnet))
+	c.lock.Lock()
+	delete(c.refreshing, key)
+	c.lock.Unlock()
+}
+
+// store saves the response until its smallest TTL expires.
+// The TTL is limited by minTTL and maxTTL.
+func (c *responseCache) store(resp *dns.Msg, subnet *net.IPNet, now time.Time) {
+	c.lock.Lock()
+	items := c.items
+	minTTL, maxTTL := c.minTTL, c.maxTTL
+	c.lock.Unlock()
+	if items == nil || !isCacheable(resp) {
+		return
+	}
+
+	ttl := lowestTTL(resp)
+	if ttl == 0 {
+		return
+	}
+	ttl = limitTTL(ttl, minTTL, maxTTL)
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Debug("DNS: can't cache response: %s", err)
+		return
+	}
+
+	// expire [4]byte
+	// dns_message []byte
+	data := make([]byte, 4+len(packed))
+	binary.BigEndian.PutUint32(data, uint32(now.Unix())+ttl)
+	copy(data[4:], packed)
+	c.statsLock.RLock()
+	items.Set(cacheKey(resp, subnet), data)
+	c.statsLock.RUnlock()
+}
+
+func (c *responseCache) del(items glcache.Cache, key []byte) {
+	c.statsLock.RLock()
+	items.Del(key)
+	c.statsLock.RUnlock()
+}
+
+// cacheKey returns the key of the request
+// Format:
+// uint8(do)
+// uint16(qtype)
+// uint16(qclass)
+// subnet (optional)
+// name
+func cacheKey(m *dns.Msg, subnet *net.IPNet) []byte {
+	q := m.Question[0]
+	b := make([]byte, 5, 5+len(q.Name)+net.IPv6len+1)
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint16(b[1:], q.Qtype)
+	binary.BigEndian.PutUint16(b[3:], q.Qclass)
+	if subnet != nil {
+		ones, _ := subnet.Mask.Size()
+		b = append(b, subnet.IP...)
+		b = append(b, byte(ones))
+	}
+	return append(b, strings.ToLower(q.Name)...)
+}
+
+// isCacheable returns true if the response may be cached
+func isCacheable(m *dns.Msg) bool {
+	if m.Truncated || len(m.Question) != 1 {
+		return false
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false
+	}
+
+	qtype := m.Question[0].Qtype
+	if m.Rcode == dns.RcodeSuccess && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		// don't cache the empty responses to A and AAAA requests
+		for _, rr := range m.Answer {
+			t := rr.Header().Rrtype
+			if t == dns.TypeA || t == dns.TypeAAAA {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// lowestTTL returns the smallest TTL of the response records;  0 if there are no records
+func lowestTTL(m *dns.Msg) uint32 {
+	var ttl uint32 = math.MaxUint32
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if ttl == math.MaxUint32 {
+		return 0
+	}
+	return ttl
+}
+
+// cachedExpire returns the expiration time of the cached data (Unix time in seconds)
+func cachedExpire(data []byte) int64 {
+	return int64(binary.BigEndian.Uint32(data[:4]))
+}
+
+// unpackCachedResponse returns the response to the request from the cached data with the TTL values.
+// Returns nil if the data can't be unpacked.
+func unpackCachedResponse(data []byte, req *dns.Msg, ttl uint32) *dns.Msg {
+	m := dns.Msg{}
+	err := m.Unpack(data[4:])
+	if err != nil {
+		return nil
+	}
+
+	resp := dns.Msg{}
+	resp.SetReply(req)
+	resp.AuthenticatedData = m.AuthenticatedData
+	resp.RecursionAvailable = m.RecursionAvailable
+	resp.Rcode = m.Rcode
+	resp.Compress = true
+
+	reqOpt := req.IsEdns0()
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = ttl
+		resp.Answer = append(resp.Answer, rr)
+	}
+	for _, rr := range m.Ns {
+		rr.Header().Ttl = ttl
+		resp.Ns = append(resp.Ns, rr)
+	}
+	udpSize := uint16(dns.DefaultMsgSize)
+	for _, rr := range m.Extra {
+		// OPT record is hop-by-hop:  it's made for the client's request below
+		if opt, ok := rr.(*dns.OPT); ok {
+			udpSize = opt.UDPSize()
+			continue
+		}
+		rr.Header().Ttl = ttl
+		resp.Extra = append(resp.Extra, rr)
+	}
+	// the client that has sent OPT record gets it in the response;
+	//  DO bit is set only if the client has requested DNSSEC data
+	if reqOpt != nil {
+		resp.SetEdns0(udpSize, reqOpt.Do())
+	}
+	return &resp
+}
+
+// cacheSubnet returns the client's subnet which is sent to upstream servers.
+// Returns nil if the responses aren't cached per subnet.
+func (s *Server) cacheSubnet(d *proxy.DNSContext) *net.IPNet {
+	if !s.conf.EnableEDNSClientSubnet {
+		return nil
+	}
+
+	if e := findECS(d.Req); e != nil && e.SourceNetmask != 0 {
+		return subnetOf(e.Address, int(e.SourceNetmask))
+	}
+
+	var ip net.IP
+	if len(s.conf.EDNSClientSubnetIP) != 0 {
+		ip = net.ParseIP(s.conf.EDNSClientSubnetIP)
+	} else if d.Addr != nil {
+		ip = getIP(d.Addr)
+	}
+	if ip == nil {
+		return nil
+	}
+	if ip.To4() != nil {
+		return subnetOf(ip, ecsCacheMaskV4)
+	}
+	return subnetOf(ip, ecsCacheMaskV6)
+}
+
+// subnetOf returns the network of the address with the prefix length
+func subnetOf(ip net.IP, ones int) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mask := net.CIDRMask(ones, len(ip)*8)
+	if mask == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// serveStale sets the expired cached response if there is one and starts refreshing it in background.
+// Returns false if there is no such response.
+func (s *Server) serveStale(d *proxy.DNSContext, subnet *net.IPNet) bool {
+	resp := s.cache.lookupStale(d.Req, subnet, time.Now())
+	if resp == nil {
+		return false
+	}
+	d.Res = resp
+
+	if s.cache.startRefresh(d.Req, subnet) {
+		refresh := &proxy.DNSContext{
+			Proto: d.Proto,
+			Addr:  d.Addr,
+			Req:   d.Req.Copy(),
+		}
+		s.RLock()
+		p := s.resolver
+		s.RUnlock()
+		go func() {
+			defer s.cache.finishRefresh(refresh.Req, subnet)
+			err := p.Resolve(refresh)
+			if err != nil {
+				log.Debug("DNS: can't refresh stale response: %s", err)
+				return
+			}
+			if refresh.Upstream != nil {
+				s.cache.store(refresh.Res, subnet, time.Now())
+			}
+		}()
+	}
+	return true
+}
+
+// CacheStats returns the counters of the DNS cache
+func (s *Server) CacheStats() CacheStats {
+	return s.cache.stats()
+}
+
+// FlushCache removes all responses from the DNS cache
+func (s *Server) FlushCache() {
+	s.cache.flush()
+	log.Debug("DNS: cache has been flushed")
+}
+
+func (s *Server) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	s.FlushCache()
+}
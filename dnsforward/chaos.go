@@ -0,0 +1,56 @@
+package dnsforward
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultVersion is returned for version.bind requests if ServerConfig.Version isn't set
+const defaultVersion = "AdGuard Home"
+
+// chaosResponse returns the response to CHAOS class TXT request for the server version (version.bind, version.server)
+// or the host name (hostname.bind, id.server).
+// If HideVersion is set, the response has no answer.
+// Returns nil if it's another request.
+func (s *Server) chaosResponse(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return nil
+	}
+
+	text := ""
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		text = s.conf.Version
+		if len(text) == 0 {
+			text = defaultVersion
+		}
+
+	case "hostname.bind.", "id.server.":
+		var err error
+		text, err = os.Hostname()
+		if err != nil {
+			text = ""
+		}
+
+	default:
+		return nil
+	}
+
+	resp := s.makeResponse(req)
+	if s.conf.HideVersion || len(text) == 0 {
+		return resp
+	}
+
+	txt := &dns.TXT{}
+	txt.Hdr = dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: dns.TypeTXT,
+		Class:  dns.ClassCHAOS,
+	}
+	txt.Txt = []string{text}
+	resp.Answer = append(resp.Answer, txt)
+	return resp
+}
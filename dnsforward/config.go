@@ -5,9 +5,12 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
@@ -15,6 +18,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
 )
 
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
@@ -30,16 +34,51 @@ type FilteringConfig struct {
 	// based on the client IP address. Returns nil if there are no custom upstreams for the client
 	GetCustomUpstreamByClient func(clientAddr string) *proxy.UpstreamConfig `yaml:"-"`
 
+	// GetUpstreamGroupsByClient - a callback function that returns upstreams configurations
+	// based on the client IP address, in the order they must be used (see ParseUpstreamGroups).
+	// Returns nil if there are no custom upstreams for the client.
+	// If set, GetCustomUpstreamByClient isn't used.
+	GetUpstreamGroupsByClient func(clientAddr string) []*proxy.UpstreamConfig `yaml:"-"`
+
 	// Protection configuration
 	// --
 
-	ProtectionEnabled  bool   `yaml:"protection_enabled"` // whether or not use any of dnsfilter features
-	BlockingMode       string `yaml:"blocking_mode"`      // mode how to answer filtered requests
-	BlockingIPv4       string `yaml:"blocking_ipv4"`      // IP address to be returned for a blocked A request
-	BlockingIPv6       string `yaml:"blocking_ipv6"`      // IP address to be returned for a blocked AAAA request
-	BlockingIPAddrv4   net.IP `yaml:"-"`
-	BlockingIPAddrv6   net.IP `yaml:"-"`
-	BlockedResponseTTL uint32 `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
+	ProtectionEnabled  bool     `yaml:"protection_enabled"` // whether or not use any of dnsfilter features
+	BlockingMode       string   `yaml:"blocking_mode"`      // mode how to answer filtered requests
+	BlockingIPv4       string   `yaml:"blocking_ipv4"`      // IP addresses to be returned for a blocked A request (comma-separated)
+	BlockingIPv6       string   `yaml:"blocking_ipv6"`      // IP addresses to be returned for a blocked AAAA request (comma-separated)
+	BlockingIPAddrv4   []net.IP `yaml:"-"`
+	BlockingIPAddrv6   []net.IP `yaml:"-"`
+	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"` // if 0, then the default for the answer type is used (3600 or 86400 for PTR);  AdGuard Home's default config has 10, so 0 must be set explicitly
+
+	// TTL of the answers generated by rewrite rules and /etc/hosts.
+	// If 0, BlockedResponseTTL is used.
+	RewriteTTL uint32 `yaml:"rewrite_ttl"`
+
+	// TTL of SOA record added to SERVFAIL responses to the requests that couldn't be filtered
+	// (e.g. the address of a safe search host couldn't be resolved),
+	// so that such failures are cached by the clients for a short time.
+	// If 0, SERVFAIL responses have no SOA record.
+	ServFailSOATTL uint32 `yaml:"servfail_soa_ttl"`
+
+	// Block all hosts which aren't matched by a whitelist rule, rewrite rule or /etc/hosts.
+	// The blocked requests are answered with NXDOMAIN.
+	DefaultDeny bool `yaml:"default_deny"`
+
+	// Text of the TXT record returned for blocked TXT requests.
+	// "{rule}" is replaced with the rule that has matched the request.
+	// If empty, TXT requests are blocked according to the blocking mode.
+	BlockedTXTMessage string `yaml:"blocked_txt_message"`
+
+	// A and AAAA requests for Mozilla canary domain "use-application-dns.net" are answered with NXDOMAIN,
+	// so that Firefox doesn't enable DNS-over-HTTPS automatically.
+	// If true, the canary domain isn't blocked.
+	AllowMozillaCanary bool `yaml:"allow_mozilla_canary"`
+
+	// Special domain names (e.g. canary domains) answered with NXDOMAIN before filtering
+	// Subdomains aren't blocked.
+	// The list never covers Mozilla canary domain:  it's controlled by AllowMozillaCanary only.
+	SpecialBlockedDomains []string `yaml:"special_blocked_domains"`
 
 	// IP (or domain name) which is used to respond to DNS requests blocked by parental control or safe-browsing
 	ParentalBlockHost     string `yaml:"parental_block_host"`
@@ -52,6 +91,11 @@ type FilteringConfig struct {
 	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"` // a list of whitelisted client IP addresses
 	RefuseAny          bool     `yaml:"refuse_any"`          // if true, refuse ANY requests
 
+	// Max. number of requests per second from a given IP (0 to disable).
+	// Unlike Ratelimit, a client may send this number of requests at once after being idle for a second.
+	// The requests over the limit are dropped.  RatelimitWhitelist addresses aren't limited.
+	ClientRatelimit uint32 `yaml:"client_ratelimit"`
+
 	// Upstream DNS servers configuration
 	// --
 
@@ -60,12 +104,39 @@ type FilteringConfig struct {
 	AllServers   bool     `yaml:"all_servers"`   // if true, parallel queries to all configured upstream servers are enabled
 	FastestAddr  bool     `yaml:"fastest_addr"`  // use Fastest Address algorithm
 
+	// How to query the upstream servers:
+	//  "load_balance": one server per request, the faster servers are chosen more often
+	//  "parallel": all servers at once, the first response wins
+	//  "fastest_addr": all servers at once, the response with the fastest IP address wins
+	//    (A and AAAA requests only, the others are handled as in "load_balance" mode)
+	// The mode applies to the servers from UpstreamDNS and to the per-client servers,
+	//  including the domain-specific ones.  Bootstrap servers aren't affected.
+	// If empty, AllServers and FastestAddr settings are used.
+	UpstreamMode string `yaml:"upstream_mode"`
+
+	// Check the upstream servers in background every UpstreamHealthInterval seconds (0: disabled)
+	//  by sending A request for UpstreamHealthName.
+	// A server is reported as unhealthy after UpstreamHealthFailures consecutive failed checks.
+	// The results don't affect the choice of the upstream server.
+	UpstreamHealthInterval uint32 `yaml:"upstream_health_interval"`
+	UpstreamHealthName     string `yaml:"upstream_health_name"`     // if empty, then default is used ("whoami.cloudflare")
+	UpstreamHealthFailures uint32 `yaml:"upstream_health_failures"` // if 0, then default is used (3)
+
+	// The errors of the same upstream servers (or of the filtering) are logged at most once per this interval (in seconds).
+	// If 0, then default is used (60).
+	ErrorLogInterval uint32 `yaml:"error_log_interval"`
+
 	// Access settings
 	// --
 
 	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses of whitelist clients
 	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
-	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
+	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked;  ".zip" blocks all names in the TLD
+
+	// Log the access control decisions: allowed or blocked, the reason (ip, domain or ratelimit),
+	//  the client's address and the question name.
+	// The level of the messages: "info" or "debug".  If empty, the decisions aren't logged.
+	AccessAuditLevel string `yaml:"access_audit_level"`
 
 	// DNS cache settings
 	// --
@@ -74,6 +145,20 @@ type FilteringConfig struct {
 	CacheMinTTL uint32 `yaml:"cache_ttl_min"` // override TTL value (minimum) received from upstream server
 	CacheMaxTTL uint32 `yaml:"cache_ttl_max"` // override TTL value (maximum) received from upstream server
 
+	// Limit TTL of the records in the responses from upstream servers, so that the clients
+	//  don't keep the records for too long (e.g. after the filtering rules are changed).
+	// The records with TTL over MaxUpstreamTTL get TTL of MaxUpstreamTTL,
+	//  the records with TTL under MinUpstreamTTL get TTL of MinUpstreamTTL.
+	// If 0, the limit is disabled.
+	MaxUpstreamTTL uint32 `yaml:"max_upstream_ttl"`
+	MinUpstreamTTL uint32 `yaml:"min_upstream_ttl"`
+
+	// If all upstream servers have failed, respond with the expired cached response (with TTL of 30 seconds)
+	//  and refresh it in background.
+	// The responses expired more than ServeStaleMax seconds ago aren't served.
+	ServeStale    bool   `yaml:"serve_stale"`
+	ServeStaleMax uint32 `yaml:"serve_stale_max"` // if 0, then default is used (86400)
+
 	// Other settings
 	// --
 
@@ -82,6 +167,76 @@ type FilteringConfig struct {
 	EnableDNSSEC           bool     `yaml:"enable_dnssec"`      // Set DNSSEC flag in outcoming DNS request
 	EnableEDNSClientSubnet bool     `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
 	MaxGoroutines          uint32   `yaml:"max_goroutines"`     // Max. number of parallel goroutines for processing incoming requests
+
+	// IP address sent in EDNS Client Subnet option instead of the client's address.
+	// If empty, the client's address is used.
+	EDNSClientSubnetIP string `yaml:"edns_client_subnet_ip"`
+
+	// Remove EDNS Client Subnet option received from the client,
+	// so that upstream servers see only the subnet added by us.
+	// ECS option is also removed from the response.
+	ECSStripIncoming bool `yaml:"edns_client_subnet_strip"`
+
+	// If the client has sent ECS option, return it to the client
+	// with the scope prefix length received from upstream server.
+	// It's ignored if the option is stripped by ECSStripIncoming.
+	ECSEchoScope bool `yaml:"edns_client_subnet_echo_scope"`
+
+	// Upstream servers that never receive EDNS Client Subnet option (e.g. "8.8.8.8", "https://dns.google/dns-query").
+	// The option is removed from the request only when it's sent to one of these servers.
+	ECSDisabledUpstreams []string `yaml:"edns_client_subnet_disabled_upstreams"`
+
+	// NAT64 prefix (e.g. "64:ff9b::/96") used to synthesize AAAA records
+	// for the hosts without native IPv6 addresses (DNS64).
+	// If empty, DNS64 is disabled.
+	DNS64Prefix string `yaml:"dns64_prefix"`
+
+	// Block the responses that resolve a public host name to a private, loopback or link-local address
+	// (DNS rebinding protection).
+	// The hosts from RebindingAllowedHosts (and their subdomains) are allowed to have such addresses.
+	RebindingProtection   bool     `yaml:"rebinding_protection"`
+	RebindingAllowedHosts []string `yaml:"rebinding_allowed_hosts"`
+
+	// Names of the local clients: IP address -> host name.
+	// PTR requests for these addresses are answered with the names without querying upstream servers.
+	ClientNames map[string]string `yaml:"client_names"`
+
+	// Block the responses that contain an IP address from these ranges (CIDR or single IP addresses)
+	BlockedResponseIPs []string `yaml:"blocked_response_ips"`
+
+	// Block the requests whose question names match one of these regular expressions (RE2 syntax).
+	// The names are matched in lower case without the trailing dot.
+	// The blocked requests are answered according to the blocking mode.
+	BlockedNameRegexps []string `yaml:"blocked_name_regexps"`
+
+	// Dry-run mode: the requests matched by filters aren't blocked, but the matches are recorded in the query log
+	FilteringDryRun bool `yaml:"filtering_dry_run"`
+
+	// Don't reveal the version and the host name in response to version.bind and hostname.bind CHAOS requests
+	HideVersion bool `yaml:"hide_version"`
+
+	// Static records: host name -> records in the zone file format without the owner name,
+	// e.g. "HTTPS 1 . alpn=h2" or "TXT \"text\"".
+	// The requests for these names and types are answered without querying upstream servers.
+	StaticRecords map[string][]string `yaml:"static_records"`
+
+	// Local zones: zone name -> NS and SOA records in the zone file format without the owner name,
+	// e.g. "NS ns.home.arpa." or "SOA ns.home.arpa. hostmaster.home.arpa. 1 1800 900 604800 86400".
+	// NS and SOA requests for the names in these zones are answered authoritatively
+	// without querying upstream servers.  The other requests are handled as usual.
+	// If there's no SOA record, it's generated from the SOA settings below.
+	LocalZones map[string][]string `yaml:"local_zones"`
+
+	// SOA record added to NXDOMAIN and empty responses for negative caching
+	// --
+
+	SOANs      string `yaml:"soa_mname"`   // primary name server (FQDN)
+	SOAMbox    string `yaml:"soa_rname"`   // mailbox of the responsible person (FQDN).  If empty, "hostmaster.<zone>" is used
+	SOASerial  uint32 `yaml:"soa_serial"`  // if 0, then default is used (100500)
+	SOARefresh uint32 `yaml:"soa_refresh"` // if 0, then default is used (1800)
+	SOARetry   uint32 `yaml:"soa_retry"`   // if 0, then default is used (900)
+	SOAExpire  uint32 `yaml:"soa_expire"`  // if 0, then default is used (604800)
+	SOAMinTTL  uint32 `yaml:"soa_minttl"`  // if 0, then default is used (86400)
 }
 
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
@@ -105,10 +260,22 @@ type TLSConfig struct {
 // ServerConfig represents server configuration.
 // The zero ServerConfig is empty and ready for use.
 type ServerConfig struct {
-	UDPListenAddr  *net.UDPAddr          // UDP listen address
-	TCPListenAddr  *net.TCPAddr          // TCP listen address
-	UpstreamConfig *proxy.UpstreamConfig // Upstream DNS servers config
-	OnDNSRequest   func(d *proxy.DNSContext)
+	UDPListenAddr   *net.UDPAddr          // UDP listen address
+	TCPListenAddr   *net.TCPAddr          // TCP listen address
+	UpstreamConfig  *proxy.UpstreamConfig // Upstream DNS servers config
+	UpstreamTimeout time.Duration         // timeout of the requests to upstream servers;  if 0, then DefaultTimeout is used
+	OnDNSRequest    func(d *proxy.DNSContext)
+	Version         string // returned for version.bind CHAOS requests;  if empty, "AdGuard Home" is used
+
+	// Called for every request with the final response (d.Res isn't nil) before it's sent to the client.
+	// The response may be modified here, but it's at the caller's risk:
+	//  the changes aren't filtered and aren't reflected in the query log and statistics.
+	// It's called from the request processing goroutine so it must not block.
+	OnDNSResponse func(d *proxy.DNSContext)
+
+	// Called for every filtered request after it's processed.
+	// It's called from the request processing goroutine so it must not block.
+	OnFilteredQuery func(q FilteredQuery)
 
 	FilteringConfig
 	TLSConfig
@@ -122,13 +289,30 @@ type ServerConfig struct {
 
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request))
+
+	// Writes the metrics of other modules in Prometheus text format after the server metrics
+	ExtraMetrics func(w io.Writer) error
 }
 
 // if any of ServerConfig values are zero, then default values from below are used
 var defaultValues = ServerConfig{
-	UDPListenAddr:   &net.UDPAddr{Port: 53},
-	TCPListenAddr:   &net.TCPAddr{Port: 53},
-	FilteringConfig: FilteringConfig{BlockedResponseTTL: 3600},
+	UDPListenAddr: &net.UDPAddr{Port: 53},
+	TCPListenAddr: &net.TCPAddr{Port: 53},
+	FilteringConfig: FilteringConfig{
+		// TTL of the generated answers of the types without a default TTL;
+		//  the configured BlockedResponseTTL isn't replaced with this value
+		BlockedResponseTTL: 3600,
+
+		// copied from AdGuard DNS
+		SOANs:     "fake-for-negative-caching.adguard.com.",
+		SOASerial: 100500,
+		// values copied from verisign's nonexistent .com domain
+		// their exact values are not important in our use case because they are used for domain transfers between primary/secondary DNS servers
+		SOARefresh: 1800,
+		SOARetry:   900,
+		SOAExpire:  604800,
+		SOAMinTTL:  86400,
+	},
 }
 
 // createProxyConfig creates and validates configuration for the main proxy
@@ -148,16 +332,17 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		MaxGoroutines:          int(s.conf.MaxGoroutines),
 	}
 
-	if s.conf.CacheSize != 0 {
-		proxyConfig.CacheEnabled = true
-		proxyConfig.CacheSizeBytes = int(s.conf.CacheSize)
+	if s.conf.EnableEDNSClientSubnet && len(s.conf.EDNSClientSubnetIP) != 0 {
+		proxyConfig.EDNSAddr = net.ParseIP(s.conf.EDNSClientSubnetIP)
+		if proxyConfig.EDNSAddr == nil {
+			return proxyConfig, fmt.Errorf("invalid EDNS Client Subnet IP address: %s", s.conf.EDNSClientSubnetIP)
+		}
 	}
 
-	proxyConfig.UpstreamMode = proxy.UModeLoadBalance
-	if s.conf.AllServers {
-		proxyConfig.UpstreamMode = proxy.UModeParallel
-	} else if s.conf.FastestAddr {
-		proxyConfig.UpstreamMode = proxy.UModeFastestAddr
+	var err error
+	proxyConfig.UpstreamMode, err = s.conf.upstreamMode()
+	if err != nil {
+		return proxyConfig, err
 	}
 
 	if len(s.conf.BogusNXDomain) > 0 {
@@ -172,7 +357,7 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 	}
 
 	// TLS settings
-	err := s.prepareTLS(&proxyConfig)
+	err = s.prepareTLS(&proxyConfig)
 	if err != nil {
 		return proxyConfig, err
 	}
@@ -185,6 +370,97 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 	return proxyConfig, nil
 }
 
+// upstreamMode returns dnsproxy upstream mode
+func (c *FilteringConfig) upstreamMode() (proxy.UpstreamModeType, error) {
+	switch c.UpstreamMode {
+	case "":
+		if c.AllServers {
+			return proxy.UModeParallel, nil
+		} else if c.FastestAddr {
+			return proxy.UModeFastestAddr, nil
+		}
+		return proxy.UModeLoadBalance, nil
+
+	case "load_balance":
+		return proxy.UModeLoadBalance, nil
+
+	case "parallel":
+		return proxy.UModeParallel, nil
+
+	case "fastest_addr":
+		return proxy.UModeFastestAddr, nil
+	}
+
+	return proxy.UModeLoadBalance, fmt.Errorf("invalid upstream mode: %s", c.UpstreamMode)
+}
+
+// parseBlockingIP parses the addresses used in "custom_ip" blocking mode.
+// One of them may be empty:  blocked requests of this type get an empty response.
+func (c *FilteringConfig) parseBlockingIP() error {
+	var err error
+	c.BlockingIPAddrv4, c.BlockingIPAddrv6, err = ParseBlockingIPs(c.BlockingIPv4, c.BlockingIPv6)
+	return err
+}
+
+// ParseBlockingIPs parses the comma-separated lists of the addresses used in "custom_ip" blocking mode.
+// One of them may be empty, but not both.
+func ParseBlockingIPs(ipv4, ipv6 string) ([]net.IP, []net.IP, error) {
+	if len(strings.TrimSpace(ipv4)) == 0 && len(strings.TrimSpace(ipv6)) == 0 {
+		return nil, nil, fmt.Errorf("no custom blocking IP address specified")
+	}
+
+	var ips4, ips6 []net.IP
+	for _, s := range strings.Split(ipv4, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid custom blocking IPv4 address %q", s)
+		}
+		ips4 = append(ips4, ip.To4())
+	}
+	for _, s := range strings.Split(ipv6, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, nil, fmt.Errorf("invalid custom blocking IPv6 address %q", s)
+		}
+		ips6 = append(ips6, ip)
+	}
+	return ips4, ips6, nil
+}
+
+// CheckBlockingMode returns an error if the blocking mode or its custom addresses are invalid
+func CheckBlockingMode(mode, ipv4, ipv6 string) error {
+	if !isBlockingModeValid(mode) {
+		return fmt.Errorf("invalid blocking mode %q", mode)
+	}
+	if mode == "custom_ip" {
+		c := FilteringConfig{BlockingIPv4: ipv4, BlockingIPv6: ipv6}
+		return c.parseBlockingIP()
+	}
+	return nil
+}
+
+// checkSOA returns an error if SOA host names aren't fully qualified domain names
+func (c *FilteringConfig) checkSOA() error {
+	for _, host := range []string{c.SOANs, c.SOAMbox} {
+		if len(host) == 0 {
+			continue
+		}
+		_, ok := dns.IsDomainName(host)
+		if !ok || !dns.IsFqdn(host) {
+			return fmt.Errorf("SOA: %q is not a fully qualified domain name", host)
+		}
+	}
+	return nil
+}
+
 // initDefaultSettings initializes default settings if nothing
 // is configured
 func (s *Server) initDefaultSettings() {
@@ -200,6 +476,39 @@ func (s *Server) initDefaultSettings() {
 	if len(s.conf.SafeBrowsingBlockHost) == 0 {
 		s.conf.SafeBrowsingBlockHost = safeBrowsingBlockHost
 	}
+	if len(s.conf.SOANs) == 0 {
+		s.conf.SOANs = defaultValues.SOANs
+	}
+	if s.conf.SOASerial == 0 {
+		s.conf.SOASerial = defaultValues.SOASerial
+	}
+	if s.conf.SOARefresh == 0 {
+		s.conf.SOARefresh = defaultValues.SOARefresh
+	}
+	if s.conf.SOARetry == 0 {
+		s.conf.SOARetry = defaultValues.SOARetry
+	}
+	if s.conf.SOAExpire == 0 {
+		s.conf.SOAExpire = defaultValues.SOAExpire
+	}
+	if s.conf.SOAMinTTL == 0 {
+		s.conf.SOAMinTTL = defaultValues.SOAMinTTL
+	}
+	if s.conf.UpstreamTimeout == 0 {
+		s.conf.UpstreamTimeout = DefaultTimeout
+	}
+	if s.conf.ServeStaleMax == 0 {
+		s.conf.ServeStaleMax = defaultServeStaleMax
+	}
+	if s.conf.ErrorLogInterval == 0 {
+		s.conf.ErrorLogInterval = defaultErrorLogInterval
+	}
+	if len(s.conf.UpstreamHealthName) == 0 {
+		s.conf.UpstreamHealthName = defaultHealthName
+	}
+	if s.conf.UpstreamHealthFailures == 0 {
+		s.conf.UpstreamHealthFailures = defaultHealthFailures
+	}
 	if s.conf.UDPListenAddr == nil {
 		s.conf.UDPListenAddr = defaultValues.UDPListenAddr
 	}
@@ -210,11 +519,17 @@ func (s *Server) initDefaultSettings() {
 
 // prepareUpstreamSettings - prepares upstream DNS server settings
 func (s *Server) prepareUpstreamSettings() error {
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS, DefaultTimeout)
+	upstreamConfig, err := proxy.ParseUpstreamsConfig(s.conf.UpstreamDNS, s.conf.BootstrapDNS, s.conf.UpstreamTimeout)
 	if err != nil {
 		return fmt.Errorf("DNS: proxy.ParseUpstreamsConfig: %s", err)
 	}
 	s.conf.UpstreamConfig = &upstreamConfig
+
+	s.ecsDisabled, err = parseECSDisabledUpstreams(s.conf.ECSDisabledUpstreams, s.conf.UpstreamTimeout)
+	if err != nil {
+		return err
+	}
+	s.conf.UpstreamConfig = s.ecsUpstreamConfig(s.conf.UpstreamConfig)
 	return nil
 }
 
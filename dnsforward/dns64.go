@@ -0,0 +1,150 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// parseDNS64Prefix parses and validates the prefix for IPv4-embedded IPv6 addresses (RFC 6052)
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("DNS64 prefix %s is not an IPv6 prefix", s)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64:
+		// bits 64..71 aren't a part of the prefix and must be zero
+
+	case 96:
+		if prefix.IP[8] != 0 {
+			return nil, fmt.Errorf("DNS64 prefix %s: bits 64..71 must be zero", s)
+		}
+
+	default:
+		return nil, fmt.Errorf("DNS64 prefix %s: length must be 32, 40, 48, 56, 64 or 96", s)
+	}
+	return prefix, nil
+}
+
+// embedIPv4 returns IPv4-embedded IPv6 address (RFC 6052 2.2)
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP[:ones/8])
+
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++ // skip "u" octet
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// Synthesize AAAA records from A records if there are no native AAAA records (RFC 6147)
+func processDNS64(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+
+	s.RLock()
+	prefix := s.dns64Prefix
+	resolver := s.resolver
+	s.RUnlock()
+
+	if prefix == nil ||
+		!ctx.responseFromUpstream ||
+		d.Req.Question[0].Qtype != dns.TypeAAAA ||
+		d.Res.Rcode != dns.RcodeSuccess {
+		return resultDone
+	}
+	for _, a := range d.Res.Answer {
+		if _, ok := a.(*dns.AAAA); ok {
+			return resultDone // native AAAA records are present
+		}
+	}
+
+	req := d.Req.Copy()
+	req.Id = dns.Id()
+	req.Question[0].Qtype = dns.TypeA
+	ad := &proxy.DNSContext{
+		Proto:                d.Proto,
+		Req:                  req,
+		Addr:                 d.Addr,
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+	}
+	err := resolver.Resolve(ad)
+	if err != nil {
+		log.Debug("DNS64: %s: %s", req.Question[0].Name, err)
+		return resultDone
+	}
+
+	resp := synthDNS64(prefix, d.Res, ad.Res)
+	if resp != nil {
+		log.Debug("DNS64: %s: synthesized %d records", req.Question[0].Name, len(resp.Answer))
+		d.Res = resp
+	}
+	return resultDone
+}
+
+// synthDNS64 creates AAAA response from the A response.
+// Returns nil if there are no A records.
+func synthDNS64(prefix *net.IPNet, aaaaResp, aResp *dns.Msg) *dns.Msg {
+	if aResp == nil || aResp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// TTL of the synthesized records must not exceed SOA minimum TTL from the negative response
+	maxTTL := uint32(0)
+	for _, ns := range aaaaResp.Ns {
+		if soa, ok := ns.(*dns.SOA); ok {
+			maxTTL = soa.Minttl
+			if soa.Hdr.Ttl < maxTTL {
+				maxTTL = soa.Hdr.Ttl
+			}
+		}
+	}
+
+	answers := []dns.RR{}
+	found := false
+	for _, rr := range aResp.Answer {
+		switch a := rr.(type) {
+		case *dns.CNAME:
+			answers = append(answers, dns.Copy(a))
+
+		case *dns.A:
+			aaaa := &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   a.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  a.Hdr.Class,
+					Ttl:    a.Hdr.Ttl,
+				},
+				AAAA: embedIPv4(prefix, a.A),
+			}
+			if maxTTL != 0 && aaaa.Hdr.Ttl > maxTTL {
+				aaaa.Hdr.Ttl = maxTTL
+			}
+			answers = append(answers, aaaa)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	resp := aaaaResp.Copy()
+	resp.Answer = answers
+	resp.Ns = nil
+	return resp
+}
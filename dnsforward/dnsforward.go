@@ -1,9 +1,12 @@
 package dnsforward
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sync"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/querylog"
 	"github.com/AdguardTeam/AdGuardHome/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
@@ -45,11 +49,33 @@ var webRegistered bool
 // The zero Server is empty and ready for use.
 type Server struct {
 	dnsProxy   *proxy.Proxy         // DNS proxy instance
+	resolver   *proxy.Proxy         // resolves the requests;  dnsProxy unless Reconfigure has kept the running proxy
 	dnsFilter  *dnsfilter.Dnsfilter // DNS filter instance
+	hostFilter hostChecker          // matches the host names of the requests;  it is dnsFilter
 	dhcpServer *dhcpd.Server        // DHCP server instance (optional)
 	queryLog   querylog.QueryLog    // Query log instance
 	stats      stats.Stats
 	access     *accessCtx
+	limiter    *clientLimiter // per-client rate limiter;  nil if disabled
+	metrics    metrics        // counters for the /metrics handler
+	workers    workerGroup    // active handleDNSRequest calls
+
+	blockedHosts blockedHostCache // addresses of safe-browsing and parental block hosts
+	dns64Prefix  *net.IPNet       // NAT64 prefix;  nil if DNS64 is disabled
+	rdnsCache    rdnsCache        // results of ResolveRDNS
+	health       healthChecker    // status of the upstream servers
+	errLog       errorLogger      // rate limiter of the error messages
+	cache        responseCache    // responses of the upstream servers of the main proxy
+
+	blockingIPIndex uint32 // counter for the round-robin order of the custom blocking addresses
+
+	specialDomains map[string]bool     // FQDN in lower case -> true;  these names are answered with NXDOMAIN
+	clientNames    map[string]string   // normalized IP address -> FQDN;  parsed ClientNames
+	blockedNets    []*net.IPNet        // parsed BlockedResponseIPs
+	blockedNames   []*regexp.Regexp    // compiled BlockedNameRegexps
+	staticRecords  map[string][]dns.RR // FQDN in lower case -> records;  parsed StaticRecords
+	localZones     map[string][]dns.RR // FQDN of the zone in lower case -> NS and SOA records;  parsed LocalZones
+	ecsDisabled    map[string]bool     // addresses of the upstream servers;  parsed ECSDisabledUpstreams
 
 	tableHostToIP     map[string]net.IP // "hostname -> IP" table for internal addresses (DHCP)
 	tableHostToIPLock sync.Mutex
@@ -80,6 +106,9 @@ type DNSCreateParams struct {
 func NewServer(p DNSCreateParams) *Server {
 	s := &Server{}
 	s.dnsFilter = p.DNSFilter
+	if p.DNSFilter != nil {
+		s.hostFilter = p.DNSFilter
+	}
 	s.stats = p.Stats
 	s.queryLog = p.QueryLog
 	s.dhcpServer = p.DHCPServer
@@ -100,9 +129,11 @@ func NewServer(p DNSCreateParams) *Server {
 func (s *Server) Close() {
 	s.Lock()
 	s.dnsFilter = nil
+	s.hostFilter = nil
 	s.stats = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
+	s.resolver = nil
 	s.Unlock()
 }
 
@@ -117,6 +148,32 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.DisallowedClients = stringArrayDup(sc.DisallowedClients)
 	c.BlockedHosts = stringArrayDup(sc.BlockedHosts)
 	c.UpstreamDNS = stringArrayDup(sc.UpstreamDNS)
+	c.RebindingAllowedHosts = stringArrayDup(sc.RebindingAllowedHosts)
+	c.SpecialBlockedDomains = stringArrayDup(sc.SpecialBlockedDomains)
+	c.BlockedResponseIPs = stringArrayDup(sc.BlockedResponseIPs)
+	c.BlockedNameRegexps = stringArrayDup(sc.BlockedNameRegexps)
+	c.ECSDisabledUpstreams = stringArrayDup(sc.ECSDisabledUpstreams)
+	c.ClientNames = nil
+	if sc.ClientNames != nil {
+		c.ClientNames = map[string]string{}
+		for ip, name := range sc.ClientNames {
+			c.ClientNames[ip] = name
+		}
+	}
+	c.StaticRecords = nil
+	if sc.StaticRecords != nil {
+		c.StaticRecords = map[string][]string{}
+		for name, records := range sc.StaticRecords {
+			c.StaticRecords[name] = stringArrayDup(records)
+		}
+	}
+	c.LocalZones = nil
+	if sc.LocalZones != nil {
+		c.LocalZones = map[string][]string{}
+		for zone, records := range sc.LocalZones {
+			c.LocalZones[zone] = stringArrayDup(records)
+		}
+	}
 	s.RUnlock()
 }
 
@@ -125,9 +182,84 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 // Query log and Stats are not updated.
 // This method may be called before Start().
 func (s *Server) Resolve(host string) ([]net.IPAddr, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	ch := make(chan result, 2)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		go func(qtype uint16) {
+			resp, err := s.ResolveContext(context.Background(), host, qtype)
+			ch <- result{resp, err}
+		}(qtype)
+	}
+
+	var ipAddrs []net.IPAddr
+	var firstErr error
+	for i := 0; i != 2; i++ {
+		r := <-ch
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		proxyutil.AppendIPAddrs(&ipAddrs, r.resp.Answer)
+	}
+
+	if len(ipAddrs) == 0 && firstErr != nil {
+		return []net.IPAddr{}, firstErr
+	}
+	return proxyutil.SortIPAddrs(ipAddrs), nil
+}
+
+// ResolveContext - send a request of the specified type for the host name to an upstream server.
+// Returns ctx.Err() if the context is cancelled or its deadline expires before the response is received.
+// In this case the request itself isn't cancelled, its result is discarded.
+// No request/response filtering is performed.
+// Query log and Stats are not updated.
+// This method may be called before Start().
+func (s *Server) ResolveContext(ctx context.Context, host string, qtype uint16) (*dns.Msg, error) {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{
+		{
+			Name:   dns.Fqdn(host),
+			Qtype:  qtype,
+			Qclass: dns.ClassINET,
+		},
+	}
+
+	// don't hold the lock while waiting for the response
 	s.RLock()
-	defer s.RUnlock()
-	return s.internalProxy.LookupIPAddr(host)
+	p := s.internalProxy
+	s.RUnlock()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		d := &proxy.DNSContext{
+			Proto:     "udp",
+			Req:       req,
+			StartTime: time.Now(),
+		}
+		err := p.Resolve(d)
+		ch <- result{d.Res, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err == nil && r.resp == nil {
+			r.err = fmt.Errorf("no response for %s", req.Question[0].Name)
+		}
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 // Exchange - send DNS request to an upstream server and receive response
@@ -135,19 +267,62 @@ func (s *Server) Resolve(host string) ([]net.IPAddr, error) {
 // Query log and Stats are not updated.
 // This method may be called before Start().
 func (s *Server) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := s.ExchangeWithInfo(req)
+	return resp, err
+}
+
+// protoInternal is the protocol of the requests sent by ExchangeLogged
+const protoInternal = "internal"
+
+// ExchangeLogged - send DNS request as if it's received from a client.
+// Unlike Exchange, the request is filtered and written to the query log and statistics
+// with the loopback address as the client and "internal" protocol,
+// so it's slower and shouldn't be used for the frequent internal requests.
+// This method may be called only after Prepare().
+func (s *Server) ExchangeLogged(req *dns.Msg) (*dns.Msg, error) {
+	d := &proxy.DNSContext{
+		Proto:     protoInternal,
+		Addr:      &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:       req,
+		StartTime: time.Now(),
+	}
+	err := s.handleDNSRequest(nil, d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Res == nil {
+		return nil, fmt.Errorf("no response for %s", req.Question[0].Name)
+	}
+	return d.Res, nil
+}
+
+// ExchangeInfo - information about the upstream server that has answered the request
+type ExchangeInfo struct {
+	Upstream string        // upstream server address;  empty if the response isn't received from upstream
+	Elapsed  time.Duration // time spent on the request
+}
+
+// ExchangeWithInfo - the same as Exchange, but also returns the upstream server address and the response time
+// The information is returned even if the request has failed.
+func (s *Server) ExchangeWithInfo(req *dns.Msg) (*dns.Msg, ExchangeInfo, error) {
 	s.RLock()
 	defer s.RUnlock()
 
+	info := ExchangeInfo{}
 	ctx := &proxy.DNSContext{
 		Proto:     "udp",
 		Req:       req,
 		StartTime: time.Now(),
 	}
 	err := s.internalProxy.Resolve(ctx)
+	info.Elapsed = time.Since(ctx.StartTime)
+	if ctx.Upstream != nil {
+		info.Upstream = ctx.Upstream.Address()
+	}
 	if err != nil {
-		return nil, err
+		return nil, info, err
 	}
-	return ctx.Res, nil
+	return ctx.Res, info, nil
 }
 
 // Start starts the DNS server
@@ -162,35 +337,65 @@ func (s *Server) startInternal() error {
 	err := s.dnsProxy.Start()
 	if err == nil {
 		s.isRunning = true
+		s.startHealthCheck()
 	}
 	return err
 }
 
-// Prepare the object
+// Prepare the object.
+// It can't be called while the server is running (the running proxy would be orphaned):
+// Reconfigure must be used instead.
 func (s *Server) Prepare(config *ServerConfig) error {
+	s.RLock()
+	running := s.isRunning
+	s.RUnlock()
+	if running {
+		return fmt.Errorf("DNS: the server is running, use Reconfigure to apply the configuration")
+	}
+	return s.prepare(config)
+}
+
+// prepare initializes the server with the configuration.  The server must not be running.
+func (s *Server) prepare(config *ServerConfig) error {
 	// 1. Initialize the server configuration
 	// --
 	if config != nil {
 		s.conf = *config
+		if len(s.conf.BlockingMode) != 0 && !isBlockingModeValid(s.conf.BlockingMode) {
+			return fmt.Errorf("DNS: invalid blocking mode %q", s.conf.BlockingMode)
+		}
 		if s.conf.BlockingMode == "custom_ip" {
-			s.conf.BlockingIPAddrv4 = net.ParseIP(s.conf.BlockingIPv4)
-			s.conf.BlockingIPAddrv6 = net.ParseIP(s.conf.BlockingIPv6)
-			if s.conf.BlockingIPAddrv4 == nil || s.conf.BlockingIPAddrv6 == nil {
-				return fmt.Errorf("DNS: invalid custom blocking IP address specified")
+			err := s.conf.parseBlockingIP()
+			if err != nil {
+				return fmt.Errorf("DNS: %s", err)
 			}
 		}
+		if !isAccessAuditLevelValid(s.conf.AccessAuditLevel) {
+			return fmt.Errorf("DNS: invalid access audit level %q", s.conf.AccessAuditLevel)
+		}
 		if s.conf.MaxGoroutines == 0 {
 			s.conf.MaxGoroutines = 50
 		}
+		if s.conf.UpstreamTimeout < 0 {
+			return fmt.Errorf("DNS: invalid upstream timeout %s", s.conf.UpstreamTimeout)
+		}
+		if s.conf.MaxUpstreamTTL != 0 && s.conf.MinUpstreamTTL > s.conf.MaxUpstreamTTL {
+			return fmt.Errorf("DNS: min_upstream_ttl %d is greater than max_upstream_ttl %d",
+				s.conf.MinUpstreamTTL, s.conf.MaxUpstreamTTL)
+		}
 	}
 
 	// 2. Set default values in the case if nothing is configured
 	// --
 	s.initDefaultSettings()
+	err := s.conf.checkSOA()
+	if err != nil {
+		return fmt.Errorf("DNS: %s", err)
+	}
 
 	// 3. Prepare DNS servers settings
 	// --
-	err := s.prepareUpstreamSettings()
+	err = s.prepareUpstreamSettings()
 	if err != nil {
 		return err
 	}
@@ -215,6 +420,53 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
+	s.limiter = nil
+	if s.conf.ClientRatelimit != 0 {
+		s.limiter = newClientLimiter(s.conf.ClientRatelimit, s.conf.RatelimitWhitelist)
+	}
+
+	s.specialDomains = specialBlockedDomains(&s.conf.FilteringConfig)
+
+	s.clientNames, err = parseClientNames(s.conf.ClientNames)
+	if err != nil {
+		return err
+	}
+
+	s.blockedNets, err = parseBlockedNets(s.conf.BlockedResponseIPs)
+	if err != nil {
+		return err
+	}
+
+	s.blockedNames, err = parseBlockedNameRegexps(s.conf.BlockedNameRegexps)
+	if err != nil {
+		return err
+	}
+
+	s.staticRecords, err = parseStaticRecords(s.conf.StaticRecords)
+	if err != nil {
+		return err
+	}
+
+	s.localZones, err = parseLocalZones(s.conf.LocalZones)
+	if err != nil {
+		return err
+	}
+
+	s.dns64Prefix = nil
+	if len(s.conf.DNS64Prefix) != 0 {
+		s.dns64Prefix, err = parseDNS64Prefix(s.conf.DNS64Prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the cache is reset only when the configuration is valid
+	var staleMax time.Duration
+	if s.conf.ServeStale {
+		staleMax = time.Duration(s.conf.ServeStaleMax) * time.Second
+	}
+	s.cache.reset(s.conf.CacheSize, staleMax, s.conf.CacheMinTTL, s.conf.CacheMaxTTL)
+
 	// 6. Register web handlers if necessary
 	// --
 	if !webRegistered && s.conf.HTTPRegister != nil {
@@ -225,9 +477,67 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// 7. Create the main DNS proxy instance
 	// --
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
+	s.resolver = s.dnsProxy
 	return nil
 }
 
+// serverState is the part of the server initialized by prepare()
+type serverState struct {
+	conf           ServerConfig
+	access         *accessCtx
+	limiter        *clientLimiter
+	internalProxy  *proxy.Proxy
+	dnsProxy       *proxy.Proxy
+	resolver       *proxy.Proxy
+	dns64Prefix    *net.IPNet
+	specialDomains map[string]bool
+	clientNames    map[string]string
+	blockedNets    []*net.IPNet
+	blockedNames   []*regexp.Regexp
+	staticRecords  map[string][]dns.RR
+	localZones     map[string][]dns.RR
+	ecsDisabled    map[string]bool
+}
+
+// saveState returns the state initialized by prepare(), so that it can be restored if prepare() fails.
+// The fields assigned by prepare() must be added here.
+func (s *Server) saveState() serverState {
+	return serverState{
+		conf:           s.conf,
+		access:         s.access,
+		limiter:        s.limiter,
+		internalProxy:  s.internalProxy,
+		dnsProxy:       s.dnsProxy,
+		resolver:       s.resolver,
+		dns64Prefix:    s.dns64Prefix,
+		specialDomains: s.specialDomains,
+		clientNames:    s.clientNames,
+		blockedNets:    s.blockedNets,
+		blockedNames:   s.blockedNames,
+		staticRecords:  s.staticRecords,
+		localZones:     s.localZones,
+		ecsDisabled:    s.ecsDisabled,
+	}
+}
+
+// restoreState restores the state saved by saveState()
+func (s *Server) restoreState(st serverState) {
+	s.conf = st.conf
+	s.access = st.access
+	s.limiter = st.limiter
+	s.internalProxy = st.internalProxy
+	s.dnsProxy = st.dnsProxy
+	s.resolver = st.resolver
+	s.dns64Prefix = st.dns64Prefix
+	s.specialDomains = st.specialDomains
+	s.clientNames = st.clientNames
+	s.blockedNets = st.blockedNets
+	s.blockedNames = st.blockedNames
+	s.staticRecords = st.staticRecords
+	s.localZones = st.localZones
+	s.ecsDisabled = st.ecsDisabled
+}
+
 // Stop stops the DNS server
 func (s *Server) Stop() error {
 	s.Lock()
@@ -235,8 +545,25 @@ func (s *Server) Stop() error {
 	return s.stopInternal()
 }
 
+// StopAndWait stops the DNS server and waits until all active requests are processed.
+// Returns an error if the workers haven't exited during the timeout,
+// in this case they continue running in background.
+// After a successful call it's safe to Close() the server.
+func (s *Server) StopAndWait(timeout time.Duration) error {
+	err := s.Stop()
+	if err != nil {
+		return err
+	}
+
+	if !s.workers.wait(timeout) {
+		return fmt.Errorf("DNS workers haven't exited in %s", timeout)
+	}
+	return nil
+}
+
 // stopInternal stops without locking
 func (s *Server) stopInternal() error {
+	s.stopHealthCheck()
 	if s.dnsProxy != nil {
 		err := s.dnsProxy.Stop()
 		if err != nil {
@@ -248,6 +575,52 @@ func (s *Server) stopInternal() error {
 	return nil
 }
 
+// workerGroup tracks the number of active workers.
+// Unlike sync.WaitGroup it allows new workers to appear while someone's waiting.
+type workerGroup struct {
+	lock sync.Mutex
+	n    int
+	idle chan struct{} // closed when the number of workers drops to 0
+}
+
+func (g *workerGroup) add() {
+	g.lock.Lock()
+	g.n++
+	if g.n == 1 {
+		g.idle = make(chan struct{})
+	}
+	g.lock.Unlock()
+}
+
+func (g *workerGroup) done() {
+	g.lock.Lock()
+	g.n--
+	if g.n == 0 {
+		close(g.idle)
+	}
+	g.lock.Unlock()
+}
+
+// wait returns FALSE if there are still active workers after the timeout
+func (g *workerGroup) wait(timeout time.Duration) bool {
+	g.lock.Lock()
+	if g.n == 0 {
+		g.lock.Unlock()
+		return true
+	}
+	idle := g.idle
+	g.lock.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
 // IsRunning returns true if the DNS server is running
 func (s *Server) IsRunning() bool {
 	s.RLock()
@@ -255,27 +628,52 @@ func (s *Server) IsRunning() bool {
 	return s.isRunning
 }
 
-// Reconfigure applies the new configuration to the DNS server
+// SetProtectionEnabled enables or disables filtering without restarting the server.
+// The requests being processed keep the value they've started with.
+func (s *Server) SetProtectionEnabled(enabled bool) {
+	s.Lock()
+	s.conf.ProtectionEnabled = enabled
+	s.Unlock()
+}
+
+// Reconfigure applies the new configuration to the DNS server.
+// The new configuration is prepared while the running proxy keeps serving the requests.
+// If the listen addresses and the settings applied by the proxy itself are the same,
+// the running proxy is kept and passes the requests to the handler which uses the new settings,
+// so no requests are dropped.  Otherwise the proxy is restarted.
+// If the new configuration is invalid, the server continues working with the old one.
 func (s *Server) Reconfigure(config *ServerConfig) error {
 	s.Lock()
 	defer s.Unlock()
 
 	log.Print("Start reconfiguring the server")
-	err := s.stopInternal()
+
+	old := s.saveState()
+	wasRunning := s.isRunning
+	err := s.prepare(config)
 	if err != nil {
+		s.restoreState(old)
 		return errorx.Decorate(err, "could not reconfigure the server")
 	}
 
-	// It seems that net.Listener.Close() doesn't close file descriptors right away.
-	// We wait for some time and hope that this fd will be closed.
-	time.Sleep(100 * time.Millisecond)
+	if wasRunning && sameListeners(&old.dnsProxy.Config, &s.dnsProxy.Config) {
+		s.resolver = s.dnsProxy
+		s.resolver.Init()
+		s.dnsProxy = old.dnsProxy
+		s.startHealthCheck()
+		log.Print("DNS: the listeners haven't changed, the running proxy is kept")
+		return nil
+	}
 
-	err = s.Prepare(config)
+	newProxy := s.dnsProxy
+	s.dnsProxy = old.dnsProxy
+	err = s.stopInternal()
+	s.dnsProxy = newProxy
 	if err != nil {
 		return errorx.Decorate(err, "could not reconfigure the server")
 	}
 
-	err = s.startInternal()
+	err = s.restartInternal()
 	if err != nil {
 		return errorx.Decorate(err, "could not reconfigure the server")
 	}
@@ -283,6 +681,90 @@ func (s *Server) Reconfigure(config *ServerConfig) error {
 	return nil
 }
 
+// sameListeners returns true if the proxy with the configuration "a" can serve the requests
+// instead of the proxy with the configuration "b":  they listen to the same addresses
+// and the settings applied by the proxy before calling our handler are the same.
+// TLS certificate isn't compared:  it's returned by onGetCertificate with the current settings.
+func sameListeners(a, b *proxy.Config) bool {
+	addrs := func(c *proxy.Config) []string {
+		list := []string{}
+		for _, a := range c.UDPListenAddr {
+			list = append(list, "udp://"+a.String())
+		}
+		for _, a := range c.TCPListenAddr {
+			list = append(list, "tcp://"+a.String())
+		}
+		for _, a := range c.TLSListenAddr {
+			list = append(list, "tls://"+a.String())
+		}
+		for _, a := range c.HTTPSListenAddr {
+			list = append(list, "https://"+a.String())
+		}
+		return list
+	}
+
+	return reflect.DeepEqual(addrs(a), addrs(b)) &&
+		(a.TLSConfig == nil) == (b.TLSConfig == nil) &&
+		a.Ratelimit == b.Ratelimit &&
+		reflect.DeepEqual(a.RatelimitWhitelist, b.RatelimitWhitelist) &&
+		a.RefuseAny == b.RefuseAny &&
+		a.MaxGoroutines == b.MaxGoroutines
+}
+
+// restartInternal starts the proxy after the previous one has been stopped
+func (s *Server) restartInternal() error {
+	// The proxy usually listens on the same addresses as the previous one,
+	//  so wait until the old sockets are actually released
+	err := waitListenAddrs(s.dnsProxy, listenReleaseTimeout)
+	if err != nil {
+		return err
+	}
+	return s.startInternal()
+}
+
+// Max. time to wait until the listening sockets of the stopped proxy are released
+const listenReleaseTimeout = time.Second
+
+// waitListenAddrs waits until all listen addresses of the proxy can be bound
+func waitListenAddrs(p *proxy.Proxy, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkListenAddrs(p)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkListenAddrs returns an error if any of the proxy listen addresses is in use
+func checkListenAddrs(p *proxy.Proxy) error {
+	for _, a := range p.UDPListenAddr {
+		if a.Port == 0 {
+			continue
+		}
+		c, err := net.ListenUDP("udp", a)
+		if err != nil {
+			return err
+		}
+		_ = c.Close()
+	}
+
+	tcpAddrs := append([]*net.TCPAddr{}, p.TCPListenAddr...)
+	tcpAddrs = append(tcpAddrs, p.TLSListenAddr...)
+	for _, a := range tcpAddrs {
+		if a.Port == 0 {
+			continue
+		}
+		l, err := net.ListenTCP("tcp", a)
+		if err != nil {
+			return err
+		}
+		_ = l.Close()
+	}
+	return nil
+}
+
 // ServeHTTP is a HTTP handler method we use to provide DNS-over-HTTPS
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.RLock()
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/jsonutil"
 	"github.com/AdguardTeam/golibs/log"
@@ -56,10 +58,12 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	resp.CacheSize = s.conf.CacheSize
 	resp.CacheMinTTL = s.conf.CacheMinTTL
 	resp.CacheMaxTTL = s.conf.CacheMaxTTL
-	if s.conf.FastestAddr {
-		resp.UpstreamMode = "fastest_addr"
-	} else if s.conf.AllServers {
+	mode, _ := s.conf.upstreamMode()
+	switch mode {
+	case proxy.UModeParallel:
 		resp.UpstreamMode = "parallel"
+	case proxy.UModeFastestAddr:
+		resp.UpstreamMode = "fastest_addr"
 	}
 	s.RUnlock()
 
@@ -72,20 +76,20 @@ func (s *Server) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(js)
 }
 
+// isBlockingModeValid returns TRUE if the blocking mode is known
+func isBlockingModeValid(bm string) bool {
+	return bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip" || bm == "refused"
+}
+
 func checkBlockingMode(req dnsConfigJSON) bool {
 	bm := req.BlockingMode
-	if !(bm == "default" || bm == "nxdomain" || bm == "null_ip" || bm == "custom_ip") {
+	if !isBlockingModeValid(bm) {
 		return false
 	}
 
 	if bm == "custom_ip" {
-		ip := net.ParseIP(req.BlockingIPv4)
-		if ip == nil || ip.To4() == nil {
-			return false
-		}
-
-		ip = net.ParseIP(req.BlockingIPv6)
-		if ip == nil {
+		c := FilteringConfig{BlockingIPv4: req.BlockingIPv4, BlockingIPv6: req.BlockingIPv6}
+		if c.parseBlockingIP() != nil {
 			return false
 		}
 	}
@@ -127,7 +131,8 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if js.Exists("upstream_mode") &&
-		!(req.UpstreamMode == "" || req.UpstreamMode == "fastest_addr" || req.UpstreamMode == "parallel") {
+		!(req.UpstreamMode == "" || req.UpstreamMode == "load_balance" ||
+			req.UpstreamMode == "fastest_addr" || req.UpstreamMode == "parallel") {
 		httpError(r, w, http.StatusBadRequest, "upstream_mode: incorrect value")
 		return
 	}
@@ -159,12 +164,11 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		if req.BlockingMode == "custom_ip" {
 			if js.Exists("blocking_ipv4") {
 				s.conf.BlockingIPv4 = req.BlockingIPv4
-				s.conf.BlockingIPAddrv4 = net.ParseIP(req.BlockingIPv4)
 			}
 			if js.Exists("blocking_ipv6") {
 				s.conf.BlockingIPv6 = req.BlockingIPv6
-				s.conf.BlockingIPAddrv6 = net.ParseIP(req.BlockingIPv6)
 			}
+			_ = s.conf.parseBlockingIP()
 		}
 	}
 
@@ -206,16 +210,11 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 	if js.Exists("upstream_mode") {
 		s.conf.FastestAddr = false
 		s.conf.AllServers = false
-		switch req.UpstreamMode {
-		case "":
-			//
-
-		case "parallel":
-			s.conf.AllServers = true
-
-		case "fastest_addr":
-			s.conf.FastestAddr = true
+		s.conf.UpstreamMode = req.UpstreamMode
+		if len(req.UpstreamMode) == 0 {
+			s.conf.UpstreamMode = "load_balance"
 		}
+		restart = true
 	}
 
 	s.Unlock()
@@ -445,13 +444,51 @@ func (s *Server) handleDOH(w http.ResponseWriter, r *http.Request) {
 	s.ServeHTTP(w, r)
 }
 
+type filterStatsJSON struct {
+	ID          int64  `json:"id"`
+	Allow       bool   `json:"allow"`
+	RulesCount  int    `json:"rules_count"`
+	LastUpdated string `json:"last_updated,omitempty"`
+	LoadedAt    string `json:"loaded_at"`
+}
+
+func (s *Server) handleFilterStats(w http.ResponseWriter, r *http.Request) {
+	data := []filterStatsJSON{}
+	for _, st := range s.FilterStats() {
+		j := filterStatsJSON{
+			ID:         st.ID,
+			Allow:      st.Allow,
+			RulesCount: st.RulesCount,
+			LoadedAt:   st.LoadedAt.Format(time.RFC3339),
+		}
+		if !st.LastUpdated.IsZero() {
+			j.LastUpdated = st.LastUpdated.Format(time.RFC3339)
+		}
+		data = append(data, j)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
 func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister("GET", "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister("POST", "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister("POST", "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister("GET", "/control/upstreams_health", s.handleUpstreamsHealth)
+	s.conf.HTTPRegister("GET", "/control/health", s.handleHealth)
+	s.conf.HTTPRegister("GET", "/control/ready", s.handleReady)
+	s.conf.HTTPRegister("POST", "/control/cache_flush", s.handleCacheFlush)
+	s.conf.HTTPRegister("GET", "/control/filtering/loaded", s.handleFilterStats)
 
 	s.conf.HTTPRegister("GET", "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister("POST", "/control/access/set", s.handleAccessSet)
 
+	s.conf.HTTPRegister("GET", "/metrics", s.handleMetrics)
+
 	s.conf.HTTPRegister("", "/dns-query", s.handleDOH)
 }
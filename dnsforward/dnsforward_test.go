@@ -1,24 +1,40 @@
 package dnsforward
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/AdguardTeam/AdGuardHome/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -282,15 +298,92 @@ func TestServerCustomClientUpstream(t *testing.T) {
 	assert.Nil(t, s.Stop())
 }
 
+func TestMetrics(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{"host.": {{192, 168, 0, 1}}},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	reply, err := dns.Exchange(createTestMessage("host."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+
+	reply, err = dns.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Nil(t, s.Stop())
+
+	buf := bytes.Buffer{}
+	assert.Nil(t, s.Metrics(&buf))
+	m := buf.String()
+	assert.Contains(t, m, "adguardhome_dns_queries_total 2\n")
+	assert.Contains(t, m, "adguardhome_dns_filtered_total{reason=\"FilteredBlackList\"} 1\n")
+	assert.Contains(t, m, "adguardhome_dns_responses_total{rcode=\"NOERROR\"} 1\n")
+	assert.Contains(t, m, "adguardhome_dns_responses_total{rcode=\"NXDOMAIN\"} 1\n")
+	assert.Contains(t, m, "adguardhome_dns_request_duration_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, m, "adguardhome_dns_request_duration_seconds_count 2\n")
+
+	s.conf.ExtraMetrics = func(w io.Writer) error {
+		_, err := io.WriteString(w, "extra_total 1\n")
+		return err
+	}
+	buf.Reset()
+	assert.Nil(t, s.Metrics(&buf))
+	assert.True(t, strings.HasSuffix(buf.String(), "\nextra_total 1\n"))
+}
+
+func TestQueryTypeStats(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{"host.": {{192, 168, 0, 1}}},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+	assert.Equal(t, map[string]uint64{}, s.QueryTypeStats())
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeAAAA, typeHTTPS, 1234} {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType("host.", qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+	}
+
+	assert.Equal(t, map[string]uint64{"A": 1, "AAAA": 2, "HTTPS": 1, "TYPE1234": 1}, s.QueryTypeStats())
+
+	buf := bytes.Buffer{}
+	assert.Nil(t, s.Metrics(&buf))
+	assert.Contains(t, buf.String(), "adguardhome_dns_queries_by_type_total{type=\"A\"} 1\n"+
+		"adguardhome_dns_queries_by_type_total{type=\"AAAA\"} 2\n"+
+		"adguardhome_dns_queries_by_type_total{type=\"HTTPS\"} 1\n"+
+		"adguardhome_dns_queries_by_type_total{type=\"TYPE1234\"} 1\n")
+}
+
 // testUpstream is a mock of real upstream.
 // specify fields with necessary values to simulate real upstream behaviour
 type testUpstream struct {
 	cn   map[string]string   // Map of [name]canonical_name
 	ipv4 map[string][]net.IP // Map of [name]IPv4
 	ipv6 map[string][]net.IP // Map of [name]IPv6
+
+	answer func(m *dns.Msg) *dns.Msg // if set, it makes the response instead of the maps
+	err    error                     // if set, all requests fail with this error
+	addr   string                    // if empty, "test" is used
+	n      int32                     // number of the requests (atomic)
 }
 
 func (u *testUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&u.n, 1)
+	if u.err != nil {
+		return nil, u.err
+	}
+	if u.answer != nil {
+		return u.answer(m), nil
+	}
+
 	resp := dns.Msg{}
 	resp.SetReply(m)
 	hasARecord := false
@@ -348,13 +441,86 @@ func (u *testUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
 }
 
 func (u *testUpstream) Address() string {
+	if len(u.addr) != 0 {
+		return u.addr
+	}
 	return "test"
 }
 
+// answerA returns the answer function which responds to A requests with the address.
+// The requests of the other types get an empty response.
+func answerA(ip net.IP, ttl uint32) func(m *dns.Msg) *dns.Msg {
+	return func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			a := &dns.A{}
+			a.Hdr = dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			a.A = ip
+			resp.Answer = append(resp.Answer, a)
+		}
+		return resp
+	}
+}
+
+// answerAfter returns the answer function which signals "started"
+// and waits until "release" is closed before responding
+func answerAfter(started chan<- struct{}, release <-chan struct{}) func(m *dns.Msg) *dns.Msg {
+	return func(m *dns.Msg) *dns.Msg {
+		started <- struct{}{}
+		<-release
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		return resp
+	}
+}
+
+// answerPTR responds with PTR record for 1.2.3.4 and NXDOMAIN for the other addresses
+func answerPTR(m *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	if m.Question[0].Name != "4.3.2.1.in-addr.arpa." {
+		resp.SetRcode(m, dns.RcodeNameError)
+		return resp
+	}
+	resp.SetReply(m)
+	ptr := &dns.PTR{}
+	ptr.Hdr = dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 600}
+	ptr.Ptr = "host.example.org."
+	resp.Answer = append(resp.Answer, ptr)
+	return resp
+}
+
+// ecsRecorder saves the ECS options from the request and copies them to the response
+type ecsRecorder struct {
+	lock   sync.Mutex
+	subnet []*dns.EDNS0_SUBNET
+}
+
+func (r *ecsRecorder) answer(m *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(m)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.subnet = nil
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				r.subnet = append(r.subnet, e)
+			}
+		}
+		resp.SetEdns0(opt.UDPSize(), false)
+		respOpt := resp.IsEdns0()
+		for _, e := range r.subnet {
+			respOpt.Option = append(respOpt.Option, e)
+		}
+	}
+	return resp
+}
+
 func (s *Server) startWithUpstream(u upstream.Upstream) error {
 	s.Lock()
 	defer s.Unlock()
-	err := s.Prepare(nil)
+	err := s.prepare(nil)
 	if err != nil {
 		return err
 	}
@@ -364,6 +530,185 @@ func (s *Server) startWithUpstream(u upstream.Upstream) error {
 	return s.dnsProxy.Start()
 }
 
+func TestStopAndWait(t *testing.T) {
+	s := createTestServer(t)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: answerAfter(started, release)}))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	go func() {
+		_, _ = dns.Exchange(createTestMessage("host."), addr)
+	}()
+	<-started
+
+	// the worker is waiting for the upstream
+	err := s.StopAndWait(100 * time.Millisecond)
+	assert.NotNil(t, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	assert.Nil(t, s.StopAndWait(5*time.Second))
+	s.Close()
+
+	// no active workers
+	assert.Nil(t, s.StopAndWait(0))
+}
+
+func TestResolveContext(t *testing.T) {
+	s := createTestServer(t)
+	assert.Nil(t, s.Prepare(nil))
+	s.internalProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}},
+	}
+
+	resp, err := s.ResolveContext(context.Background(), "host", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, "host.", resp.Question[0].Name)
+	assert.Equal(t, 1, len(resp.Answer))
+
+	resp, err = s.ResolveContext(context.Background(), "host.", dns.TypeMX)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	addrs, err := s.Resolve("host")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.IP{1, 2, 3, 4}}}, addrs)
+
+	// the upstream doesn't respond
+	release := make(chan struct{})
+	defer close(release)
+	s.internalProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{answer: answerAfter(make(chan struct{}, 1), release)}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = s.ResolveContext(ctx, "host", dns.TypeA)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestBlockedHostCache(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+	for _, host := range []string{"a.example.org.", "b.example.org."} {
+		d.Req = createTestMessage(host)
+		resp := s.genBlockedHost(d.Req, "block.example.org", d)
+		assert.Equal(t, 1, len(resp.Answer))
+		a, ok := resp.Answer[0].(*dns.A)
+		assert.True(t, ok)
+		assert.Equal(t, host, a.Hdr.Name)
+		assert.Equal(t, "1.2.3.4", a.A.String())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// another type is resolved separately
+	d.Req = createTestMessageWithType("a.example.org.", dns.TypeAAAA)
+	_ = s.genBlockedHost(d.Req, "block.example.org", d)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+
+	// answers with zero TTL aren't cached
+	s.blockedHosts = blockedHostCache{}
+	u.answer = answerA(net.IP{1, 2, 3, 4}, 0)
+	for i := 0; i != 2; i++ {
+		d.Req = createTestMessage("a.example.org.")
+		_ = s.genBlockedHost(d.Req, "block.example.org", d)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&u.n))
+}
+
+func TestBlockedHostCacheExpire(t *testing.T) {
+	c := blockedHostCache{}
+	now := time.Now()
+	a := &dns.A{Hdr: dns.RR_Header{Name: "block.example.org.", Rrtype: dns.TypeA, Ttl: 10}, A: net.IP{1, 2, 3, 4}}
+	c.set("block.example.org#1", []dns.RR{a}, now)
+
+	answers, ok := c.get("block.example.org#1", now.Add(4*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(6), answers[0].Header().Ttl)
+	assert.Equal(t, uint32(10), a.Hdr.Ttl)
+
+	_, ok = c.get("block.example.org#1", now.Add(10*time.Second))
+	assert.False(t, ok)
+
+	for i := 0; i != blockedHostCacheSize+1; i++ {
+		c.set(fmt.Sprintf("host%d#1", i), []dns.RR{a}, now)
+	}
+	assert.True(t, len(c.items) <= blockedHostCacheSize)
+}
+
+// svcbRdata is HTTPS record data: priority 1, target ".", alpn "h2",
+// ipv4hint 127.0.0.255 and 1.2.3.4, ipv6hint ::1
+const svcbRdata = "0001" + "00" +
+	"0001" + "0003" + "026832" +
+	"0004" + "0008" + "7f0000ff" + "01020304" +
+	"0006" + "0010" + "00000000000000000000000000000001"
+
+func TestStripSVCBHints(t *testing.T) {
+	rr := &dns.RFC3597{Rdata: svcbRdata}
+	rr.Hdr = dns.RR_Header{Name: "svcb.example.org.", Rrtype: typeHTTPS, Class: dns.ClassINET}
+
+	// nothing is blocked
+	newRR, err := stripSVCBHints(rr, func(ip net.IP) bool { return false })
+	assert.Nil(t, err)
+	assert.Nil(t, newRR)
+
+	newRR, err = stripSVCBHints(rr, func(ip net.IP) bool { return ip.Equal(net.IP{127, 0, 0, 255}) })
+	assert.Nil(t, err)
+	assert.Equal(t, "0001"+"00"+"0001000302683200040004010203040006001000000000000000000000000000000001", newRR.Rdata)
+	assert.Equal(t, svcbRdata, rr.Rdata)
+
+	// the hint parameters without addresses are removed
+	newRR, err = stripSVCBHints(rr, func(ip net.IP) bool { return true })
+	assert.Nil(t, err)
+	assert.Equal(t, "0001"+"00"+"00010003026832", newRR.Rdata)
+
+	rr.Rdata = "0001000004"
+	_, err = stripSVCBHints(rr, func(ip net.IP) bool { return true })
+	assert.NotNil(t, err)
+}
+
+func TestBlockedSVCB(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{answer: func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		if m.Question[0].Qtype == typeHTTPS {
+			rr := &dns.RFC3597{Rdata: svcbRdata}
+			rr.Hdr = dns.RR_Header{Name: m.Question[0].Name, Rrtype: typeHTTPS, Class: dns.ClassINET, Ttl: 60}
+			resp.Answer = append(resp.Answer, rr)
+		}
+		return resp
+	}}
+	assert.Nil(t, s.startWithUpstream(u))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the blocked address is removed from the hints
+	reply, err := dns.Exchange(createTestMessageWithType("svcb.example.org.", typeHTTPS), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Answer))
+	rr, ok := reply.Answer[0].(*dns.RFC3597)
+	assert.True(t, ok)
+	assert.Equal(t, "0001"+"00"+"0001000302683200040004010203040006001000000000000000000000000000000001", rr.Rdata)
+
+	// the blocked host
+	reply, err = dns.Exchange(createTestMessageWithType("null.example.org.", typeHTTPS), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+
+	assert.Nil(t, s.Stop())
+}
+
 // testCNAMEs is a simple map of names and CNAMEs necessary for the testUpstream work
 var testCNAMEs = map[string]string{
 	"badhost.":               "null.example.org.",
@@ -378,7 +723,7 @@ var testIPv4 = map[string][]net.IP{
 
 func TestBlockCNAMEProtectionEnabled(t *testing.T) {
 	s := createTestServer(t)
-	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
+	testUpstm := &testUpstream{cn: testCNAMEs, ipv4: testIPv4}
 	s.conf.ProtectionEnabled = false
 	err := s.startWithUpstream(testUpstm)
 	assert.True(t, err == nil)
@@ -394,7 +739,7 @@ func TestBlockCNAMEProtectionEnabled(t *testing.T) {
 
 func TestBlockCNAME(t *testing.T) {
 	s := createTestServer(t)
-	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
+	testUpstm := &testUpstream{cn: testCNAMEs, ipv4: testIPv4}
 	err := s.startWithUpstream(testUpstm)
 	assert.True(t, err == nil)
 	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
@@ -424,9 +769,57 @@ func TestBlockCNAME(t *testing.T) {
 	_ = s.Stop()
 }
 
+func TestBlockCNAMECloaking(t *testing.T) {
+	s := createTestServer(t)
+
+	// only the deepest target of the chain is blocked
+	req := createTestMessage("cloaked.example.com.")
+	resp := &dns.Msg{}
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "cloaked.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: "cdn.example.com.",
+		},
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "cdn.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+			Target: "null.example.org.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "null.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{1, 2, 3, 4},
+		},
+	}
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   req,
+		Res:   resp,
+	}
+	ctx := &dnsContext{srv: s, proxyCtx: d}
+	ctx.setts = s.getClientRequestFilteringSettings(d)
+
+	res, err := s.filterDNSResponse(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, res)
+	assert.True(t, res.IsFiltered)
+	assert.Equal(t, "null.example.org", res.CloakedHost)
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, 0, len(d.Res.Answer))
+	assert.Equal(t, req.Question, d.Res.Question)
+
+	// CNAME records which don't belong to the chain are ignored
+	resp.Answer[0].(*dns.CNAME).Hdr.Name = "other.example.com."
+	d.Res = resp
+	res, err = s.filterDNSResponse(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+	assert.Equal(t, resp, d.Res)
+}
+
 func TestClientRulesForCNAMEMatching(t *testing.T) {
 	s := createTestServer(t)
-	testUpstm := &testUpstream{testCNAMEs, testIPv4, nil}
+	testUpstm := &testUpstream{cn: testCNAMEs, ipv4: testIPv4}
 	s.conf.FilterHandler = func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) {
 		settings.FilteringEnabled = false
 	}
@@ -538,98 +931,800 @@ func TestBlockedCustomIP(t *testing.T) {
 	}
 }
 
-func TestBlockedByHosts(t *testing.T) {
+func TestBlockedCustomIPv4Only(t *testing.T) {
 	s := createTestServer(t)
-	err := s.Start()
-	if err != nil {
-		t.Fatalf("Failed to start server: %s", err)
-	}
+	conf := s.conf
+	conf.BlockingMode = "custom_ip"
+	conf.BlockingIPv4 = ""
+	conf.BlockingIPv6 = ""
+	assert.NotNil(t, s.Prepare(&conf)) // no addresses
+
+	conf.BlockingIPv6 = "0.0.0.1"
+	assert.NotNil(t, s.Prepare(&conf)) // not an IPv6 address
+
+	conf.BlockingIPv4 = "0.0.0.1"
+	conf.BlockingIPv6 = ""
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
 	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
 
-	//
-	// Hosts blocking
-	//
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{Name: "host.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
-	}
+	req := createTestMessageWithType("null.example.org.", dns.TypeA)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reply.Answer))
+	a, ok := reply.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.Equal(t, "0.0.0.1", a.A.String())
 
-	reply, err := dns.Exchange(&req, addr.String())
-	if err != nil {
-		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
-	}
-	if len(reply.Answer) != 1 {
-		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
-	}
-	if a, ok := reply.Answer[0].(*dns.A); ok {
-		if !net.IPv4(127, 0, 0, 1).Equal(a.A) {
-			t.Fatalf("DNS server %s returned wrong answer instead of 8.8.8.8: %v", addr, a.A)
+	// there's no IPv6 address: the answer is empty
+	req = createTestMessageWithType("null.example.org.", dns.TypeAAAA)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 0, len(reply.Answer))
+}
+
+func TestBlockedCustomIPMultiple(t *testing.T) {
+	s := createTestServer(t)
+	conf := s.conf
+	conf.BlockingMode = "custom_ip"
+	conf.BlockingIPv4 = "0.0.0.1, 0.0.0.2,0.0.0.3"
+	conf.BlockingIPv6 = "::1,::2"
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	addrs := func(rrs []dns.RR) []string {
+		list := []string{}
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.A:
+				list = append(list, v.A.String())
+			case *dns.AAAA:
+				list = append(list, v.AAAA.String())
+			}
 		}
-	} else {
-		t.Fatalf("DNS server %s returned wrong answer type instead of A: %v", addr, reply.Answer[0])
+		return list
 	}
 
-	err = s.Stop()
-	if err != nil {
-		t.Fatalf("DNS server failed to stop: %s", err)
+	// all addresses are returned, the first one is rotated
+	firsts := map[string]bool{}
+	for i := 0; i != 3; i++ {
+		req := createTestMessageWithType("null.example.org.", dns.TypeA)
+		reply, err := dns.Exchange(req, addr.String())
+		assert.Nil(t, err)
+		list := addrs(reply.Answer)
+		assert.Equal(t, 3, len(list))
+		firsts[list[0]] = true
+		sort.Strings(list)
+		assert.Equal(t, []string{"0.0.0.1", "0.0.0.2", "0.0.0.3"}, list)
 	}
+	assert.Equal(t, 3, len(firsts))
+
+	req := createTestMessageWithType("null.example.org.", dns.TypeAAAA)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	list := addrs(reply.Answer)
+	sort.Strings(list)
+	assert.Equal(t, []string{"::1", "::2"}, list)
+
+	conf.BlockingIPv4 = "0.0.0.1,::1"
+	assert.NotNil(t, s.Prepare(&conf))
 }
 
-func TestBlockedBySafeBrowsing(t *testing.T) {
+func TestSOA(t *testing.T) {
 	s := createTestServer(t)
-	err := s.Start()
-	if err != nil {
-		t.Fatalf("Failed to start server: %s", err)
-	}
+	assert.Nil(t, s.Start())
 	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
 
-	//
-	// Safebrowsing blocking
-	//
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{Name: "wmconvirus.narod.ru.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	getSOA := func() *dns.SOA {
+		req := createTestMessage("nxdomain.example.org.")
+		reply, err := dns.Exchange(req, addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+		assert.Equal(t, 1, len(reply.Ns))
+		soa, ok := reply.Ns[0].(*dns.SOA)
+		assert.True(t, ok)
+		return soa
 	}
-	reply, err := dns.Exchange(&req, addr.String())
-	if err != nil {
-		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+
+	// default values
+	soa := getSOA()
+	assert.Equal(t, "fake-for-negative-caching.adguard.com.", soa.Ns)
+	assert.Equal(t, "hostmaster.nxdomain.example.org.", soa.Mbox)
+	assert.Equal(t, uint32(100500), soa.Serial)
+	assert.Equal(t, uint32(1800), soa.Refresh)
+	assert.Equal(t, uint32(900), soa.Retry)
+	assert.Equal(t, uint32(604800), soa.Expire)
+	assert.Equal(t, uint32(86400), soa.Minttl)
+
+	conf := s.conf
+	conf.SOANs = "ns.lan."
+	conf.SOAMbox = "admin.lan."
+	conf.SOASerial = 1
+	conf.SOARefresh = 2
+	conf.SOARetry = 3
+	conf.SOAExpire = 4
+	conf.SOAMinTTL = 5
+	assert.Nil(t, s.Reconfigure(&conf))
+	addr = s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	soa = getSOA()
+	assert.Equal(t, "ns.lan.", soa.Ns)
+	assert.Equal(t, "admin.lan.", soa.Mbox)
+	assert.Equal(t, uint32(1), soa.Serial)
+	assert.Equal(t, uint32(2), soa.Refresh)
+	assert.Equal(t, uint32(3), soa.Retry)
+	assert.Equal(t, uint32(4), soa.Expire)
+	assert.Equal(t, uint32(5), soa.Minttl)
+
+	assert.Nil(t, s.Stop())
+
+	// host names must be FQDNs
+	conf.SOANs = "ns.lan"
+	assert.NotNil(t, s.Prepare(&conf))
+	conf.SOANs = "ns.lan."
+	conf.SOAMbox = "admin..lan."
+	assert.NotNil(t, s.Prepare(&conf))
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// RFC 6052 2.4
+	ip4 := net.IP{192, 0, 2, 33}
+	testCases := []struct {
+		prefix string
+		ip     string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
 	}
-	if len(reply.Answer) != 1 {
-		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	for _, tc := range testCases {
+		prefix, err := parseDNS64Prefix(tc.prefix)
+		assert.Nil(t, err, tc.prefix)
+		assert.Equal(t, tc.ip, embedIPv4(prefix, ip4).String(), tc.prefix)
 	}
-	if a, ok := reply.Answer[0].(*dns.A); ok {
-		addrs, lookupErr := net.LookupHost(safeBrowsingBlockHost)
-		if lookupErr != nil {
-			t.Fatalf("cannot resolve %s due to %s", safeBrowsingBlockHost, lookupErr)
-		}
 
-		found := false
-		for _, blockAddr := range addrs {
-			if blockAddr == a.A.String() {
-				found = true
+	for _, p := range []string{"1.2.3.0/24", "64:ff9b::/95", "64:ff9b:0:0:100::/96", "invalid"} {
+		_, err := parseDNS64Prefix(p)
+		assert.NotNil(t, err, p)
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	ipv4 := map[string][]net.IP{
+		"ipv4.": {{1, 2, 3, 4}},
+		"both.": {{1, 2, 3, 5}},
+	}
+	ipv6 := map[string][]net.IP{
+		"both.": {net.ParseIP("2001:db8::1")},
+	}
+	u := &testUpstream{answer: func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		q := m.Question[0]
+		switch q.Qtype {
+		case dns.TypeA:
+			for _, ip := range ipv4[q.Name] {
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600}
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
 			}
+		case dns.TypeAAAA:
+			for _, ip := range ipv6[q.Name] {
+				hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 600}
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if len(resp.Answer) == 0 {
+			hdr := dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}
+			resp.Ns = append(resp.Ns, &dns.SOA{Hdr: hdr, Ns: "ns.", Mbox: "hostmaster.", Minttl: 60})
 		}
+		return resp
+	}}
 
-		if !found {
-			t.Fatalf("DNS server %s returned wrong answer: %v", addr, a.A)
+	for _, tc := range []struct {
+		prefix string
+		ip     string
+	}{
+		{"64:ff9b::/96", "64:ff9b::102:304"},
+		{"2001:db8:1:2::/64", "2001:db8:1:2:1:203:400:0"},
+	} {
+		s := createTestServer(t)
+		s.conf.DNS64Prefix = tc.prefix
+		assert.Nil(t, s.startWithUpstream(u))
+		addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+		// synthesized
+		reply, err := dns.Exchange(createTestMessageWithType("ipv4.", dns.TypeAAAA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(reply.Answer))
+		assert.Equal(t, 0, len(reply.Ns))
+		aaaa, ok := reply.Answer[0].(*dns.AAAA)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, tc.ip, aaaa.AAAA.String())
+			assert.Equal(t, uint32(60), aaaa.Hdr.Ttl) // SOA minimum TTL
 		}
-	} else {
-		t.Fatalf("DNS server %s returned wrong answer type instead of A: %v", addr, reply.Answer[0])
+
+		// native AAAA
+		reply, err = dns.Exchange(createTestMessageWithType("both.", dns.TypeAAAA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(reply.Answer))
+		aaaa, ok = reply.Answer[0].(*dns.AAAA)
+		assert.True(t, ok)
+		if ok {
+			assert.Equal(t, "2001:db8::1", aaaa.AAAA.String())
+		}
+
+		// no A records
+		reply, err = dns.Exchange(createTestMessageWithType("none.", dns.TypeAAAA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Equal(t, 0, len(reply.Answer))
+		assert.Equal(t, 1, len(reply.Ns))
+
+		// A requests aren't affected
+		reply, err = dns.Exchange(createTestMessageWithType("ipv4.", dns.TypeA), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(reply.Answer))
+
+		assert.Nil(t, s.Stop())
 	}
 
-	err = s.Stop()
-	if err != nil {
-		t.Fatalf("DNS server failed to stop: %s", err)
+	s := createTestServer(t)
+	s.conf.DNS64Prefix = "64:ff9b::/97"
+	assert.NotNil(t, s.Prepare(nil))
+}
+
+func TestBlockedTXT(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.BlockedTXTMessage = "blocked by AdGuardHome rule: {rule}"
+	assert.Nil(t, s.Start())
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	reply, err := dns.Exchange(createTestMessageWithType("nxdomain.example.org.", dns.TypeTXT), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Answer))
+	txt, ok := reply.Answer[0].(*dns.TXT)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, []string{"blocked by AdGuardHome rule: ||nxdomain.example.org"}, txt.Txt)
 	}
+
+	// the other types aren't affected
+	reply, err = dns.Exchange(createTestMessageWithType("nxdomain.example.org.", dns.TypeMX), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	assert.Nil(t, s.Stop())
+
+	// long text is split into several strings
+	s.conf.BlockedTXTMessage = strings.Repeat("a", 300)
+	m := s.genBlockedTXT(createTestMessageWithType("host.", dns.TypeTXT), "")
+	txt = m.Answer[0].(*dns.TXT)
+	assert.Equal(t, []string{strings.Repeat("a", 255), strings.Repeat("a", 45)}, txt.Txt)
 }
 
-func TestRewrite(t *testing.T) {
-	c := dnsfilter.Config{}
-	c.Rewrites = []dnsfilter.RewriteEntry{
+// testQueryLog stores the parameters of the last entry
+type testQueryLog struct {
+	lock sync.Mutex
+	p    querylog.AddParams
+}
+
+func (l *testQueryLog) Start()                             {}
+func (l *testQueryLog) Close()                             {}
+func (l *testQueryLog) WriteDiskConfig(c *querylog.Config) {}
+func (l *testQueryLog) Add(p querylog.AddParams) {
+	l.lock.Lock()
+	l.p = p
+	l.lock.Unlock()
+}
+
+func (l *testQueryLog) last() querylog.AddParams {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.p
+}
+
+func TestQueryLogResponseRule(t *testing.T) {
+	// the rules of the filter lists are loaded from files
+	dir, err := ioutil.TempDir("", "agh-test")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "7.txt")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("||127.0.0.255\n"), 0644))
+	filters := []dnsfilter.Filter{{
+		ID: 7, FilePath: fn,
+	}}
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{{Domain: "rewrite.org", Answer: "host.org"}}
+	f := dnsfilter.New(&c, filters)
+	ql := &testQueryLog{}
+	s := NewServer(DNSCreateParams{DNSFilter: f, QueryLog: ql})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.ProtectionEnabled = true
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{"host.org.": {{127, 0, 0, 255}}},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	for _, host := range []string{"host.org.", "rewrite.org."} {
+		reply, err := dns.Exchange(createTestMessage(host), addr)
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode, host)
+
+		p := ql.last()
+		assert.Equal(t, host, p.Question.Question[0].Name)
+		assert.NotNil(t, p.OrigAnswer, host)
+		assert.True(t, p.Result.IsFiltered, host)
+		assert.Equal(t, dnsfilter.FilteredBlackList, p.Result.Reason, host)
+		assert.Equal(t, "||127.0.0.255", p.Result.Rule, host)
+		assert.Equal(t, int64(7), p.Result.FilterID, host)
+	}
+
+	assert.Nil(t, s.Stop())
+}
+
+func TestOnFilteredQuery(t *testing.T) {
+	s := createTestServer(t)
+	ch := make(chan FilteredQuery, 10)
+	s.conf.OnFilteredQuery = func(q FilteredQuery) { ch <- q }
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 0)}))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	_, err := dns.Exchange(createTestMessage("nxdomain.example.org."), addr)
+	assert.Nil(t, err)
+	// not filtered
+	_, err = dns.Exchange(createTestMessage("whitelist.example.org."), addr)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Stop())
+
+	assert.Equal(t, 1, len(ch))
+	q := <-ch
+	assert.Equal(t, "nxdomain.example.org", q.Host)
+	assert.Equal(t, dns.TypeA, q.QType)
+	assert.True(t, q.ClientIP.IsLoopback())
+	assert.Equal(t, dnsfilter.FilteredBlackList, q.Reason)
+	assert.Equal(t, "||nxdomain.example.org", q.Rule)
+}
+
+func TestSyslogWriter(t *testing.T) {
+	q := FilteredQuery{
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Host:     "example.org",
+		QType:    dns.TypeAAAA,
+		ClientIP: net.IP{1, 2, 3, 4},
+		Reason:   dnsfilter.FilteredBlackList,
+		Rule:     `/"ex]ample\.org"/`,
+		FilterID: 2,
+	}
+	expected := `AdGuardHome %d blocked [query@32473 host="example.org" type="AAAA" client="1.2.3.4" reason="FilteredBlackList" rule="/\"ex\]ample\\.org\"/" filter_id="2"] Blocked example.org for 1.2.3.4`
+	expected = fmt.Sprintf(expected, os.Getpid())
+
+	// UDP
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer l.Close()
+	w, err := NewSyslogWriter(l.LocalAddr().String())
+	assert.Nil(t, err)
+	w.Send(q)
+
+	buf := make([]byte, 1024)
+	_ = l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := l.Read(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<13>1 2020-01-02T03:04:05Z "), msg)
+	assert.True(t, strings.HasSuffix(msg, expected), msg)
+	w.Close()
+	w.Send(q) // ignored
+
+	// TCP
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer tl.Close()
+	w, err = NewSyslogWriter("tcp://" + tl.Addr().String())
+	assert.Nil(t, err)
+	w.Send(q)
+	w.Send(q)
+	w.Close()
+
+	conn, err := tl.Accept()
+	assert.Nil(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	_ = conn.Close()
+	for i := 0; i != 2; i++ {
+		sp := strings.IndexByte(string(data), ' ')
+		assert.True(t, sp > 0)
+		n, err := strconv.Atoi(string(data[:sp]))
+		assert.Nil(t, err)
+		msg := string(data[sp+1 : sp+1+n])
+		assert.True(t, strings.HasSuffix(msg, expected), msg)
+		data = data[sp+1+n:]
+	}
+	assert.Equal(t, 0, len(data))
+
+	// the requests are dropped without connecting during the retry interval after a failed connection
+	tl, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	addr := tl.Addr().String()
+	_ = tl.Close()
+	w, err = NewSyslogWriter("tcp://" + addr)
+	assert.Nil(t, err)
+	w.Send(q)
+	for i := 0; i != 100; i++ {
+		w.lock.Lock()
+		dropped := w.dropped
+		w.lock.Unlock()
+		if dropped != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tl, err = net.ListenTCP("tcp", tl.Addr().(*net.TCPAddr))
+	assert.Nil(t, err)
+	defer tl.Close()
+	w.Send(q)
+	w.Close()
+	assert.Equal(t, uint64(2), w.dropped)
+	_ = tl.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = tl.Accept()
+	assert.NotNil(t, err)
+
+	_, err = NewSyslogWriter("http://127.0.0.1:514")
+	assert.NotNil(t, err)
+	_, err = NewSyslogWriter("127.0.0.1")
+	assert.NotNil(t, err)
+}
+
+func TestBlockedRefused(t *testing.T) {
+	filters := []dnsfilter.Filter{{
+		ID: 0, Data: []byte("||null.example.org^\n"),
+	}}
+	c := dnsfilter.Config{}
+
+	f := dnsfilter.New(&c, filters)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ProtectionEnabled = true
+	conf.BlockingMode = "refuse"
+	conf.UpstreamDNS = []string{"8.8.8.8:53", "8.8.4.4:53"}
+	err := s.Prepare(&conf)
+	assert.True(t, err != nil) // invalid BlockingMode
+
+	conf.BlockingMode = "refused"
+	err = s.Prepare(&conf)
+	assert.Nil(t, err)
+	err = s.Start()
+	assert.Nil(t, err)
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT} {
+		req := createTestMessageWithType("null.example.org.", qtype)
+		reply, err := dns.Exchange(req, addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+		assert.Equal(t, 0, len(reply.Answer))
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+}
+
+func TestEDNSClientSubnetIP(t *testing.T) {
+	s := NewServer(DNSCreateParams{})
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.UpstreamDNS = []string{"8.8.8.8:53"}
+
+	// the client's address is used by default
+	conf.EnableEDNSClientSubnet = true
+	assert.Nil(t, s.Prepare(&conf))
+	assert.True(t, s.dnsProxy.Config.EnableEDNSClientSubnet)
+	assert.Nil(t, s.dnsProxy.Config.EDNSAddr)
+
+	conf.EDNSClientSubnetIP = "bad IP"
+	assert.NotNil(t, s.Prepare(&conf))
+
+	conf.EDNSClientSubnetIP = "1.2.3.4"
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, "1.2.3.4", s.dnsProxy.Config.EDNSAddr.String())
+
+	// the address is ignored if the option is disabled
+	conf.EnableEDNSClientSubnet = false
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Nil(t, s.dnsProxy.Config.EDNSAddr)
+}
+
+func TestUpstreamMode(t *testing.T) {
+	s := NewServer(DNSCreateParams{})
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.UpstreamDNS = []string{"8.8.8.8:53"}
+
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeLoadBalance, s.dnsProxy.Config.UpstreamMode)
+
+	// legacy settings
+	conf.AllServers = true
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeParallel, s.dnsProxy.Config.UpstreamMode)
+	conf.AllServers = false
+	conf.FastestAddr = true
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeFastestAddr, s.dnsProxy.Config.UpstreamMode)
+
+	// UpstreamMode overrides the legacy settings
+	conf.UpstreamMode = "load_balance"
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeLoadBalance, s.dnsProxy.Config.UpstreamMode)
+	conf.UpstreamMode = "parallel"
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeParallel, s.dnsProxy.Config.UpstreamMode)
+	conf.UpstreamMode = "fastest_addr"
+	assert.Nil(t, s.Prepare(&conf))
+	assert.Equal(t, proxy.UModeFastestAddr, s.dnsProxy.Config.UpstreamMode)
+
+	conf.UpstreamMode = "fastest"
+	assert.NotNil(t, s.Prepare(&conf))
+}
+
+func TestReconfigure(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.GetCustomUpstreamByClient = func(clientAddr string) *proxy.UpstreamConfig {
+		u := &testUpstream{
+			ipv4: map[string][]net.IP{"host.": {{192, 168, 0, 1}}},
+		}
+		return &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{u}}
+	}
+
+	// the listen address must stay the same after reconfiguring
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	_ = l.Close()
+	s.conf.UDPListenAddr = &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: port}
+	s.conf.TCPListenAddr = &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: port}
+	s.conf.MaxGoroutines = 50
+	assert.Nil(t, s.Reconfigure(nil))
+	addr := s.conf.UDPListenAddr.String()
+
+	exchange := func() error {
+		reply, err := dns.Exchange(createTestMessage("host."), addr)
+		if err == nil && reply.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("rcode: %d", reply.Rcode)
+		}
+		return err
+	}
+	assert.Nil(t, exchange())
+
+	// invalid settings: the server keeps working with the old ones
+	conf := s.conf
+	conf.UpstreamMode = "invalid"
+	assert.NotNil(t, s.Reconfigure(&conf))
+	assert.Equal(t, "", s.conf.UpstreamMode)
+	assert.Nil(t, exchange())
+
+	// the settings prepared before the invalid one are rolled back too
+	conf = s.conf
+	conf.BlockedNameRegexps = []string{"^host$"}
+	conf.LocalZones = map[string][]string{"lan": {"A 1.2.3.4"}}
+	assert.NotNil(t, s.Reconfigure(&conf))
+	assert.Equal(t, 0, len(s.blockedNames))
+	assert.Equal(t, 0, len(s.localZones))
+	assert.Nil(t, exchange())
+
+	// the running proxy is kept:  the queries sent while the server is reconfigured succeed
+	p := s.dnsProxy
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			err := exchange()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i != 5; i++ {
+		assert.Nil(t, s.Reconfigure(nil))
+		assert.Nil(t, exchange())
+	}
+	close(stop)
+	assert.Nil(t, <-errs)
+	assert.True(t, p == s.dnsProxy)
+	assert.True(t, s.resolver != s.dnsProxy)
+
+	// the new settings are used by the running proxy
+	conf = s.conf
+	conf.BlockedNameRegexps = []string{"^host$"}
+	assert.Nil(t, s.Reconfigure(&conf))
+	assert.True(t, p == s.dnsProxy)
+	reply, err := dns.Exchange(createTestMessage("host."), addr)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	assert.Nil(t, s.Stop())
+}
+
+func TestClientLimiter(t *testing.T) {
+	l := newClientLimiter(2, []string{"127.0.0.2"})
+	now := time.Unix(1000, 0)
+
+	// burst
+	assert.True(t, l.allow("127.0.0.1", now))
+	assert.True(t, l.allow("127.0.0.1", now))
+	assert.False(t, l.allow("127.0.0.1", now))
+
+	// the other clients aren't affected
+	assert.True(t, l.allow("127.0.0.3", now))
+	for i := 0; i != 5; i++ {
+		assert.True(t, l.allow("127.0.0.2", now))
+	}
+
+	// the bucket is refilled
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow("127.0.0.1", now))
+	assert.False(t, l.allow("127.0.0.1", now))
+
+	// the number of requests during the last second
+	now = now.Add(500 * time.Millisecond)
+	rates := l.rates(now)
+	assert.Equal(t, uint64(5), rates["127.0.0.1"])
+	assert.Equal(t, uint64(5), rates["127.0.0.2"])
+	assert.Equal(t, uint64(1), rates["127.0.0.3"])
+
+	rates = l.rates(now.Add(2 * time.Second))
+	assert.Equal(t, 0, len(rates))
+
+	// idle clients are removed
+	assert.True(t, l.allow("127.0.0.1", now.Add(2*clientIdleTime)))
+	assert.Equal(t, 1, len(l.clients))
+}
+
+func TestClientRatelimit(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.ClientRatelimit = 1
+	assert.Nil(t, s.Start())
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, s.Prepare(nil))
+	assert.Nil(t, s.Start())
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// blocked requests don't need an upstream server
+	req := createTestMessage("nxdomain.example.org.")
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+
+	// the second request is dropped
+	c := dns.Client{Timeout: 200 * time.Millisecond}
+	_, _, err = c.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, s.ClientRates())
+	assert.Nil(t, s.Stop())
+}
+
+func TestBlockedByHosts(t *testing.T) {
+	s := createTestServer(t)
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	//
+	// Hosts blocking
+	//
+	req := dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{
+		{Name: "host.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+
+	reply, err := dns.Exchange(&req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	if a, ok := reply.Answer[0].(*dns.A); ok {
+		if !net.IPv4(127, 0, 0, 1).Equal(a.A) {
+			t.Fatalf("DNS server %s returned wrong answer instead of 8.8.8.8: %v", addr, a.A)
+		}
+	} else {
+		t.Fatalf("DNS server %s returned wrong answer type instead of A: %v", addr, reply.Answer[0])
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+}
+
+func TestBlockedBySafeBrowsing(t *testing.T) {
+	s := createTestServer(t)
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	//
+	// Safebrowsing blocking
+	//
+	req := dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{
+		{Name: "wmconvirus.narod.ru.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	reply, err := dns.Exchange(&req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	if a, ok := reply.Answer[0].(*dns.A); ok {
+		addrs, lookupErr := net.LookupHost(safeBrowsingBlockHost)
+		if lookupErr != nil {
+			t.Fatalf("cannot resolve %s due to %s", safeBrowsingBlockHost, lookupErr)
+		}
+
+		found := false
+		for _, blockAddr := range addrs {
+			if blockAddr == a.A.String() {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("DNS server %s returned wrong answer: %v", addr, a.A)
+		}
+	} else {
+		t.Fatalf("DNS server %s returned wrong answer type instead of A: %v", addr, reply.Answer[0])
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{
 		dnsfilter.RewriteEntry{
 			Domain: "test.com",
 			Answer: "1.2.3.4",
@@ -894,6 +1989,59 @@ func TestIsBlockedIPDisallowed(t *testing.T) {
 	assert.True(t, !a.IsBlockedIP("2.3.1.1"))
 }
 
+func TestIsBlockedIPCIDR(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init(nil, []string{
+		"1.1.1.1",
+		"192.168.0.0/16",
+		"192.168.1.0/24",
+		"2001:db8::0001",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		" 10.0.0.1 ",
+	}, nil))
+
+	// IPv4
+	assert.True(t, a.IsBlockedIP("1.1.1.1"))
+	assert.True(t, a.IsBlockedIP("192.168.1.1"))
+	assert.True(t, a.IsBlockedIP("192.168.2.1"))
+	assert.True(t, a.IsBlockedIP("10.0.0.1"))
+	assert.False(t, a.IsBlockedIP("192.169.0.1"))
+	assert.False(t, a.IsBlockedIP("1.1.1.2"))
+
+	// IPv4-mapped IPv6
+	assert.True(t, a.IsBlockedIP("::ffff:1.1.1.1"))
+	assert.True(t, a.IsBlockedIP("::ffff:192.168.3.3"))
+
+	// IPv6
+	assert.True(t, a.IsBlockedIP("2001:db8::1"))
+	assert.True(t, a.IsBlockedIP("2001:db8:1::1"))
+	assert.True(t, a.IsBlockedIP("2001:db8:2::1"))
+	assert.False(t, a.IsBlockedIP("2001:db9::1"))
+	assert.False(t, a.IsBlockedIP("::1"))
+
+	a = &accessCtx{}
+	assert.Nil(t, a.Init([]string{
+		"2001:db8::1",
+		"2001:db8:1::/48",
+		"2001:db8:1:2::/64",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+	}, nil, nil))
+
+	assert.False(t, a.IsBlockedIP("2001:db8:0::1"))
+	assert.False(t, a.IsBlockedIP("2001:db8:1:2::3"))
+	assert.False(t, a.IsBlockedIP("2001:db8:1:3::3"))
+	assert.True(t, a.IsBlockedIP("2001:db8::2"))
+	assert.True(t, a.IsBlockedIP("2001:db8:2::1"))
+	assert.False(t, a.IsBlockedIP("10.1.2.3"))
+	assert.False(t, a.IsBlockedIP("10.2.3.4"))
+	assert.True(t, a.IsBlockedIP("11.0.0.1"))
+	assert.True(t, a.IsBlockedIP("invalid"))
+
+	assert.NotNil(t, a.Init([]string{"10.0.0.0/33"}, nil, nil))
+}
+
 func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	a := &accessCtx{}
 	assert.True(t, a.Init(nil, nil, []string{"host1",
@@ -918,6 +2066,74 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 	assert.True(t, a.IsBlockedDomain("asdf.host3.com"))
 }
 
+func TestIsBlockedDomainTLD(t *testing.T) {
+	a := &accessCtx{}
+	assert.Nil(t, a.Init(nil, nil, []string{".zip", ".MOV", ".co.uk", "host1"}))
+
+	assert.True(t, a.IsBlockedDomain("evil.zip"))
+	assert.True(t, a.IsBlockedDomain("a.b.EVIL.Zip"))
+	assert.True(t, a.IsBlockedDomain("zip"))
+	assert.True(t, a.IsBlockedDomain("movie.mov"))
+	assert.True(t, a.IsBlockedDomain("example.co.uk"))
+	assert.True(t, a.IsBlockedDomain("host1"))
+
+	assert.False(t, a.IsBlockedDomain("zipcar.com"))
+	assert.False(t, a.IsBlockedDomain("evil.zip.example.com"))
+	assert.False(t, a.IsBlockedDomain("evilzip"))
+	assert.False(t, a.IsBlockedDomain("uk"))
+	assert.False(t, a.IsBlockedDomain("example.uk"))
+
+	// the rules are passed to the filtering engine
+	a = &accessCtx{}
+	assert.Nil(t, a.Init(nil, nil, []string{"||xyz^"}))
+	assert.True(t, a.IsBlockedDomain("evil.xyz"))
+	assert.Equal(t, 0, len(a.blockedSuffixes))
+}
+
+func TestAccessAudit(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.DisallowedClients = []string{"1.2.3.4"}
+	s.conf.BlockedHosts = []string{"blocked.example.org"}
+	s.conf.AccessAuditLevel = "info"
+	assert.Nil(t, s.Prepare(nil))
+
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	d := &proxy.DNSContext{
+		Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}},
+		Req:  createTestMessage("example.org."),
+	}
+	ok, err := s.beforeRequestHandler(nil, d)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.True(t, strings.Contains(buf.String(), "DNS: access: decision=blocked reason=ip client=1.2.3.4 qname=example.org.\n"))
+
+	buf.Reset()
+	d.Addr = &net.UDPAddr{IP: net.IP{1, 2, 3, 5}}
+	d.Req = createTestMessage("blocked.example.org.")
+	ok, _ = s.beforeRequestHandler(nil, d)
+	assert.False(t, ok)
+	assert.True(t, strings.Contains(buf.String(), "decision=blocked reason=domain client=1.2.3.5 qname=blocked.example.org.\n"))
+
+	buf.Reset()
+	d.Req = createTestMessage("example.org.")
+	ok, _ = s.beforeRequestHandler(nil, d)
+	assert.True(t, ok)
+	assert.True(t, strings.Contains(buf.String(), "decision=allowed client=1.2.3.5 qname=example.org.\n"))
+
+	// disabled
+	s.conf.AccessAuditLevel = ""
+	buf.Reset()
+	ok, _ = s.beforeRequestHandler(nil, d)
+	assert.True(t, ok)
+	assert.Equal(t, "", buf.String())
+
+	s.conf.AccessAuditLevel = "trace"
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
 func TestValidateUpstream(t *testing.T) {
 	invalidUpstreams := []string{"1.2.3.4.5",
 		"123.3.7m",
@@ -1053,3 +2269,1918 @@ func TestPTRResponse(t *testing.T) {
 
 	s.Close()
 }
+
+func TestResolveRDNS(t *testing.T) {
+	s := createTestServer(t)
+	assert.Nil(t, s.Prepare(nil))
+	u := &testUpstream{answer: answerPTR}
+	s.internalProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{u},
+	}
+
+	host, err := s.ResolveRDNS(net.IP{1, 2, 3, 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "host.example.org", host)
+	host, err = s.ResolveRDNS(net.IP{1, 2, 3, 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "host.example.org", host)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// NXDOMAIN is cached too
+	host, err = s.ResolveRDNS(net.IP{1, 2, 3, 5})
+	assert.Nil(t, err)
+	assert.Equal(t, "", host)
+	host, err = s.ResolveRDNS(net.IP{1, 2, 3, 5})
+	assert.Nil(t, err)
+	assert.Equal(t, "", host)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+func TestRDNSCache(t *testing.T) {
+	c := rdnsCache{}
+	now := time.Now()
+	c.set("1.2.3.4", "host", 1, now)
+
+	// TTL is increased up to rdnsMinTTL
+	host, ok := c.get("1.2.3.4", now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "host", host)
+
+	_, ok = c.get("1.2.3.4", now.Add(rdnsMinTTL*time.Second))
+	assert.False(t, ok)
+}
+
+func createECSMessage(host string, ip net.IP) *dns.Msg {
+	req := createTestMessage(host)
+	req.SetEdns0(4096, false)
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       ip,
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, e)
+	return req
+}
+
+func TestECSStripIncoming(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.EnableEDNSClientSubnet = true
+	s.conf.EDNSClientSubnetIP = "1.2.3.4"
+	s.conf.ECSStripIncoming = true
+	rec := &ecsRecorder{}
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: rec.answer}))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createECSMessage("a.example.org.", net.IP{5, 6, 7, 0}),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+
+	// the client's subnet is replaced with the configured one
+	rec.lock.Lock()
+	assert.Equal(t, 1, len(rec.subnet))
+	assert.Equal(t, "1.2.3.0", rec.subnet[0].Address.String())
+	rec.lock.Unlock()
+
+	// and the response doesn't contain it
+	assert.NotNil(t, d.Res.IsEdns0())
+	assert.Equal(t, 0, len(d.Res.IsEdns0().Option))
+
+	// the client's subnet is passed to upstream if the option is disabled
+	s.conf.ECSStripIncoming = false
+	d.Req = createECSMessage("b.example.org.", net.IP{5, 6, 7, 0})
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	rec.lock.Lock()
+	assert.Equal(t, 1, len(rec.subnet))
+	assert.Equal(t, "5.6.7.0", rec.subnet[0].Address.String())
+	rec.lock.Unlock()
+	assert.Equal(t, 1, len(d.Res.IsEdns0().Option))
+}
+
+func TestECSDisabledUpstreams(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.EnableEDNSClientSubnet = true
+	s.conf.ECSDisabledUpstreams = []string{"1.1.1.1", "tls://2.2.2.2"}
+	enabled := &ecsRecorder{}
+	disabled := &ecsRecorder{}
+	s.conf.GetUpstreamGroupsByClient = func(clientAddr string) []*proxy.UpstreamConfig {
+		return []*proxy.UpstreamConfig{{
+			Upstreams: []upstream.Upstream{&testUpstream{answer: enabled.answer, addr: "9.9.9.9:53"}},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"private.org.": {&testUpstream{answer: disabled.answer, addr: "1.1.1.1:53"}},
+			},
+		}}
+	}
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: (&ecsRecorder{}).answer}))
+	defer func() { _ = s.Stop() }()
+	assert.Equal(t, map[string]bool{"1.1.1.1:53": true, "tls://2.2.2.2:853": true}, s.ecsDisabled)
+
+	resolve := func(host string) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createECSMessage(host, net.IP{5, 6, 7, 0}),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	// ECS-enabled upstream receives the client's subnet
+	resp := resolve("a.example.org.")
+	enabled.lock.Lock()
+	assert.Equal(t, 1, len(enabled.subnet))
+	assert.Equal(t, "5.6.7.0", enabled.subnet[0].Address.String())
+	enabled.lock.Unlock()
+	assert.Equal(t, 1, len(resp.IsEdns0().Option))
+
+	// ECS-disabled upstream doesn't
+	resp = resolve("a.private.org.")
+	disabled.lock.Lock()
+	assert.Equal(t, 0, len(disabled.subnet))
+	disabled.lock.Unlock()
+	assert.Equal(t, 0, len(resp.IsEdns0().Option))
+
+	// the default configuration
+	conf := s.conf.UpstreamConfig
+	for _, u := range conf.Upstreams {
+		_, ok := u.(*noECSUpstream)
+		assert.False(t, ok)
+	}
+
+	s.conf.UpstreamDNS = []string{"1.1.1.1", "8.8.8.8"}
+	assert.Nil(t, s.Prepare(&s.conf))
+	conf = s.conf.UpstreamConfig
+	assert.Equal(t, 2, len(conf.Upstreams))
+	_, ok := conf.Upstreams[0].(*noECSUpstream)
+	assert.True(t, ok)
+	_, ok = conf.Upstreams[1].(*noECSUpstream)
+	assert.False(t, ok)
+
+	s.conf.ECSDisabledUpstreams = []string{"sdns://bad"}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestRemoveECS(t *testing.T) {
+	m := createECSMessage("example.org.", net.IP{1, 2, 3, 0})
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+
+	assert.True(t, removeECS(m))
+	assert.Equal(t, 1, len(opt.Option))
+	assert.Equal(t, uint16(dns.EDNS0COOKIE), opt.Option[0].Option())
+	assert.False(t, removeECS(m))
+	assert.False(t, removeECS(createTestMessage("example.org.")))
+}
+
+func TestUpstreamGroups(t *testing.T) {
+	s := createTestServer(t)
+	fail := &testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}
+	primary := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	fallback := &testUpstream{answer: answerA(net.IP{5, 6, 7, 8}, 60)}
+	var groups []*proxy.UpstreamConfig
+	s.conf.GetUpstreamGroupsByClient = func(clientAddr string) []*proxy.UpstreamConfig {
+		return groups
+	}
+	assert.Nil(t, s.startWithUpstream(&testUpstream{}))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string) string {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage(host),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		assert.Equal(t, 1, len(d.Res.Answer))
+		return d.Res.Answer[0].(*dns.A).A.String()
+	}
+
+	// the fallback group isn't used while the primary group works
+	groups = []*proxy.UpstreamConfig{
+		{Upstreams: []upstream.Upstream{primary}},
+		{Upstreams: []upstream.Upstream{fallback}},
+	}
+	assert.Equal(t, "1.2.3.4", resolve("a.example.org."))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primary.n))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fallback.n))
+
+	// all servers of the primary group fail
+	groups = []*proxy.UpstreamConfig{
+		{Upstreams: []upstream.Upstream{fail}},
+		{Upstreams: []upstream.Upstream{fallback}},
+	}
+	assert.Equal(t, "5.6.7.8", resolve("b.example.org."))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fail.n))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fallback.n))
+}
+
+func TestParseUpstreamGroups(t *testing.T) {
+	groups := []UpstreamGroup{
+		{Servers: []string{"8.8.8.8", "8.8.4.4"}, Priority: 10},
+		{Servers: nil, Priority: 1},
+		{Servers: []string{"1.1.1.1"}, Priority: 0},
+	}
+	configs, err := ParseUpstreamGroups(groups, nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(configs))
+	assert.Equal(t, 1, len(configs[0].Upstreams))
+	assert.Equal(t, "1.1.1.1:53", configs[0].Upstreams[0].Address())
+	assert.Equal(t, 2, len(configs[1].Upstreams))
+
+	_, err = ParseUpstreamGroups([]UpstreamGroup{{Servers: []string{"[/example.org"}}}, nil, 0)
+	assert.NotNil(t, err)
+}
+
+func TestRebindingProtection(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.RebindingProtection = true
+	s.conf.RebindingAllowedHosts = []string{"internal.example.org"}
+	u := &testUpstream{}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	testCases := []struct {
+		host    string
+		ip      net.IP
+		blocked bool
+	}{
+		{"loopback.example.org.", net.IP{127, 0, 0, 1}, true},
+		{"private.example.org.", net.IP{10, 1, 2, 3}, true},
+		{"linklocal.example.org.", net.IP{169, 254, 1, 1}, true},
+		{"public.example.org.", net.IP{1, 2, 3, 4}, false},
+		{"internal.example.org.", net.IP{10, 1, 2, 3}, false},
+		{"host.internal.example.org.", net.IP{192, 168, 1, 1}, false},
+		{"router.", net.IP{192, 168, 1, 1}, false},
+	}
+	for _, tc := range testCases {
+		u.answer = answerA(tc.ip, 60)
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage(tc.host),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		if tc.blocked {
+			assert.Equal(t, dns.RcodeNameError, d.Res.Rcode, tc.host)
+			assert.Equal(t, 0, len(d.Res.Answer), tc.host)
+		} else {
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode, tc.host)
+			assert.Equal(t, 1, len(d.Res.Answer), tc.host)
+		}
+	}
+
+	// protection is disabled
+	s.conf.RebindingProtection = false
+	u.answer = answerA(net.IP{127, 0, 0, 1}, 60)
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("loopback2.example.org."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, 1, len(d.Res.Answer))
+}
+
+func TestIsRebindingIP(t *testing.T) {
+	assert.True(t, isRebindingIP(net.ParseIP("127.0.0.1")))
+	assert.True(t, isRebindingIP(net.ParseIP("10.0.0.1")))
+	assert.True(t, isRebindingIP(net.ParseIP("172.31.255.255")))
+	assert.True(t, isRebindingIP(net.ParseIP("192.168.0.1")))
+	assert.True(t, isRebindingIP(net.ParseIP("::1")))
+	assert.True(t, isRebindingIP(net.ParseIP("fe80::1")))
+	assert.True(t, isRebindingIP(net.ParseIP("fd00::1")))
+	assert.False(t, isRebindingIP(net.ParseIP("172.32.0.1")))
+	assert.False(t, isRebindingIP(net.ParseIP("8.8.8.8")))
+	assert.False(t, isRebindingIP(net.ParseIP("2001:db8::1")))
+	assert.False(t, isRebindingIP(net.ParseIP("0.0.0.0")))
+}
+
+func TestExchangeWithInfo(t *testing.T) {
+	s := createTestServer(t)
+	assert.Nil(t, s.Prepare(nil))
+	s.internalProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}},
+	}
+
+	resp, info, err := s.ExchangeWithInfo(createTestMessage("host."))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "test", info.Upstream)
+	assert.True(t, info.Elapsed > 0)
+
+	s.internalProxy.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}},
+	}
+	_, info, err = s.ExchangeWithInfo(createTestMessage("host."))
+	assert.NotNil(t, err)
+	assert.Equal(t, "", info.Upstream)
+}
+
+func TestBlockMozillaCanary(t *testing.T) {
+	s := createTestServer(t)
+	// the list never covers the canary domain
+	s.conf.SpecialBlockedDomains = []string{"use-application-dns.net"}
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("use-application-dns.net."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// only A and AAAA requests are blocked
+	d.Req = createTestMessageWithType("use-application-dns.net.", dns.TypeTXT)
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the request is passed to upstream
+	s.conf.AllowMozillaCanary = true
+	s.specialDomains = specialBlockedDomains(&s.conf.FilteringConfig)
+	d.Req = createTestMessage("use-application-dns.net.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 1, len(d.Res.Answer))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+func TestSpecialBlockedDomains(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.SpecialBlockedDomains = []string{"Mask.iCloud.com", "mask-h2.icloud.com.", " "}
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	testCases := []struct {
+		host    string
+		qtype   uint16
+		blocked bool
+	}{
+		{"mask.icloud.com.", dns.TypeA, true},
+		{"MASK.ICLOUD.COM.", dns.TypeA, true},
+		{"mask-h2.icloud.com.", dns.TypeAAAA, true},
+		{"a.mask.icloud.com.", dns.TypeA, false},
+		{"icloud.com.", dns.TypeA, false},
+
+		// Mozilla canary domain is blocked by default
+		{"use-application-dns.net.", dns.TypeA, true},
+	}
+	for _, tc := range testCases {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(tc.host, tc.qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		if tc.blocked {
+			assert.Equal(t, dns.RcodeNameError, d.Res.Rcode, tc.host)
+		} else {
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode, tc.host)
+		}
+	}
+	assert.Equal(t, 2, len(s.specialDomains))
+}
+
+// testHostChecker is a mock filtering module that returns the same result for every host
+type testHostChecker struct {
+	res dnsfilter.Result
+	err error
+}
+
+func (c *testHostChecker) CheckHost(host string, qtype uint16, setts *dnsfilter.RequestFilteringSettings) (dnsfilter.Result, error) {
+	return c.res, c.err
+}
+
+func TestFilterErrorServerFailure(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	s.hostFilter = &testHostChecker{err: fmt.Errorf("filter failure")}
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("host.example.org."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.NotNil(t, d.Res)
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Equal(t, d.Req.Id, d.Res.Id)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+	assert.Equal(t, 0, len(d.Res.Ns))
+}
+
+func TestServerFailureSOA(t *testing.T) {
+	s := createTestServer(t)
+	fail := &testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}
+	assert.Nil(t, s.startWithUpstream(fail))
+	defer func() { _ = s.Stop() }()
+	req := createTestMessage("host.example.org.")
+
+	// the address of the block host couldn't be resolved
+	resp := s.genBlockedHost(req, "block.example.net", &proxy.DNSContext{Req: req})
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Ns))
+
+	s.conf.ServFailSOATTL = 10
+	resp = s.genBlockedHost(req, "block.example.net", &proxy.DNSContext{Req: req})
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Ns))
+	soa, ok := resp.Ns[0].(*dns.SOA)
+	assert.True(t, ok)
+	assert.Equal(t, "host.example.org.", soa.Hdr.Name)
+	assert.Equal(t, uint32(10), soa.Hdr.Ttl)
+	assert.Equal(t, uint32(10), soa.Minttl)
+
+	// filtering error
+	s.hostFilter = &testHostChecker{err: fmt.Errorf("filter failure")}
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   req,
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+	assert.Equal(t, 1, len(d.Res.Ns))
+	assert.Equal(t, uint32(10), d.Res.Ns[0].Header().Ttl)
+}
+
+// testStats is a mock statistics module that saves the last entry
+type testStats struct {
+	lock sync.Mutex
+	e    stats.Entry
+}
+
+func (st *testStats) Start()                               {}
+func (st *testStats) Close()                               {}
+func (st *testStats) GetTopClientsIP(limit uint) []string  { return nil }
+func (st *testStats) WriteDiskConfig(dc *stats.DiskConfig) {}
+func (st *testStats) Update(e stats.Entry) {
+	st.lock.Lock()
+	st.e = e
+	st.lock.Unlock()
+}
+
+func TestSafeSearchProviderStats(t *testing.T) {
+	s := createTestServer(t)
+	st := &testStats{}
+	s.stats = st
+	ql := &testQueryLog{}
+	s.queryLog = ql
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	s.hostFilter = &testHostChecker{res: dnsfilter.Result{
+		IsFiltered:         true,
+		Reason:             dnsfilter.FilteredSafeSearch,
+		IP:                 net.IP{216, 239, 38, 120},
+		SafeSearchProvider: dnsfilter.SafeSearchGoogle,
+	}}
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("www.google.com."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, "216.239.38.120", d.Res.Answer[0].(*dns.A).A.String())
+
+	st.lock.Lock()
+	assert.Equal(t, stats.RSafeSearch, st.e.Result)
+	assert.Equal(t, "google", st.e.SafeSearchEngine)
+	st.lock.Unlock()
+	assert.Equal(t, dnsfilter.SafeSearchGoogle, ql.last().Result.SafeSearchProvider)
+}
+
+func TestFilteringDryRun(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.FilteringDryRun = true
+	st := &testStats{}
+	s.stats = st
+	ql := &testQueryLog{}
+	s.queryLog = ql
+	u := &testUpstream{cn: testCNAMEs, ipv4: map[string][]net.IP{
+		"null.example.org.": {{1, 2, 3, 4}},
+	}}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage(host),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	// the client gets the real answer
+	resp := resolve("null.example.org.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+
+	// while the log records the match
+	res := ql.last().Result
+	assert.False(t, res.IsFiltered)
+	assert.True(t, res.DryRun)
+	assert.Equal(t, dnsfilter.FilteredBlackList, res.Reason)
+	assert.Equal(t, "||null.example.org^", res.Rule)
+	st.lock.Lock()
+	assert.Equal(t, stats.RNotFiltered, st.e.Result)
+	st.lock.Unlock()
+
+	// matched by response (CNAME)
+	resp = resolve("badhost.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "null.example.org.", resp.Answer[0].(*dns.CNAME).Target)
+	res = ql.last().Result
+	assert.True(t, res.DryRun)
+	assert.Equal(t, "||null.example.org^", res.Rule)
+	assert.Nil(t, ql.last().OrigAnswer)
+
+	// not matched
+	_ = resolve("example.org.")
+	assert.False(t, ql.last().Result.DryRun)
+
+	// blocked as usual when the mode is disabled
+	s.conf.FilteringDryRun = false
+	resp = resolve("null.example.org.")
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.True(t, ql.last().Result.IsFiltered)
+}
+
+func TestTruncateUDPResponse(t *testing.T) {
+	s := createTestServer(t)
+	ips := []net.IP{}
+	for i := 0; i < 100; i++ {
+		ips = append(ips, net.IP{1, 2, 3, byte(i)})
+	}
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{"big.example.org.": ips},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("big.example.org."),
+	}
+
+	// no OPT record: 512 bytes
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= dns.MinMsgSize)
+	assert.True(t, len(d.Res.Answer) < len(ips))
+
+	// a small advertised buffer
+	d.Req = createTestMessage("big.example.org.")
+	d.Req.SetEdns0(1000, false)
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= 1000)
+	assert.True(t, d.Res.Len() > dns.MinMsgSize)
+
+	// the buffer is large enough
+	d.Req = createTestMessage("big.example.org.")
+	d.Req.SetEdns0(4096, false)
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.False(t, d.Res.Truncated)
+	assert.Equal(t, len(ips), len(d.Res.Answer))
+
+	// TCP responses aren't truncated
+	d.Proto = proxy.ProtoTCP
+	d.Req = createTestMessage("big.example.org.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.False(t, d.Res.Truncated)
+	assert.Equal(t, len(ips), len(d.Res.Answer))
+}
+
+func TestRewriteTTL(t *testing.T) {
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{
+		{Domain: "test.com", Answer: "1.2.3.4", Type: dns.TypeA},
+	}
+	f := dnsfilter.New(&c, nil)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	conf := ServerConfig{}
+	conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	conf.ProtectionEnabled = true
+	conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	assert.Nil(t, s.Prepare(&conf))
+
+	resolve := func() *dns.A {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType("test.com.", dns.TypeA),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		assert.Equal(t, 1, len(d.Res.Answer))
+		a, ok := d.Res.Answer[0].(*dns.A)
+		assert.True(t, ok)
+		return a
+	}
+
+	// the default TTL for A records
+	assert.Equal(t, uint32(3600), resolve().Hdr.Ttl)
+
+	s.conf.BlockedResponseTTL = 10
+	assert.Equal(t, uint32(10), resolve().Hdr.Ttl)
+
+	s.conf.RewriteTTL = 300
+	a := resolve()
+	assert.Equal(t, uint32(300), a.Hdr.Ttl)
+	assert.Equal(t, "1.2.3.4", a.A.String())
+
+	// blocked responses aren't affected
+	assert.Equal(t, uint32(10), s.blockedTTL(dns.TypeA))
+	s.conf.BlockedResponseTTL = 0
+	assert.Equal(t, uint32(86400), s.blockedTTL(dns.TypePTR))
+	assert.Equal(t, uint32(3600), s.blockedTTL(dns.TypeMX))
+}
+
+func TestFilterListBlockIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ads := filepath.Join(dir, "1.txt")
+	assert.Nil(t, ioutil.WriteFile(ads, []byte("||ads.example.org^\n"), 0644))
+	malware := filepath.Join(dir, "2.txt")
+	assert.Nil(t, ioutil.WriteFile(malware, []byte("||malware.example.org^\n"), 0644))
+	filters := []dnsfilter.Filter{
+		{ID: 0, Data: []byte("||user.example.org^\n")},
+		{ID: 1, FilePath: ads, BlockIPv4: "10.0.0.1", BlockIPv6: "fd00::1"},
+		{ID: 2, FilePath: malware, BlockIPv4: "10.0.0.2"},
+	}
+
+	f := dnsfilter.New(&dnsfilter.Config{}, filters)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.ProtectionEnabled = true
+	s.conf.BlockingMode = "null_ip"
+	assert.Nil(t, s.Prepare(nil))
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(host, qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("ads.example.org.", dns.TypeA)
+	assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	resp = resolve("ads.example.org.", dns.TypeAAAA)
+	assert.Equal(t, "fd00::1", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	resp = resolve("malware.example.org.", dns.TypeA)
+	assert.Equal(t, "10.0.0.2", resp.Answer[0].(*dns.A).A.String())
+
+	// the global blocking mode is used
+	resp = resolve("malware.example.org.", dns.TypeAAAA)
+	assert.Equal(t, "::", resp.Answer[0].(*dns.AAAA).AAAA.String())
+	resp = resolve("user.example.org.", dns.TypeA)
+	assert.Equal(t, "0.0.0.0", resp.Answer[0].(*dns.A).A.String())
+}
+
+func TestECSEchoScope(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.ECSEchoScope = true
+	u := &testUpstream{answer: func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		resp.SetEdns0(4096, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 16,
+			SourceScope:   20,
+			Address:       net.IP{9, 9, 0, 0},
+		})
+		return resp
+	}}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createECSMessage("ecs.example.org.", net.IP{5, 6, 7, 0}),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	e := findECS(d.Res)
+	assert.NotNil(t, e)
+	assert.Equal(t, "5.6.7.0", e.Address.String())
+	assert.Equal(t, uint8(24), e.SourceNetmask)
+	assert.Equal(t, uint8(20), e.SourceScope)
+	assert.Equal(t, 1, len(d.Res.IsEdns0().Option))
+
+	// the client hasn't sent ECS option
+	d.Req = createTestMessage("ecs.example.org.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	e = findECS(d.Res)
+	assert.NotNil(t, e)
+	assert.Equal(t, "9.9.0.0", e.Address.String())
+
+	// disabled: upstream's option is passed as is
+	s.conf.ECSEchoScope = false
+	d.Req = createECSMessage("ecs.example.org.", net.IP{5, 6, 7, 0})
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	e = findECS(d.Res)
+	assert.NotNil(t, e)
+	assert.Equal(t, "9.9.0.0", e.Address.String())
+}
+
+func TestDefaultDeny(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.DefaultDeny = true
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("whitelist.example.org."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, 1, len(d.Res.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	d.Req = createTestMessage("random-0123.example.net.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// blocked hosts are still answered according to the blocking mode
+	s.conf.BlockingMode = "null_ip"
+	d.Req = createTestMessage("null.example.org.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, "0.0.0.0", d.Res.Answer[0].(*dns.A).A.String())
+
+	s.conf.DefaultDeny = false
+	d.Req = createTestMessage("random-0123.example.net.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+}
+
+func TestClientBlockingMode(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.BlockingMode = "null_ip"
+	s.conf.FilterHandler = func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) {
+		switch clientAddr {
+		case "192.168.1.2":
+			settings.BlockingMode = "custom_ip"
+			settings.BlockingIPv4 = []net.IP{{192, 168, 1, 100}}
+		case "192.168.1.3":
+			settings.BlockingMode = "nxdomain"
+		}
+	}
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(ip net.IP) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: ip},
+			Req:   createTestMessage("null.example.org."),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve(net.IP{192, 168, 1, 2})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "192.168.1.100", resp.Answer[0].(*dns.A).A.String())
+
+	resp = resolve(net.IP{192, 168, 1, 3})
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	// the server's blocking mode is used for the other clients
+	resp = resolve(net.IP{192, 168, 1, 4})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "0.0.0.0", resp.Answer[0].(*dns.A).A.String())
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+}
+
+func TestUpstreamsHealth(t *testing.T) {
+	s := createTestServer(t)
+	fail := &testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}
+	good := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	ups := []upstream.Upstream{good, fail}
+
+	s.health.reset(ups)
+	st := s.UpstreamsHealth()
+	assert.Equal(t, 2, len(st))
+	assert.True(t, st[1].Healthy)
+	assert.True(t, st[1].LastCheck.IsZero())
+
+	s.health.check(ups, "whoami.cloudflare.", 2)
+	st = s.UpstreamsHealth()
+	assert.True(t, st[0].Healthy)
+	assert.Equal(t, uint32(0), st[0].Failures)
+	assert.Equal(t, "", st[0].LastError)
+	assert.False(t, st[0].LastCheck.IsZero())
+	// a single failure isn't enough
+	assert.True(t, st[1].Healthy)
+	assert.Equal(t, uint32(1), st[1].Failures)
+	assert.Equal(t, "upstream is down", st[1].LastError)
+
+	s.health.check(ups, "whoami.cloudflare.", 2)
+	st = s.UpstreamsHealth()
+	assert.True(t, st[0].Healthy)
+	assert.False(t, st[1].Healthy)
+	assert.Equal(t, uint32(2), st[1].Failures)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&good.n))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fail.n))
+
+	// the status of the known servers is kept after reconfiguration
+	s.health.reset([]upstream.Upstream{fail})
+	st = s.UpstreamsHealth()
+	assert.Equal(t, 1, len(st))
+	assert.False(t, st[0].Healthy)
+}
+
+func TestOnDNSResponse(t *testing.T) {
+	s := createTestServer(t)
+	var responses []*dns.Msg
+	s.conf.OnDNSResponse = func(d *proxy.DNSContext) {
+		responses = append(responses, d.Res)
+		// the hook may modify the response
+		d.Res.Answer[0].Header().Ttl = 1
+	}
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("example.net."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, d.Res, responses[0])
+	assert.Equal(t, "1.2.3.4", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(1), d.Res.Answer[0].Header().Ttl)
+	assert.True(t, d.Res.Compress)
+
+	// the hook sees the responses generated before the filtering too
+	s.conf.OnDNSResponse = func(d *proxy.DNSContext) {
+		responses = append(responses, d.Res)
+	}
+	s.specialDomains = map[string]bool{"use-application-dns.net.": true}
+	d.Req = createTestMessage("use-application-dns.net.")
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, 2, len(responses))
+	assert.Equal(t, dns.RcodeNameError, responses[1].Rcode)
+}
+
+func TestClientNamesPTR(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.ClientNames = map[string]string{
+		"192.168.1.10":   "laptop.lan",
+		"fd00::0:0:0:20": "phone.lan.",
+	}
+	u := &testUpstream{answer: answerPTR}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(arpa string) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(arpa, dns.TypePTR),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("10.1.168.192.in-addr.arpa.")
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "laptop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	resp = resolve("0.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.IP6.ARPA.")
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "phone.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// unknown addresses are resolved by upstream
+	_ = resolve("11.1.168.192.in-addr.arpa.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the local clients are answered when the protection is disabled
+	s.conf.ProtectionEnabled = false
+	resp = resolve("10.1.168.192.in-addr.arpa.")
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "laptop.lan.", resp.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	s.conf.ClientNames = map[string]string{"192.168.1.300": "bad.lan"}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestPackSVCB(t *testing.T) {
+	data, err := packSVCB(strings.Fields("1 . ipv6hint=::1 alpn=h2 ipv4hint=127.0.0.255,1.2.3.4"))
+	assert.Nil(t, err)
+	assert.Equal(t, svcbRdata, hex.EncodeToString(data))
+
+	data, err = packSVCB(strings.Fields("0 doh.example.org"))
+	assert.Nil(t, err)
+	assert.Equal(t, "0000"+"03646f68076578616d706c65036f726700", hex.EncodeToString(data))
+
+	_, err = packSVCB(strings.Fields("1"))
+	assert.NotNil(t, err)
+	_, err = packSVCB(strings.Fields("1 . ipv4hint=::1"))
+	assert.NotNil(t, err)
+	_, err = packSVCB(strings.Fields("1 . alpn=h2 alpn=h3"))
+	assert.NotNil(t, err)
+	_, err = packSVCB(strings.Fields("1 . unknown=1"))
+	assert.NotNil(t, err)
+}
+
+func TestStaticRecords(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.StaticRecords = map[string][]string{
+		"DoH.lan": {
+			"HTTPS 1 . alpn=h2 ipv4hint=192.168.1.2",
+			`TXT "dns server"`,
+		},
+	}
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 0)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(host, qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("doh.lan.", typeHTTPS)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	rr, ok := resp.Answer[0].(*dns.RFC3597)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(typeHTTPS), rr.Hdr.Rrtype)
+	assert.Equal(t, "doh.lan.", rr.Hdr.Name)
+	assert.Equal(t, "0001"+"00"+"00010003026832"+"00040004c0a80102", rr.Rdata)
+
+	resp = resolve("DOH.lan.", dns.TypeTXT)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, []string{"dns server"}, resp.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, "DOH.lan.", resp.Answer[0].Header().Name)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// the other types are resolved by upstream
+	resp = resolve("doh.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	// the static records are answered when the protection is disabled
+	s.conf.ProtectionEnabled = false
+	resp = resolve("doh.lan.", dns.TypeTXT)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	s.conf.StaticRecords = map[string][]string{"doh.lan": {"HTTPS 1 . port=x"}}
+	assert.NotNil(t, s.Prepare(&s.conf))
+	s.conf.StaticRecords = map[string][]string{"doh.lan": {"A 1.2.3"}}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestChaosVersion(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.Version = "AdGuard Home v0.104.0"
+	u := &testUpstream{}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string) *dns.Msg {
+		req := createTestMessageWithType(host, dns.TypeTXT)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   req,
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("VERSION.bind.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	txt := resp.Answer[0].(*dns.TXT)
+	assert.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+	assert.Equal(t, []string{"AdGuard Home v0.104.0"}, txt.Txt)
+
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+	resp = resolve("hostname.bind.")
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, []string{hostname}, resp.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// hidden
+	s.conf.HideVersion = true
+	resp = resolve("version.bind.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+	resp = resolve("id.server.")
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// the other CHAOS requests are processed as usual
+	_ = resolve("example.org.")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+}
+
+func TestErrorLogger(t *testing.T) {
+	l := errorLogger{}
+	now := time.Now()
+	err := fmt.Errorf("i/o timeout")
+
+	assert.True(t, l.log("upstream 1.1.1.1:53", err, time.Minute, now))
+	assert.False(t, l.log("upstream 1.1.1.1:53", err, time.Minute, now.Add(time.Second)))
+	assert.False(t, l.log("upstream 1.1.1.1:53", err, time.Minute, now.Add(59*time.Second)))
+	assert.Equal(t, 2, l.targets["upstream 1.1.1.1:53"].suppressed)
+
+	// the other targets are logged independently
+	assert.True(t, l.log("upstream 8.8.8.8:53", err, time.Minute, now.Add(time.Second)))
+
+	assert.True(t, l.log("upstream 1.1.1.1:53", err, time.Minute, now.Add(time.Minute)))
+	assert.Equal(t, 0, l.targets["upstream 1.1.1.1:53"].suppressed)
+}
+
+func TestUpstreamErrorLog(t *testing.T) {
+	s := createTestServer(t)
+	fail := &testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}
+	assert.Nil(t, s.startWithUpstream(fail))
+	defer func() { _ = s.Stop() }()
+
+	for i := 0; i != 3; i++ {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage(fmt.Sprintf("host%d.example.net.", i)),
+		}
+		assert.NotNil(t, s.handleDNSRequest(nil, d))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fail.n))
+	assert.Equal(t, 1, len(s.errLog.targets))
+	assert.Equal(t, 2, s.errLog.targets["upstream fail"].suppressed)
+}
+
+func TestBlockedResponseIPs(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.BlockedResponseIPs = []string{"203.0.113.0/24", "2001:db8::1"}
+	s.conf.BlockingMode = "nxdomain"
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{
+			"bad.example.net.":  {{203, 0, 113, 77}},
+			"good.example.net.": {{203, 0, 114, 1}},
+		},
+		ipv6: map[string][]net.IP{
+			"bad.example.net.": {net.ParseIP("2001:db8::1")},
+		},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(host, qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("bad.example.net.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	resp = resolve("bad.example.net.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = resolve("good.example.net.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, "203.0.114.1", resp.Answer[0].(*dns.A).A.String())
+
+	s.conf.BlockedResponseIPs = []string{"203.0.113.0/33"}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestInvalidQuestionCount(t *testing.T) {
+	s := createTestServer(t)
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	req := createTestMessage("example.net.")
+	req.Question = nil
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   req,
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeFormatError, d.Res.Rcode)
+	assert.Equal(t, 0, len(d.Res.Question))
+
+	req = createTestMessage("example.net.")
+	req.Question = append(req.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	d.Req = req
+	d.Res = nil
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeFormatError, d.Res.Rcode)
+	assert.Equal(t, req.Id, d.Res.Id)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	// the server never responds
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+
+	s := createTestServer(t)
+	s.conf.UpstreamDNS = []string{conn.LocalAddr().String()}
+	s.conf.UpstreamTimeout = 200 * time.Millisecond
+	assert.Nil(t, s.Prepare(&s.conf))
+	assert.Equal(t, 200*time.Millisecond, s.conf.UpstreamTimeout)
+
+	start := time.Now()
+	_, err = s.Exchange(createTestMessage("example.net."))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	// the client's upstream servers use the same timeout
+	configs, err := ParseUpstreamGroups([]UpstreamGroup{{Servers: s.conf.UpstreamDNS}}, nil, s.conf.UpstreamTimeout)
+	assert.Nil(t, err)
+	start = time.Now()
+	_, err = configs[0].Upstreams[0].Exchange(createTestMessage("example.net."))
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	s.conf.UpstreamTimeout = 0
+	assert.Nil(t, s.Prepare(&s.conf))
+	assert.Equal(t, DefaultTimeout, s.conf.UpstreamTimeout)
+
+	s.conf.UpstreamTimeout = -time.Second
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestExchangeLogged(t *testing.T) {
+	s := createTestServer(t)
+	ql := &testQueryLog{}
+	s.queryLog = ql
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resp, err := s.ExchangeLogged(createTestMessage("example.net."))
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+
+	p := ql.last()
+	assert.Equal(t, "example.net.", p.Question.Question[0].Name)
+	assert.Equal(t, "internal", p.ClientProto)
+	assert.Equal(t, "127.0.0.1", p.ClientIP.String())
+
+	// the request is filtered as a client's one
+	resp, err = s.ExchangeLogged(createTestMessage("nxdomain.example.org."))
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.True(t, ql.last().Result.IsFiltered)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+}
+
+func TestDNSSECNegativeResponse(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.EnableDNSSEC = true
+	// signed NXDOMAIN
+	u := &testUpstream{answer: func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetRcode(m, dns.RcodeNameError)
+		soa, _ := dns.NewRR("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 3600 600 86400 60")
+		nsec, _ := dns.NewRR("example.net. 60 IN NSEC www.example.net. A NS SOA RRSIG NSEC")
+		sig, _ := dns.NewRR("example.net. 60 IN RRSIG NSEC 13 2 60 20301231000000 20200101000000 1234 example.net. AAAA")
+		resp.Ns = []dns.RR{soa, nsec, sig}
+		if opt := m.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		return resp
+	}}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	// the client has requested DNSSEC records
+	req := createTestMessage("nx.example.net.")
+	req.SetEdns0(4096, true)
+	reply, err := dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, 3, len(reply.Ns))
+	assert.True(t, reply.IsEdns0().Do())
+
+	// the same response with the DNSSEC records removed
+	req = createTestMessage("nx.example.net.")
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, 1, len(reply.Ns))
+	_, ok := reply.Ns[0].(*dns.SOA)
+	assert.True(t, ok)
+	if opt := reply.IsEdns0(); opt != nil {
+		assert.False(t, opt.Do())
+	}
+
+	// the client has requested DNSSEC records again
+	req = createTestMessage("nx.example.net.")
+	req.SetEdns0(4096, true)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(reply.Ns))
+
+	// the blocked host: the generated response is unsigned but DO flag is copied
+	req = createTestMessage("nxdomain.example.org.")
+	req.SetEdns0(4096, true)
+	reply, err = dns.Exchange(req, addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.True(t, reply.IsEdns0().Do())
+}
+
+func TestCacheFlush(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.CacheSize = 4096
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	for i := 0; i != 2; i++ {
+		reply, err := dns.Exchange(createTestMessage("example.net."), addr.String())
+		assert.Nil(t, err)
+		assert.Equal(t, "1.2.3.4", reply.Answer[0].(*dns.A).A.String())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+
+	st := s.CacheStats()
+	assert.Equal(t, uint64(1), st.Hits)
+	assert.Equal(t, uint64(1), st.Misses)
+	assert.Equal(t, 1, st.Entries)
+	assert.True(t, st.Size > 0)
+
+	buf := bytes.Buffer{}
+	assert.Nil(t, s.Metrics(&buf))
+	assert.True(t, strings.Contains(buf.String(), "adguardhome_dns_cache_hits_total 1\n"))
+	assert.True(t, strings.Contains(buf.String(), "adguardhome_dns_cache_entries 1\n"))
+
+	// the request is sent to upstream again after the cache is flushed
+	w := httptest.NewRecorder()
+	s.handleCacheFlush(w, httptest.NewRequest("POST", "/control/cache_flush", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	st = s.CacheStats()
+	assert.Equal(t, 0, st.Entries)
+	assert.Equal(t, 0, st.Size)
+	assert.Equal(t, uint64(1), st.Hits)
+
+	reply, err := dns.Exchange(createTestMessage("example.net."), addr.String())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", reply.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+	assert.Equal(t, 1, s.CacheStats().Entries)
+}
+
+func TestResponseCache(t *testing.T) {
+	c := responseCache{}
+	now := time.Now()
+	resp := &dns.Msg{}
+	resp.SetReply(createTestMessage("example.net."))
+	a, _ := dns.NewRR("example.net. 60 IN A 1.2.3.4")
+	resp.Answer = []dns.RR{a}
+
+	// disabled cache
+	c.store(resp, nil, now)
+	assert.Nil(t, c.lookup(createTestMessage("example.net."), nil, now))
+	assert.Equal(t, CacheStats{}, c.stats())
+
+	c.reset(4096, 0, 0, 0)
+	c.store(resp, nil, now)
+	r := c.lookup(createTestMessage("EXAMPLE.net."), nil, now.Add(10*time.Second))
+	assert.NotNil(t, r)
+	assert.Equal(t, "EXAMPLE.net.", r.Question[0].Name)
+	assert.Equal(t, uint32(50), r.Answer[0].Header().Ttl)
+
+	// responses are cached per subnet
+	_, subnet, _ := net.ParseCIDR("1.2.3.0/24")
+	assert.Nil(t, c.lookup(createTestMessage("example.net."), subnet, now))
+
+	// expired
+	assert.Nil(t, c.lookup(createTestMessage("example.net."), nil, now.Add(time.Minute)))
+	assert.Equal(t, 0, c.stats().Entries)
+
+	// the least recently used entries are evicted
+	c.reset(200, 0, 0, 0)
+	for i := 0; i != 10; i++ {
+		resp.Question[0].Name = fmt.Sprintf("host%d.example.net.", i)
+		c.store(resp, nil, now)
+	}
+	st := c.stats()
+	assert.True(t, st.Evictions > 0)
+	assert.True(t, st.Size <= 200)
+	assert.NotNil(t, c.lookup(createTestMessageWithType("host9.example.net.", dns.TypeA), nil, now))
+	assert.Nil(t, c.lookup(createTestMessageWithType("host0.example.net.", dns.TypeA), nil, now))
+
+	// empty A responses aren't cached
+	c.flush()
+	resp.Question[0].Name = "example.net."
+	resp.Answer = nil
+	c.store(resp, nil, now)
+	assert.Equal(t, 0, c.stats().Entries)
+}
+
+func TestResponseCacheTTLOverride(t *testing.T) {
+	c := responseCache{}
+	c.reset(4096, 0, 30, 120)
+	now := time.Now()
+	resp := &dns.Msg{}
+	resp.SetReply(createTestMessage("example.net."))
+	a, _ := dns.NewRR("example.net. 10 IN A 1.2.3.4")
+	resp.Answer = []dns.RR{a}
+
+	// cache_ttl_min:  the response is kept longer than its TTL
+	c.store(resp, nil, now)
+	r := c.lookup(createTestMessage("example.net."), nil, now.Add(20*time.Second))
+	assert.NotNil(t, r)
+	assert.Equal(t, uint32(10), r.Answer[0].Header().Ttl)
+	assert.Nil(t, c.lookup(createTestMessage("example.net."), nil, now.Add(30*time.Second)))
+
+	// cache_ttl_max:  the response expires before its TTL
+	a.Header().Ttl = 3600
+	c.store(resp, nil, now)
+	r = c.lookup(createTestMessage("example.net."), nil, now)
+	assert.NotNil(t, r)
+	assert.Equal(t, uint32(120), r.Answer[0].Header().Ttl)
+	assert.Nil(t, c.lookup(createTestMessage("example.net."), nil, now.Add(120*time.Second)))
+}
+
+func TestResponseCacheOPT(t *testing.T) {
+	c := responseCache{}
+	c.reset(4096, 0, 0, 0)
+	now := time.Now()
+	resp := &dns.Msg{}
+	resp.SetReply(createTestMessage("example.net."))
+	a, _ := dns.NewRR("example.net. 60 IN A 1.2.3.4")
+	resp.Answer = []dns.RR{a}
+	resp.SetEdns0(1232, false)
+	c.store(resp, nil, now)
+
+	// EDNS client without DO bit gets OPT record
+	req := createTestMessage("example.net.")
+	req.SetEdns0(4096, false)
+	r := c.lookup(req, nil, now)
+	assert.NotNil(t, r)
+	opt := r.IsEdns0()
+	assert.NotNil(t, opt)
+	assert.Equal(t, uint16(1232), opt.UDPSize())
+	assert.False(t, opt.Do())
+
+	// non-EDNS client doesn't get OPT record
+	r = c.lookup(createTestMessage("example.net."), nil, now)
+	assert.NotNil(t, r)
+	assert.Nil(t, r.IsEdns0())
+}
+
+func TestServeStale(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.CacheSize = 4096
+	s.conf.ServeStale = true
+	s.conf.ServeStaleMax = 3600
+	fail := &testUpstream{err: fmt.Errorf("upstream is down"), addr: "fail"}
+	assert.Nil(t, s.startWithUpstream(fail))
+	defer func() { _ = s.Stop() }()
+
+	// the response has expired a minute ago
+	resp := &dns.Msg{}
+	resp.SetReply(createTestMessage("example.net."))
+	a, _ := dns.NewRR("example.net. 60 IN A 1.2.3.4")
+	resp.Answer = []dns.RR{a}
+	s.cache.store(resp, nil, time.Now().Add(-2*time.Minute))
+
+	d := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("example.net."),
+	}
+	assert.Nil(t, s.handleDNSRequest(nil, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, "1.2.3.4", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(staleTTL), d.Res.Answer[0].Header().Ttl)
+
+	// the response is being refreshed in background
+	for i := 0; atomic.LoadInt32(&fail.n) < 2 && i != 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fail.n))
+
+	// no stale response
+	d = &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("other.example.net."),
+	}
+	assert.NotNil(t, s.handleDNSRequest(nil, d))
+
+	// the response has expired too long ago
+	s.cache.store(resp, nil, time.Now().Add(-2*time.Hour))
+	d = &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+		Req:   createTestMessage("example.net."),
+	}
+	assert.NotNil(t, s.handleDNSRequest(nil, d))
+
+	// serving stale responses is disabled
+	s.conf.ServeStale = false
+	assert.Nil(t, s.Prepare(nil))
+	s.cache.store(resp, nil, time.Now().Add(-2*time.Minute))
+	assert.Nil(t, s.cache.lookupStale(createTestMessage("example.net."), nil, time.Now()))
+}
+
+func TestResponseCachedFlag(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.CacheSize = 4096
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func() *dnsContext {
+		ctx := &dnsContext{
+			srv: s,
+			proxyCtx: &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+				Req:   createTestMessage("example.net."),
+			},
+		}
+		assert.Equal(t, resultDone, processUpstream(ctx))
+		return ctx
+	}
+
+	ctx := resolve()
+	assert.True(t, ctx.responseFromUpstream)
+	assert.False(t, ctx.responseCached)
+
+	ctx = resolve()
+	assert.True(t, ctx.responseFromUpstream)
+	assert.True(t, ctx.responseCached)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&u.n))
+}
+
+func TestSetProtectionEnabled(t *testing.T) {
+	s := createTestServer(t)
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func() *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage("nxdomain.example.org."),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	assert.Equal(t, dns.RcodeNameError, resolve().Rcode)
+
+	s.SetProtectionEnabled(false)
+	assert.Equal(t, dns.RcodeSuccess, resolve().Rcode)
+
+	s.SetProtectionEnabled(true)
+	assert.Equal(t, dns.RcodeNameError, resolve().Rcode)
+}
+
+func TestCheckHosts(t *testing.T) {
+	filters := []dnsfilter.Filter{{
+		ID: 0, Data: []byte("||blocked.example.org^\n@@||allowed.example.org^\n"),
+	}}
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{
+		{Domain: "rewrite.example.org", Answer: "1.2.3.4"},
+		{Domain: "alias.example.org", Answer: "example.net"},
+	}
+	f := dnsfilter.New(&c, filters)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	assert.Nil(t, s.Prepare(nil))
+
+	hosts := []string{"blocked.example.org", "sub.blocked.example.org.", "allowed.example.org", "other.example.org",
+		"rewrite.example.org", "alias.example.org"}
+	res, err := s.CheckHosts(hosts, dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, len(hosts), len(res))
+
+	assert.True(t, res[0].IsFiltered)
+	assert.Equal(t, dnsfilter.FilteredBlackList, res[0].Reason)
+	assert.Equal(t, "||blocked.example.org^", res[0].Rule)
+	assert.True(t, res[1].IsFiltered)
+
+	assert.False(t, res[2].IsFiltered)
+	assert.Equal(t, dnsfilter.NotFilteredWhiteList, res[2].Reason)
+	assert.Equal(t, "@@||allowed.example.org^", res[2].Rule)
+
+	assert.False(t, res[3].IsFiltered)
+	assert.Equal(t, dnsfilter.NotFilteredNotFound, res[3].Reason)
+
+	assert.Equal(t, dnsfilter.ReasonRewrite, res[4].Reason)
+	assert.Equal(t, []net.IP{{1, 2, 3, 4}}, res[4].IPList)
+	assert.Equal(t, dnsfilter.ReasonRewrite, res[5].Reason)
+	assert.Equal(t, "example.net", res[5].CanonName)
+
+	// the default-deny mode is applied too
+	s.conf.DefaultDeny = true
+	res, err = s.CheckHosts([]string{"other.example.org", "allowed.example.org"}, dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, dnsfilter.FilteredDefaultDeny, res[0].Reason)
+	assert.False(t, res[1].IsFiltered)
+
+	// the server isn't locked while the hosts are matched
+	s.hostFilter = &lockingHostChecker{s: s}
+	res, err = s.CheckHosts([]string{"other.example.org"}, dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res))
+}
+
+// lockingHostChecker is a mock filtering module that locks the server for writing
+type lockingHostChecker struct {
+	s *Server
+}
+
+func (c *lockingHostChecker) CheckHost(host string, qtype uint16, setts *dnsfilter.RequestFilteringSettings) (dnsfilter.Result, error) {
+	c.s.Lock()
+	c.s.Unlock()
+	return dnsfilter.Result{}, nil
+}
+
+func TestRewriteNoData(t *testing.T) {
+	c := dnsfilter.Config{}
+	c.Rewrites = []dnsfilter.RewriteEntry{
+		{Domain: "example.org", Answer: "-AAAA"},
+	}
+	f := dnsfilter.New(&c, nil)
+	s := NewServer(DNSCreateParams{DNSFilter: f})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.ProtectionEnabled = true
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	u := &testUpstream{
+		ipv4: map[string][]net.IP{"example.org.": {{1, 2, 3, 4}}},
+		ipv6: map[string][]net.IP{"example.org.": {net.ParseIP("::1")}},
+	}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType("example.org.", qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve(dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 0, len(resp.Answer))
+
+	resp = resolve(dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "1.2.3.4", resp.Answer[0].(*dns.A).A.String())
+}
+
+func TestQueryLogClientName(t *testing.T) {
+	ql := &testQueryLog{}
+	f := dnsfilter.New(&dnsfilter.Config{}, nil)
+	s := NewServer(DNSCreateParams{DNSFilter: f, QueryLog: ql})
+	s.conf.UDPListenAddr = &net.UDPAddr{Port: 0}
+	s.conf.TCPListenAddr = &net.TCPAddr{Port: 0}
+	s.conf.UpstreamDNS = []string{"8.8.8.8:53"}
+	s.conf.FilterHandler = func(clientAddr string, settings *dnsfilter.RequestFilteringSettings) {
+		if clientAddr == "192.168.1.2" {
+			settings.ClientName = "Living Room TV"
+		}
+	}
+	assert.Nil(t, s.startWithUpstream(&testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(ip net.IP) {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: ip},
+			Req:   createTestMessage("example.org."),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+	}
+
+	// the client name is known even if the filtering is disabled
+	resolve(net.IP{192, 168, 1, 2})
+	assert.Equal(t, "Living Room TV", ql.last().ClientName)
+
+	resolve(net.IP{192, 168, 1, 3})
+	assert.Equal(t, "", ql.last().ClientName)
+
+	s.SetProtectionEnabled(true)
+	resolve(net.IP{192, 168, 1, 2})
+	assert.Equal(t, "Living Room TV", ql.last().ClientName)
+}
+
+func TestPrepareRunning(t *testing.T) {
+	s := createTestServer(t)
+	assert.Nil(t, s.Start())
+	defer func() { _ = s.Stop() }()
+	p := s.dnsProxy
+
+	// the running proxy isn't replaced
+	conf := s.conf
+	conf.BlockingMode = "null_ip"
+	assert.NotNil(t, s.Prepare(&conf))
+	assert.True(t, p == s.dnsProxy)
+	assert.Equal(t, "", s.conf.BlockingMode)
+	assert.True(t, s.IsRunning())
+
+	// Reconfigure applies the configuration
+	assert.Nil(t, s.Reconfigure(&conf))
+	assert.Equal(t, "null_ip", s.conf.BlockingMode)
+	assert.True(t, s.IsRunning())
+
+	// the stopped server may be prepared again
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, s.Prepare(nil))
+}
+
+func TestBlockedNameRegexps(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.BlockedNameRegexps = []string{`^ads?\d*\.`, `\.tracker\.example$`}
+	s.conf.BlockingMode = "nxdomain"
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessage(host),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("AD1.example.net.")
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	resp = resolve("a.b.tracker.example.")
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	resp = resolve("bad.example.net.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, 1, len(resp.Answer))
+	resp = resolve("tracker.example.org.")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+
+	// invalid regexp
+	_ = s.Stop()
+	s.conf.BlockedNameRegexps = []string{`(ads`}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestLocalZones(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.LocalZones = map[string][]string{
+		"home.arpa": {
+			"SOA ns.home.arpa. admin.home.arpa. 7 3600 600 86400 300",
+			"NS ns.home.arpa.",
+		},
+		"lan": nil,
+	}
+	s.conf.RewriteTTL = 10
+	u := &testUpstream{answer: answerA(net.IP{1, 2, 3, 4}, 60)}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(host, qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("Home.Arpa.", dns.TypeSOA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, 1, len(resp.Answer))
+	soa, ok := resp.Answer[0].(*dns.SOA)
+	assert.True(t, ok)
+	assert.Equal(t, "Home.Arpa.", soa.Hdr.Name)
+	assert.Equal(t, "ns.home.arpa.", soa.Ns)
+	assert.Equal(t, "admin.home.arpa.", soa.Mbox)
+	assert.Equal(t, uint32(7), soa.Serial)
+	assert.Equal(t, uint32(10), soa.Hdr.Ttl)
+
+	resp = resolve("home.arpa.", dns.TypeNS)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, "ns.home.arpa.", resp.Answer[0].(*dns.NS).Ns)
+
+	// the names below the apex have no NS and SOA records
+	resp = resolve("host.home.arpa.", dns.TypeSOA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.Authoritative)
+	assert.Equal(t, 0, len(resp.Answer))
+	assert.Equal(t, 1, len(resp.Ns))
+	assert.Equal(t, "home.arpa.", resp.Ns[0].Header().Name)
+
+	// SOA and NS records are generated from the SOA settings
+	resp = resolve("lan.", dns.TypeSOA)
+	assert.Equal(t, 1, len(resp.Answer))
+	soa = resp.Answer[0].(*dns.SOA)
+	assert.Equal(t, s.conf.SOANs, soa.Ns)
+	assert.Equal(t, "hostmaster.lan.", soa.Mbox)
+	assert.Equal(t, s.conf.SOASerial, soa.Serial)
+	resp = resolve("lan.", dns.TypeNS)
+	assert.Equal(t, 1, len(resp.Answer))
+	assert.Equal(t, s.conf.SOANs, resp.Answer[0].(*dns.NS).Ns)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&u.n))
+
+	// the other requests are passed to upstream servers
+	resp = resolve("host.home.arpa.", dns.TypeA)
+	assert.Equal(t, 1, len(resp.Answer))
+	resp = resolve("example.net.", dns.TypeSOA)
+	assert.False(t, resp.Authoritative)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&u.n))
+
+	_ = s.Stop()
+	s.conf.LocalZones = map[string][]string{"home.arpa": {"A 1.2.3.4"}}
+	assert.NotNil(t, s.Prepare(&s.conf))
+	s.conf.LocalZones = map[string][]string{"home.arpa": {"SOA a. b. 1 2 3 4 5", "SOA a. b. 1 2 3 4 5"}}
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestUpstreamTTL(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.MaxUpstreamTTL = 3600
+	s.conf.MinUpstreamTTL = 30
+	// CNAME record and address records with different TTL
+	u := &testUpstream{answer: func(m *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(m)
+		cname, _ := dns.NewRR(m.Question[0].Name + " 86400 IN CNAME target.example.net.")
+		resp.Answer = append(resp.Answer, cname)
+		switch m.Question[0].Qtype {
+		case dns.TypeA:
+			a, _ := dns.NewRR("target.example.net. 5 IN A 1.2.3.4")
+			resp.Answer = append(resp.Answer, a)
+		case dns.TypeAAAA:
+			aaaa, _ := dns.NewRR("target.example.net. 604800 IN AAAA ::1")
+			resp.Answer = append(resp.Answer, aaaa)
+		}
+		return resp
+	}}
+	assert.Nil(t, s.startWithUpstream(u))
+	defer func() { _ = s.Stop() }()
+
+	resolve := func(host string, qtype uint16) *dns.Msg {
+		d := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			Req:   createTestMessageWithType(host, qtype),
+		}
+		assert.Nil(t, s.handleDNSRequest(nil, d))
+		return d.Res
+	}
+
+	resp := resolve("host.example.net.", dns.TypeA)
+	assert.Equal(t, 2, len(resp.Answer))
+	assert.Equal(t, uint32(3600), resp.Answer[0].(*dns.CNAME).Hdr.Ttl)
+	assert.Equal(t, uint32(30), resp.Answer[1].(*dns.A).Hdr.Ttl)
+
+	resp = resolve("host.example.net.", dns.TypeAAAA)
+	assert.Equal(t, 2, len(resp.Answer))
+	assert.Equal(t, uint32(3600), resp.Answer[0].(*dns.CNAME).Hdr.Ttl)
+	assert.Equal(t, uint32(3600), resp.Answer[1].(*dns.AAAA).Hdr.Ttl)
+
+	// no limits
+	_ = s.Stop()
+	s.conf.MaxUpstreamTTL = 0
+	s.conf.MinUpstreamTTL = 0
+	assert.Nil(t, s.startWithUpstream(u))
+	resp = resolve("other.example.net.", dns.TypeA)
+	assert.Equal(t, uint32(86400), resp.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(5), resp.Answer[1].Header().Ttl)
+
+	_ = s.Stop()
+	s.conf.MaxUpstreamTTL = 60
+	s.conf.MinUpstreamTTL = 120
+	assert.NotNil(t, s.Prepare(&s.conf))
+}
+
+func TestLimitTTL(t *testing.T) {
+	assert.Equal(t, uint32(100), limitTTL(100, 0, 0))
+	assert.Equal(t, uint32(60), limitTTL(100, 0, 60))
+	assert.Equal(t, uint32(200), limitTTL(100, 200, 0))
+	assert.Equal(t, uint32(10), limitTTL(0, 10, 60))
+}
+
+func TestHealthReady(t *testing.T) {
+	s := createTestServer(t)
+	probe := func(h http.HandlerFunc, url string) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", url, nil))
+		return w.Code
+	}
+
+	// stopped
+	assert.Equal(t, http.StatusOK, probe(s.handleHealth, "/control/health"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(s.handleReady, "/control/ready"))
+
+	// running, the health checking is disabled
+	assert.Nil(t, s.Start())
+	assert.Equal(t, http.StatusOK, probe(s.handleHealth, "/control/health"))
+	assert.Equal(t, http.StatusOK, probe(s.handleReady, "/control/ready"))
+
+	// running, the upstream servers are unhealthy
+	s.health.lock.Lock()
+	s.health.status = []UpstreamHealth{{Address: "a"}, {Address: "b"}}
+	s.health.lock.Unlock()
+	ready, reason := s.IsReady()
+	assert.False(t, ready)
+	assert.Equal(t, "no healthy upstream servers", reason)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(s.handleReady, "/control/ready"))
+
+	s.health.lock.Lock()
+	s.health.status[1].Healthy = true
+	s.health.lock.Unlock()
+	assert.Equal(t, http.StatusOK, probe(s.handleReady, "/control/ready"))
+
+	// stopped again
+	assert.Nil(t, s.Stop())
+	assert.Equal(t, http.StatusOK, probe(s.handleHealth, "/control/health"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(s.handleReady, "/control/ready"))
+}
@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Default interval between the log messages about the errors of the same target (in seconds)
+const defaultErrorLogInterval = 60
+
+// errorLogger logs the errors of the same target (e.g. upstream servers) at most once per interval.
+// The errors of network operations usually contain the details that differ from request to request
+// (e.g. a local port number), so the errors are grouped by target only.
+// The number of the suppressed errors is logged with the next message.
+// The zero value is ready for use.
+type errorLogger struct {
+	lock    sync.Mutex
+	targets map[string]*errorLogTarget
+}
+
+type errorLogTarget struct {
+	lastLog    time.Time // time of the last logged message
+	suppressed int       // number of the errors not logged since lastLog
+}
+
+// log logs the error unless an error of the same target has been logged within the interval.
+// Returns false if the message has been suppressed.
+func (l *errorLogger) log(target string, err error, interval time.Duration, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.targets == nil {
+		l.targets = map[string]*errorLogTarget{}
+	}
+	t, ok := l.targets[target]
+	if !ok {
+		t = &errorLogTarget{}
+		l.targets[target] = t
+	} else if now.Sub(t.lastLog) < interval {
+		t.suppressed++
+		return false
+	}
+
+	if t.suppressed != 0 {
+		log.Info("DNS: %s: %s (%d similar errors suppressed)", target, err, t.suppressed)
+	} else {
+		log.Info("DNS: %s: %s", target, err)
+	}
+	t.lastLog = now
+	t.suppressed = 0
+	return true
+}
+
+// logError logs the error of the target with the configured interval
+func (s *Server) logError(target string, err error) {
+	interval := time.Duration(s.conf.ErrorLogInterval) * time.Second
+	s.errLog.log(target, err, interval, time.Now())
+}
+
+// upstreamsTarget returns the name of the upstream servers used in the error messages
+func upstreamsTarget(conf *proxy.UpstreamConfig) string {
+	if conf == nil || len(conf.Upstreams) == 0 {
+		return "upstream"
+	}
+	addrs := []string{}
+	for _, u := range conf.Upstreams {
+		addrs = append(addrs, u.Address())
+	}
+	return "upstream " + strings.Join(addrs, ", ")
+}
@@ -1,9 +1,13 @@
 package dnsforward
 
 import (
+	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
@@ -11,23 +15,49 @@ import (
 )
 
 func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
+	s.RLock()
+	access := s.access
+	limiter := s.limiter
+	s.RUnlock()
+
 	ip := ipFromAddr(d.Addr)
-	if s.access.IsBlockedIP(ip) {
+	if access.IsBlockedIP(ip) {
 		log.Tracef("Client IP %s is blocked by settings", ip)
+		s.auditAccess(d, accessBlockedIP)
 		return false, nil
 	}
 
 	if len(d.Req.Question) == 1 {
 		host := strings.TrimSuffix(d.Req.Question[0].Name, ".")
-		if s.access.IsBlockedDomain(host) {
+		if access.IsBlockedDomain(host) {
 			log.Tracef("Domain %s is blocked by settings", host)
+			s.auditAccess(d, accessBlockedDomain)
 			return false, nil
 		}
 	}
 
+	if limiter != nil && !limiter.allow(ip, time.Now()) {
+		log.Tracef("Client IP %s has exceeded the rate limit", ip)
+		s.auditAccess(d, accessBlockedRatelimit)
+		return false, nil
+	}
+
+	s.auditAccess(d, accessAllowed)
 	return true, nil
 }
 
+// FilterStats returns the rules count and the update time of the filter lists loaded by dnsfilter.
+// The list is empty if there's no dnsfilter instance.
+func (s *Server) FilterStats() []dnsfilter.FilterListStats {
+	s.RLock()
+	f := s.dnsFilter
+	s.RUnlock()
+	if f == nil {
+		return []dnsfilter.FilterListStats{}
+	}
+	return f.FilterStats()
+}
+
 // getClientRequestFilteringSettings lookups client filtering settings
 // using the client's IP address from the DNSContext
 func (s *Server) getClientRequestFilteringSettings(d *proxy.DNSContext) *dnsfilter.RequestFilteringSettings {
@@ -40,21 +70,78 @@ func (s *Server) getClientRequestFilteringSettings(d *proxy.DNSContext) *dnsfilt
 	return &setts
 }
 
+// hostChecker matches the host names against the filtering rules;  it's implemented by dnsfilter.Dnsfilter
+type hostChecker interface {
+	CheckHost(host string, qtype uint16, setts *dnsfilter.RequestFilteringSettings) (dnsfilter.Result, error)
+}
+
+// matchHost matches the host name of the request against the filtering rules of f.
+// defaultDeny is ServerConfig.DefaultDeny.
+func matchHost(f hostChecker, defaultDeny bool, host string, qtype uint16, setts *dnsfilter.RequestFilteringSettings) (dnsfilter.Result, error) {
+	res, err := f.CheckHost(host, qtype, setts)
+	if err != nil {
+		return res, err
+	}
+
+	if defaultDeny && setts.FilteringEnabled && !res.Reason.Matched() {
+		// only the explicitly allowed hosts are resolved
+		res = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredDefaultDeny}
+	}
+	return res, nil
+}
+
+// CheckHosts matches the host names against the filtering rules the same way as the DNS requests
+// of a client without its own settings.  No DNS requests are sent.
+// The results are in the order of the host names.
+func (s *Server) CheckHosts(hosts []string, qtype uint16) ([]dnsfilter.Result, error) {
+	// the server isn't locked while the hosts are matched
+	s.RLock()
+	if s.dnsFilter == nil {
+		s.RUnlock()
+		return nil, fmt.Errorf("filtering module isn't initialized")
+	}
+	f := s.hostFilter
+	setts := s.dnsFilter.GetConfig()
+	filterHandler := s.conf.FilterHandler
+	defaultDeny := s.conf.DefaultDeny
+	s.RUnlock()
+
+	setts.FilteringEnabled = true
+	if filterHandler != nil {
+		filterHandler("", &setts)
+	}
+
+	results := make([]dnsfilter.Result, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+		res, err := matchHost(f, defaultDeny, host, qtype, &setts)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %s", host, err)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
 // filterDNSRequest applies the dnsFilter and sets d.Res if the request was filtered
 func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
 	req := d.Req
 	host := strings.TrimSuffix(req.Question[0].Name, ".")
-	res, err := s.dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, ctx.setts)
+	res, err := matchHost(s.hostFilter, s.conf.DefaultDeny, host, d.Req.Question[0].Qtype, ctx.setts)
 	if err != nil {
 		// Return immediately if there's an error
 		return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
+	}
+
+	if s.markDryRun(&res) {
+		log.Debug("DNS: dry run: %s would be blocked: %s %s", host, res.Reason, res.Rule)
 
 	} else if res.IsFiltered {
 		// log.Tracef("Host %s is filtered, reason - '%s', matched rule: '%s'", host, res.Reason, res.Rule)
-		d.Res = s.genDNSFilterMessage(d, &res)
+		d.Res = s.genDNSFilterMessage(d, ctx.setts, &res)
 
-	} else if res.Reason == dnsfilter.ReasonRewrite && len(res.CanonName) != 0 && len(res.IPList) == 0 {
+	} else if res.Reason == dnsfilter.ReasonRewrite && len(res.CanonName) != 0 && len(res.IPList) == 0 && !res.NoData {
 		ctx.origQuestion = d.Req.Question[0]
 		// resolve canonical name, not the original host name
 		d.Req.Question[0].Name = dns.Fqdn(res.CanonName)
@@ -64,17 +151,17 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 
 		name := host
 		if len(res.CanonName) != 0 {
-			resp.Answer = append(resp.Answer, s.genCNAMEAnswer(req, res.CanonName))
+			resp.Answer = append(resp.Answer, s.genCNAMEAnswer(req, res.CanonName, s.rewriteTTL(dns.TypeCNAME)))
 			name = res.CanonName
 		}
 
 		for _, ip := range res.IPList {
 			if req.Question[0].Qtype == dns.TypeA {
-				a := s.genAAnswer(req, ip.To4())
+				a := s.genAAnswer(req, ip.To4(), s.rewriteTTL(dns.TypeA))
 				a.Hdr.Name = dns.Fqdn(name)
 				resp.Answer = append(resp.Answer, a)
 			} else if req.Question[0].Qtype == dns.TypeAAAA {
-				a := s.genAAAAAnswer(req, ip)
+				a := s.genAAAAAnswer(req, ip, s.rewriteTTL(dns.TypeAAAA))
 				a.Hdr.Name = dns.Fqdn(name)
 				resp.Answer = append(resp.Answer, a)
 			}
@@ -89,7 +176,7 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 		ptr.Hdr = dns.RR_Header{
 			Name:   req.Question[0].Name,
 			Rrtype: dns.TypePTR,
-			Ttl:    s.conf.BlockedResponseTTL,
+			Ttl:    s.rewriteTTL(dns.TypePTR),
 			Class:  dns.ClassINET,
 		}
 		ptr.Ptr = res.ReverseHost
@@ -100,23 +187,135 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 	return &res, err
 }
 
+// markDryRun turns the blocking result into "would block" one if the filtering is in dry-run mode.
+// Returns false if the result must be applied.
+func (s *Server) markDryRun(res *dnsfilter.Result) bool {
+	if !s.conf.FilteringDryRun || res == nil || !res.IsFiltered {
+		return false
+	}
+	res.IsFiltered = false
+	res.DryRun = true
+	return true
+}
+
+// parseClientNames returns the map of client names with normalized IP addresses and FQDN
+func parseClientNames(names map[string]string) (map[string]string, error) {
+	m := map[string]string{}
+	for addr, name := range names {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("DNS: client_names: invalid IP address %q", addr)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 {
+			return nil, fmt.Errorf("DNS: client_names: invalid host name %q", name)
+		}
+		m[ip.String()] = dns.Fqdn(name)
+	}
+	return m, nil
+}
+
+// clientNameByARPA returns the name of the local client by the reversed address (in-addr.arpa or ip6.arpa).
+// Returns an empty string if the client is unknown.
+func (s *Server) clientNameByARPA(arpa string) string {
+	if len(s.clientNames) == 0 {
+		return ""
+	}
+	arpa = strings.ToLower(strings.TrimSuffix(arpa, "."))
+	ip := util.DNSUnreverseAddr(arpa)
+	if ip == nil {
+		return ""
+	}
+	return s.clientNames[ip.String()]
+}
+
+// Respond to PTR requests if the target IP address is a local client with a configured name
+func processClientNames(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	req := d.Req
+	if req.Question[0].Qtype != dns.TypePTR {
+		return resultDone
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	name := s.clientNameByARPA(req.Question[0].Name)
+	if len(name) == 0 {
+		return resultDone
+	}
+
+	log.Debug("DNS: reverse-lookup of a local client: %s -> %s", req.Question[0].Name, name)
+	resp := s.makeResponse(req)
+	ptr := &dns.PTR{}
+	ptr.Hdr = dns.RR_Header{
+		Name:   req.Question[0].Name,
+		Rrtype: dns.TypePTR,
+		Ttl:    s.rewriteTTL(dns.TypePTR),
+		Class:  dns.ClassINET,
+	}
+	ptr.Ptr = name
+	resp.Answer = append(resp.Answer, ptr)
+	d.Res = resp
+	return resultDone
+}
+
 // If response contains CNAME, A or AAAA records, we apply filtering to each canonical host name or IP address.
 // If this is a match, we set a new response in d.Res and return.
+// Blocked addresses are removed from the address hints of SVCB and HTTPS records.
 func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 	d := ctx.proxyCtx
-	for _, a := range d.Res.Answer {
+
+	// A tracker may be hidden behind a first-party name (CNAME cloaking):
+	//  check every name of the CNAME chain starting with the question host
+	for _, host := range util.CNAMEChain(d.Res.Answer, d.Req.Question[0].Name) {
+		log.Debug("DNSFwd: Checking CNAME %s for %s", host, d.Req.Question[0].Name)
+		res, err := s.checkResponseHost(ctx, host)
+		if err != nil {
+			return nil, err
+
+		} else if res != nil {
+			res.CloakedHost = host
+			d.Res = s.genDNSFilterMessage(d, ctx.setts, res)
+			log.Debug("DNSFwd: Matched %s by CNAME: %s", d.Req.Question[0].Name, host)
+			return res, nil
+		}
+	}
+
+	copied := false
+	for i, a := range d.Res.Answer {
 		host := ""
+		var ip net.IP
 
 		switch v := a.(type) {
-		case *dns.CNAME:
-			log.Debug("DNSFwd: Checking CNAME %s for %s", v.Target, v.Hdr.Name)
-			host = strings.TrimSuffix(v.Target, ".")
+		case *dns.RFC3597:
+			if !isSVCBType(v.Hdr.Rrtype) {
+				continue
+			}
+			rr, err := s.filterSVCBHints(ctx, v)
+			if err != nil {
+				return nil, err
+			} else if rr != nil {
+				// the response may be stored in cache: don't modify it
+				if !copied {
+					d.Res = d.Res.Copy()
+					copied = true
+				}
+				d.Res.Answer[i] = rr
+			}
+			continue
 
 		case *dns.A:
+			ip = v.A
 			host = v.A.String()
 			log.Debug("DNSFwd: Checking record A (%s) for %s", host, v.Hdr.Name)
 
 		case *dns.AAAA:
+			ip = v.AAAA
 			host = v.AAAA.String()
 			log.Debug("DNSFwd: Checking record AAAA (%s) for %s", host, v.Hdr.Name)
 
@@ -124,25 +323,86 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 			continue
 		}
 
-		s.RLock()
-		// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
-		// This could happen after proxy server has been stopped, but its workers are not yet exited.
-		if !s.conf.ProtectionEnabled || s.dnsFilter == nil {
-			s.RUnlock()
-			continue
+		if res := s.checkBlockedIP(ip); res != nil {
+			d.Res = s.genDNSFilterMessage(d, ctx.setts, res)
+			log.Debug("DNSFwd: Matched %s by response: %s", d.Req.Question[0].Name, host)
+			return res, nil
 		}
-		res, err := s.dnsFilter.CheckHostRules(host, d.Req.Question[0].Qtype, ctx.setts)
-		s.RUnlock()
 
+		res, err := s.checkResponseHost(ctx, host)
 		if err != nil {
 			return nil, err
 
-		} else if res.IsFiltered {
-			d.Res = s.genDNSFilterMessage(d, &res)
+		} else if res != nil {
+			d.Res = s.genDNSFilterMessage(d, ctx.setts, res)
 			log.Debug("DNSFwd: Matched %s by response: %s", d.Req.Question[0].Name, host)
-			return &res, nil
+			return res, nil
 		}
 	}
 
+	res := s.checkRebinding(d)
+	if res != nil {
+		d.Res = s.genDNSFilterMessage(d, ctx.setts, res)
+		return res, nil
+	}
+
 	return nil, nil
 }
+
+// checkResponseHost matches the host name or IP address from the response against filtering rules.
+// Returns nil if it isn't filtered.
+func (s *Server) checkResponseHost(ctx *dnsContext, host string) (*dnsfilter.Result, error) {
+	s.RLock()
+	// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
+	// This could happen after proxy server has been stopped, but its workers are not yet exited.
+	if !s.conf.ProtectionEnabled || s.dnsFilter == nil {
+		s.RUnlock()
+		return nil, nil
+	}
+	res, err := s.dnsFilter.CheckHostRules(host, ctx.proxyCtx.Req.Question[0].Qtype, ctx.setts)
+	s.RUnlock()
+
+	if err != nil {
+		return nil, err
+
+	} else if !res.IsFiltered {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+// filterSVCBHints returns SVCB or HTTPS record without the blocked address hints.
+// Returns nil if nothing is blocked.
+func (s *Server) filterSVCBHints(ctx *dnsContext, rr *dns.RFC3597) (*dns.RFC3597, error) {
+	d := ctx.proxyCtx
+
+	s.RLock()
+	defer s.RUnlock()
+	// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
+	if !s.conf.ProtectionEnabled || s.dnsFilter == nil {
+		return nil, nil
+	}
+
+	var err error
+	blocked := func(ip net.IP) bool {
+		if err != nil {
+			return false
+		}
+		var res dnsfilter.Result
+		res, err = s.dnsFilter.CheckHostRules(ip.String(), d.Req.Question[0].Qtype, ctx.setts)
+		if res.IsFiltered {
+			log.Debug("DNSFwd: Removed address hint %s for %s", ip, rr.Hdr.Name)
+		}
+		return err == nil && res.IsFiltered
+	}
+
+	newRR, perr := stripSVCBHints(rr, blocked)
+	if err != nil {
+		return nil, err
+	}
+	if perr != nil {
+		log.Debug("DNSFwd: Couldn't parse %s record for %s: %s", dns.Type(rr.Hdr.Rrtype), rr.Hdr.Name, perr)
+		return nil, nil
+	}
+	return newRR, nil
+}
@@ -25,7 +25,12 @@ type dnsContext struct {
 	err                  error        // error returned from the module
 	protectionEnabled    bool         // filtering is enabled, dnsfilter object is ready
 	responseFromUpstream bool         // response is received from upstream servers
+	responseCached       bool         // response is served from the cache (fresh or stale)
 	origReqDNSSEC        bool         // DNSSEC flag in the original request from user
+	origReqECS           bool         // ECS option from the original request has been removed
+	udpSize              int          // max. size of UDP response the client accepts;  0 for other protocols
+
+	clientECS *dns.EDNS0_SUBNET // copy of ECS option from the client's request (only if ECSEchoScope is set)
 }
 
 const (
@@ -36,21 +41,33 @@ const (
 
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
+	s.workers.add()
+	defer s.workers.done()
+
 	ctx := &dnsContext{srv: s, proxyCtx: d}
 	ctx.result = &dnsfilter.Result{}
 	ctx.startTime = time.Now()
+	// the request may be modified by the modules, so the client's buffer size is saved here
+	ctx.udpSize = clientUDPSize(d)
 
 	type modProcessFunc func(ctx *dnsContext) int
 	mods := []modProcessFunc{
 		processInitial,
 		processInternalHosts,
 		processInternalIPAddrs,
+		processClientNames,
+		processBlockedNames,
 		processFilteringBeforeRequest,
+		processStaticRecords,
+		processLocalZones,
 		processUpstream,
+		processDNS64,
+		processUpstreamTTL,
 		processDNSSECAfterResponse,
 		processFilteringAfterResponse,
 		processQueryLogsAndStats,
 	}
+loop:
 	for _, process := range mods {
 		r := process(ctx)
 		switch r {
@@ -58,7 +75,7 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 			// continue: call the next filter
 
 		case resultFinish:
-			return nil
+			break loop
 
 		case resultError:
 			return ctx.err
@@ -66,27 +83,78 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 	}
 
 	if d.Res != nil {
+		s.RLock()
+		onResponse := s.conf.OnDNSResponse
+		s.RUnlock()
+		if onResponse != nil {
+			onResponse(d)
+		}
+		if ctx.udpSize != 0 {
+			d.Res.Truncate(ctx.udpSize)
+		}
 		d.Res.Compress = true // some devices require DNS message compression
 	}
 	return nil
 }
 
+// clientUDPSize returns the max. size of UDP response advertised by the client in OPT record (RFC 6891 6.2.5).
+// Returns 0 if the request isn't received over UDP.
+func clientUDPSize(d *proxy.DNSContext) int {
+	if d.Proto != proxy.ProtoUDP {
+		return 0
+	}
+	size := dns.MinMsgSize
+	opt := d.Req.IsEdns0()
+	if opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
 // Perform initial checks;  process WHOIS & rDNS
 func processInitial(ctx *dnsContext) int {
 	s := ctx.srv
 	d := ctx.proxyCtx
-	if s.conf.AAAADisabled && d.Req.Question[0].Qtype == dns.TypeAAAA {
+
+	// the other modules expect exactly one question in the request
+	if len(d.Req.Question) != 1 {
+		log.Debug("DNS: invalid number of questions from %s: %d", d.Addr, len(d.Req.Question))
+		d.Res = s.genFormatError(d.Req)
+		return resultFinish
+	}
+
+	if resp := s.chaosResponse(d.Req); resp != nil {
+		d.Res = resp
+		return resultFinish
+	}
+
+	s.RLock()
+	aaaaDisabled := s.conf.AAAADisabled
+	onRequest := s.conf.OnDNSRequest
+	blockCanary := !s.conf.AllowMozillaCanary
+	special := s.specialDomains[strings.ToLower(dns.Fqdn(d.Req.Question[0].Name))]
+	s.RUnlock()
+
+	if aaaaDisabled && d.Req.Question[0].Qtype == dns.TypeAAAA {
 		_ = proxy.CheckDisabledAAAARequest(d, true)
 		return resultFinish
 	}
 
-	if s.conf.OnDNSRequest != nil {
-		s.conf.OnDNSRequest(d)
+	if onRequest != nil {
+		onRequest(d)
 	}
 
 	// disable Mozilla DoH
-	if (d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
-		d.Req.Question[0].Name == "use-application-dns.net." {
+	if blockCanary &&
+		(d.Req.Question[0].Qtype == dns.TypeA || d.Req.Question[0].Qtype == dns.TypeAAAA) &&
+		strings.EqualFold(d.Req.Question[0].Name, mozillaCanary) {
+		d.Res = s.genNXDomain(d.Req)
+		return resultFinish
+	}
+
+	// canary domains (e.g. Apple's private relay)
+	if special {
+		log.Debug("DNS: %s is a special blocked domain", d.Req.Question[0].Name)
 		d.Res = s.genNXDomain(d.Req)
 		return resultFinish
 	}
@@ -94,6 +162,23 @@ func processInitial(ctx *dnsContext) int {
 	return resultDone
 }
 
+// Mozilla canary domain:  if it doesn't resolve, Firefox doesn't enable DNS-over-HTTPS
+const mozillaCanary = "use-application-dns.net."
+
+// specialBlockedDomains returns the set of domain names answered with NXDOMAIN.
+// Mozilla canary domain is handled separately.
+func specialBlockedDomains(c *FilteringConfig) map[string]bool {
+	domains := map[string]bool{}
+	for _, host := range c.SpecialBlockedDomains {
+		host = strings.TrimSpace(host)
+		if len(host) != 0 {
+			domains[strings.ToLower(dns.Fqdn(host))] = true
+		}
+	}
+	delete(domains, mozillaCanary)
+	return domains
+}
+
 // Return TRUE if host names doesn't contain disallowed characters
 func isHostnameOK(hostname string) bool {
 	for _, c := range hostname {
@@ -183,7 +268,7 @@ func processInternalHosts(ctx *dnsContext) int {
 		a.Hdr = dns.RR_Header{
 			Name:   req.Question[0].Name,
 			Rrtype: dns.TypeA,
-			Ttl:    s.conf.BlockedResponseTTL,
+			Ttl:    s.blockedTTL(dns.TypeA),
 			Class:  dns.ClassINET,
 		}
 		a.A = make([]byte, 4)
@@ -229,7 +314,7 @@ func processInternalIPAddrs(ctx *dnsContext) int {
 	ptr.Hdr = dns.RR_Header{
 		Name:   req.Question[0].Name,
 		Rrtype: dns.TypePTR,
-		Ttl:    s.conf.BlockedResponseTTL,
+		Ttl:    s.blockedTTL(dns.TypePTR),
 		Class:  dns.ClassINET,
 	}
 	ptr.Ptr = host + "."
@@ -251,21 +336,27 @@ func processFilteringBeforeRequest(ctx *dnsContext) int {
 	// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
 	// This could happen after proxy server has been stopped, but its workers are not yet exited.
 	//
-	// A better approach is for proxy.Stop() to wait until all its workers exit,
-	//  but this would require the Upstream interface to have Close() function
-	//  (to prevent from hanging while waiting for unresponsive DNS server to respond).
+	// proxy.Stop() doesn't wait until all its workers exit,
+	//  so StopAndWait() should be used before Close().
+	// Still, the workers may outlive the timeout of StopAndWait()
+	//  (e.g. while waiting for unresponsive DNS server to respond).
 
 	var err error
+	if s.dnsFilter != nil {
+		// the settings contain the client name for the query log even if the filtering is disabled
+		ctx.setts = s.getClientRequestFilteringSettings(d)
+	}
 	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil
 	if ctx.protectionEnabled {
-		ctx.setts = s.getClientRequestFilteringSettings(d)
 		ctx.result, err = s.filterDNSRequest(ctx)
 	}
 	s.RUnlock()
 
 	if err != nil {
-		ctx.err = err
-		return resultError
+		// the client gets SERVFAIL immediately instead of waiting for a timeout
+		s.logError("filtering", err)
+		d.Res = s.genServerFailure(d.Req)
+		ctx.result = &dnsfilter.Result{}
 	}
 	return resultDone
 }
@@ -278,12 +369,12 @@ func processUpstream(ctx *dnsContext) int {
 		return resultDone // response is already set - nothing to do
 	}
 
-	if d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
+	var groups []*proxy.UpstreamConfig
+	if d.Addr != nil {
 		clientIP := ipFromAddr(d.Addr)
-		upstreamsConf := s.conf.GetCustomUpstreamByClient(clientIP)
-		if upstreamsConf != nil {
+		groups = s.getUpstreamGroups(clientIP)
+		if len(groups) != 0 {
 			log.Debug("Using custom upstreams for %s", clientIP)
-			d.CustomUpstreamConfig = upstreamsConf
 		}
 	}
 
@@ -299,17 +390,157 @@ func processUpstream(ctx *dnsContext) int {
 		}
 	}
 
+	if s.conf.EnableEDNSClientSubnet && s.conf.ECSStripIncoming && removeECS(d.Req) {
+		log.Debug("DNS: removed ECS option from the request")
+		ctx.origReqECS = true
+	} else if s.conf.ECSEchoScope {
+		if e := findECS(d.Req); e != nil {
+			// the option in the request may be modified while resolving
+			ecs := *e
+			ctx.clientECS = &ecs
+		}
+	}
+
+	s.RLock()
+	resolver := s.resolver
+	s.RUnlock()
+
 	// request was not filtered so let it be processed further
-	err := s.dnsProxy.Resolve(d)
+	var err error
+	target := ""
+	var subnet *net.IPNet
+	if len(groups) == 0 {
+		// responses of the custom upstreams aren't cached
+		subnet = s.cacheSubnet(d)
+		d.Res = s.cache.lookup(d.Req, subnet, time.Now())
+		if d.Res != nil {
+			log.Debug("DNS: serving cached response")
+			ctx.responseCached = true
+		} else {
+			err = resolver.Resolve(d)
+			if err != nil {
+				target = upstreamsTarget(resolver.UpstreamConfig)
+			} else if d.Upstream != nil {
+				s.cache.store(d.Res, subnet, time.Now())
+			}
+		}
+	}
+	for i, conf := range groups {
+		// use the next group only if all upstreams of this group have failed
+		d.CustomUpstreamConfig = s.ecsUpstreamConfig(conf)
+		d.Res = nil
+		err = resolver.Resolve(d)
+		if err == nil {
+			break
+		}
+		log.Debug("DNS: upstream group #%d failed: %s", i, err)
+		target = upstreamsTarget(conf)
+	}
 	if err != nil {
-		ctx.err = err
-		return resultError
+		s.logError(target, err)
+		if !s.conf.ServeStale || len(groups) != 0 || !s.serveStale(d, subnet) {
+			ctx.err = err
+			return resultError
+		}
+		log.Debug("DNS: serving stale response for %s", d.Req.Question[0].Name)
+		ctx.responseCached = true
+	}
+
+	if ctx.origReqECS && d.Res != nil {
+		// the client must not receive the subnet that it didn't send
+		removeECS(d.Res)
+	} else if ctx.clientECS != nil && d.Res != nil {
+		echoECSScope(d.Res, ctx.clientECS)
 	}
 
 	ctx.responseFromUpstream = true
 	return resultDone
 }
 
+// removeECS removes EDNS Client Subnet options from the message.
+// Returns true if the options were found.
+func removeECS(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	found := false
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			found = true
+			continue
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	return found
+}
+
+// findECS returns EDNS Client Subnet option of the message or nil
+func findECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_SUBNET)
+		if ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// echoECSScope replaces ECS option in the response with the client's subnet
+// and the scope prefix length returned by upstream server (RFC 7871 7.2.2).
+// The response isn't modified if it has no ECS option.
+func echoECSScope(resp *dns.Msg, clientECS *dns.EDNS0_SUBNET) {
+	e := findECS(resp)
+	if e == nil {
+		return
+	}
+	ecs := *clientECS
+	ecs.SourceScope = e.SourceScope
+
+	removeECS(resp)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &ecs)
+	log.Debug("DNS: ECS scope in the response: %s/%d/%d", ecs.Address, ecs.SourceNetmask, ecs.SourceScope)
+}
+
+// Limit TTL of the records from upstream servers by MinUpstreamTTL and MaxUpstreamTTL
+func processUpstreamTTL(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if !ctx.responseFromUpstream || d.Res == nil ||
+		(s.conf.MinUpstreamTTL == 0 && s.conf.MaxUpstreamTTL == 0) {
+		return resultDone
+	}
+
+	for _, list := range [][]dns.RR{d.Res.Answer, d.Res.Ns, d.Res.Extra} {
+		for _, rr := range list {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue // TTL field of OPT record contains the extended flags
+			}
+			rr.Header().Ttl = limitTTL(rr.Header().Ttl, s.conf.MinUpstreamTTL, s.conf.MaxUpstreamTTL)
+		}
+	}
+	return resultDone
+}
+
+// limitTTL returns TTL limited by the min. and max. values;  0 means no limit
+func limitTTL(ttl, min, max uint32) uint32 {
+	if max != 0 && ttl > max {
+		ttl = max
+	}
+	if ttl < min {
+		ttl = min
+	}
+	return ttl
+}
+
 // Process DNSSEC after response from upstream server
 func processDNSSECAfterResponse(ctx *dnsContext) int {
 	d := ctx.proxyCtx
@@ -319,43 +550,49 @@ func processDNSSECAfterResponse(ctx *dnsContext) int {
 		return resultDone
 	}
 
-	if !ctx.origReqDNSSEC {
-		optResp := d.Res.IsEdns0()
-		if optResp != nil && !optResp.Do() {
-			return resultDone
-		}
+	if ctx.origReqDNSSEC {
+		// the client has requested DNSSEC records itself:
+		//  RRSIG and NSEC/NSEC3 records proving the non-existence are passed as is
+		return resultDone
+	}
 
-		// Remove RRSIG records from response
-		// because there is no DO flag in the original request from client,
-		// but we have EnableDNSSEC set, so we have set DO flag ourselves,
-		// and now we have to clean up the DNS records our client didn't ask for.
-
-		answers := []dns.RR{}
-		for _, a := range d.Res.Answer {
-			switch a.(type) {
-			case *dns.RRSIG:
-				log.Debug("Removing RRSIG record from response: %v", a)
-			default:
-				answers = append(answers, a)
-			}
-		}
-		d.Res.Answer = answers
-
-		answers = []dns.RR{}
-		for _, a := range d.Res.Ns {
-			switch a.(type) {
-			case *dns.RRSIG:
-				log.Debug("Removing RRSIG record from response: %v", a)
-			default:
-				answers = append(answers, a)
-			}
-		}
-		d.Res.Ns = answers
+	optResp := d.Res.IsEdns0()
+	if optResp != nil && !optResp.Do() {
+		return resultDone
+	}
+
+	// Remove DNSSEC records from response
+	// because there is no DO flag in the original request from client,
+	// but we have EnableDNSSEC set, so we have set DO flag ourselves,
+	// and now we have to clean up the DNS records our client didn't ask for.
+	qtype := d.Req.Question[0].Qtype
+	d.Res.Answer = removeDNSSECRecords(d.Res.Answer, qtype)
+	d.Res.Ns = removeDNSSECRecords(d.Res.Ns, qtype)
+	d.Res.Extra = removeDNSSECRecords(d.Res.Extra, qtype)
+	if optResp != nil {
+		optResp.SetDo(false)
 	}
 
 	return resultDone
 }
 
+// removeDNSSECRecords returns the records without RRSIG, NSEC and NSEC3 ones.
+// The records of the requested type are kept.
+func removeDNSSECRecords(rrs []dns.RR, qtype uint16) []dns.RR {
+	res := []dns.RR{}
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rr.Header().Rrtype != qtype {
+				log.Debug("Removing %s record from response: %v", dns.Type(rr.Header().Rrtype), rr)
+				continue
+			}
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
 // Apply filtering logic after we have received response from upstream servers
 func processFilteringAfterResponse(ctx *dnsContext) int {
 	s := ctx.srv
@@ -375,11 +612,30 @@ func processFilteringAfterResponse(ctx *dnsContext) int {
 
 		if len(d.Res.Answer) != 0 {
 			answer := []dns.RR{}
-			answer = append(answer, s.genCNAMEAnswer(d.Req, res.CanonName))
+			answer = append(answer, s.genCNAMEAnswer(d.Req, res.CanonName, s.rewriteTTL(dns.TypeCNAME)))
 			answer = append(answer, d.Res.Answer...) // host -> IP
 			d.Res.Answer = answer
 		}
 
+		// the response for the canonical name is received from upstream servers:
+		//  filter it as usual, but keep the rewrite result if nothing matches
+		if !ctx.protectionEnabled || !ctx.responseFromUpstream {
+			break
+		}
+		origResp2 := d.Res
+		res2, err := s.filterDNSResponse(ctx)
+		if err != nil {
+			ctx.err = err
+			return resultError
+		}
+		if s.markDryRun(res2) {
+			d.Res = origResp2
+			ctx.result = res2
+		} else if res2 != nil {
+			ctx.result = res2
+			ctx.origResp = origResp2 // matched by response
+		}
+
 	case dnsfilter.NotFilteredWhiteList:
 		// nothing
 
@@ -389,13 +645,23 @@ func processFilteringAfterResponse(ctx *dnsContext) int {
 			break
 		}
 		origResp2 := d.Res
+		reqResult := ctx.result
 		ctx.result, err = s.filterDNSResponse(ctx)
 		if err != nil {
 			ctx.err = err
 			return resultError
 		}
-		if ctx.result != nil {
+		if s.conf.FilteringDryRun {
+			// the response is passed to the client as is
+			d.Res = origResp2
+		}
+		if s.markDryRun(ctx.result) {
+			log.Debug("DNS: dry run: %s would be blocked by response: %s %s",
+				d.Req.Question[0].Name, ctx.result.Reason, ctx.result.Rule)
+		} else if ctx.result != nil {
 			ctx.origResp = origResp2 // matched by response
+		} else if reqResult != nil && reqResult.DryRun {
+			ctx.result = reqResult
 		} else {
 			ctx.result = &dnsfilter.Result{}
 		}
@@ -0,0 +1,263 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Default settings of the upstream health checker
+const (
+	defaultHealthName     = "whoami.cloudflare"
+	defaultHealthFailures = 3
+)
+
+// UpstreamHealth - the health status of an upstream server
+type UpstreamHealth struct {
+	Address   string        // upstream server address
+	Healthy   bool          // false if the last Failures checks have failed and Failures >= UpstreamHealthFailures
+	Failures  uint32        // number of consecutive failed checks
+	Latency   time.Duration // response time of the last successful check
+	LastCheck time.Time     // time of the last check;  zero if the server hasn't been checked yet
+	LastError string        // error of the last failed check
+}
+
+// healthChecker periodically sends a request to each upstream server and keeps the results.
+// The zero value is ready for use.
+type healthChecker struct {
+	lock   sync.Mutex
+	status []UpstreamHealth // in the order of the upstream configuration
+	stop   chan struct{}    // closed to stop the checking goroutine;  nil if it's not running
+}
+
+// UpstreamsHealth returns the health status of the upstream servers.
+// The list is empty if the health checking is disabled.
+func (s *Server) UpstreamsHealth() []UpstreamHealth {
+	h := &s.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]UpstreamHealth{}, h.status...)
+}
+
+// startHealthCheck starts checking the upstream servers of the internal proxy in background
+// Called with the server lock held.
+func (s *Server) startHealthCheck() {
+	s.stopHealthCheck()
+	h := &s.health
+	if s.conf.UpstreamHealthInterval == 0 || s.internalProxy == nil || s.internalProxy.UpstreamConfig == nil {
+		h.lock.Lock()
+		h.status = nil
+		h.lock.Unlock()
+		return
+	}
+
+	ups := s.internalProxy.UpstreamConfig.Upstreams
+	name := dns.Fqdn(s.conf.UpstreamHealthName)
+	maxFailures := s.conf.UpstreamHealthFailures
+	interval := time.Duration(s.conf.UpstreamHealthInterval) * time.Second
+
+	h.lock.Lock()
+	h.reset(ups)
+	stop := make(chan struct{})
+	h.stop = stop
+	h.lock.Unlock()
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			h.check(ups, name, maxFailures)
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopHealthCheck stops the checking goroutine.  The last results are kept.
+func (s *Server) stopHealthCheck() {
+	h := &s.health
+	h.lock.Lock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	h.lock.Unlock()
+}
+
+// reset sets the list of the checked servers keeping the status of the known ones
+// Called with the lock held.
+func (h *healthChecker) reset(ups []upstream.Upstream) {
+	old := map[string]UpstreamHealth{}
+	for _, st := range h.status {
+		old[st.Address] = st
+	}
+
+	h.status = nil
+	for _, u := range ups {
+		st, ok := old[u.Address()]
+		if !ok {
+			st = UpstreamHealth{Address: u.Address(), Healthy: true}
+		}
+		h.status = append(h.status, st)
+	}
+}
+
+// check sends the probe request to all servers at once and updates their status
+func (h *healthChecker) check(ups []upstream.Upstream, name string, maxFailures uint32) {
+	results := make([]UpstreamHealth, len(ups))
+	wg := sync.WaitGroup{}
+	for i, u := range ups {
+		wg.Add(1)
+		go func(i int, u upstream.Upstream) {
+			defer wg.Done()
+			results[i] = probeUpstream(u, name)
+		}(i, u)
+	}
+	wg.Wait()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, r := range results {
+		for i := range h.status {
+			st := &h.status[i]
+			if st.Address != r.Address {
+				continue
+			}
+
+			st.LastCheck = r.LastCheck
+			if len(r.LastError) == 0 {
+				st.Failures = 0
+				st.Healthy = true
+				st.Latency = r.Latency
+				st.LastError = ""
+				break
+			}
+
+			st.Failures++
+			st.LastError = r.LastError
+			if st.Failures >= maxFailures && st.Healthy {
+				st.Healthy = false
+				log.Info("DNS: upstream %s is unhealthy: %s", st.Address, st.LastError)
+			}
+			break
+		}
+	}
+}
+
+// probeUpstream sends A request for the host name to the upstream server
+func probeUpstream(u upstream.Upstream, name string) UpstreamHealth {
+	req := &dns.Msg{}
+	req.Id = dns.Id()
+	req.RecursionDesired = true
+	req.Question = []dns.Question{
+		{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+
+	r := UpstreamHealth{Address: u.Address()}
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	r.LastCheck = time.Now()
+	r.Latency = r.LastCheck.Sub(start)
+	if err == nil && resp == nil {
+		err = fmt.Errorf("no response")
+	} else if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = fmt.Errorf("SERVFAIL response")
+	}
+	if err != nil {
+		r.LastError = err.Error()
+	}
+	return r
+}
+
+type upstreamHealthJSON struct {
+	Address   string  `json:"address"`
+	Healthy   bool    `json:"healthy"`
+	Failures  uint32  `json:"failures"`
+	LatencyMs float64 `json:"latency_ms"`
+	LastCheck string  `json:"last_check,omitempty"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+func (s *Server) handleUpstreamsHealth(w http.ResponseWriter, r *http.Request) {
+	data := []upstreamHealthJSON{}
+	for _, st := range s.UpstreamsHealth() {
+		j := upstreamHealthJSON{
+			Address:   st.Address,
+			Healthy:   st.Healthy,
+			Failures:  st.Failures,
+			LatencyMs: float64(st.Latency) / float64(time.Millisecond),
+			LastError: st.LastError,
+		}
+		if !st.LastCheck.IsZero() {
+			j.LastCheck = st.LastCheck.Format(time.RFC3339)
+		}
+		data = append(data, j)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// IsReady returns true if the server is running and at least one upstream server is healthy.
+// The upstream servers are considered healthy if the health checking is disabled.
+func (s *Server) IsReady() (bool, string) {
+	s.RLock()
+	running := s.isRunning && s.dnsProxy != nil
+	s.RUnlock()
+	if !running {
+		return false, "DNS server isn't running"
+	}
+
+	status := s.UpstreamsHealth()
+	if len(status) == 0 {
+		return true, ""
+	}
+	for _, st := range status {
+		if st.Healthy {
+			return true, ""
+		}
+	}
+	return false, "no healthy upstream servers"
+}
+
+type probeJSON struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func writeProbe(r *http.Request, w http.ResponseWriter, code int, data probeJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Debug("%s %s: json.Encode: %s", r.Method, r.URL, err)
+	}
+}
+
+// handleHealth is the liveness probe:  it doesn't check the DNS server
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeProbe(r, w, http.StatusOK, probeJSON{Status: "ok"})
+}
+
+// handleReady is the readiness probe:  it responds with 503 if the server can't resolve the requests
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready, reason := s.IsReady()
+	if !ready {
+		writeProbe(r, w, http.StatusServiceUnavailable, probeJSON{Status: "not ready", Reason: reason})
+		return
+	}
+	writeProbe(r, w, http.StatusOK, probeJSON{Status: "ok"})
+}
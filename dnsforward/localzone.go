@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// parseLocalZones returns NS and SOA records of LocalZones by the zone FQDN in lower case.
+// A zone has at most one SOA record.
+func parseLocalZones(zones map[string][]string) (map[string][]dns.RR, error) {
+	m := map[string][]dns.RR{}
+	for name, list := range zones {
+		zone := strings.ToLower(dns.Fqdn(strings.TrimSpace(name)))
+		if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+			return nil, fmt.Errorf("DNS: local_zones: invalid zone name %q", name)
+		}
+
+		m[zone] = []dns.RR{}
+		hasSOA := false
+		for _, s := range list {
+			rr, err := dns.NewRR(zone + " IN " + s)
+			if err == nil && rr == nil {
+				err = fmt.Errorf("empty record")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("DNS: local_zones: %s: %q: %s", name, s, err)
+			}
+
+			switch rr.Header().Rrtype {
+			case dns.TypeNS:
+			case dns.TypeSOA:
+				if hasSOA {
+					return nil, fmt.Errorf("DNS: local_zones: %s: more than one SOA record", name)
+				}
+				hasSOA = true
+			default:
+				return nil, fmt.Errorf("DNS: local_zones: %s: %q: only NS and SOA records are supported", name, s)
+			}
+			m[zone] = append(m[zone], rr)
+		}
+	}
+	return m, nil
+}
+
+// findLocalZone returns the name of the closest local zone that contains the host.
+// Returns an empty string if the host isn't in a local zone.
+func (s *Server) findLocalZone(host string) string {
+	if len(s.localZones) == 0 {
+		return ""
+	}
+	name := strings.ToLower(dns.Fqdn(host))
+	for len(name) != 0 && name != "." {
+		if _, ok := s.localZones[name]; ok {
+			return name
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return ""
+}
+
+// localZoneRecords returns the copies of the zone records of the type owned by the name.
+// SOA record is generated if it isn't configured;  NS record is made from SOA's primary name server
+// if there are no NS records.
+func (s *Server) localZoneRecords(zone, name string, rrtype uint16) []dns.RR {
+	var soa *dns.SOA
+	var ans []dns.RR
+	for _, rr := range s.localZones[zone] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			soa = rr.(*dns.SOA)
+		}
+		if rr.Header().Rrtype == rrtype {
+			ans = append(ans, dns.Copy(rr))
+		}
+	}
+	if soa == nil {
+		soa = s.makeSOA(zone, 0)
+	}
+
+	if len(ans) == 0 {
+		switch rrtype {
+		case dns.TypeSOA:
+			ans = append(ans, dns.Copy(soa))
+		case dns.TypeNS:
+			ans = append(ans, &dns.NS{
+				Hdr: dns.RR_Header{Rrtype: dns.TypeNS, Class: dns.ClassINET},
+				Ns:  soa.Ns,
+			})
+		}
+	}
+
+	for _, rr := range ans {
+		rr.Header().Name = name
+		rr.Header().Ttl = s.rewriteTTL(rrtype)
+	}
+	return ans
+}
+
+// Answer NS and SOA requests for the names in the local zones.
+// The other requests (e.g. A and PTR handled by rewrites and hosts) are passed to the next modules.
+func processLocalZones(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	q := d.Req.Question[0]
+	if q.Qtype != dns.TypeNS && q.Qtype != dns.TypeSOA {
+		return resultDone
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	zone := s.findLocalZone(q.Name)
+	if len(zone) == 0 {
+		return resultDone
+	}
+
+	log.Debug("DNS: %s %s is in the local zone %s", dns.Type(q.Qtype), q.Name, zone)
+	resp := s.makeResponse(d.Req)
+	resp.Authoritative = true
+	if strings.EqualFold(dns.Fqdn(q.Name), zone) {
+		resp.Answer = s.localZoneRecords(zone, q.Name, q.Qtype)
+	} else {
+		// the records are owned by the zone apex only:  the answer is empty
+		resp.Ns = s.localZoneRecords(zone, zone, dns.TypeSOA)
+	}
+	d.Res = resp
+	return resultDone
+}
@@ -0,0 +1,219 @@
+package dnsforward
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+// Upper bounds of the request duration histogram buckets (in seconds)
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics holds the counters exported in Prometheus text format.
+// The zero value is ready for use.
+type metrics struct {
+	lock sync.Mutex
+
+	queries  uint64                      // total number of processed requests
+	reasons  map[dnsfilter.Reason]uint64 // number of filtered requests by reason
+	rcodes   map[int]uint64              // number of responses by rcode
+	buckets  []uint64                    // number of requests in each of durationBuckets
+	duration float64                     // sum of request durations (in seconds)
+	qtypes   map[uint16]uint64           // number of requests by question type
+}
+
+// update counts a processed request
+func (m *metrics) update(res *dns.Msg, elapsed time.Duration, reason dnsfilter.Reason) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.reasons == nil {
+		m.reasons = map[dnsfilter.Reason]uint64{}
+		m.rcodes = map[int]uint64{}
+		m.buckets = make([]uint64, len(durationBuckets))
+	}
+
+	m.queries++
+	if reason.Matched() {
+		m.reasons[reason]++
+	}
+	if res != nil {
+		m.rcodes[res.Rcode]++
+	}
+
+	sec := elapsed.Seconds()
+	m.duration += sec
+	for i, le := range durationBuckets {
+		if sec <= le {
+			m.buckets[i]++
+		}
+	}
+}
+
+// countQType counts a request by its question type
+func (m *metrics) countQType(qtype uint16) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.qtypes == nil {
+		m.qtypes = map[uint16]uint64{}
+	}
+	m.qtypes[qtype]++
+}
+
+// queryTypes returns the number of requests by question type name
+func (m *metrics) queryTypes() map[string]uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := map[string]uint64{}
+	for qt, n := range m.qtypes {
+		res[qtypeName(qt)] = n
+	}
+	return res
+}
+
+// qtypeName returns the name of the question type, e.g. "AAAA" or "TYPE1234"
+func qtypeName(qtype uint16) string {
+	switch qtype {
+	case typeSVCB:
+		return "SVCB"
+	case typeHTTPS:
+		return "HTTPS"
+	}
+	s, ok := dns.TypeToString[qtype]
+	if !ok {
+		return fmt.Sprintf("TYPE%d", qtype)
+	}
+	return s
+}
+
+// write writes all metrics in Prometheus text exposition format
+func (m *metrics) write(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_queries_total Total number of DNS queries.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_queries_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_dns_queries_total %d\n", m.queries)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_filtered_total Number of filtered DNS queries by reason.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_filtered_total counter\n")
+	reasons := []dnsfilter.Reason{}
+	for r := range m.reasons {
+		reasons = append(reasons, r)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+	for _, r := range reasons {
+		fmt.Fprintf(bw, "adguardhome_dns_filtered_total{reason=%q} %d\n", r.String(), m.reasons[r])
+	}
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_responses_total Number of DNS responses by rcode.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_responses_total counter\n")
+	rcodes := []int{}
+	for rc := range m.rcodes {
+		rcodes = append(rcodes, rc)
+	}
+	sort.Ints(rcodes)
+	for _, rc := range rcodes {
+		fmt.Fprintf(bw, "adguardhome_dns_responses_total{rcode=%q} %d\n", rcodeName(rc), m.rcodes[rc])
+	}
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_queries_by_type_total Number of DNS queries by question type.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_queries_by_type_total counter\n")
+	qtypes := []uint16{}
+	for qt := range m.qtypes {
+		qtypes = append(qtypes, qt)
+	}
+	sort.Slice(qtypes, func(i, j int) bool { return qtypes[i] < qtypes[j] })
+	for _, qt := range qtypes {
+		fmt.Fprintf(bw, "adguardhome_dns_queries_by_type_total{type=%q} %d\n", qtypeName(qt), m.qtypes[qt])
+	}
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_request_duration_seconds Time spent processing DNS queries, including the upstream exchange.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_request_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		var n uint64
+		if m.buckets != nil {
+			n = m.buckets[i]
+		}
+		fmt.Fprintf(bw, "adguardhome_dns_request_duration_seconds_bucket{le=\"%g\"} %d\n", le, n)
+	}
+	fmt.Fprintf(bw, "adguardhome_dns_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.queries)
+	fmt.Fprintf(bw, "adguardhome_dns_request_duration_seconds_sum %g\n", m.duration)
+	fmt.Fprintf(bw, "adguardhome_dns_request_duration_seconds_count %d\n", m.queries)
+
+	return bw.Flush()
+}
+
+func rcodeName(rc int) string {
+	s, ok := dns.RcodeToString[rc]
+	if !ok {
+		return fmt.Sprintf("%d", rc)
+	}
+	return s
+}
+
+// QueryTypeStats returns the number of processed requests by question type (e.g. "A", "AAAA", "HTTPS")
+func (s *Server) QueryTypeStats() map[string]uint64 {
+	return s.metrics.queryTypes()
+}
+
+// Metrics writes the server metrics in Prometheus text exposition format
+func (s *Server) Metrics(w io.Writer) error {
+	err := s.metrics.write(w)
+	if err != nil {
+		return err
+	}
+	err = writeCacheMetrics(w, s.CacheStats())
+	if err != nil || s.conf.ExtraMetrics == nil {
+		return err
+	}
+	return s.conf.ExtraMetrics(w)
+}
+
+// writeCacheMetrics writes the counters of the DNS cache in Prometheus text exposition format
+func writeCacheMetrics(w io.Writer, st CacheStats) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_cache_hits_total Number of DNS queries answered from cache.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_cache_hits_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_dns_cache_hits_total %d\n", st.Hits)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_cache_misses_total Number of DNS queries not found in cache.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_cache_misses_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_dns_cache_misses_total %d\n", st.Misses)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_cache_evictions_total Number of entries removed from the full cache.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_cache_evictions_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_dns_cache_evictions_total %d\n", st.Evictions)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_cache_entries Current number of entries in cache.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_cache_entries gauge\n")
+	fmt.Fprintf(bw, "adguardhome_dns_cache_entries %d\n", st.Entries)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_dns_cache_size_bytes Current size of cache entries.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_dns_cache_size_bytes gauge\n")
+	fmt.Fprintf(bw, "adguardhome_dns_cache_size_bytes %d\n", st.Size)
+
+	return bw.Flush()
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.Buffer{}
+	_ = s.Metrics(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}
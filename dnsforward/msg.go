@@ -1,8 +1,12 @@
 package dnsforward
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
@@ -19,11 +23,39 @@ func (s *Server) makeResponse(req *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// blockingMode returns the blocking mode and the custom blocking addresses for the client.
+// The client's own mode overrides the server's one.
+func (s *Server) blockingMode(setts *dnsfilter.RequestFilteringSettings) (string, []net.IP, []net.IP) {
+	if setts != nil && len(setts.BlockingMode) != 0 {
+		return setts.BlockingMode, setts.BlockingIPv4, setts.BlockingIPv6
+	}
+	return s.conf.BlockingMode, s.conf.BlockingIPAddrv4, s.conf.BlockingIPAddrv6
+}
+
 // genDNSFilterMessage generates a DNS message corresponding to the filtering result
-func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
+func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, setts *dnsfilter.RequestFilteringSettings,
+	result *dnsfilter.Result) *dns.Msg {
 	m := d.Req
+	mode, blockingIPv4, blockingIPv6 := s.blockingMode(setts)
 
-	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
+	qtype := m.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		// SVCB and HTTPS records may contain the addresses of the host (ipv4hint, ipv6hint),
+		//  so they're blocked like the other types.
+		// But if Safe search replaces the addresses, the host is allowed:
+		//  respond with an empty answer so that the client uses A and AAAA records.
+		if isSVCBType(qtype) && result.Reason == dnsfilter.FilteredSafeSearch {
+			return s.makeResponse(m)
+		}
+
+		if qtype == dns.TypeTXT && len(s.conf.BlockedTXTMessage) != 0 &&
+			result.Reason != dnsfilter.FilteredSafeSearch {
+			return s.genBlockedTXT(m, result.Rule)
+		}
+
+		if mode == "refused" {
+			return s.genRefused(m)
+		}
 		return s.genNXDomain(m)
 	}
 
@@ -32,6 +64,8 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 		return s.genBlockedHost(m, s.conf.SafeBrowsingBlockHost, d)
 	case dnsfilter.FilteredParental:
 		return s.genBlockedHost(m, s.conf.ParentalBlockHost, d)
+	case dnsfilter.FilteredDefaultDeny:
+		return s.genNXDomain(m)
 	default:
 		// If the query was filtered by "Safe search", dnsfilter also must return
 		// the IP address that must be used in response.
@@ -40,7 +74,12 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return s.genResponseWithIP(m, result.IP)
 		}
 
-		if s.conf.BlockingMode == "null_ip" {
+		// the filter list has its own address for the blocked hosts
+		if result.BlockIP != nil {
+			return s.genResponseWithIP(m, result.BlockIP)
+		}
+
+		if mode == "null_ip" {
 			// it means that we should return 0.0.0.0 or :: for any blocked request
 
 			switch m.Question[0].Qtype {
@@ -50,20 +89,33 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 				return s.genAAAARecord(m, net.IPv6zero)
 			}
 
-		} else if s.conf.BlockingMode == "custom_ip" {
+		} else if mode == "custom_ip" {
 			// means that we should return custom IP for any blocked request
+			// If there's no address of this type, respond with an empty answer.
+			// Several addresses are returned in the round-robin order.
 
 			switch m.Question[0].Qtype {
 			case dns.TypeA:
-				return s.genARecord(m, s.conf.BlockingIPAddrv4)
+				if len(blockingIPv4) == 0 {
+					return s.makeResponse(m)
+				}
+				return s.genARecord(m, s.rotateBlockingIPs(blockingIPv4)...)
 			case dns.TypeAAAA:
-				return s.genAAAARecord(m, s.conf.BlockingIPAddrv6)
+				if len(blockingIPv6) == 0 {
+					return s.makeResponse(m)
+				}
+				return s.genAAAARecord(m, s.rotateBlockingIPs(blockingIPv6)...)
 			}
 
-		} else if s.conf.BlockingMode == "nxdomain" {
+		} else if mode == "nxdomain" {
 			// means that we should return NXDOMAIN for any blocked request
 
 			return s.genNXDomain(m)
+
+		} else if mode == "refused" {
+			// means that we should return REFUSED for any blocked request
+
+			return s.genRefused(m)
 		}
 
 		// Default blocking mode
@@ -76,43 +128,133 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 	}
 }
 
+// genBlockedTXT returns TXT record with the explanation why the request is blocked
+func (s *Server) genBlockedTXT(request *dns.Msg, rule string) *dns.Msg {
+	resp := s.makeResponse(request)
+	msg := strings.Replace(s.conf.BlockedTXTMessage, "{rule}", rule, -1)
+
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   request.Question[0].Name,
+			Rrtype: dns.TypeTXT,
+			Ttl:    s.blockedTTL(dns.TypeTXT),
+			Class:  dns.ClassINET,
+		},
+	}
+	// a character-string can't be longer than 255 bytes
+	for len(msg) > 255 {
+		txt.Txt = append(txt.Txt, msg[:255])
+		msg = msg[255:]
+	}
+	txt.Txt = append(txt.Txt, msg)
+
+	resp.Answer = append(resp.Answer, txt)
+	return resp
+}
+
+// Default TTLs of the generated answers (in seconds), used if BlockedResponseTTL is 0
+var defaultAnswerTTLs = map[uint16]uint32{
+	dns.TypeA:     3600,
+	dns.TypeAAAA:  3600,
+	dns.TypeCNAME: 3600,
+	dns.TypeTXT:   3600,
+	dns.TypeSOA:   3600,
+	dns.TypePTR:   86400, // host names of the addresses rarely change
+}
+
+// blockedTTL returns TTL of a generated answer of this type
+func (s *Server) blockedTTL(rrtype uint16) uint32 {
+	if s.conf.BlockedResponseTTL != 0 {
+		return s.conf.BlockedResponseTTL
+	}
+	ttl, ok := defaultAnswerTTLs[rrtype]
+	if !ok {
+		return defaultValues.BlockedResponseTTL
+	}
+	return ttl
+}
+
+// rewriteTTL returns TTL of an answer generated by a rewrite rule or /etc/hosts
+func (s *Server) rewriteTTL(rrtype uint16) uint32 {
+	if s.conf.RewriteTTL != 0 {
+		return s.conf.RewriteTTL
+	}
+	return s.blockedTTL(rrtype)
+}
+
 func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeServerFailure)
 	resp.RecursionAvailable = true
+	if s.conf.ServFailSOATTL != 0 {
+		// the failure is cached for the minimum of SOA TTL and SOA MINIMUM
+		soa := s.genSOA(request)[0].(*dns.SOA)
+		soa.Hdr.Ttl = s.conf.ServFailSOATTL
+		soa.Minttl = s.conf.ServFailSOATTL
+		resp.Ns = []dns.RR{soa}
+	}
+	return &resp
+}
+
+// genFormatError returns FORMERR response for a malformed request
+func (s *Server) genFormatError(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeFormatError)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
+func (s *Server) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
 	return &resp
 }
 
-func (s *Server) genARecord(request *dns.Msg, ip net.IP) *dns.Msg {
+func (s *Server) genARecord(request *dns.Msg, ips ...net.IP) *dns.Msg {
 	resp := s.makeResponse(request)
-	resp.Answer = append(resp.Answer, s.genAAnswer(request, ip))
+	for _, ip := range ips {
+		resp.Answer = append(resp.Answer, s.genAAnswer(request, ip, s.blockedTTL(dns.TypeA)))
+	}
 	return resp
 }
 
-func (s *Server) genAAAARecord(request *dns.Msg, ip net.IP) *dns.Msg {
+func (s *Server) genAAAARecord(request *dns.Msg, ips ...net.IP) *dns.Msg {
 	resp := s.makeResponse(request)
-	resp.Answer = append(resp.Answer, s.genAAAAAnswer(request, ip))
+	for _, ip := range ips {
+		resp.Answer = append(resp.Answer, s.genAAAAAnswer(request, ip, s.blockedTTL(dns.TypeAAAA)))
+	}
 	return resp
 }
 
-func (s *Server) genAAnswer(req *dns.Msg, ip net.IP) *dns.A {
+// rotateBlockingIPs returns the addresses starting with the next one in the round-robin order,
+// so that the clients using only the first address are spread among all of them
+func (s *Server) rotateBlockingIPs(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	n := int(atomic.AddUint32(&s.blockingIPIndex, 1) % uint32(len(ips)))
+	return append(append([]net.IP{}, ips[n:]...), ips[:n]...)
+}
+
+func (s *Server) genAAnswer(req *dns.Msg, ip net.IP, ttl uint32) *dns.A {
 	answer := new(dns.A)
 	answer.Hdr = dns.RR_Header{
 		Name:   req.Question[0].Name,
 		Rrtype: dns.TypeA,
-		Ttl:    s.conf.BlockedResponseTTL,
+		Ttl:    ttl,
 		Class:  dns.ClassINET,
 	}
 	answer.A = ip
 	return answer
 }
 
-func (s *Server) genAAAAAnswer(req *dns.Msg, ip net.IP) *dns.AAAA {
+func (s *Server) genAAAAAnswer(req *dns.Msg, ip net.IP, ttl uint32) *dns.AAAA {
 	answer := new(dns.AAAA)
 	answer.Hdr = dns.RR_Header{
 		Name:   req.Question[0].Name,
 		Rrtype: dns.TypeAAAA,
-		Ttl:    s.conf.BlockedResponseTTL,
+		Ttl:    ttl,
 		Class:  dns.ClassINET,
 	}
 	answer.AAAA = ip
@@ -140,7 +282,13 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 		return s.genResponseWithIP(request, ip)
 	}
 
-	// look up the hostname, TODO: cache
+	key := fmt.Sprintf("%s#%d", newAddr, request.Question[0].Qtype)
+	answers, ok := s.blockedHosts.get(key, time.Now())
+	if ok {
+		return s.genBlockedHostResponse(request, answers)
+	}
+
+	// look up the hostname
 	replReq := dns.Msg{}
 	replReq.SetQuestion(dns.Fqdn(newAddr), request.Question[0].Qtype)
 	replReq.RecursionDesired = true
@@ -152,41 +300,132 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 		Req:       &replReq,
 	}
 
-	err := s.dnsProxy.Resolve(newContext)
+	err := s.resolver.Resolve(newContext)
 	if err != nil {
 		log.Printf("Couldn't look up replacement host '%s': %s", newAddr, err)
 		return s.genServerFailure(request)
 	}
 
-	resp := s.makeResponse(request)
 	if newContext.Res != nil {
-		for _, answer := range newContext.Res.Answer {
-			answer.Header().Name = request.Question[0].Name
-			resp.Answer = append(resp.Answer, answer)
-		}
+		answers = newContext.Res.Answer
+		s.blockedHosts.set(key, answers, time.Now())
 	}
+	return s.genBlockedHostResponse(request, answers)
+}
 
+// genBlockedHostResponse makes a response with the addresses of a block host
+func (s *Server) genBlockedHostResponse(request *dns.Msg, answers []dns.RR) *dns.Msg {
+	resp := s.makeResponse(request)
+	for _, a := range answers {
+		answer := dns.Copy(a)
+		answer.Header().Name = request.Question[0].Name
+		resp.Answer = append(resp.Answer, answer)
+	}
 	return resp
 }
 
+// Max. number of entries in blockedHostCache
+const blockedHostCacheSize = 64
+
+// blockedHostCache keeps the addresses of the hosts used to respond to requests
+// blocked by parental control or safe-browsing, so that they aren't resolved for every request.
+// The zero blockedHostCache is ready for use.
+type blockedHostCache struct {
+	lock  sync.Mutex
+	items map[string]blockedHostEntry // "host#qtype" -> entry
+}
+
+type blockedHostEntry struct {
+	answers []dns.RR
+	expire  time.Time
+}
+
+// get returns the cached answers.  TTL values are decreased by the time spent in cache.
+func (c *blockedHostCache) get(key string, now time.Time) ([]dns.RR, bool) {
+	c.lock.Lock()
+	e, ok := c.items[key]
+	c.lock.Unlock()
+	if !ok || !now.Before(e.expire) {
+		return nil, false
+	}
+
+	ttl := uint32(e.expire.Sub(now) / time.Second)
+	answers := []dns.RR{}
+	for _, a := range e.answers {
+		answer := dns.Copy(a)
+		if answer.Header().Ttl > ttl {
+			answer.Header().Ttl = ttl
+		}
+		answers = append(answers, answer)
+	}
+	return answers, true
+}
+
+// set stores the answers until the smallest TTL expires.
+// Answers with zero TTL aren't stored.
+func (c *blockedHostCache) set(key string, answers []dns.RR, now time.Time) {
+	if len(answers) == 0 {
+		return
+	}
+	ttl := answers[0].Header().Ttl
+	for _, a := range answers {
+		if a.Header().Ttl < ttl {
+			ttl = a.Header().Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	e := blockedHostEntry{
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+	for _, a := range answers {
+		e.answers = append(e.answers, dns.Copy(a))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items == nil {
+		c.items = map[string]blockedHostEntry{}
+	}
+	if len(c.items) >= blockedHostCacheSize {
+		for k, it := range c.items {
+			if !now.Before(it.expire) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= blockedHostCacheSize {
+			c.items = map[string]blockedHostEntry{}
+		}
+	}
+	c.items[key] = e
+}
+
 // Make a CNAME response
-func (s *Server) genCNAMEAnswer(req *dns.Msg, cname string) *dns.CNAME {
+func (s *Server) genCNAMEAnswer(req *dns.Msg, cname string, ttl uint32) *dns.CNAME {
 	answer := new(dns.CNAME)
 	answer.Hdr = dns.RR_Header{
 		Name:   req.Question[0].Name,
 		Rrtype: dns.TypeCNAME,
-		Ttl:    s.conf.BlockedResponseTTL,
+		Ttl:    ttl,
 		Class:  dns.ClassINET,
 	}
 	answer.Target = dns.Fqdn(cname)
 	return answer
 }
 
+// genNXDomain returns NXDOMAIN response with SOA record for negative caching.
+// The response is generated by us so it's unsigned and has no NSEC records,
+// but DO flag is copied from the request as required by RFC 3225.
 func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeNameError)
 	resp.RecursionAvailable = true
 	resp.Ns = s.genSOA(request)
+	if opt := request.IsEdns0(); opt != nil && opt.Do() {
+		resp.SetEdns0(opt.UDPSize(), true)
+	}
 	return &resp
 }
 
@@ -195,31 +434,32 @@ func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	if len(request.Question) > 0 {
 		zone = request.Question[0].Name
 	}
+	return []dns.RR{s.makeSOA(zone, s.blockedTTL(dns.TypeSOA))}
+}
 
+// makeSOA returns SOA record of the zone with the configured values
+func (s *Server) makeSOA(zone string, ttl uint32) *dns.SOA {
 	soa := dns.SOA{
-		// values copied from verisign's nonexistent .com domain
-		// their exact values are not important in our use case because they are used for domain transfers between primary/secondary DNS servers
-		Refresh: 1800,
-		Retry:   900,
-		Expire:  604800,
-		Minttl:  86400,
-		// copied from AdGuard DNS
-		Ns:     "fake-for-negative-caching.adguard.com.",
-		Serial: 100500,
+		Refresh: s.conf.SOARefresh,
+		Retry:   s.conf.SOARetry,
+		Expire:  s.conf.SOAExpire,
+		Minttl:  s.conf.SOAMinTTL,
+		Ns:      s.conf.SOANs,
+		Serial:  s.conf.SOASerial,
 		// rest is request-specific
 		Hdr: dns.RR_Header{
 			Name:   zone,
 			Rrtype: dns.TypeSOA,
-			Ttl:    s.conf.BlockedResponseTTL,
+			Ttl:    ttl,
 			Class:  dns.ClassINET,
 		},
-		Mbox: "hostmaster.", // zone will be appended later if it's not empty or "."
+		Mbox: s.conf.SOAMbox,
 	}
-	if soa.Hdr.Ttl == 0 {
-		soa.Hdr.Ttl = defaultValues.BlockedResponseTTL
-	}
-	if len(zone) > 0 && zone[0] != '.' {
-		soa.Mbox += zone
+	if len(soa.Mbox) == 0 {
+		soa.Mbox = "hostmaster."
+		if len(zone) > 0 && zone[0] != '.' {
+			soa.Mbox += zone
+		}
 	}
-	return []dns.RR{&soa}
+	return &soa
 }
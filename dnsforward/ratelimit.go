@@ -0,0 +1,129 @@
+package dnsforward
+
+import (
+	"sync"
+	"time"
+)
+
+// clientLimiter limits the number of requests from each client using a token bucket algorithm
+type clientLimiter struct {
+	lock      sync.Mutex
+	rate      float64                  // max. number of requests per second;  it's also the burst size
+	whitelist map[string]bool          // IP addresses of the clients which aren't limited
+	clients   map[string]*clientBucket // IP address -> bucket
+	nextSweep time.Time                // time when the idle clients are removed
+}
+
+type clientBucket struct {
+	tokens float64   // number of requests the client may send right now
+	last   time.Time // time of the last request
+
+	second int64  // the current second (UNIX time)
+	count  uint64 // number of requests during the current second
+	prev   uint64 // number of requests during the previous second
+}
+
+// Idle clients are removed after this time
+const clientIdleTime = time.Minute
+
+func newClientLimiter(rate uint32, whitelist []string) *clientLimiter {
+	l := &clientLimiter{
+		rate:      float64(rate),
+		whitelist: map[string]bool{},
+		clients:   map[string]*clientBucket{},
+	}
+	for _, ip := range whitelist {
+		l.whitelist[ip] = true
+	}
+	return l
+}
+
+// allow returns FALSE if the client has exceeded its limit
+func (l *clientLimiter) allow(ip string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.After(l.nextSweep) {
+		for k, b := range l.clients {
+			if now.Sub(b.last) > clientIdleTime {
+				delete(l.clients, k)
+			}
+		}
+		l.nextSweep = now.Add(clientIdleTime)
+	}
+
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &clientBucket{tokens: l.rate, last: now}
+		l.clients[ip] = b
+	}
+
+	b.countRequest(now)
+
+	if l.whitelist[ip] {
+		b.last = now
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// countRequest updates per-second counters
+func (b *clientBucket) countRequest(now time.Time) {
+	sec := now.Unix()
+	switch {
+	case sec == b.second:
+		// nothing to do
+	case sec == b.second+1:
+		b.prev = b.count
+		b.count = 0
+	default:
+		b.prev = 0
+		b.count = 0
+	}
+	b.second = sec
+	b.count++
+}
+
+// rates returns the number of requests from each client during the last second
+func (l *clientLimiter) rates(now time.Time) map[string]uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	sec := now.Unix()
+	m := map[string]uint64{}
+	for ip, b := range l.clients {
+		n := uint64(0)
+		switch sec {
+		case b.second:
+			n = b.prev
+		case b.second + 1:
+			n = b.count
+		}
+		if n != 0 {
+			m[ip] = n
+		}
+	}
+	return m
+}
+
+// ClientRates returns the number of requests from each client during the last second.
+// Returns nil if per-client rate limiting is disabled.
+func (s *Server) ClientRates() map[string]uint64 {
+	s.RLock()
+	l := s.limiter
+	s.RUnlock()
+	if l == nil {
+		return nil
+	}
+	return l.rates(time.Now())
+}
@@ -0,0 +1,141 @@
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Max. time to wait for a PTR response
+const rdnsTimeout = 5 * time.Second
+
+// Max. number of entries in rdnsCache
+const rdnsCacheSize = 10000
+
+// TTL limits for the cached PTR responses (in seconds)
+const (
+	rdnsMinTTL      = 60
+	rdnsMaxTTL      = 24 * 60 * 60
+	rdnsNegativeTTL = 60 * 60 // used if NXDOMAIN response has no SOA record
+)
+
+// rdnsCache keeps the host names of the IP addresses resolved by ResolveRDNS.
+// Empty host name means that the address couldn't be resolved (negative caching).
+// The zero rdnsCache is ready for use.
+type rdnsCache struct {
+	lock  sync.Mutex
+	items map[string]rdnsEntry // IP -> entry
+}
+
+type rdnsEntry struct {
+	host   string
+	expire time.Time
+}
+
+// get returns the cached host name
+func (c *rdnsCache) get(ip string, now time.Time) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[ip]
+	if !ok {
+		return "", false
+	}
+	if !now.Before(e.expire) {
+		delete(c.items, ip)
+		return "", false
+	}
+	return e.host, true
+}
+
+// set stores the host name for the specified time.
+// TTL is limited by rdnsMinTTL and rdnsMaxTTL.
+func (c *rdnsCache) set(ip, host string, ttl uint32, now time.Time) {
+	if ttl < rdnsMinTTL {
+		ttl = rdnsMinTTL
+	} else if ttl > rdnsMaxTTL {
+		ttl = rdnsMaxTTL
+	}
+	e := rdnsEntry{
+		host:   host,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items == nil {
+		c.items = map[string]rdnsEntry{}
+	}
+	if len(c.items) >= rdnsCacheSize {
+		for k, it := range c.items {
+			if !now.Before(it.expire) {
+				delete(c.items, k)
+			}
+		}
+		if len(c.items) >= rdnsCacheSize {
+			c.items = map[string]rdnsEntry{}
+		}
+	}
+	c.items[ip] = e
+}
+
+// ResolveRDNS - get host name by IP address using a PTR request.
+// The results (including NXDOMAIN) are cached for the time specified by the response TTL.
+// Returns an empty string and nil error if there's no host name for this address.
+// Network errors aren't cached.
+// This method may be called before Start().
+func (s *Server) ResolveRDNS(ip net.IP) (string, error) {
+	key := ip.String()
+	host, ok := s.rdnsCache.get(key, time.Now())
+	if ok {
+		log.Tracef("rDNS: %s: cached %q", key, host)
+		return host, nil
+	}
+
+	arpa, err := dns.ReverseAddr(key)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	resp, err := s.ResolveContext(ctx, arpa, dns.TypePTR)
+	if err != nil {
+		return "", err
+	}
+
+	host, ttl := parsePTRResponse(resp)
+	if len(host) == 0 && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		// e.g. SERVFAIL: try again next time
+		return "", nil
+	}
+	s.rdnsCache.set(key, host, ttl, time.Now())
+	return host, nil
+}
+
+// parsePTRResponse returns the host name (without the last dot) and its TTL.
+// If there's no PTR record, TTL of the negative response (RFC 2308 5) is returned.
+func parsePTRResponse(resp *dns.Msg) (string, uint32) {
+	for _, a := range resp.Answer {
+		ptr, ok := a.(*dns.PTR)
+		if ok {
+			return strings.TrimSuffix(ptr.Ptr, "."), ptr.Hdr.Ttl
+		}
+	}
+
+	for _, ns := range resp.Ns {
+		soa, ok := ns.(*dns.SOA)
+		if ok {
+			ttl := soa.Minttl
+			if soa.Hdr.Ttl < ttl {
+				ttl = soa.Hdr.Ttl
+			}
+			return "", ttl
+		}
+	}
+	return "", rdnsNegativeTTL
+}
@@ -0,0 +1,88 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Private address ranges (RFC 1918, RFC 4193)
+var privateNets = parseNets("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isRebindingIP returns true if a public host name must not be resolved to this address
+func isRebindingIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRebindingAllowed returns true if the host name may be resolved to a private address:
+// it's not a fully qualified name (e.g. "router") or it's a subdomain of an allowed host
+func isRebindingAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(host, ".") {
+		return true
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSuffix(a, "."))
+		if host == a || strings.HasSuffix(host, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRebinding returns a non-nil result if the response resolves a public host name
+// to a private IP address and DNS rebinding protection is enabled
+func (s *Server) checkRebinding(d *proxy.DNSContext) *dnsfilter.Result {
+	if !s.conf.RebindingProtection {
+		return nil
+	}
+	host := d.Req.Question[0].Name
+	if isRebindingAllowed(host, s.conf.RebindingAllowedHosts) {
+		return nil
+	}
+
+	for _, a := range d.Res.Answer {
+		var ip net.IP
+		switch v := a.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		if isRebindingIP(ip) {
+			log.Debug("DNSFwd: DNS rebinding: %s resolves to %s", host, ip)
+			return &dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredRebinding,
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package dnsforward
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// parseStaticRecords returns the records of StaticRecords by the FQDN in lower case.
+// A record is specified in the zone file format without the owner name, TTL and class, e.g.:
+//
+//	HTTPS 1 . alpn=h2 ipv4hint=192.168.1.1
+//	TXT "some text"
+//
+// SVCB and HTTPS records are supported with the presentation format parameters
+// even though our version of miekg/dns can't parse them.
+func parseStaticRecords(records map[string][]string) (map[string][]dns.RR, error) {
+	m := map[string][]dns.RR{}
+	for name, list := range records {
+		host := strings.ToLower(dns.Fqdn(strings.TrimSpace(name)))
+		if _, ok := dns.IsDomainName(host); !ok || host == "." {
+			return nil, fmt.Errorf("DNS: static_records: invalid host name %q", name)
+		}
+		for _, s := range list {
+			rr, err := parseStaticRR(host, s)
+			if err != nil {
+				return nil, fmt.Errorf("DNS: static_records: %s: %q: %s", name, s, err)
+			}
+			m[host] = append(m[host], rr)
+		}
+	}
+	return m, nil
+}
+
+// parseStaticRR returns the record of the host
+func parseStaticRR(host, s string) (dns.RR, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty record")
+	}
+
+	var rrtype uint16
+	switch strings.ToUpper(fields[0]) {
+	case "SVCB":
+		rrtype = typeSVCB
+	case "HTTPS":
+		rrtype = typeHTTPS
+	default:
+		rr, err := dns.NewRR(host + " IN " + s)
+		if err != nil {
+			return nil, err
+		} else if rr == nil {
+			return nil, fmt.Errorf("empty record")
+		}
+		return rr, nil
+	}
+
+	data, err := packSVCB(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+	rr := &dns.RFC3597{}
+	rr.Hdr = dns.RR_Header{
+		Name:   host,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+	}
+	rr.Rdata = hex.EncodeToString(data)
+	return rr, nil
+}
+
+// staticAnswer returns the copies of the static records for the question.
+// Returns nil if there are no records of this type for the host.
+func (s *Server) staticAnswer(q dns.Question) []dns.RR {
+	if len(s.staticRecords) == 0 {
+		return nil
+	}
+	var ans []dns.RR
+	for _, rr := range s.staticRecords[strings.ToLower(q.Name)] {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = s.rewriteTTL(q.Qtype)
+		ans = append(ans, rr)
+	}
+	return ans
+}
+
+// Answer the requests with the static records.
+// The filtering rules and rewrites have priority over the static records.
+func processStaticRecords(ctx *dnsContext) int {
+	s := ctx.srv
+	d := ctx.proxyCtx
+	if d.Res != nil {
+		return resultDone // response is already set - nothing to do
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	ans := s.staticAnswer(d.Req.Question[0])
+	if len(ans) == 0 {
+		return resultDone
+	}
+
+	log.Debug("DNS: static records for %s", d.Req.Question[0].Name)
+	resp := s.makeResponse(d.Req)
+	resp.Answer = ans
+	d.Res = resp
+	return resultDone
+}
@@ -23,12 +23,13 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 	shouldLog := true
 	msg := d.Req
 
+	s.RLock()
 	// don't log ANY request if refuseAny is enabled
 	if len(msg.Question) >= 1 && msg.Question[0].Qtype == dns.TypeANY && s.conf.RefuseAny {
 		shouldLog = false
 	}
+	onFiltered := s.conf.OnFilteredQuery
 
-	s.RLock()
 	// Synchronize access to s.queryLog and s.stats so they won't be suddenly uninitialized while in use.
 	// This can happen after proxy server has been stopped, but its workers haven't yet exited.
 	if shouldLog && s.queryLog != nil {
@@ -45,23 +46,47 @@ func processQueryLogsAndStats(ctx *dnsContext) int {
 			p.ClientProto = "doh"
 		} else if d.Proto == "tls" {
 			p.ClientProto = "dot"
+		} else if d.Proto == protoInternal {
+			p.ClientProto = "internal"
 		}
 
 		if d.Upstream != nil {
 			p.Upstream = d.Upstream.Address()
 		}
+		if ctx.setts != nil {
+			p.ClientName = ctx.setts.ClientName
+		}
 		s.queryLog.Add(p)
 
-		worker.ProcessDNSResult(p)
+		worker.ProcessDNSResult(p, ctx.responseCached)
 	}
 
 	s.updateStats(d, elapsed, *ctx.result)
 	s.RUnlock()
 
+	reason := ctx.result.Reason
+	if ctx.result.DryRun {
+		reason = dnsfilter.NotFilteredNotFound
+	}
+	s.metrics.update(d.Res, elapsed, reason)
+
+	if onFiltered != nil && ctx.result.IsFiltered {
+		onFiltered(FilteredQuery{
+			Time:     ctx.startTime,
+			Host:     strings.TrimSuffix(msg.Question[0].Name, "."),
+			QType:    msg.Question[0].Qtype,
+			ClientIP: getIP(d.Addr),
+			Reason:   ctx.result.Reason,
+			Rule:     ctx.result.Rule,
+			FilterID: ctx.result.FilterID,
+		})
+	}
+
 	return resultDone
 }
 
 func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dnsfilter.Result) {
+	s.metrics.countQType(d.Req.Question[0].Qtype)
 	if s.stats == nil {
 		return
 	}
@@ -77,6 +102,11 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 	}
 	e.Time = uint32(elapsed / 1000)
 	e.Result = stats.RNotFiltered
+	if res.DryRun {
+		// the request hasn't been blocked
+		s.stats.Update(e)
+		return
+	}
 
 	switch res.Reason {
 
@@ -88,12 +118,19 @@ func (s *Server) updateStats(d *proxy.DNSContext, elapsed time.Duration, res dns
 
 	case dnsfilter.FilteredSafeSearch:
 		e.Result = stats.RSafeSearch
+		e.SafeSearchEngine = res.SafeSearchProvider.String()
 
 	case dnsfilter.FilteredBlackList:
 		fallthrough
 	case dnsfilter.FilteredInvalid:
 		fallthrough
 	case dnsfilter.FilteredBlockedService:
+		fallthrough
+	case dnsfilter.FilteredRebinding:
+		fallthrough
+	case dnsfilter.FilteredDefaultDeny:
+		fallthrough
+	case dnsfilter.FilteredBlockedIP:
 		e.Result = stats.RFiltered
 	}
 
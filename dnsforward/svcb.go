@@ -0,0 +1,262 @@
+package dnsforward
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SVCB and HTTPS resource record types.
+// They aren't supported by our version of miekg/dns, so such records are received as dns.RFC3597.
+const (
+	typeSVCB  = 64
+	typeHTTPS = 65
+)
+
+// SvcParamKey values of the address hints
+const (
+	svcbKeyIPv4Hint = 4
+	svcbKeyIPv6Hint = 6
+)
+
+// isSVCBType returns TRUE if the records of this type may contain address hints
+func isSVCBType(qtype uint16) bool {
+	return qtype == typeSVCB || qtype == typeHTTPS
+}
+
+// stripSVCBHints removes the addresses for which blocked() returns TRUE
+// from ipv4hint and ipv6hint parameters of SVCB or HTTPS record.
+// A hint parameter is removed if none of its addresses is left.
+// Returns a new record or nil if nothing is removed.
+func stripSVCBHints(rr *dns.RFC3597, blocked func(ip net.IP) bool) (*dns.RFC3597, error) {
+	data, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return nil, err
+	}
+
+	// SvcPriority (2 bytes) and TargetName (uncompressed domain name)
+	_, off, err := dns.UnpackDomainName(data, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, data[:off]...)
+	changed := false
+	for off != len(data) {
+		if len(data)-off < 4 {
+			return nil, fmt.Errorf("svcb: truncated parameter")
+		}
+		key := binary.BigEndian.Uint16(data[off:])
+		n := int(binary.BigEndian.Uint16(data[off+2:]))
+		val := data[off+4:]
+		if len(val) < n {
+			return nil, fmt.Errorf("svcb: truncated parameter value")
+		}
+		val = val[:n]
+		off += 4 + n
+
+		ipLen := 0
+		switch key {
+		case svcbKeyIPv4Hint:
+			ipLen = net.IPv4len
+		case svcbKeyIPv6Hint:
+			ipLen = net.IPv6len
+		}
+		if ipLen == 0 {
+			out = appendSVCBParam(out, key, val)
+			continue
+		}
+		if n%ipLen != 0 {
+			return nil, fmt.Errorf("svcb: invalid address hint length %d", n)
+		}
+
+		ips := []byte{}
+		for i := 0; i != n; i += ipLen {
+			ip := net.IP(val[i : i+ipLen])
+			if blocked(ip) {
+				changed = true
+				continue
+			}
+			ips = append(ips, ip...)
+		}
+		if len(ips) != 0 {
+			out = appendSVCBParam(out, key, ips)
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+
+	newRR := &dns.RFC3597{Hdr: rr.Hdr}
+	newRR.Rdata = hex.EncodeToString(out)
+	return newRR, nil
+}
+
+func appendSVCBParam(b []byte, key uint16, val []byte) []byte {
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint16(hdr, key)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(val)))
+	b = append(b, hdr...)
+	return append(b, val...)
+}
+
+// SvcParamKey names of the presentation format
+var svcbKeyNames = map[string]uint16{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        svcbKeyIPv4Hint,
+	"ech":             5,
+	"ipv6hint":        svcbKeyIPv6Hint,
+}
+
+// packSVCB returns RDATA of SVCB or HTTPS record from its presentation format fields:
+// "<priority> <target> [key=value ...]".
+// Supported keys: mandatory, alpn, no-default-alpn, port, ipv4hint, ech, ipv6hint and keyNNNNN with a hex value.
+func packSVCB(fields []string) ([]byte, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("svcb: priority and target name are required")
+	}
+	prio, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("svcb: invalid priority %q", fields[0])
+	}
+	target := dns.Fqdn(fields[1])
+	if _, ok := dns.IsDomainName(target); !ok {
+		return nil, fmt.Errorf("svcb: invalid target name %q", fields[1])
+	}
+
+	data := make([]byte, 2+len(target)+1)
+	binary.BigEndian.PutUint16(data, uint16(prio))
+	n, err := dns.PackDomainName(target, data, 2, nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("svcb: invalid target name %q: %s", fields[1], err)
+	}
+	data = data[:n]
+
+	params := map[uint16][]byte{}
+	for _, f := range fields[2:] {
+		name, val := f, ""
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name, val = f[:i], strings.Trim(f[i+1:], `"`)
+		}
+		key, v, err := packSVCBParam(strings.ToLower(name), val)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("svcb: duplicate parameter %q", name)
+		}
+		params[key] = v
+	}
+
+	// the parameters must be in the increasing order of their keys
+	keys := []int{}
+	for k := range params {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		data = appendSVCBParam(data, uint16(k), params[uint16(k)])
+	}
+	return data, nil
+}
+
+// packSVCBParam returns the key and the wire format value of SvcParam
+func packSVCBParam(name, val string) (uint16, []byte, error) {
+	key, ok := svcbKeyNames[name]
+	if !ok {
+		if !strings.HasPrefix(name, "key") {
+			return 0, nil, fmt.Errorf("svcb: unknown parameter %q", name)
+		}
+		k, err := strconv.ParseUint(name[3:], 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("svcb: unknown parameter %q", name)
+		}
+		v, err := hex.DecodeString(val)
+		if err != nil {
+			return 0, nil, fmt.Errorf("svcb: %s: invalid hex value", name)
+		}
+		return uint16(k), v, nil
+	}
+
+	var v []byte
+	switch name {
+	case "no-default-alpn":
+		if len(val) != 0 {
+			return 0, nil, fmt.Errorf("svcb: %s: unexpected value", name)
+		}
+
+	case "port":
+		port, err := strconv.ParseUint(val, 10, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("svcb: %s: invalid port %q", name, val)
+		}
+		v = make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(port))
+
+	case "ech":
+		var err error
+		v, err = base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return 0, nil, fmt.Errorf("svcb: %s: invalid base64 value", name)
+		}
+
+	default:
+		if len(val) == 0 {
+			return 0, nil, fmt.Errorf("svcb: %s: value is required", name)
+		}
+		for _, s := range strings.Split(val, ",") {
+			b, err := packSVCBListItem(key, s)
+			if err != nil {
+				return 0, nil, fmt.Errorf("svcb: %s: %s", name, err)
+			}
+			v = append(v, b...)
+		}
+	}
+	return key, v, nil
+}
+
+// packSVCBListItem returns the wire format of an item of the comma-separated value
+func packSVCBListItem(key uint16, s string) ([]byte, error) {
+	switch key {
+	case 0: // mandatory
+		k, ok := svcbKeyNames[s]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", s)
+		}
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, k)
+		return b, nil
+
+	case 1: // alpn
+		if len(s) == 0 || len(s) > 255 {
+			return nil, fmt.Errorf("invalid protocol ID %q", s)
+		}
+		return append([]byte{byte(len(s))}, s...), nil
+
+	case svcbKeyIPv4Hint:
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		return ip, nil
+
+	case svcbKeyIPv6Hint:
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", s)
+		}
+		return ip.To16(), nil
+	}
+	return nil, fmt.Errorf("unexpected value %q", s)
+}
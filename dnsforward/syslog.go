@@ -0,0 +1,201 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// FilteredQuery is passed to ServerConfig.OnFilteredQuery for every filtered request
+type FilteredQuery struct {
+	Time     time.Time
+	Host     string // question host name (without the last dot)
+	QType    uint16
+	ClientIP net.IP
+	Reason   dnsfilter.Reason
+	Rule     string // the rule that has matched the request
+	FilterID int64  // ID of the filter list the rule belongs to
+}
+
+// Filtered requests are sent to syslog in background.
+// If the queue is full, the new requests are dropped.
+const syslogQueueSize = 1000
+
+// After a failed connection attempt the requests are dropped during the retry interval.
+// The interval is doubled after each failure up to syslogMaxRetry.
+const (
+	syslogMinRetry = 1 * time.Second
+	syslogMaxRetry = 1 * time.Minute
+)
+
+// Close() waits for the queued requests to be sent during this time;  the rest are dropped
+const syslogCloseTimeout = 5 * time.Second
+
+// SyslogWriter sends the filtered requests to a remote syslog server (RFC 5424)
+type SyslogWriter struct {
+	network  string // "udp" or "tcp"
+	addr     string
+	hostname string
+
+	lock    sync.Mutex
+	closed  bool
+	queue   chan FilteredQuery
+	stop    chan struct{} // closed when the queued requests must be dropped
+	done    chan struct{}
+	dropped uint64 // number of dropped requests since the last successful write
+}
+
+// NewSyslogWriter creates a new SyslogWriter and starts its goroutine
+// addr: "[udp://|tcp://]host:port" (UDP is used by default)
+func NewSyslogWriter(addr string) (*SyslogWriter, error) {
+	w := &SyslogWriter{network: "udp", addr: addr}
+	if i := strings.Index(addr, "://"); i != -1 {
+		w.network = addr[:i]
+		w.addr = addr[i+3:]
+	}
+	if w.network != "udp" && w.network != "tcp" {
+		return nil, fmt.Errorf("syslog: unsupported protocol %q", w.network)
+	}
+	_, _, err := net.SplitHostPort(w.addr)
+	if err != nil {
+		return nil, fmt.Errorf("syslog: invalid address %q: %s", addr, err)
+	}
+
+	w.hostname, _ = os.Hostname()
+	if len(w.hostname) == 0 {
+		w.hostname = "-"
+	}
+	w.queue = make(chan FilteredQuery, syslogQueueSize)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run()
+	return w, nil
+}
+
+// Send queues the request;  it never blocks
+// It may be used as ServerConfig.OnFilteredQuery
+func (w *SyslogWriter) Send(q FilteredQuery) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- q:
+	default:
+		w.dropped++
+	}
+}
+
+// Close stops the goroutine after the queued requests are sent.
+// The requests that aren't sent during syslogCloseTimeout are dropped.
+func (w *SyslogWriter) Close() {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.lock.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(syslogCloseTimeout):
+		close(w.stop)
+		log.Debug("syslog: dropping the queued messages")
+	}
+}
+
+func (w *SyslogWriter) drop() {
+	w.lock.Lock()
+	w.dropped++
+	w.lock.Unlock()
+}
+
+func (w *SyslogWriter) run() {
+	defer close(w.done)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	var retry time.Duration
+	var retryTime time.Time
+	for q := range w.queue {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		var err error
+		if conn == nil {
+			if time.Now().Before(retryTime) {
+				w.drop()
+				continue
+			}
+			conn, err = net.DialTimeout(w.network, w.addr, DefaultTimeout)
+			if err != nil {
+				retry *= 2
+				if retry < syslogMinRetry {
+					retry = syslogMinRetry
+				} else if retry > syslogMaxRetry {
+					retry = syslogMaxRetry
+				}
+				retryTime = time.Now().Add(retry)
+				log.Debug("syslog: %s;  retrying in %s", err, retry)
+				w.drop()
+				continue
+			}
+			retry = 0
+		}
+
+		msg := w.format(q)
+		if w.network == "tcp" {
+			// octet counting framing (RFC 6587 3.4.1)
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			log.Debug("syslog: %s", err)
+			_ = conn.Close()
+			conn = nil
+			w.drop()
+			continue
+		}
+
+		w.lock.Lock()
+		if w.dropped != 0 {
+			log.Debug("syslog: dropped %d messages", w.dropped)
+			w.dropped = 0
+		}
+		w.lock.Unlock()
+	}
+}
+
+// format returns RFC 5424 message: "<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ELEMENT] MSG"
+func (w *SyslogWriter) format(q FilteredQuery) string {
+	const pri = 1*8 + 5 // facility: user-level messages, severity: notice
+	return fmt.Sprintf("<%d>1 %s %s AdGuardHome %d blocked [query@32473 host=\"%s\" type=\"%s\" client=\"%s\" reason=\"%s\" rule=\"%s\" filter_id=\"%d\"] Blocked %s for %s",
+		pri, q.Time.UTC().Format(time.RFC3339Nano), w.hostname, os.Getpid(),
+		syslogEscape(q.Host), dns.Type(q.QType), q.ClientIP, q.Reason, syslogEscape(q.Rule), q.FilterID,
+		q.Host, q.ClientIP)
+}
+
+// syslogEscape escapes the characters that aren't allowed in SD-PARAM value
+func syslogEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return r.Replace(s)
+}
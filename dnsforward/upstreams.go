@@ -0,0 +1,137 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// UpstreamGroup - a group of upstream servers with the same priority
+// Groups with a smaller Priority value are used first:
+// the next group is used only if all servers of the previous group have failed.
+type UpstreamGroup struct {
+	Servers  []string `yaml:"servers" json:"servers"`
+	Priority int      `yaml:"priority" json:"priority"`
+}
+
+// ParseUpstreamGroups returns the configurations of the groups sorted by priority
+// Empty groups are skipped.  If timeout is 0, then DefaultTimeout is used.
+func ParseUpstreamGroups(groups []UpstreamGroup, bootstrap []string, timeout time.Duration) ([]*proxy.UpstreamConfig, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	sorted := make([]UpstreamGroup, 0, len(groups))
+	for _, g := range groups {
+		if len(g.Servers) != 0 {
+			sorted = append(sorted, g)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	configs := []*proxy.UpstreamConfig{}
+	for _, g := range sorted {
+		conf, err := proxy.ParseUpstreamsConfig(g.Servers, bootstrap, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream group with priority %d: %s", g.Priority, err)
+		}
+		configs = append(configs, &conf)
+	}
+	return configs, nil
+}
+
+// getUpstreamGroups returns the client's upstream configurations in the order they must be used
+// Returns nil if the default upstreams must be used.
+func (s *Server) getUpstreamGroups(clientIP string) []*proxy.UpstreamConfig {
+	if s.conf.GetUpstreamGroupsByClient != nil {
+		return s.conf.GetUpstreamGroupsByClient(clientIP)
+	}
+	if s.conf.GetCustomUpstreamByClient != nil {
+		conf := s.conf.GetCustomUpstreamByClient(clientIP)
+		if conf != nil {
+			return []*proxy.UpstreamConfig{conf}
+		}
+	}
+	return nil
+}
+
+// noECSUpstream removes EDNS Client Subnet option from the requests to the upstream server
+type noECSUpstream struct {
+	upstream.Upstream
+}
+
+func (u *noECSUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if findECS(m) != nil {
+		// the same request may be sent to several servers at once: don't modify it
+		m = m.Copy()
+		removeECS(m)
+		log.Debug("DNS: removed ECS option from the request to %s", u.Address())
+	}
+	return u.Upstream.Exchange(m)
+}
+
+// parseECSDisabledUpstreams returns the set of the normalized upstream addresses
+// (as returned by upstream.Upstream.Address())
+func parseECSDisabledUpstreams(list []string, timeout time.Duration) (map[string]bool, error) {
+	m := map[string]bool{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		u, err := upstream.AddressToUpstream(s, upstream.Options{Timeout: timeout})
+		if err != nil {
+			return nil, fmt.Errorf("DNS: edns_client_subnet_disabled_upstreams: %s", err)
+		}
+		m[u.Address()] = true
+	}
+	return m, nil
+}
+
+// ecsUpstreamConfig returns the configuration in which the upstream servers from ECSDisabledUpstreams
+// don't receive EDNS Client Subnet option.
+// Returns the same object if there are no such servers in the configuration.
+func (s *Server) ecsUpstreamConfig(conf *proxy.UpstreamConfig) *proxy.UpstreamConfig {
+	if conf == nil || len(s.ecsDisabled) == 0 {
+		return conf
+	}
+
+	changed := false
+	wrap := func(ups []upstream.Upstream) []upstream.Upstream {
+		var res []upstream.Upstream
+		for i, u := range ups {
+			if _, ok := u.(*noECSUpstream); ok || !s.ecsDisabled[u.Address()] {
+				continue
+			}
+			if res == nil {
+				res = append([]upstream.Upstream{}, ups...)
+			}
+			res[i] = &noECSUpstream{u}
+		}
+		if res == nil {
+			return ups
+		}
+		changed = true
+		return res
+	}
+
+	newConf := proxy.UpstreamConfig{
+		Upstreams:               wrap(conf.Upstreams),
+		DomainReservedUpstreams: map[string][]upstream.Upstream{},
+	}
+	for domain, ups := range conf.DomainReservedUpstreams {
+		newConf.DomainReservedUpstreams[domain] = wrap(ups)
+	}
+	if !changed {
+		return conf
+	}
+	return &newConf
+}
@@ -9,11 +9,14 @@ require (
 	github.com/NYTimes/gziphandler v1.1.1
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gobuffalo/packr v1.30.1
+	github.com/google/nftables v0.0.0-20200802175506-c25e4f69b425
 	github.com/joomcode/errorx v1.0.1
 	github.com/kardianos/service v1.1.0
 	github.com/krolaw/dhcp4 v0.0.0-20180925202202-7cead472c414
 	github.com/lionsoul2014/ip2region v2.2.0-release+incompatible
+	github.com/mdlayher/netlink v0.0.0-20191009155606-de872b0d824b
 	github.com/miekg/dns v1.1.29
+	github.com/oschwald/geoip2-golang v1.4.0
 	github.com/pkg/errors v0.9.1
 	github.com/sparrc/go-ping v0.0.0-20190613174326-4e5b6552494c
 	github.com/stretchr/testify v1.5.1
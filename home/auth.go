@@ -385,9 +385,10 @@ func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 			}
 
 		} else if strings.HasPrefix(r.URL.Path, "/assets/") ||
-			strings.HasPrefix(r.URL.Path, "/login.") {
+			strings.HasPrefix(r.URL.Path, "/login.") ||
+			r.URL.Path == "/control/health" || r.URL.Path == "/control/ready" {
 			// process as usual
-			// no additional auth requirements
+			// no additional auth requirements;  the probes are used by the orchestrators
 		} else if Context.auth != nil && Context.auth.AuthRequired() {
 			// redirect to login page if not authenticated
 			ok := false
@@ -173,5 +173,22 @@ func TestAuthHTTP(t *testing.T) {
 	assert.True(t, handlerCalled)
 	r.Header.Del("Cookie")
 
+	// health and readiness probes don't require authentication
+	for _, path := range []string{"/control/health", "/control/ready"} {
+		w = testResponseWriter{hdr: make(http.Header)}
+		r.URL = &url.URL{Path: path}
+		handlerCalled = false
+		handler2(&w, &r)
+		assert.True(t, handlerCalled, path)
+	}
+
+	// the other API requests do
+	w = testResponseWriter{hdr: make(http.Header)}
+	r.URL = &url.URL{Path: "/control/status"}
+	handlerCalled = false
+	handler2(&w, &r)
+	assert.Equal(t, http.StatusForbidden, w.statusCode)
+	assert.True(t, !handlerCalled)
+
 	Context.auth.Close()
 }
@@ -2,6 +2,7 @@ package home
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os/exec"
@@ -41,13 +42,28 @@ type Client struct {
 	UseOwnBlockedServices bool // false: use global settings
 	BlockedServices       []string
 
-	Upstreams []string // list of upstream servers to be used for the client's requests
+	// Blocking mode for this client; empty: use global settings
+	BlockingMode string
+	BlockingIPv4 string
+	BlockingIPv6 string
 
-	// Custom upstream config for this client
+	Upstreams      []string                   // list of upstream servers to be used for the client's requests
+	UpstreamGroups []dnsforward.UpstreamGroup // upstream servers with priority;  Upstreams have priority 0
+
+	// Custom upstream configs for this client, sorted by priority
 	// nil: not yet initialized
 	// not nil, but empty: initialized, no good upstreams
 	// not nil, not empty: Upstreams ready to be used
-	upstreamConfig *proxy.UpstreamConfig
+	upstreamConfigs []*proxy.UpstreamConfig
+}
+
+// upstreamGroups returns all upstream groups of the client
+func (c *Client) upstreamGroups() []dnsforward.UpstreamGroup {
+	groups := []dnsforward.UpstreamGroup{}
+	if len(c.Upstreams) != 0 {
+		groups = append(groups, dnsforward.UpstreamGroup{Servers: c.Upstreams})
+	}
+	return append(groups, c.UpstreamGroups...)
 }
 
 type clientSource uint
@@ -141,7 +157,82 @@ type clientObject struct {
 	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
 	BlockedServices          []string `yaml:"blocked_services"`
 
-	Upstreams []string `yaml:"upstreams"`
+	BlockingMode string `yaml:"blocking_mode,omitempty"`
+	BlockingIPv4 string `yaml:"blocking_ipv4,omitempty"`
+	BlockingIPv6 string `yaml:"blocking_ipv6,omitempty"`
+
+	Upstreams upstreamList `yaml:"upstreams"`
+}
+
+// upstreamList - client's upstream servers in the configuration file and HTTP API
+// For backward compatibility an element may be either an upstream server (priority 0)
+// or a group of servers with priority, e.g. ["1.1.1.1", {servers: ["8.8.8.8"], priority: 10}]
+type upstreamList []upstreamItem
+
+type upstreamItem struct {
+	server string
+	group  *dnsforward.UpstreamGroup // nil if server is set
+}
+
+// UnmarshalYAML - yaml.Unmarshaler
+func (it *upstreamItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if unmarshal(&it.server) == nil {
+		return nil
+	}
+	it.group = &dnsforward.UpstreamGroup{}
+	return unmarshal(it.group)
+}
+
+// MarshalYAML - yaml.Marshaler
+func (it upstreamItem) MarshalYAML() (interface{}, error) {
+	if it.group != nil {
+		return it.group, nil
+	}
+	return it.server, nil
+}
+
+// UnmarshalJSON - json.Unmarshaler
+func (it *upstreamItem) UnmarshalJSON(data []byte) error {
+	if json.Unmarshal(data, &it.server) == nil {
+		return nil
+	}
+	it.group = &dnsforward.UpstreamGroup{}
+	return json.Unmarshal(data, it.group)
+}
+
+// MarshalJSON - json.Marshaler
+func (it upstreamItem) MarshalJSON() ([]byte, error) {
+	if it.group != nil {
+		return json.Marshal(it.group)
+	}
+	return json.Marshal(it.server)
+}
+
+// split returns the upstream servers with priority 0 and the groups
+func (l upstreamList) split() ([]string, []dnsforward.UpstreamGroup) {
+	var servers []string
+	var groups []dnsforward.UpstreamGroup
+	for _, it := range l {
+		if it.group != nil {
+			groups = append(groups, *it.group)
+		} else {
+			servers = append(servers, it.server)
+		}
+	}
+	return servers, groups
+}
+
+func makeUpstreamList(servers []string, groups []dnsforward.UpstreamGroup) upstreamList {
+	var l upstreamList
+	for _, s := range servers {
+		l = append(l, upstreamItem{server: s})
+	}
+	for i := range groups {
+		g := groups[i]
+		g.Servers = stringArrayDup(g.Servers)
+		l = append(l, upstreamItem{group: &g})
+	}
+	return l
 }
 
 func (clients *clientsContainer) tagKnown(tag string) bool {
@@ -162,8 +253,11 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 
 			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
 
-			Upstreams: cy.Upstreams,
+			BlockingMode: cy.BlockingMode,
+			BlockingIPv4: cy.BlockingIPv4,
+			BlockingIPv6: cy.BlockingIPv6,
 		}
+		cli.Upstreams, cli.UpstreamGroups = cy.Upstreams.split()
 
 		for _, s := range cy.BlockedServices {
 			if !dnsfilter.BlockedSvcKnown(s) {
@@ -201,12 +295,16 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+
+			BlockingMode: cli.BlockingMode,
+			BlockingIPv4: cli.BlockingIPv4,
+			BlockingIPv6: cli.BlockingIPv6,
 		}
 
 		cy.Tags = stringArrayDup(cli.Tags)
 		cy.IDs = stringArrayDup(cli.IDs)
 		cy.BlockedServices = stringArrayDup(cli.BlockedServices)
-		cy.Upstreams = stringArrayDup(cli.Upstreams)
+		cy.Upstreams = makeUpstreamList(cli.Upstreams, cli.UpstreamGroups)
 
 		*objects = append(*objects, cy)
 	}
@@ -272,13 +370,38 @@ func (clients *clientsContainer) Find(ip string) (Client, bool) {
 	c.Tags = stringArrayDup(c.Tags)
 	c.BlockedServices = stringArrayDup(c.BlockedServices)
 	c.Upstreams = stringArrayDup(c.Upstreams)
+	c.UpstreamGroups = upstreamGroupsDup(c.UpstreamGroups)
 	return c, true
 }
 
+func upstreamGroupsDup(groups []dnsforward.UpstreamGroup) []dnsforward.UpstreamGroup {
+	if groups == nil {
+		return nil
+	}
+	dup := make([]dnsforward.UpstreamGroup, len(groups))
+	for i, g := range groups {
+		dup[i] = dnsforward.UpstreamGroup{Servers: stringArrayDup(g.Servers), Priority: g.Priority}
+	}
+	return dup
+}
+
 // FindUpstreams looks for upstreams configured for the client
+// and returns the configuration with the highest priority.
 // If no client found for this IP, or if no custom upstreams are configured,
 // this method returns nil
 func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig {
+	configs := clients.FindUpstreamGroups(ip)
+	if len(configs) == 0 {
+		return nil
+	}
+	return configs[0]
+}
+
+// FindUpstreamGroups looks for upstreams configured for the client
+// and returns their configurations sorted by priority.
+// If no client found for this IP, or if no custom upstreams are configured,
+// this method returns nil
+func (clients *clientsContainer) FindUpstreamGroups(ip string) []*proxy.UpstreamConfig {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
@@ -287,18 +410,22 @@ func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig
 		return nil
 	}
 
-	if len(c.Upstreams) == 0 {
+	if len(c.Upstreams) == 0 && len(c.UpstreamGroups) == 0 {
 		return nil
 	}
 
-	if c.upstreamConfig == nil {
-		config, err := proxy.ParseUpstreamsConfig(c.Upstreams, config.DNS.BootstrapDNS, dnsforward.DefaultTimeout)
-		if err == nil {
-			c.upstreamConfig = &config
+	if c.upstreamConfigs == nil {
+		configs, err := dnsforward.ParseUpstreamGroups(c.upstreamGroups(), config.DNS.BootstrapDNS, upstreamTimeout())
+		if err != nil {
+			configs = []*proxy.UpstreamConfig{}
+		}
+		c.upstreamConfigs = configs
+		if cp, ok := clients.list[c.Name]; ok {
+			cp.upstreamConfigs = configs
 		}
 	}
 
-	return c.upstreamConfig
+	return c.upstreamConfigs
 }
 
 // Find searches for a client by IP (and does not lock anything)
@@ -401,8 +528,18 @@ func (clients *clientsContainer) check(c *Client) error {
 	}
 	sort.Strings(c.Tags)
 
-	if len(c.Upstreams) != 0 {
-		err := dnsforward.ValidateUpstreams(c.Upstreams)
+	if len(c.BlockingMode) != 0 {
+		err := dnsforward.CheckBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, g := range c.upstreamGroups() {
+		if len(g.Servers) == 0 {
+			return fmt.Errorf("invalid upstream servers: empty group with priority %d", g.Priority)
+		}
+		err := dnsforward.ValidateUpstreams(g.Servers)
 		if err != nil {
 			return fmt.Errorf("invalid upstream servers: %s", err)
 		}
@@ -529,7 +666,7 @@ func (clients *clientsContainer) Update(name string, c Client) error {
 	}
 
 	// update upstreams cache
-	c.upstreamConfig = nil
+	c.upstreamConfigs = nil
 
 	*old = c
 	return nil
@@ -20,7 +20,11 @@ type clientJSON struct {
 	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
 	BlockedServices          []string `json:"blocked_services"`
 
-	Upstreams []string `json:"upstreams"`
+	BlockingMode string `json:"blocking_mode"`
+	BlockingIPv4 string `json:"blocking_ipv4"`
+	BlockingIPv6 string `json:"blocking_ipv6"`
+
+	Upstreams upstreamList `json:"upstreams"`
 }
 
 type clientHostJSON struct {
@@ -98,8 +102,11 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
-		Upstreams: cj.Upstreams,
+		BlockingMode: cj.BlockingMode,
+		BlockingIPv4: cj.BlockingIPv4,
+		BlockingIPv6: cj.BlockingIPv6,
 	}
+	c.Upstreams, c.UpstreamGroups = cj.Upstreams.split()
 	return &c, nil
 }
 
@@ -118,7 +125,11 @@ func clientToJSON(c *Client) clientJSON {
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
-		Upstreams: c.Upstreams,
+		BlockingMode: c.BlockingMode,
+		BlockingIPv4: c.BlockingIPv4,
+		BlockingIPv6: c.BlockingIPv6,
+
+		Upstreams: makeUpstreamList(c.Upstreams, c.UpstreamGroups),
 	}
 	return cj
 }
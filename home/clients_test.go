@@ -1,14 +1,17 @@
 package home
 
 import (
+	"encoding/json"
 	"net"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func TestClients(t *testing.T) {
@@ -264,3 +267,98 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Equal(t, 1, len(config.Upstreams))
 	assert.Equal(t, 1, len(config.DomainReservedUpstreams))
 }
+
+func TestClientsUpstreamGroups(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	client := Client{
+		IDs:       []string{"1.1.1.1"},
+		Name:      "client1",
+		Upstreams: []string{"1.1.1.1"},
+		UpstreamGroups: []dnsforward.UpstreamGroup{
+			{Servers: []string{"8.8.8.8", "8.8.4.4"}, Priority: 10},
+			{Servers: []string{"9.9.9.9"}, Priority: -1},
+		},
+	}
+	ok, err := clients.Add(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	configs := clients.FindUpstreamGroups("1.1.1.1")
+	assert.Equal(t, 3, len(configs))
+	assert.Equal(t, "9.9.9.9:53", configs[0].Upstreams[0].Address())
+	assert.Equal(t, "1.1.1.1:53", configs[1].Upstreams[0].Address())
+	assert.Equal(t, 2, len(configs[2].Upstreams))
+	assert.Equal(t, configs[0], clients.FindUpstreams("1.1.1.1"))
+
+	// empty group
+	client.Name = "client2"
+	client.IDs = []string{"2.2.2.2"}
+	client.UpstreamGroups = []dnsforward.UpstreamGroup{{Priority: 1}}
+	_, err = clients.Add(client)
+	assert.NotNil(t, err)
+}
+
+func TestClientsBlockingMode(t *testing.T) {
+	clients := clientsContainer{}
+	clients.testing = true
+
+	clients.Init(nil, nil, nil)
+
+	client := Client{
+		IDs:          []string{"1.1.1.1"},
+		Name:         "client1",
+		BlockingMode: "custom_ip",
+		BlockingIPv4: "192.168.1.100",
+	}
+	ok, err := clients.Add(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// no custom address
+	client.Name = "client2"
+	client.IDs = []string{"2.2.2.2"}
+	client.BlockingIPv4 = ""
+	_, err = clients.Add(client)
+	assert.NotNil(t, err)
+
+	// unknown mode
+	client.BlockingMode = "sinkhole"
+	_, err = clients.Add(client)
+	assert.NotNil(t, err)
+}
+
+func TestUpstreamList(t *testing.T) {
+	// old format
+	var l upstreamList
+	assert.Nil(t, yaml.Unmarshal([]byte("- 1.1.1.1\n- tls://dns.example.org\n"), &l))
+	servers, groups := l.split()
+	assert.Equal(t, []string{"1.1.1.1", "tls://dns.example.org"}, servers)
+	assert.Equal(t, 0, len(groups))
+	data, err := yaml.Marshal(l)
+	assert.Nil(t, err)
+	assert.Equal(t, "- 1.1.1.1\n- tls://dns.example.org\n", string(data))
+
+	// groups
+	l = nil
+	assert.Nil(t, yaml.Unmarshal([]byte("- 1.1.1.1\n- servers:\n  - 8.8.8.8\n  priority: 10\n"), &l))
+	servers, groups = l.split()
+	assert.Equal(t, []string{"1.1.1.1"}, servers)
+	assert.Equal(t, []dnsforward.UpstreamGroup{{Servers: []string{"8.8.8.8"}, Priority: 10}}, groups)
+	data, err = yaml.Marshal(makeUpstreamList(servers, groups))
+	assert.Nil(t, err)
+	assert.Equal(t, "- 1.1.1.1\n- servers:\n  - 8.8.8.8\n  priority: 10\n", string(data))
+
+	// JSON
+	l = nil
+	assert.Nil(t, json.Unmarshal([]byte(`["1.1.1.1",{"servers":["8.8.8.8"],"priority":10}]`), &l))
+	servers, groups = l.split()
+	assert.Equal(t, []string{"1.1.1.1"}, servers)
+	assert.Equal(t, []dnsforward.UpstreamGroup{{Servers: []string{"8.8.8.8"}, Priority: 10}}, groups)
+	data, err = json.Marshal(l)
+	assert.Nil(t, err)
+	assert.Equal(t, `["1.1.1.1",{"servers":["8.8.8.8"],"priority":10}]`, string(data))
+}
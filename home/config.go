@@ -5,12 +5,14 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/querylog"
 	"github.com/AdguardTeam/AdGuardHome/stats"
+	"github.com/AdguardTeam/AdGuardHome/worker"
 	"github.com/AdguardTeam/golibs/file"
 	"github.com/AdguardTeam/golibs/log"
 	yaml "gopkg.in/yaml.v2"
@@ -84,11 +86,20 @@ type dnsConfig struct {
 	QueryLogMemSize     uint32 `yaml:"querylog_size_memory"`  // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP   bool   `yaml:"anonymize_client_ip"`   // anonymize clients' IP addresses in logs and stats
 
+	// Timeout of the requests to upstream servers (in seconds).  If 0, then default is used (10).
+	UpstreamTimeout uint32 `yaml:"upstream_timeout"`
+
+	// Address of the syslog server which receives filtered requests, e.g. "udp://192.168.1.2:514".
+	// If empty, the requests aren't sent.
+	SyslogAddr string `yaml:"syslog_addr"`
+
 	dnsforward.FilteringConfig `yaml:",inline"`
 
 	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
 	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
+
+	WorkerConf worker.Config `yaml:"worker"`
 }
 
 type tlsConfigSettings struct {
@@ -115,13 +126,23 @@ var config = configuration{
 		FilteringConfig: dnsforward.FilteringConfig{
 			ProtectionEnabled:  true,      // whether or not use any of dnsfilter features
 			BlockingMode:       "default", // mode how to answer filtered requests
-			BlockedResponseTTL: 10,        // in seconds
+			BlockedResponseTTL: 10,        // in seconds;  0: the default TTL for the answer type
 			Ratelimit:          20,
 			RefuseAny:          true,
 			AllServers:         false,
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
+		WorkerConf: worker.Config{
+			NFT: worker.NFTConfig{
+				Table:   "gfw",
+				Set:     "temp",
+				Timeout: 24 * time.Hour,
+			},
+			IPSet: worker.IPSetConfig{
+				Timeout: 24 * time.Hour,
+			},
+		},
 	},
 	TLS: tlsConfigSettings{
 		PortHTTPS:      443,
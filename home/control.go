@@ -6,8 +6,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/golibs/log"
@@ -108,7 +110,45 @@ func httpRegister(method string, url string, handler func(http.ResponseWriter, *
 		return
 	}
 
-	http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+	httpHandlersLock.Lock()
+	defer httpHandlersLock.Unlock()
+	methods, ok := httpHandlers[url]
+	if !ok {
+		methods = map[string]http.Handler{}
+		httpHandlers[url] = methods
+		http.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(&methodHandler{url: url}))))
+	}
+	methods[method] = ensureHandler(method, handler)
+}
+
+// Handlers registered by httpRegister: URL -> HTTP method -> handler.
+// The same URL may be registered for several methods.
+var httpHandlers = map[string]map[string]http.Handler{}
+var httpHandlersLock sync.RWMutex
+
+// methodHandler passes the request to the handler registered for its URL and HTTP method
+type methodHandler struct {
+	url string
+}
+
+func (m *methodHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpHandlersLock.RLock()
+	methods := httpHandlers[m.url]
+	h, ok := methods[r.Method]
+	allowed := []string{}
+	if !ok {
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+	}
+	httpHandlersLock.RUnlock()
+
+	if !ok {
+		sort.Strings(allowed)
+		http.Error(w, "This request must be "+strings.Join(allowed, " or "), http.StatusMethodNotAllowed)
+		return
+	}
+	h.ServeHTTP(w, r)
 }
 
 // ----------------------------------
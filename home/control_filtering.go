@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -358,6 +359,16 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	js, err := json.Marshal(newCheckHostResp(result))
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+func newCheckHostResp(result dnsfilter.Result) checkHostResp {
 	resp := checkHostResp{}
 	resp.Reason = result.Reason.String()
 	resp.FilterID = result.FilterID
@@ -365,6 +376,60 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	resp.SvcName = result.ServiceName
 	resp.CanonName = result.CanonName
 	resp.IPList = result.IPList
+	return resp
+}
+
+// Max. number of host names in one check_bulk request
+const maxCheckBulkHosts = 1000
+
+type checkBulkReq struct {
+	Hosts []string `json:"hosts"`
+	QType string   `json:"qtype"` // "A" if empty
+}
+
+type checkBulkResp struct {
+	Host string `json:"host"`
+	checkHostResp
+}
+
+// Check the host names against the filtering rules the same way as the DNS requests
+func (f *Filtering) handleCheckBulk(w http.ResponseWriter, r *http.Request) {
+	req := checkBulkReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+		return
+	}
+
+	if len(req.Hosts) > maxCheckBulkHosts {
+		httpError(w, http.StatusBadRequest, "too many host names: %d (max. %d)", len(req.Hosts), maxCheckBulkHosts)
+		return
+	}
+
+	qtype := dns.TypeA
+	if len(req.QType) != 0 {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(req.QType)]
+		if !ok {
+			httpError(w, http.StatusBadRequest, "unknown qtype: %s", req.QType)
+			return
+		}
+	}
+
+	if Context.dnsServer == nil {
+		httpError(w, http.StatusInternalServerError, "DNS server isn't initialized")
+		return
+	}
+	results, err := Context.dnsServer.CheckHosts(req.Hosts, qtype)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "couldn't apply filtering: %s", err)
+		return
+	}
+
+	resp := []checkBulkResp{}
+	for i, result := range results {
+		resp = append(resp, checkBulkResp{Host: req.Hosts[i], checkHostResp: newCheckHostResp(result)})
+	}
 	js, err := json.Marshal(resp)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
@@ -384,6 +449,7 @@ func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister("POST", "/control/filtering/refresh", f.handleFilteringRefresh)
 	httpRegister("POST", "/control/filtering/set_rules", f.handleFilteringSetRules)
 	httpRegister("GET", "/control/filtering/check_host", f.handleCheckHost)
+	httpRegister("POST", "/control/filtering/check_bulk", f.handleCheckBulk)
 }
 
 func checkFiltersUpdateIntervalHours(i uint32) bool {
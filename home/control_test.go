@@ -1,8 +1,12 @@
 package home
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 /* Tests performed:
@@ -75,3 +79,26 @@ kXS9jgARhhiWXJrk
 		t.Fatalf("valid cert & priv key: validateCertificates(): %v", data)
 	}
 }
+
+func TestMethodHandler(t *testing.T) {
+	url := "/control/test/method"
+	httpHandlers[url] = map[string]http.Handler{
+		"GET":  ensureHandler("GET", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("get")) }),
+		"POST": ensureHandler("POST", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("post")) }),
+	}
+	defer delete(httpHandlers, url)
+	h := &methodHandler{url: url}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	assert.Equal(t, "get", w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", url, nil))
+	assert.Equal(t, "post", w.Body.String())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", url, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "This request must be GET or POST\n", w.Body.String())
+}
@@ -1,20 +1,26 @@
 package home
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"path/filepath"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/querylog"
 	"github.com/AdguardTeam/AdGuardHome/stats"
 	"github.com/AdguardTeam/AdGuardHome/util"
+	"github.com/AdguardTeam/AdGuardHome/worker"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 )
 
+// Max. time the worker may spend on the pending routing work when the DNS modules are closed
+const workerStopTimeout = 5 * time.Second
+
 // Called by other modules when configuration is changed
 func onConfigModified() {
 	_ = config.write()
@@ -33,6 +39,7 @@ func initDNSServer() error {
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
+		ClientRates:       getClientRates,
 	}
 	Context.stats, err = stats.New(statsConf)
 	if err != nil {
@@ -61,6 +68,32 @@ func initDNSServer() error {
 	filterConf.HTTPRegister = httpRegister
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
 
+	workerConf := config.DNS.WorkerConf
+	if len(workerConf.GeoDBPath) == 0 {
+		workerConf.GeoDBPath = filepath.Join(baseDir, "ip2region.db")
+		if workerConf.GeoBackend == "maxmind" {
+			workerConf.GeoDBPath = filepath.Join(baseDir, "GeoLite2-Country.mmdb")
+		}
+	}
+	if len(workerConf.DomainsFile) == 0 {
+		workerConf.DomainsFile = filepath.Join(baseDir, "worker_domains.txt")
+	}
+	if len(workerConf.IPsFile) == 0 {
+		workerConf.IPsFile = filepath.Join(baseDir, "worker_ips.txt")
+	}
+	workerConf.HTTPRegister = httpRegister
+	err = worker.Init(&workerConf)
+	if err != nil {
+		log.Error("worker.Init: %s", err)
+	}
+
+	if len(config.DNS.SyslogAddr) != 0 {
+		Context.syslog, err = dnsforward.NewSyslogWriter(config.DNS.SyslogAddr)
+		if err != nil {
+			log.Error("%s", err)
+		}
+	}
+
 	p := dnsforward.DNSCreateParams{
 		DNSFilter:  Context.dnsFilter,
 		Stats:      Context.stats,
@@ -82,6 +115,14 @@ func initDNSServer() error {
 	return nil
 }
 
+// getClientRates returns the number of requests from each client during the last second
+func getClientRates() map[string]uint64 {
+	if Context.dnsServer == nil {
+		return nil
+	}
+	return Context.dnsServer.ClientRates()
+}
+
 func isRunning() bool {
 	return Context.dnsServer != nil && Context.dnsServer.IsRunning()
 }
@@ -160,10 +201,13 @@ func generateServerConfig() dnsforward.ServerConfig {
 	newconfig := dnsforward.ServerConfig{
 		UDPListenAddr:   &net.UDPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
 		TCPListenAddr:   &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.DNS.Port},
+		UpstreamTimeout: upstreamTimeout(),
+		Version:         "AdGuard Home " + versionString,
 		FilteringConfig: config.DNS.FilteringConfig,
 		ConfigModified:  onConfigModified,
 		HTTPRegister:    httpRegister,
 		OnDNSRequest:    onDNSRequest,
+		ExtraMetrics:    worker.WriteMetrics,
 	}
 
 	tlsConf := tlsConfigSettings{}
@@ -181,8 +225,12 @@ func generateServerConfig() dnsforward.ServerConfig {
 	newconfig.TLSCiphers = Context.tlsCiphers
 	newconfig.TLSAllowUnencryptedDOH = tlsConf.AllowUnencryptedDOH
 
+	if Context.syslog != nil {
+		newconfig.OnFilteredQuery = Context.syslog.Send
+	}
+
 	newconfig.FilterHandler = applyAdditionalFiltering
-	newconfig.GetCustomUpstreamByClient = Context.clients.FindUpstreams
+	newconfig.GetUpstreamGroupsByClient = Context.clients.FindUpstreamGroups
 	return newconfig
 }
 
@@ -251,6 +299,12 @@ func applyAdditionalFiltering(clientAddr string, setts *dnsfilter.RequestFilteri
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
 
+	if len(c.BlockingMode) != 0 {
+		setts.BlockingMode = c.BlockingMode
+		// the addresses are checked when the client is added
+		setts.BlockingIPv4, setts.BlockingIPv6, _ = dnsforward.ParseBlockingIPs(c.BlockingIPv4, c.BlockingIPv6)
+	}
+
 	if !c.UseOwnSettings {
 		return
 	}
@@ -305,12 +359,21 @@ func reconfigureDNSServer() error {
 	return nil
 }
 
+// upstreamTimeout returns the configured timeout of the requests to upstream servers
+func upstreamTimeout() time.Duration {
+	if config.DNS.UpstreamTimeout == 0 {
+		return dnsforward.DefaultTimeout
+	}
+	return time.Duration(config.DNS.UpstreamTimeout) * time.Second
+}
+
 func stopDNSServer() error {
 	if !isRunning() {
 		return nil
 	}
 
-	err := Context.dnsServer.Stop()
+	// wait for the active DNS requests to be processed before closing the modules they use
+	err := Context.dnsServer.StopAndWait(upstreamTimeout() + time.Second)
 	if err != nil {
 		return errorx.Decorate(err, "Couldn't stop forwarding DNS server")
 	}
@@ -326,6 +389,11 @@ func closeDNSServer() {
 		Context.dnsServer = nil
 	}
 
+	if Context.syslog != nil {
+		Context.syslog.Close()
+		Context.syslog = nil
+	}
+
 	if Context.dnsFilter != nil {
 		Context.dnsFilter.Close()
 		Context.dnsFilter = nil
@@ -343,5 +411,12 @@ func closeDNSServer() {
 
 	Context.filters.Close()
 
+	ctx, cancel := context.WithTimeout(context.Background(), workerStopTimeout)
+	err := worker.Stop(ctx)
+	cancel()
+	if err != nil {
+		log.Error("%s", err)
+	}
+
 	log.Debug("Closed all DNS modules")
 }
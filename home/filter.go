@@ -692,8 +692,10 @@ func enableFilters(async bool) {
 				continue
 			}
 			f := dnsfilter.Filter{
-				ID:       filter.ID,
-				FilePath: filter.Path(),
+				ID:        filter.ID,
+				FilePath:  filter.Path(),
+				BlockIPv4: filter.BlockIPv4,
+				BlockIPv6: filter.BlockIPv6,
 			}
 			filters = append(filters, f)
 		}
@@ -68,6 +68,8 @@ type homeContext struct {
 	autoHosts  util.AutoHosts       // IP-hostname pairs taken from system configuration (e.g. /etc/hosts) files
 	updater    *update.Updater
 
+	syslog *dnsforward.SyslogWriter // sends filtered requests to syslog (optional)
+
 	// Runtime properties
 	// --
 
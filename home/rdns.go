@@ -2,13 +2,12 @@ package home
 
 import (
 	"encoding/binary"
-	"strings"
+	"net"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/miekg/dns"
 )
 
 // RDNS - module context
@@ -73,43 +72,23 @@ func (r *RDNS) Begin(ip string) {
 func (r *RDNS) resolve(ip string) string {
 	log.Tracef("Resolving host for %s", ip)
 
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{
-			Qtype:  dns.TypePTR,
-			Qclass: dns.ClassINET,
-		},
-	}
-	var err error
-	req.Question[0].Name, err = dns.ReverseAddr(ip)
-	if err != nil {
-		log.Debug("Error while calling dns.ReverseAddr(%s): %s", ip, err)
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		log.Debug("rDNS: invalid IP address %s", ip)
 		return ""
 	}
-
-	resp, err := r.dnsServer.Exchange(&req)
+	host, err := r.dnsServer.ResolveRDNS(addr)
 	if err != nil {
 		log.Debug("Error while making an rDNS lookup for %s: %s", ip, err)
 		return ""
 	}
-	if len(resp.Answer) == 0 {
+	if len(host) == 0 {
 		log.Debug("No answer for rDNS lookup of %s", ip)
 		return ""
 	}
-	ptr, ok := resp.Answer[0].(*dns.PTR)
-	if !ok {
-		log.Debug("not a PTR response for %s", ip)
-		return ""
-	}
-
-	log.Tracef("PTR response for %s: %s", ip, ptr.String())
-	if strings.HasSuffix(ptr.Ptr, ".") {
-		ptr.Ptr = ptr.Ptr[:len(ptr.Ptr)-1]
-	}
 
-	return ptr.Ptr
+	log.Tracef("PTR response for %s: %s", ip, host)
+	return host
 }
 
 // Wait for a signal and then synchronously resolve hostname by IP address
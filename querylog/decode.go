@@ -2,6 +2,7 @@ package querylog
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +28,8 @@ func decodeLogEntry(ent *logEntry, str string) {
 			if len(ent.IP) == 0 {
 				ent.IP = v
 			}
+		case "CN":
+			ent.ClientName = v
 		case "T":
 			ent.Time, err = time.Parse(time.RFC3339, v)
 
@@ -56,6 +59,14 @@ func decodeLogEntry(ent *logEntry, str string) {
 		case "Reason":
 			i, err = strconv.Atoi(v)
 			ent.Result.Reason = dnsfilter.Reason(i)
+		case "CloakedHost":
+			ent.Result.CloakedHost = v
+		case "DryRun":
+			b, err = strconv.ParseBool(v)
+			ent.Result.DryRun = b
+		case "SafeSearchProvider":
+			i, err = strconv.Atoi(v)
+			ent.Result.SafeSearchProvider = dnsfilter.SafeSearchProvider(i)
 
 		case "Upstream":
 			ent.Upstream = v
@@ -108,6 +119,19 @@ func readJSONValue(s, name string) string {
 	return s[start:end]
 }
 
+// indexStringEnd returns the index of the closing quote of a JSON string, skipping the escaped characters
+func indexStringEnd(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
 const (
 	jsonTErr = iota
 	jsonTObj
@@ -147,11 +171,18 @@ func readJSON(ps *string) (string, string, int32) {
 	}
 
 	if s[1] == '"' {
-		q2 = strings.IndexByte(s[2:], '"')
+		q2 = indexStringEnd(s[2:])
 		if q2 == -1 {
 			return k, v, t
 		}
 		v = s[2 : 2+q2]
+		if strings.IndexByte(v, '\\') != -1 {
+			// e.g. regular expression rules
+			err := json.Unmarshal([]byte(s[1:2+q2+1]), &v)
+			if err != nil {
+				return k, v, t
+			}
+		}
 		t = jsonTStr
 		s = s[2+q2+1:]
 
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -69,6 +70,9 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) map[string]interface{} {
 		"client":       l.getClientIP(entry.IP),
 		"client_proto": entry.ClientProto,
 	}
+	if len(entry.ClientName) != 0 {
+		jsonEntry["client_name"] = entry.ClientName
+	}
 	jsonEntry["question"] = map[string]interface{}{
 		"host":  entry.QHost,
 		"type":  entry.QType,
@@ -95,6 +99,18 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) map[string]interface{} {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if entry.Result.DryRun {
+		jsonEntry["dry_run"] = true
+	}
+
+	if entry.Result.SafeSearchProvider != dnsfilter.SafeSearchNone {
+		jsonEntry["safe_search_engine"] = entry.Result.SafeSearchProvider.String()
+	}
+
+	if len(entry.Result.CloakedHost) != 0 {
+		jsonEntry["cloaked_host"] = entry.Result.CloakedHost
+	}
+
 	answers := answerToMap(msg)
 	if answers != nil {
 		jsonEntry["answer"] = answers
@@ -31,8 +31,9 @@ type queryLog struct {
 
 // logEntry - represents a single log entry
 type logEntry struct {
-	IP   string    `json:"IP"` // Client IP
-	Time time.Time `json:"T"`
+	IP         string    `json:"IP"`           // Client IP
+	ClientName string    `json:"CN,omitempty"` // Name of the persistent client (not stored if IP is anonymized)
+	Time       time.Time `json:"T"`
 
 	QHost  string `json:"QH"`
 	QType  string `json:"QT"`
@@ -126,6 +127,9 @@ func (l *queryLog) Add(params AddParams) {
 		Upstream:    params.Upstream,
 		ClientProto: params.ClientProto,
 	}
+	if !l.conf.AnonymizeClientIP {
+		entry.ClientName = params.ClientName
+	}
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
 	entry.QType = dns.Type(q.Qtype).String()
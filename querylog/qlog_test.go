@@ -208,6 +208,56 @@ func TestQueryLogFileDisabled(t *testing.T) {
 	assert.Equal(t, "example2.org", ll[1].QHost)
 }
 
+// The matched rule and filter list ID are stored on disk
+func TestQueryLogRule(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		FileEnabled: true,
+		Interval:    1,
+		MemSize:     100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	rules := []string{
+		"||example.org^",
+		`/^ads\d+\.example\.org$/`,
+		`/"quoted"&<>/`,
+	}
+	for i, rule := range rules {
+		q := dns.Msg{}
+		q.SetQuestion("example.org.", dns.TypeA)
+		res := dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredBlackList,
+			Rule:       rule,
+			FilterID:   int64(i + 1),
+		}
+		l.Add(AddParams{
+			Question: &q,
+			Answer:   &q,
+			Result:   &res,
+			ClientIP: net.IP{2, 2, 2, 2},
+		})
+	}
+	_ = l.flushLogBuffer(true)
+
+	entries, _ := l.search(newSearchParams())
+	assert.Equal(t, len(rules), len(entries))
+	for i, e := range entries {
+		n := len(rules) - 1 - i
+		assert.Equal(t, rules[n], e.Result.Rule)
+		assert.Equal(t, int64(n+1), e.Result.FilterID)
+		assert.Equal(t, dnsfilter.FilteredBlackList, e.Result.Reason)
+		assert.Equal(t, "2.2.2.2", e.IP)
+
+		j := l.logEntryToJSONEntry(e)
+		assert.Equal(t, rules[n], j["rule"])
+		assert.Equal(t, int64(n+1), j["filterId"])
+	}
+}
+
 func addEntry(l *queryLog, host, answerStr, client string) {
 	q := dns.Msg{}
 	q.Question = append(q.Question, dns.Question{
@@ -251,3 +301,50 @@ func assertLogEntry(t *testing.T, entry *logEntry, host, answer, client string)
 	assert.Equal(t, answer, ip.String())
 	return true
 }
+
+func TestQueryLogClientName(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		FileEnabled: true,
+		Interval:    1,
+		MemSize:     100,
+	}
+	conf.BaseDir = prepareTestDir()
+	defer func() { _ = os.RemoveAll(conf.BaseDir) }()
+	l := newQueryLog(conf)
+
+	q := dns.Msg{}
+	q.SetQuestion("example.org.", dns.TypeA)
+	l.Add(AddParams{
+		Question:   &q,
+		ClientIP:   net.IP{192, 168, 1, 2},
+		ClientName: "Living Room TV",
+	})
+	addEntry(l, "example.com", "1.1.1.1", "192.168.1.3")
+	// the name is read from the file
+	_ = l.flushLogBuffer(true)
+
+	params := newSearchParams()
+	params.searchCriteria = append(params.searchCriteria, searchCriteria{
+		criteriaType: ctDomainOrClient,
+		strict:       false,
+		value:        "living room",
+	})
+	entries, _ := l.search(params)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "Living Room TV", entries[0].ClientName)
+
+	m := l.logEntryToJSONEntry(entries[0])
+	assert.Equal(t, "Living Room TV", m["client_name"])
+	assert.Equal(t, "192.168.1.2", m["client"])
+
+	// the name isn't stored if the addresses are anonymized
+	l.conf.AnonymizeClientIP = true
+	l.Add(AddParams{
+		Question:   &q,
+		ClientIP:   net.IP{192, 168, 1, 2},
+		ClientName: "Living Room TV",
+	})
+	entries, _ = l.search(newSearchParams())
+	assert.Equal(t, "", entries[0].ClientName)
+}
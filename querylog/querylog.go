@@ -47,8 +47,9 @@ type AddParams struct {
 	Result      *dnsfilter.Result // Filtering result (optional)
 	Elapsed     time.Duration     // Time spent for processing the request
 	ClientIP    net.IP
+	ClientName  string // Name of the persistent client (optional)
 	Upstream    string // Upstream server URL
-	ClientProto string // Protocol for the client connection: "" (plain), "doh", "dot"
+	ClientProto string // Protocol for the client connection: "" (plain), "doh", "dot", "internal" (sent by the server itself)
 }
 
 // New - create a new instance of the query log
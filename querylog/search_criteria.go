@@ -9,7 +9,7 @@ import (
 type criteriaType int
 
 const (
-	ctDomainOrClient  criteriaType = iota // domain name or client IP address
+	ctDomainOrClient  criteriaType = iota // domain name, client IP address or client name
 	ctFilteringStatus                     // filtering status
 )
 
@@ -24,6 +24,7 @@ const (
 	filteringStatusRewritten           = "rewritten"            // all kinds of rewrites
 	filteringStatusSafeSearch          = "safe_search"          // enforced safe search
 	filteringStatusProcessed           = "processed"            // not blocked, not white-listed entries
+	filteringStatusWouldBlock          = "would_block"          // matched by filters in dry-run mode
 )
 
 // filteringStatusValues -- array with all possible filteringStatus values
@@ -31,7 +32,7 @@ var filteringStatusValues = []string{
 	filteringStatusAll, filteringStatusFiltered, filteringStatusBlocked,
 	filteringStatusBlockedSafebrowsing, filteringStatusBlockedParental,
 	filteringStatusWhitelisted, filteringStatusRewritten, filteringStatusSafeSearch,
-	filteringStatusProcessed,
+	filteringStatusProcessed, filteringStatusWouldBlock,
 }
 
 // searchCriteria - every search request may contain a list of different search criteria
@@ -50,7 +51,8 @@ func (c *searchCriteria) quickMatch(line string) bool {
 	switch c.criteriaType {
 	case ctDomainOrClient:
 		return c.quickMatchJSONValue(line, "QH") ||
-			c.quickMatchJSONValue(line, "IP")
+			c.quickMatchJSONValue(line, "IP") ||
+			c.quickMatchJSONValue(line, "CN")
 	default:
 		return true
 	}
@@ -96,6 +98,14 @@ func (c *searchCriteria) match(entry *logEntry) bool {
 			return true
 		}
 
+		name := strings.ToLower(entry.ClientName)
+		if len(name) != 0 && c.strict && name == searchVal {
+			return true
+		}
+		if len(name) != 0 && !c.strict && strings.Contains(name, searchVal) {
+			return true
+		}
+
 		return false
 
 	case ctFilteringStatus:
@@ -112,7 +122,10 @@ func (c *searchCriteria) match(entry *logEntry) bool {
 		case filteringStatusBlocked:
 			return res.IsFiltered &&
 				(res.Reason == dnsfilter.FilteredBlackList ||
-					res.Reason == dnsfilter.FilteredBlockedService)
+					res.Reason == dnsfilter.FilteredBlockedService ||
+					res.Reason == dnsfilter.FilteredRebinding ||
+					res.Reason == dnsfilter.FilteredDefaultDeny ||
+					res.Reason == dnsfilter.FilteredBlockedIP)
 		case filteringStatusBlockedParental:
 			return res.IsFiltered && res.Reason == dnsfilter.FilteredParental
 		case filteringStatusBlockedSafebrowsing:
@@ -125,9 +138,15 @@ func (c *searchCriteria) match(entry *logEntry) bool {
 		case filteringStatusSafeSearch:
 			return res.IsFiltered && res.Reason == dnsfilter.FilteredSafeSearch
 
+		case filteringStatusWouldBlock:
+			return res.DryRun
+
 		case filteringStatusProcessed:
-			return !(res.Reason == dnsfilter.FilteredBlackList ||
+			return res.DryRun || !(res.Reason == dnsfilter.FilteredBlackList ||
 				res.Reason == dnsfilter.FilteredBlockedService ||
+				res.Reason == dnsfilter.FilteredRebinding ||
+				res.Reason == dnsfilter.FilteredDefaultDeny ||
+				res.Reason == dnsfilter.FilteredBlockedIP ||
 				res.Reason == dnsfilter.NotFilteredWhiteList)
 
 		default:
@@ -27,6 +27,9 @@ type Config struct {
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request))
 
+	// Get the number of requests from each client during the last second (optional)
+	ClientRates func() map[string]uint64
+
 	limit uint32 // maximum time we need to keep data for (in hours)
 }
 
@@ -82,4 +85,6 @@ type Entry struct {
 	Client net.IP
 	Result Result
 	Time   uint32 // processing time (msec)
+
+	SafeSearchEngine string // search engine for which safe search is enforced (only with RSafeSearch)
 }
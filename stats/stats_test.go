@@ -73,6 +73,7 @@ func TestStats(t *testing.T) {
 	assert.True(t, d["num_replaced_safesearch"].(uint64) == 0)
 	assert.True(t, d["num_replaced_parental"].(uint64) == 0)
 	assert.True(t, d["avg_processing_time"].(float64) == 0.123456)
+	assert.Equal(t, 0, len(d["top_safesearch_engines"].([]map[string]uint64)))
 
 	topClients := s.GetTopClientsIP(2)
 	assert.True(t, topClients[0] == "127.0.0.1")
@@ -123,6 +124,47 @@ func TestLargeNumbers(t *testing.T) {
 	os.Remove(conf.Filename)
 }
 
+func TestSafeSearchEngines(t *testing.T) {
+	var hour int32
+	hour = 1
+	newID := func() uint32 {
+		return uint32(atomic.LoadInt32(&hour))
+	}
+
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+		UnitID:    newID,
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	e := Entry{
+		Domain:           "www.google.com",
+		Client:           net.ParseIP("127.0.0.1"),
+		Result:           RSafeSearch,
+		SafeSearchEngine: "google",
+	}
+	s.Update(e)
+
+	// the next unit: the previous one is stored in DB
+	atomic.AddInt32(&hour, 1)
+	s.Update(e)
+	e.Domain = "www.bing.com"
+	e.SafeSearchEngine = "bing"
+	s.Update(e)
+
+	d := s.getData()
+	assert.Equal(t, uint64(3), d["num_replaced_safesearch"].(uint64))
+	m := d["top_safesearch_engines"].([]map[string]uint64)
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, uint64(2), m[0]["google"])
+	assert.Equal(t, uint64(1), m[1]["bing"])
+
+	s.Close()
+	os.Remove(conf.Filename)
+}
+
 // this code is a chunk copied from getData() that generates aggregate data per day
 func aggregateDataPerDay(firstID uint32) int {
 	firstDayID := (firstID + 24 - 1) / 24 * 24 // align_ceil(24)
@@ -150,3 +192,34 @@ func TestAggregateDataPerTimeUnit(t *testing.T) {
 		assert.True(t, alen == 30, "i=%d", i)
 	}
 }
+
+func TestClientRates(t *testing.T) {
+	conf := Config{
+		Filename:  "./stats.db",
+		LimitDays: 1,
+		ClientRates: func() map[string]uint64 {
+			return map[string]uint64{"1.2.3.4": 10, "1.2.5.6": 5, "127.0.0.1": 20}
+		},
+	}
+	os.Remove(conf.Filename)
+	s, _ := createObject(conf)
+
+	d := s.getData()
+	m := d["clients_rate"].([]map[string]uint64)
+	assert.Equal(t, 3, len(m))
+	assert.Equal(t, uint64(20), m[0]["127.0.0.1"])
+	assert.Equal(t, uint64(10), m[1]["1.2.3.4"])
+	s.Close()
+
+	// anonymized addresses are merged
+	conf.AnonymizeClientIP = true
+	s, _ = createObject(conf)
+	d = s.getData()
+	m = d["clients_rate"].([]map[string]uint64)
+	assert.Equal(t, 2, len(m))
+	assert.Equal(t, uint64(20), m[0]["127.0.0.0"])
+	assert.Equal(t, uint64(15), m[1]["1.2.0.0"])
+	s.Close()
+
+	os.Remove(conf.Filename)
+}
@@ -41,6 +41,8 @@ type unit struct {
 	domains        map[string]uint64 // number of requests per domain
 	blockedDomains map[string]uint64 // number of blocked requests per domain
 	clients        map[string]uint64 // number of requests per client
+
+	safeSearchEngines map[string]uint64 // number of safe search requests per search engine
 }
 
 // name-count pair
@@ -59,6 +61,8 @@ type unitDB struct {
 	Clients        []countPair
 
 	TimeAvg uint32 // usec
+
+	SafeSearchEngines []countPair
 }
 
 func createObject(conf Config) (*statsCtx, error) {
@@ -165,6 +169,7 @@ func (s *statsCtx) initUnit(u *unit, id uint32) {
 	u.domains = make(map[string]uint64)
 	u.blockedDomains = make(map[string]uint64)
 	u.clients = make(map[string]uint64)
+	u.safeSearchEngines = make(map[string]uint64)
 }
 
 // Open a DB transaction
@@ -306,6 +311,7 @@ func serialize(u *unit) *unitDB {
 	udb.Domains = convertMapToArray(u.domains, maxDomains)
 	udb.BlockedDomains = convertMapToArray(u.blockedDomains, maxDomains)
 	udb.Clients = convertMapToArray(u.clients, maxClients)
+	udb.SafeSearchEngines = convertMapToArray(u.safeSearchEngines, len(u.safeSearchEngines))
 	return &udb
 }
 
@@ -323,6 +329,7 @@ func deserialize(u *unit, udb *unitDB) {
 	u.domains = convertArrayToMap(udb.Domains)
 	u.blockedDomains = convertArrayToMap(udb.BlockedDomains)
 	u.clients = convertArrayToMap(udb.Clients)
+	u.safeSearchEngines = convertArrayToMap(udb.SafeSearchEngines)
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
 }
 
@@ -483,6 +490,9 @@ func (s *statsCtx) Update(e Entry) {
 	}
 
 	u.clients[client]++
+	if e.Result == RSafeSearch && len(e.SafeSearchEngine) != 0 {
+		u.safeSearchEngines[e.SafeSearchEngine]++
+	}
 	u.timeSum += uint64(e.Time)
 	u.nTotal++
 	s.unitLock.Unlock()
@@ -696,6 +706,24 @@ func (s *statsCtx) getData() map[string]interface{} {
 	a2 = convertMapToArray(m, maxClients)
 	d["top_clients"] = convertTopArray(a2)
 
+	m = map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.SafeSearchEngines {
+			m[it.Name] += it.Count
+		}
+	}
+	a2 = convertMapToArray(m, len(m))
+	d["top_safesearch_engines"] = convertTopArray(a2)
+
+	if s.conf.ClientRates != nil {
+		m = map[string]uint64{}
+		for ip, n := range s.conf.ClientRates() {
+			m[s.getClientIP(ip)] += n
+		}
+		a2 = convertMapToArray(m, maxClients)
+		d["clients_rate"] = convertTopArray(a2)
+	}
+
 	// total counters:
 
 	sum := unitDB{}
@@ -3,6 +3,8 @@ package util
 import (
 	"net"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
 // convert character to hex number
@@ -68,3 +70,26 @@ func DNSUnreverseAddr(s string) net.IP {
 
 	return nil // unknown suffix
 }
+
+// CNAMEChain - follow CNAME records from qname and return the names of the chain (without qname and the last dot)
+func CNAMEChain(answers []dns.RR, qname string) []string {
+	targets := map[string]string{}
+	for _, a := range answers {
+		cname, ok := a.(*dns.CNAME)
+		if ok {
+			targets[strings.ToLower(cname.Hdr.Name)] = strings.ToLower(cname.Target)
+		}
+	}
+
+	var chain []string
+	name := strings.ToLower(qname)
+	for len(chain) < len(targets) {
+		target, ok := targets[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, strings.TrimSuffix(target, "."))
+		name = target
+	}
+	return chain
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCNAMEChain(t *testing.T) {
+	answers := []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.Example.com.", Rrtype: dns.TypeCNAME}, Target: "www.example.com.cdn.net."},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.cdn.net.", Rrtype: dns.TypeCNAME}, Target: "edge.cdn.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "edge.cdn.net.", Rrtype: dns.TypeA}, A: net.IP{1, 1, 1, 1}},
+	}
+
+	chain := CNAMEChain(answers, "www.example.com.")
+	assert.Equal(t, []string{"www.example.com.cdn.net", "edge.cdn.net"}, chain)
+
+	assert.Nil(t, CNAMEChain(answers[2:], "edge.cdn.net."))
+
+	// a loop doesn't hang
+	loop := []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeCNAME}, Target: "b.com."},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "b.com.", Rrtype: dns.TypeCNAME}, Target: "a.com."},
+	}
+	assert.Equal(t, 2, len(CNAMEChain(loop, "a.com.")))
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// entry is an IP address queued for routing
+type entry struct {
+	ip      net.IP
+	ttl     time.Duration
+	domain  string
+	country string
+	set     string // firewall set name (empty: the default set)
+
+	filterID int64  // ID of the filter list which whitelisted the request
+	client   net.IP // address of the client which sent the request
+}
+
+// batcher collects entries and passes them to flush in batches:
+// either when the batch reaches its maximum size or when the interval elapses
+type batcher struct {
+	ch       chan entry
+	size     int
+	interval time.Duration
+	flush    func([]entry)
+
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newBatcher(size int, interval time.Duration, flush func([]entry)) *batcher {
+	b := &batcher{
+		ch:       make(chan entry, size),
+		size:     size,
+		interval: interval,
+		flush:    flush,
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// enqueue adds an entry to the current batch.
+// Returns FALSE if the batcher is already closed.
+func (b *batcher) enqueue(e entry) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return false
+	}
+	b.ch <- e
+	return true
+}
+
+// close flushes the pending entries and stops the processing goroutine
+func (b *batcher) close() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.ch)
+	b.lock.Unlock()
+
+	<-b.done
+}
+
+func (b *batcher) run() {
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+
+	var buf []entry
+	for {
+		select {
+		case e, ok := <-b.ch:
+			if !ok {
+				if len(buf) != 0 {
+					b.flush(buf)
+				}
+				close(b.done)
+				return
+			}
+
+			buf = append(buf, e)
+			if len(buf) >= b.size {
+				b.flush(buf)
+				buf = nil
+			}
+
+		case <-t.C:
+			if len(buf) != 0 {
+				b.flush(buf)
+				buf = nil
+			}
+		}
+	}
+}
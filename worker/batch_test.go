@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFlusher struct {
+	lock    sync.Mutex
+	batches [][]entry
+}
+
+func (f *testFlusher) flush(entries []entry) {
+	f.lock.Lock()
+	f.batches = append(f.batches, entries)
+	f.lock.Unlock()
+}
+
+func (f *testFlusher) count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.batches)
+}
+
+func TestBatcherSize(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(2, time.Hour, f.flush)
+
+	assert.True(t, b.enqueue(entry{ip: net.ParseIP("1.1.1.1")}))
+	assert.True(t, b.enqueue(entry{ip: net.ParseIP("2.2.2.2")}))
+	assert.True(t, b.enqueue(entry{ip: net.ParseIP("3.3.3.3")}))
+	b.close()
+
+	assert.Equal(t, 2, len(f.batches))
+	assert.Equal(t, 2, len(f.batches[0]))
+	assert.Equal(t, "3.3.3.3", f.batches[1][0].ip.String())
+
+	// enqueue after close is rejected
+	assert.False(t, b.enqueue(entry{ip: net.ParseIP("4.4.4.4")}))
+}
+
+func TestBatcherInterval(t *testing.T) {
+	f := &testFlusher{}
+	b := newBatcher(100, 10*time.Millisecond, f.flush)
+	defer b.close()
+
+	assert.True(t, b.enqueue(entry{ip: net.ParseIP("1.1.1.1")}))
+	for i := 0; i != 100 && f.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, f.count())
+}
@@ -0,0 +1,150 @@
+package worker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// routedEntry is an address which was added to the firewall set
+type routedEntry struct {
+	IP        string    `json:"ip"`
+	Domain    string    `json:"domain"`
+	Country   string    `json:"country"`
+	Set       string    `json:"set,omitempty"`    // empty: the default set
+	Chain     []string  `json:"chain,omitempty"`  // CNAME chain from Domain to the address
+	Client    string    `json:"client,omitempty"` // address of the client whose request caused the routing
+	AddedAt   time.Time `json:"added_at"`
+	ExpiresAt time.Time `json:"expires_at"` // the element is removed from the set at this time
+
+	dedupUntil time.Time // the address isn't routed again until this time
+}
+
+// routedCache keeps the addresses which were recently routed
+type routedCache struct {
+	lock      sync.Mutex
+	items     map[string]*routedEntry    // IP -> entry
+	domains   map[string]map[string]bool // domain -> IPs routed for it
+	nextSweep time.Time
+}
+
+func newRoutedCache() *routedCache {
+	return &routedCache{
+		items:   make(map[string]*routedEntry),
+		domains: make(map[string]map[string]bool),
+	}
+}
+
+// has returns TRUE if ip was routed and it mustn't be routed again yet
+func (c *routedCache) has(ip string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[ip]
+	if !ok {
+		return false
+	}
+	if !now.Before(e.ExpiresAt) {
+		c.del(ip)
+		return false
+	}
+	return now.Before(e.dedupUntil)
+}
+
+// set stores the routed entry
+func (c *routedCache) set(e *routedEntry, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.del(e.IP)
+	c.items[e.IP] = e
+	ips, ok := c.domains[e.Domain]
+	if !ok {
+		ips = map[string]bool{}
+		c.domains[e.Domain] = ips
+	}
+	ips[e.IP] = true
+
+	if now.After(c.nextSweep) {
+		for k, v := range c.items {
+			if !now.Before(v.ExpiresAt) {
+				c.del(k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+}
+
+// get returns a copy of the entry for ip
+func (c *routedCache) get(ip string) (routedEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[ip]
+	if !ok {
+		return routedEntry{}, false
+	}
+	return *e, true
+}
+
+// remove deletes the entry for ip
+func (c *routedCache) remove(ip string) {
+	c.lock.Lock()
+	c.del(ip)
+	c.lock.Unlock()
+}
+
+// del deletes the entry for ip and its domain index record.  The lock must be held.
+func (c *routedCache) del(ip string) {
+	e, ok := c.items[ip]
+	if !ok {
+		return
+	}
+	delete(c.items, ip)
+
+	ips := c.domains[e.Domain]
+	delete(ips, ip)
+	if len(ips) == 0 {
+		delete(c.domains, e.Domain)
+	}
+}
+
+// domainIPs returns the addresses which were routed for domain and haven't yet expired
+func (c *routedCache) domainIPs(domain string, now time.Time) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var ips []string
+	for ip := range c.domains[domain] {
+		if now.Before(c.items[ip].ExpiresAt) {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// list returns the entries which haven't yet expired, the newest first
+func (c *routedCache) list(now time.Time, offset, limit int) []routedEntry {
+	c.lock.Lock()
+	entries := make([]routedEntry, 0, len(c.items))
+	for _, e := range c.items {
+		if now.Before(e.ExpiresAt) {
+			entries = append(entries, *e)
+		}
+	}
+	c.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].AddedAt.After(entries[j].AddedAt)
+	})
+
+	if offset >= len(entries) {
+		return []routedEntry{}
+	}
+	entries = entries[offset:]
+	if limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutedCache(t *testing.T) {
+	c := newRoutedCache()
+	now := time.Now()
+
+	assert.False(t, c.has("1.2.3.4", now))
+
+	c.set(&routedEntry{
+		IP:         "1.2.3.4",
+		AddedAt:    now,
+		ExpiresAt:  now.Add(time.Hour),
+		dedupUntil: now.Add(time.Minute),
+	}, now)
+	assert.True(t, c.has("1.2.3.4", now))
+	assert.True(t, c.has("1.2.3.4", now.Add(59*time.Second)))
+
+	// may be routed again, but the entry is still listed
+	assert.False(t, c.has("1.2.3.4", now.Add(time.Minute)))
+	assert.Equal(t, 1, len(c.list(now.Add(time.Minute), 0, 10)))
+
+	// expired entry is removed
+	assert.False(t, c.has("1.2.3.4", now.Add(time.Hour)))
+	assert.Equal(t, 0, len(c.items))
+
+	// expired entries are swept on insert
+	c.set(&routedEntry{IP: "1.1.1.1", ExpiresAt: now.Add(time.Second)}, now)
+	c.set(&routedEntry{IP: "2.2.2.2", ExpiresAt: now.Add(time.Hour)}, now.Add(2*time.Minute))
+	assert.Equal(t, 1, len(c.items))
+}
+
+func TestRoutedCacheList(t *testing.T) {
+	c := newRoutedCache()
+	now := time.Now()
+
+	for i, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		c.set(&routedEntry{
+			IP:        ip,
+			AddedAt:   now.Add(time.Duration(i) * time.Second),
+			ExpiresAt: now.Add(time.Hour),
+		}, now)
+	}
+
+	l := c.list(now, 0, 10)
+	assert.Equal(t, 3, len(l))
+	assert.Equal(t, "3.3.3.3", l[0].IP)
+
+	l = c.list(now, 1, 1)
+	assert.Equal(t, 1, len(l))
+	assert.Equal(t, "2.2.2.2", l[0].IP)
+
+	l = c.list(now, 5, 10)
+	assert.Equal(t, 0, len(l))
+}
+
+func TestRoutedCacheDomainIPs(t *testing.T) {
+	c := newRoutedCache()
+	now := time.Now()
+
+	c.set(&routedEntry{IP: "1.1.1.1", Domain: "a.com", ExpiresAt: now.Add(time.Hour)}, now)
+	c.set(&routedEntry{IP: "2.2.2.2", Domain: "a.com", ExpiresAt: now.Add(time.Minute)}, now)
+	c.set(&routedEntry{IP: "3.3.3.3", Domain: "b.com", ExpiresAt: now.Add(time.Hour)}, now)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, c.domainIPs("a.com", now))
+	assert.Equal(t, []string{"1.1.1.1"}, c.domainIPs("a.com", now.Add(time.Minute)))
+	assert.Nil(t, c.domainIPs("c.com", now))
+
+	// the address moves to another domain
+	c.set(&routedEntry{IP: "1.1.1.1", Domain: "b.com", ExpiresAt: now.Add(time.Hour)}, now)
+	assert.Equal(t, []string{"2.2.2.2"}, c.domainIPs("a.com", now))
+	assert.Equal(t, []string{"1.1.1.1", "3.3.3.3"}, c.domainIPs("b.com", now))
+
+	c.remove("2.2.2.2")
+	assert.Nil(t, c.domainIPs("a.com", now))
+	assert.Equal(t, 1, len(c.domains))
+}
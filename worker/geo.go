@@ -0,0 +1,141 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/ip2region"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoLookup - geo database
+type GeoLookup interface {
+	// Country returns the country of the IP address
+	// or an empty string if the address isn't found.
+	// ip2region returns country names (mostly in Chinese), MaxMind returns ISO 3166-1 codes.
+	Country(ip net.IP) (string, error)
+}
+
+// Location is the geographic location of an IP address.
+// The fields are empty if they aren't known.
+type Location struct {
+	Country  string
+	Province string // province, state or another first-level subdivision
+	City     string
+}
+
+// locationLookup is implemented by the geo databases which know the province and city of an address
+type locationLookup interface {
+	Location(ip net.IP) (Location, error)
+}
+
+// lookupLocation returns the location of the IP address.
+// Only the country is returned if the database doesn't support the detailed lookup.
+func lookupLocation(g GeoLookup, ip net.IP) (Location, error) {
+	if ll, ok := g.(locationLookup); ok {
+		return ll.Location(ip)
+	}
+	country, err := g.Country(ip)
+	return Location{Country: country}, err
+}
+
+// newGeoLookup opens the database for the configured geo backend
+func newGeoLookup(c *Config) (GeoLookup, error) {
+	switch c.GeoBackend {
+	case "", "ip2region":
+		r, err := ip2region.New(c.GeoDBPath)
+		if err != nil {
+			return nil, fmt.Errorf("ip2region.New(): %s", err)
+		}
+		return &ip2regionLookup{r: r}, nil
+
+	case "maxmind":
+		db, err := geoip2.Open(c.GeoDBPath)
+		if err != nil {
+			return nil, fmt.Errorf("geoip2.Open(): %s", err)
+		}
+		return &maxmindLookup{db: db}, nil
+	}
+
+	return nil, fmt.Errorf("unknown geo backend: %s", c.GeoBackend)
+}
+
+// ip2regionLookup - ip2region database
+type ip2regionLookup struct {
+	r *ip2region.Ip2Region
+}
+
+// Country - GeoLookup
+func (l *ip2regionLookup) Country(ip net.IP) (string, error) {
+	loc, err := l.Location(ip)
+	return loc.Country, err
+}
+
+// Location - locationLookup
+func (l *ip2regionLookup) Location(ip net.IP) (Location, error) {
+	info, err := l.r.MemorySearch(ip.String())
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{
+		Country:  ip2regionField(info.Country),
+		Province: ip2regionField(info.Province),
+		City:     ip2regionField(info.City),
+	}, nil
+}
+
+// Close - io.Closer
+func (l *ip2regionLookup) Close() error {
+	l.r.Close()
+	return nil
+}
+
+// ip2regionField returns an empty string for the unknown value ("0")
+func ip2regionField(s string) string {
+	if s == "0" {
+		return ""
+	}
+	return s
+}
+
+// maxmindLookup - MaxMind GeoIP2 or GeoLite2 database (Country or City)
+type maxmindLookup struct {
+	db *geoip2.Reader
+}
+
+// Country - GeoLookup
+func (l *maxmindLookup) Country(ip net.IP) (string, error) {
+	rec, err := l.db.Country(ip)
+	if err != nil {
+		return "", err
+	}
+	return rec.Country.IsoCode, nil
+}
+
+// Location - locationLookup
+// Province and city are known only if it's a City database.
+func (l *maxmindLookup) Location(ip net.IP) (Location, error) {
+	if !strings.Contains(l.db.Metadata().DatabaseType, "City") {
+		country, err := l.Country(ip)
+		return Location{Country: country}, err
+	}
+
+	rec, err := l.db.City(ip)
+	if err != nil {
+		return Location{}, err
+	}
+	loc := Location{
+		Country: rec.Country.IsoCode,
+		City:    rec.City.Names["en"],
+	}
+	if len(rec.Subdivisions) != 0 {
+		loc.Province = rec.Subdivisions[0].IsoCode
+	}
+	return loc, nil
+}
+
+// Close - io.Closer
+func (l *maxmindLookup) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,29 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGeoLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker")
+	assert.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := Config{GeoDBPath: filepath.Join(dir, "GeoLite2-Country.mmdb")}
+	c.GeoBackend = "maxmind"
+	_, err = newGeoLookup(&c)
+	assert.NotNil(t, err) // no file
+
+	assert.Nil(t, ioutil.WriteFile(c.GeoDBPath, []byte("not a database"), 0644))
+	_, err = newGeoLookup(&c)
+	assert.NotNil(t, err) // invalid file
+
+	c.GeoBackend = "geoip"
+	_, err = newGeoLookup(&c)
+	assert.NotNil(t, err)
+}
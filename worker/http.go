@@ -0,0 +1,296 @@
+// HTTP request handlers for accessing the routed addresses
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const defaultListLimit = 100
+
+func httpError(r *http.Request, w http.ResponseWriter, code int, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	log.Info("Worker: %s %s: %s", r.Method, r.URL, text)
+	http.Error(w, text, code)
+}
+
+// Return the list of routed addresses.
+// Query parameters: "offset", "limit" (default: 100)
+func handleRoutedList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset := 0
+	limit := defaultListLimit
+	if v, err := strconv.Atoi(q.Get("offset")); err == nil && v >= 0 {
+		offset = v
+	}
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+
+	entries := []routedEntry{}
+	st := loadState()
+	if st.routed != nil {
+		entries = st.routed.list(time.Now(), offset, limit)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "http write: %s", err)
+	}
+}
+
+type ipJSON struct {
+	IP string `json:"ip"`
+}
+
+// Add an address to the firewall set: POST /control/worker/routed
+func handleRoutedAdd(w http.ResponseWriter, r *http.Request) {
+	req := ipJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		httpError(r, w, http.StatusBadRequest, "invalid IP address: %s", req.IP)
+		return
+	}
+
+	st := loadState()
+	if st.router == nil || st.routed == nil {
+		httpError(r, w, http.StatusInternalServerError, "routing is disabled")
+		return
+	}
+
+	now := time.Now()
+	ttl := st.conf.TTLMax
+	err = st.router.Add(ip, "", ttl)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "couldn't add %s: %s", ip, err)
+		return
+	}
+
+	st.routed.set(&routedEntry{
+		IP:         ip.String(),
+		AddedAt:    now,
+		ExpiresAt:  now.Add(ttl),
+		dedupUntil: now.Add(ttl),
+	}, now)
+	log.Info("Worker: manually added %s", ip)
+}
+
+// Remove an address from the firewall set: DELETE /control/worker/routed/{ip}
+func handleRoutedRemove(w http.ResponseWriter, r *http.Request) {
+	s := strings.TrimPrefix(r.URL.Path, "/control/worker/routed/")
+	ip := net.ParseIP(s)
+	if ip == nil {
+		httpError(r, w, http.StatusBadRequest, "invalid IP address: %s", s)
+		return
+	}
+
+	st := loadState()
+	if st.router == nil || st.routed == nil {
+		httpError(r, w, http.StatusInternalServerError, "routing is disabled")
+		return
+	}
+
+	e, _ := st.routed.get(ip.String())
+	err := st.router.Remove(ip, e.Set)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "couldn't remove %s: %s", ip, err)
+		return
+	}
+
+	st.routed.remove(ip.String())
+	log.Info("Worker: manually removed %s", ip)
+}
+
+type domainJSON struct {
+	Domain string `json:"domain"`
+}
+
+// Return the list of routed domains
+func handleDomainsList(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(domains.List())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "http write: %s", err)
+	}
+}
+
+func decodeDomain(r *http.Request) (string, error) {
+	req := domainJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return "", fmt.Errorf("json.Decode: %s", err)
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(req.Domain), "."))
+	if len(host) == 0 {
+		return "", fmt.Errorf("domain is empty")
+	}
+	return host, nil
+}
+
+// saveDomains writes the domain list to the file if it's configured
+func saveDomains(r *http.Request, w http.ResponseWriter) {
+	fn := loadState().conf.DomainsFile
+	if len(fn) == 0 {
+		return
+	}
+	err := domains.Save(fn)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "couldn't save the domain list: %s", err)
+	}
+}
+
+// Add a domain to the list of routed domains
+func handleDomainsAdd(w http.ResponseWriter, r *http.Request) {
+	host, err := decodeDomain(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if !domains.Append(host) {
+		httpError(r, w, http.StatusBadRequest, "domain already exists: %s", host)
+		return
+	}
+	saveDomains(r, w)
+}
+
+// Remove a domain from the list of routed domains
+func handleDomainsRemove(w http.ResponseWriter, r *http.Request) {
+	host, err := decodeDomain(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if !domains.Remove(host) {
+		httpError(r, w, http.StatusBadRequest, "domain not found: %s", host)
+		return
+	}
+	saveDomains(r, w)
+}
+
+// Return the list of the addresses which are always routed
+func handleIPsList(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(allowedIPs.List())
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "http write: %s", err)
+	}
+}
+
+// decodeIPRule returns the address or the subnet from the request in the canonical form
+func decodeIPRule(r *http.Request) (string, error) {
+	req := ipJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return "", fmt.Errorf("json.Decode: %s", err)
+	}
+
+	s := strings.TrimSpace(req.IP)
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid subnet: %s", s)
+		}
+		return n.String(), nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address: %s", s)
+	}
+	return ip.String(), nil
+}
+
+// saveIPs writes the IP list to the file if it's configured
+func saveIPs(r *http.Request, w http.ResponseWriter) {
+	fn := loadState().conf.IPsFile
+	if len(fn) == 0 {
+		return
+	}
+	err := allowedIPs.Save(fn)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "couldn't save the IP list: %s", err)
+	}
+}
+
+// Add an address or a subnet to the list of the addresses which are always routed
+func handleIPsAdd(w http.ResponseWriter, r *http.Request) {
+	rule, err := decodeIPRule(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if !allowedIPs.Append(rule) {
+		httpError(r, w, http.StatusBadRequest, "IP already exists: %s", rule)
+		return
+	}
+	saveIPs(r, w)
+}
+
+// Remove an address or a subnet from the list of the addresses which are always routed
+func handleIPsRemove(w http.ResponseWriter, r *http.Request) {
+	rule, err := decodeIPRule(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if !allowedIPs.Remove(rule) {
+		httpError(r, w, http.StatusBadRequest, "IP not found: %s", rule)
+		return
+	}
+	saveIPs(r, w)
+}
+
+var webRegistered bool
+
+func registerHandlers(httpRegister func(string, string, func(http.ResponseWriter, *http.Request))) {
+	if webRegistered || httpRegister == nil {
+		return
+	}
+	webRegistered = true
+
+	httpRegister("GET", "/control/worker/routed", handleRoutedList)
+	httpRegister("POST", "/control/worker/routed", handleRoutedAdd)
+	httpRegister("DELETE", "/control/worker/routed/", handleRoutedRemove)
+
+	httpRegister("GET", "/control/worker/domains", handleDomainsList)
+	httpRegister("POST", "/control/worker/domains/add", handleDomainsAdd)
+	httpRegister("POST", "/control/worker/domains/remove", handleDomainsRemove)
+
+	httpRegister("GET", "/control/worker/ips", handleIPsList)
+	httpRegister("POST", "/control/worker/ips/add", handleIPsAdd)
+	httpRegister("POST", "/control/worker/ips/remove", handleIPsRemove)
+}
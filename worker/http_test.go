@@ -0,0 +1,138 @@
+package worker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleRouted(t *testing.T) {
+	r := prepareTestWorker(t, Config{})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/control/worker/routed", strings.NewReader(`{"ip":"1.2.3.4"}`))
+	handleRoutedAdd(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"1.2.3.4"}, r.added)
+	assert.True(t, routed.has("1.2.3.4", time.Now()))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/routed", strings.NewReader(`{"ip":"1.2.3"}`))
+	handleRoutedAdd(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/control/worker/routed?limit=10", nil)
+	handleRoutedList(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"ip":"1.2.3.4"`))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/control/worker/routed/1.2.3.4", nil)
+	handleRoutedRemove(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"1.2.3.4"}, r.removed)
+	assert.False(t, routed.has("1.2.3.4", time.Now()))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/control/worker/routed/bad", nil)
+	handleRoutedRemove(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandleRoutedDisabled(t *testing.T) {
+	_ = prepareTestWorker(t, Config{})
+	routed = nil
+	defer func() { routed = newRoutedCache() }()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/control/worker/routed", strings.NewReader(`{"ip":"1.2.3.4"}`))
+	handleRoutedAdd(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("DELETE", "/control/worker/routed/1.2.3.4", nil)
+	handleRoutedRemove(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestHandleDomains(t *testing.T) {
+	_ = prepareTestWorker(t, Config{DomainAllowlist: true})
+	domains = RuleManager{}
+
+	assert.False(t, conf.isRoutableDomain("example.com"))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/control/worker/domains/add", strings.NewReader(`{"domain":"Example.com."}`))
+	handleDomainsAdd(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, conf.isRoutableDomain("example.com"))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/domains/add", strings.NewReader(`{"domain":"example.com"}`))
+	handleDomainsAdd(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/control/worker/domains", nil)
+	handleDomainsList(w, req)
+	assert.Equal(t, `["example.com"]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/domains/remove", strings.NewReader(`{"domain":"example.com"}`))
+	handleDomainsRemove(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, conf.isRoutableDomain("example.com"))
+
+	// all domains are routable if the allowlist is disabled
+	conf.DomainAllowlist = false
+	assert.True(t, conf.isRoutableDomain("example.com"))
+}
+
+func TestHandleIPs(t *testing.T) {
+	_ = prepareTestWorker(t, Config{})
+	allowedIPs = RuleManager{}
+	defer func() { allowedIPs = RuleManager{} }()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/control/worker/ips/add", strings.NewReader(`{"ip":"5.6.7.8/24"}`))
+	handleIPsAdd(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, allowedIPs.MatchIP(net.IP{5, 6, 7, 1}))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/ips/add", strings.NewReader(`{"ip":"5.6.7.0/24"}`))
+	handleIPsAdd(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/ips/add", strings.NewReader(`{"ip":"1.2.3"}`))
+	handleIPsAdd(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/ips/add", strings.NewReader(`{"ip":"1.2.3.4"}`))
+	handleIPsAdd(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/control/worker/ips", nil)
+	handleIPsList(w, req)
+	assert.Equal(t, `["1.2.3.4","5.6.7.0/24"]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/ips/remove", strings.NewReader(`{"ip":"5.6.7.0/24"}`))
+	handleIPsRemove(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, allowedIPs.MatchIP(net.IP{5, 6, 7, 1}))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/control/worker/ips/remove", strings.NewReader(`{"ip":"5.6.7.0/24"}`))
+	handleIPsRemove(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Routing actions
+const (
+	actionRoute    = "route"     // the address is added to the firewall set
+	actionRemove   = "remove"    // the address is removed because the domain is local now
+	actionGeoError = "geo_error" // the address couldn't be looked up
+)
+
+// routeEvent is a routing decision written to the log
+type routeEvent struct {
+	action   string
+	domain   string
+	ip       net.IP
+	country  string
+	set      string // empty: the default set
+	filterID int64
+	client   net.IP // nil: unknown
+	err      error
+}
+
+// logEvent writes the event in the configured format.
+// Failed events are logged as errors.
+func logEvent(ev routeEvent) {
+	stateLock.RLock()
+	format := conf.LogFormat
+	stateLock.RUnlock()
+
+	var s string
+	if format == "text" {
+		s = ev.text()
+	} else {
+		s = ev.kv()
+	}
+
+	if ev.err != nil {
+		log.Error("%s", s)
+		return
+	}
+	log.Info("%s", s)
+}
+
+// kv returns the event as "key=value" pairs, e.g.:
+// worker: action=route domain=example.org ip=1.2.3.4 country=US filter_id=10 client=192.168.1.2
+func (ev *routeEvent) kv() string {
+	b := strings.Builder{}
+	b.WriteString("worker:")
+	add := func(k, v string) {
+		if len(v) == 0 {
+			return
+		}
+		if strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+
+	add("action", ev.action)
+	add("domain", ev.domain)
+	add("ip", ev.ip.String())
+	add("country", ev.country)
+	add("set", ev.set)
+	add("filter_id", strconv.FormatInt(ev.filterID, 10))
+	if ev.client != nil {
+		add("client", ev.client.String())
+	}
+	if ev.err != nil {
+		add("error", ev.err.Error())
+	}
+	return b.String()
+}
+
+// text returns the event in a human-readable form
+func (ev *routeEvent) text() string {
+	switch ev.action {
+	case actionGeoError:
+		return fmt.Sprintf("geo lookup error:%s=>%s %s", ev.domain, ev.ip, ev.err)
+
+	case actionRemove:
+		if ev.err != nil {
+			return fmt.Sprintf("cmd error:%s=>%s remove %s", ev.domain, ev.ip, ev.err)
+		}
+		return fmt.Sprintf("remove %s=>%s: the domain is local now", ev.domain, ev.ip)
+	}
+
+	if ev.err != nil {
+		return fmt.Sprintf("cmd error:%s=>%s do %s", ev.domain, ev.ip, ev.err)
+	}
+	if len(ev.set) != 0 {
+		return fmt.Sprintf("setup %s=>%s location %s set %s", ev.domain, ev.ip, ev.country, ev.set)
+	}
+	return fmt.Sprintf("setup %s=>%s location %s", ev.domain, ev.ip, ev.country)
+}
@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteEvent(t *testing.T) {
+	ev := routeEvent{
+		action:   actionRoute,
+		domain:   "example.org",
+		ip:       net.IP{1, 2, 3, 4},
+		country:  "US",
+		filterID: 10,
+	}
+	assert.Equal(t, "worker: action=route domain=example.org ip=1.2.3.4 country=US filter_id=10", ev.kv())
+	assert.Equal(t, "setup example.org=>1.2.3.4 location US", ev.text())
+
+	ev.set = "video"
+	ev.country = "United States"
+	assert.Equal(t, `worker: action=route domain=example.org ip=1.2.3.4 country="United States" set=video filter_id=10`, ev.kv())
+	assert.Equal(t, "setup example.org=>1.2.3.4 location United States set video", ev.text())
+
+	ev.client = net.IP{192, 168, 1, 2}
+	assert.Equal(t, `worker: action=route domain=example.org ip=1.2.3.4 country="United States" set=video filter_id=10 client=192.168.1.2`, ev.kv())
+
+	ev = routeEvent{
+		action:   actionRemove,
+		domain:   "example.org",
+		ip:       net.IP{1, 2, 3, 4},
+		filterID: 10,
+		err:      errors.New("exit status 1"),
+	}
+	assert.Equal(t, `worker: action=remove domain=example.org ip=1.2.3.4 filter_id=10 error="exit status 1"`, ev.kv())
+	assert.Equal(t, "cmd error:example.org=>1.2.3.4 remove exit status 1", ev.text())
+}
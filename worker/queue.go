@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"net"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// dnsResult is a DNS answer waiting for processing
+type dnsResult struct {
+	qname    string   // the name the client asked for (lower case, without the last dot)
+	answers  []dns.RR // answer section
+	filterID int64    // ID of the filter list which whitelisted the request
+	client   net.IP   // address of the client which sent the request
+}
+
+// resultQueue processes DNS results in a background goroutine,
+// so that geo lookups and firewall commands don't delay DNS responses.
+// If the queue is full, the new results are dropped.
+type resultQueue struct {
+	ch      chan dnsResult
+	process func(dnsResult)
+
+	lock    sync.Mutex
+	closed  bool
+	dropped uint64 // number of dropped results since the last report
+	total   uint64 // total number of dropped results
+	done    chan struct{}
+}
+
+func newResultQueue(size int, process func(dnsResult)) *resultQueue {
+	q := &resultQueue{
+		ch:      make(chan dnsResult, size),
+		process: process,
+		done:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues the result;  it never blocks
+// Returns FALSE if the result is dropped.
+func (q *resultQueue) push(r dnsResult) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.ch <- r:
+		return true
+	default:
+		q.dropped++
+		q.total++
+		return false
+	}
+}
+
+// close processes the queued results and stops the goroutine
+func (q *resultQueue) close() {
+	q.shutdown()
+	<-q.done
+}
+
+// shutdown stops accepting new results.  The queued results are still processed.
+func (q *resultQueue) shutdown() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.ch)
+}
+
+func (q *resultQueue) run() {
+	defer close(q.done)
+	for r := range q.ch {
+		q.process(r)
+
+		q.lock.Lock()
+		if q.dropped != 0 {
+			log.Info("worker: queue is full, dropped %d results", q.dropped)
+			q.dropped = 0
+		}
+		q.lock.Unlock()
+	}
+}
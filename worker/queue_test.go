@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultQueue(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	lock := sync.Mutex{}
+	processed := []string{}
+	q := newResultQueue(2, func(r dnsResult) {
+		if r.qname == "block" {
+			close(started)
+			<-release
+		}
+		lock.Lock()
+		processed = append(processed, r.qname)
+		lock.Unlock()
+	})
+
+	// the goroutine is busy: the queue is filled up, then the results are dropped
+	assert.True(t, q.push(dnsResult{qname: "block"}))
+	<-started
+	assert.True(t, q.push(dnsResult{qname: "a"}))
+	assert.True(t, q.push(dnsResult{qname: "b"}))
+	assert.False(t, q.push(dnsResult{qname: "c"}))
+	assert.Equal(t, uint64(1), q.total)
+
+	// the queued results are processed on close
+	close(release)
+	q.close()
+	assert.Equal(t, []string{"block", "a", "b"}, processed)
+
+	assert.False(t, q.push(dnsResult{qname: "d"}))
+	q.close()
+}
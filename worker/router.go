@@ -0,0 +1,277 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Router adds IP addresses to the firewall sets and removes them from them.
+// If set is empty, the default set from the backend configuration is used.
+type Router interface {
+	Add(ip net.IP, set string, ttl time.Duration) error
+	Remove(ip net.IP, set string) error
+}
+
+// batchRouter is a Router which is able to add several addresses with one command
+type batchRouter interface {
+	AddBatch(entries []entry) error
+}
+
+// NFTConfig - nftables settings
+type NFTConfig struct {
+	Table   string        `yaml:"table"`   // table name, e.g. "gfw"
+	Set     string        `yaml:"set"`     // set name, e.g. "temp"
+	Timeout time.Duration `yaml:"timeout"` // lifetime of an element in the set
+}
+
+// IPSetConfig - ipset settings
+type IPSetConfig struct {
+	Set     string        `yaml:"set"`     // set name for IPv4 addresses
+	Set6    string        `yaml:"set6"`    // set name for IPv6 addresses (if empty, Set is used)
+	Timeout time.Duration `yaml:"timeout"` // lifetime of an entry in the set
+}
+
+// entryRouter is a Router which needs the domain and the country of the address
+type entryRouter interface {
+	addEntry(e entry) error
+}
+
+// newRouter creates a Router for the configured backend.
+// If AddCommand is set, it's used to add the addresses instead of the backend.
+func newRouter(c *Config) (Router, error) {
+	r, err := newBackendRouter(c)
+	if err != nil || len(c.AddCommand) == 0 {
+		return r, err
+	}
+	if len(c.AddCommand[0]) == 0 {
+		return nil, fmt.Errorf("add_command: program name is empty")
+	}
+	return &commandRouter{args: c.AddCommand, backend: r}, nil
+}
+
+// newBackendRouter creates a Router for the configured backend
+func newBackendRouter(c *Config) (Router, error) {
+	switch c.Backend {
+	case "", "nft":
+		err := c.NFT.validate()
+		if err != nil {
+			return nil, err
+		}
+		return &nftRouter{conf: c.NFT}, nil
+
+	case "netlink":
+		err := c.NFT.validate()
+		if err != nil {
+			return nil, err
+		}
+		return newNetlinkRouter(c.NFT)
+
+	case "ipset":
+		err := c.IPSet.validate()
+		if err != nil {
+			return nil, err
+		}
+		return &ipsetRouter{conf: c.IPSet}, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend: %s", c.Backend)
+}
+
+// timeout returns the element lifetime for the configured backend
+func (c *Config) timeout() time.Duration {
+	if c.Backend == "ipset" {
+		return c.IPSet.Timeout
+	}
+	return c.NFT.Timeout
+}
+
+// nftRouter adds elements to an nftables set by running "nft"
+type nftRouter struct {
+	conf NFTConfig
+}
+
+func (r *nftRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	cmd := exec.Command("nft", nftArgs(&r.conf, set, ip, ttl)...)
+	return cmd.Run()
+}
+
+func (r *nftRouter) Remove(ip net.IP, set string) error {
+	cmd := exec.Command("nft", nftDeleteArgs(&r.conf, set, ip)...)
+	return cmd.Run()
+}
+
+// AddBatch adds all entries with a single "nft" command per address family and set
+func (r *nftRouter) AddBatch(entries []entry) error {
+	type key struct {
+		family string
+		set    string
+	}
+	var keys []key
+	groups := map[key][]entry{}
+	for _, e := range entries {
+		k := key{family: nftFamily(e.ip), set: e.set}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], e)
+	}
+
+	for _, k := range keys {
+		cmd := exec.Command("nft", nftBatchArgs(&r.conf, k.set, groups[k])...)
+		err := cmd.Run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setName returns the name of the set: the default one if set is empty
+func (c *NFTConfig) setName(set string) string {
+	if len(set) == 0 {
+		return c.Set
+	}
+	return set
+}
+
+// nftBatchArgs returns the arguments for "nft" which add all entries to the set.
+// All entries must belong to the same address family.
+func nftBatchArgs(c *NFTConfig, set string, entries []entry) []string {
+	args := []string{"add", "element", nftFamily(entries[0].ip), c.Table, c.setName(set), "{"}
+	for i, e := range entries {
+		if i != 0 {
+			args = append(args, ",")
+		}
+		args = append(args, e.ip.String(), "timeout", formatTimeout(e.ttl))
+	}
+	return append(args, "}")
+}
+
+// nftArgs returns the arguments for "nft" which add ip to the set.
+// IPv6 addresses are added to the table of "ip6" family.
+func nftArgs(c *NFTConfig, set string, ip net.IP, ttl time.Duration) []string {
+	return []string{"add", "element", nftFamily(ip), c.Table, c.setName(set), "{", ip.String(), "timeout", formatTimeout(ttl), "}"}
+}
+
+// nftDeleteArgs returns the arguments for "nft" which remove ip from the set
+func nftDeleteArgs(c *NFTConfig, set string, ip net.IP) []string {
+	return []string{"delete", "element", nftFamily(ip), c.Table, c.setName(set), "{", ip.String(), "}"}
+}
+
+func nftFamily(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// formatTimeout converts duration to the nft time format, e.g. "24h", "1h30m"
+func formatTimeout(d time.Duration) string {
+	s := d.Truncate(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func (c *NFTConfig) validate() error {
+	if len(c.Table) == 0 {
+		return fmt.Errorf("nft table name is empty")
+	}
+	if len(c.Set) == 0 {
+		return fmt.Errorf("nft set name is empty")
+	}
+	if c.Timeout < time.Second {
+		return fmt.Errorf("nft timeout must be at least 1s")
+	}
+	return nil
+}
+
+// ipsetRouter adds entries to an ipset by running "ipset"
+type ipsetRouter struct {
+	conf IPSetConfig
+}
+
+func (r *ipsetRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	cmd := exec.Command("ipset", ipsetArgs(&r.conf, set, ip, ttl)...)
+	return cmd.Run()
+}
+
+func (r *ipsetRouter) Remove(ip net.IP, set string) error {
+	cmd := exec.Command("ipset", "del", r.conf.setName(set, ip), ip.String(), "-exist")
+	return cmd.Run()
+}
+
+// setName returns the name of the set for this address family.
+// A non-empty set is used for both families.
+func (c *IPSetConfig) setName(set string, ip net.IP) string {
+	if len(set) != 0 {
+		return set
+	}
+	if ip.To4() == nil && len(c.Set6) != 0 {
+		return c.Set6
+	}
+	return c.Set
+}
+
+func (c *IPSetConfig) validate() error {
+	if len(c.Set) == 0 {
+		return fmt.Errorf("ipset set name is empty")
+	}
+	if c.Timeout < time.Second {
+		return fmt.Errorf("ipset timeout must be at least 1s")
+	}
+	return nil
+}
+
+// ipsetArgs returns the arguments for "ipset" which add ip to the set
+func ipsetArgs(c *IPSetConfig, set string, ip net.IP, ttl time.Duration) []string {
+	sec := int64(ttl / time.Second)
+	return []string{"add", c.setName(set, ip), ip.String(), "timeout", strconv.FormatInt(sec, 10), "-exist"}
+}
+
+// commandRouter adds the addresses by running the user's command.
+// The addresses are removed by the backend.
+type commandRouter struct {
+	args    []string // command with placeholders
+	backend Router
+}
+
+func (r *commandRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	return r.addEntry(entry{ip: ip, set: set, ttl: ttl})
+}
+
+func (r *commandRouter) addEntry(e entry) error {
+	args := commandArgs(r.args, e)
+	// the arguments are passed to the program as is, there's no shell to interpret them
+	cmd := exec.Command(args[0], args[1:]...)
+	return cmd.Run()
+}
+
+func (r *commandRouter) Remove(ip net.IP, set string) error {
+	return r.backend.Remove(ip, set)
+}
+
+// commandArgs replaces the placeholders in the command arguments with the values of the entry:
+// {ip}, {domain}, {country}, {set} (empty for the default set) and {ttl} (in seconds)
+func commandArgs(tmpl []string, e entry) []string {
+	rep := strings.NewReplacer(
+		"{ip}", e.ip.String(),
+		"{domain}", e.domain,
+		"{country}", e.country,
+		"{set}", e.set,
+		"{ttl}", strconv.FormatInt(int64(e.ttl/time.Second), 10),
+	)
+	args := make([]string, len(tmpl))
+	for i, a := range tmpl {
+		args[i] = rep.Replace(a)
+	}
+	return args
+}
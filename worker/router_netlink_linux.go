@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// netlinkRouter adds elements to an nftables set via netlink without running "nft"
+type netlinkRouter struct {
+	conf NFTConfig
+
+	// conn queues the messages until Flush(),
+	//  so the lock is held from the first queued message through Flush()
+	lock sync.Mutex
+	conn *nftables.Conn
+	sets map[string]*nftables.Set // "family/set" -> set
+}
+
+func newNetlinkRouter(c NFTConfig) (Router, error) {
+	return &netlinkRouter{conf: c, conn: &nftables.Conn{}, sets: map[string]*nftables.Set{}}, nil
+}
+
+// reset drops the queued messages and the error of the failed batch,
+// so they don't get into the next Flush().
+// Called with the lock held.
+func (r *netlinkRouter) reset() {
+	r.conn = &nftables.Conn{TestDial: r.conn.TestDial, NetNS: r.conn.NetNS}
+}
+
+// getSet returns the set for this address family.  The sets are looked up once.
+// Called with the lock held.
+func (r *netlinkRouter) getSet(ip net.IP, set string) (*nftables.Set, error) {
+	family := nftables.TableFamilyIPv4
+	if ip.To4() == nil {
+		family = nftables.TableFamilyIPv6
+	}
+	name := r.conf.setName(set)
+	key := fmt.Sprintf("%d/%s", family, name)
+
+	s, ok := r.sets[key]
+	if ok {
+		return s, nil
+	}
+
+	s, err := r.conn.GetSetByName(&nftables.Table{Name: r.conf.Table, Family: family}, name)
+	if err != nil {
+		return nil, fmt.Errorf("nft set %s %s: %s", r.conf.Table, name, err)
+	}
+	// the elements are always added with a timeout, like "nft add element ... timeout"
+	s.HasTimeout = true
+	r.sets[key] = s
+	return s, nil
+}
+
+func (r *netlinkRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	return r.addElements(set, []entry{{ip: ip, ttl: ttl}})
+}
+
+func (r *netlinkRouter) Remove(ip net.IP, set string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s, err := r.getSet(ip, set)
+	if err != nil {
+		return err
+	}
+	err = r.conn.SetDeleteElements(s, []nftables.SetElement{{Key: nftKey(ip)}})
+	if err != nil {
+		r.reset()
+		return err
+	}
+	return r.conn.Flush()
+}
+
+// AddBatch adds all entries with a single netlink batch
+func (r *netlinkRouter) AddBatch(entries []entry) error {
+	groups := map[string][]entry{}
+	var sets []string
+	for _, e := range entries {
+		if _, ok := groups[e.set]; !ok {
+			sets = append(sets, e.set)
+		}
+		groups[e.set] = append(groups[e.set], e)
+	}
+
+	for _, set := range sets {
+		err := r.addElements(set, groups[set])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addElements adds the entries to the set and sends the batch.
+// The sets are looked up before any element is queued,
+// so nothing is left in the queue if one of them doesn't exist.
+func (r *netlinkRouter) addElements(set string, entries []entry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sets := make([]*nftables.Set, len(entries))
+	for i, e := range entries {
+		s, err := r.getSet(e.ip, set)
+		if err != nil {
+			return err
+		}
+		sets[i] = s
+	}
+
+	for i, e := range entries {
+		elem := nftables.SetElement{Key: nftKey(e.ip), Timeout: e.ttl.Truncate(time.Second)}
+		err := r.conn.SetAddElements(sets[i], []nftables.SetElement{elem})
+		if err != nil {
+			r.reset()
+			return err
+		}
+	}
+	return r.conn.Flush()
+}
+
+// nftKey returns the element key: 4 bytes for IPv4 and 16 bytes for IPv6
+func nftKey(ip net.IP) []byte {
+	ip4 := ip.To4()
+	if ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
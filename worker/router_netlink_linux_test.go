@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkRouter(t *testing.T) {
+	c := Config{
+		Backend: "netlink",
+		NFT:     NFTConfig{Table: "gfw", Set: "temp", Timeout: time.Hour},
+	}
+	r, err := newRouter(&c)
+	assert.Nil(t, err)
+	_, ok := r.(*netlinkRouter)
+	assert.True(t, ok)
+
+	c.NFT.Table = ""
+	_, err = newRouter(&c)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 4, len(nftKey(net.ParseIP("1.2.3.4"))))
+	assert.Equal(t, 16, len(nftKey(net.ParseIP("::1"))))
+}
+
+func TestNetlinkRouterFailedBatch(t *testing.T) {
+	var sent []netlink.Message
+	conn := &nftables.Conn{TestDial: func(req []netlink.Message) ([]netlink.Message, error) {
+		sent = append(sent, req...)
+		if req[0].Header.Type == netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES<<8)|unix.NFT_MSG_GETSET) {
+			return nil, fmt.Errorf("no such set")
+		}
+		return req, nil
+	}}
+	r := &netlinkRouter{conf: NFTConfig{Table: "gfw", Set: "temp"}, conn: conn, sets: map[string]*nftables.Set{}}
+	// only IPv4 set is known
+	r.sets[fmt.Sprintf("%d/temp", nftables.TableFamilyIPv4)] = &nftables.Set{
+		Table:   &nftables.Table{Name: "gfw", Family: nftables.TableFamilyIPv4},
+		Name:    "temp",
+		KeyType: nftables.TypeIPAddr,
+	}
+
+	err := r.AddBatch([]entry{
+		{ip: net.ParseIP("1.1.1.1"), ttl: time.Hour},
+		{ip: net.ParseIP("::1"), ttl: time.Hour},
+	})
+	assert.NotNil(t, err)
+
+	sent = nil
+	assert.Nil(t, r.Add(net.ParseIP("2.2.2.2"), "", time.Hour))
+	n := 0
+	for _, m := range sent {
+		if m.Header.Type == netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES<<8)|unix.NFT_MSG_NEWSETELEM) {
+			n++
+		}
+	}
+	// 1.1.1.1 from the failed batch isn't sent
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package worker
+
+import (
+	"fmt"
+)
+
+func newNetlinkRouter(c NFTConfig) (Router, error) {
+	return nil, fmt.Errorf("netlink backend is supported only on Linux")
+}
@@ -0,0 +1,127 @@
+package worker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNFTArgs(t *testing.T) {
+	c := NFTConfig{
+		Table:   "proxy",
+		Set:     "bypass",
+		Timeout: 30 * time.Minute,
+	}
+	assert.Nil(t, c.validate())
+
+	args := nftArgs(&c, "", net.ParseIP("1.2.3.4"), c.Timeout)
+	assert.Equal(t, []string{"add", "element", "ip", "proxy", "bypass", "{", "1.2.3.4", "timeout", "30m", "}"}, args)
+
+	args = nftArgs(&c, "", net.ParseIP("::1"), c.Timeout)
+	assert.Equal(t, []string{"add", "element", "ip6", "proxy", "bypass", "{", "::1", "timeout", "30m", "}"}, args)
+
+	args = nftDeleteArgs(&c, "", net.ParseIP("1.2.3.4"))
+	assert.Equal(t, []string{"delete", "element", "ip", "proxy", "bypass", "{", "1.2.3.4", "}"}, args)
+
+	args = nftArgs(&c, "video", net.ParseIP("1.2.3.4"), c.Timeout)
+	assert.Equal(t, []string{"add", "element", "ip", "proxy", "video", "{", "1.2.3.4", "timeout", "30m", "}"}, args)
+
+	args = nftDeleteArgs(&c, "video", net.ParseIP("1.2.3.4"))
+	assert.Equal(t, []string{"delete", "element", "ip", "proxy", "video", "{", "1.2.3.4", "}"}, args)
+
+	c.Set = ""
+	assert.NotNil(t, c.validate())
+}
+
+func TestNFTBatchArgs(t *testing.T) {
+	c := NFTConfig{Table: "gfw", Set: "temp"}
+	entries := []entry{
+		{ip: net.ParseIP("1.2.3.4"), ttl: 24 * time.Hour},
+		{ip: net.ParseIP("5.6.7.8"), ttl: time.Hour},
+	}
+
+	args := nftBatchArgs(&c, "", entries)
+	assert.Equal(t, []string{"add", "element", "ip", "gfw", "temp", "{",
+		"1.2.3.4", "timeout", "24h", ",",
+		"5.6.7.8", "timeout", "1h", "}"}, args)
+}
+
+func TestFormatTimeout(t *testing.T) {
+	assert.Equal(t, "24h", formatTimeout(24*time.Hour))
+	assert.Equal(t, "30m", formatTimeout(30*time.Minute))
+	assert.Equal(t, "1h30m", formatTimeout(90*time.Minute))
+	assert.Equal(t, "1m30s", formatTimeout(90*time.Second))
+	assert.Equal(t, "45s", formatTimeout(45*time.Second+time.Millisecond))
+}
+
+func TestIPSetArgs(t *testing.T) {
+	c := IPSetConfig{Set: "bypass"}
+
+	args := ipsetArgs(&c, "", net.ParseIP("1.2.3.4"), time.Hour)
+	assert.Equal(t, []string{"add", "bypass", "1.2.3.4", "timeout", "3600", "-exist"}, args)
+
+	args = ipsetArgs(&c, "", net.ParseIP("::1"), time.Hour)
+	assert.Equal(t, "bypass", args[1])
+
+	c.Set6 = "bypass6"
+	args = ipsetArgs(&c, "", net.ParseIP("::1"), time.Hour)
+	assert.Equal(t, "bypass6", args[1])
+
+	args = ipsetArgs(&c, "video", net.ParseIP("::1"), time.Hour)
+	assert.Equal(t, "video", args[1])
+}
+
+func TestNewRouter(t *testing.T) {
+	c := Config{
+		NFT: NFTConfig{Table: "gfw", Set: "temp", Timeout: time.Hour},
+	}
+	r, err := newRouter(&c)
+	assert.Nil(t, err)
+	_, ok := r.(*nftRouter)
+	assert.True(t, ok)
+
+	c.Backend = "ipset"
+	_, err = newRouter(&c)
+	assert.NotNil(t, err)
+
+	c.IPSet.Set = "bypass"
+	c.IPSet.Timeout = time.Hour
+	r, err = newRouter(&c)
+	assert.Nil(t, err)
+	_, ok = r.(*ipsetRouter)
+	assert.True(t, ok)
+
+	c.Backend = "iptables"
+	_, err = newRouter(&c)
+	assert.NotNil(t, err)
+}
+
+func TestCommandArgs(t *testing.T) {
+	e := entry{ip: net.ParseIP("1.2.3.4"), ttl: 90 * time.Minute, domain: "example.org", country: "US", set: "video"}
+	args := commandArgs([]string{"/usr/bin/route-add", "--ip={ip}", "{domain}", "{country}", "{set}", "{ttl}", "{unknown}"}, e)
+	assert.Equal(t, []string{"/usr/bin/route-add", "--ip=1.2.3.4", "example.org", "US", "video", "5400", "{unknown}"}, args)
+
+	// the values aren't interpreted by a shell and aren't substituted again
+	e.domain = "$(reboot); {ip}"
+	args = commandArgs([]string{"route-add", "{domain} {ip}"}, e)
+	assert.Equal(t, []string{"route-add", "$(reboot); {ip} 1.2.3.4"}, args)
+}
+
+func TestNewCommandRouter(t *testing.T) {
+	c := Config{
+		NFT:        NFTConfig{Table: "gfw", Set: "temp", Timeout: time.Hour},
+		AddCommand: []string{"route-add", "{ip}"},
+	}
+	r, err := newRouter(&c)
+	assert.Nil(t, err)
+	cr, ok := r.(*commandRouter)
+	assert.True(t, ok)
+	_, ok = cr.backend.(*nftRouter)
+	assert.True(t, ok)
+
+	c.AddCommand = []string{""}
+	_, err = newRouter(&c)
+	assert.NotNil(t, err)
+}
@@ -1,50 +1,187 @@
 package worker
 
 import (
+	"io/ioutil"
+	"net"
 	"sort"
+	"strings"
 	"sync"
+
+	"github.com/AdguardTeam/golibs/file"
 )
 
 // RuleManager rule list
 type RuleManager struct {
 	items []string
-	size  int
+	nets  []*net.IPNet // the addresses and the subnets from items, for MatchIP()
 
 	lock sync.RWMutex
 }
 
+// index returns the position of item in the list or -1 if it's not found.
+// The caller must hold the lock.
+func (rules *RuleManager) index(item string) int {
+	index := sort.SearchStrings(rules.items, item)
+	if index == len(rules.items) || rules.items[index] != item {
+		return -1
+	}
+	return index
+}
+
 // Has check rule in list
 func (rules *RuleManager) Has(item string) bool {
-	return sort.SearchStrings(rules.items, item) != rules.size
+	rules.lock.RLock()
+	defer rules.lock.RUnlock()
+
+	return rules.index(item) != -1
+}
+
+// Match checks whether host is in the list or matches a wildcard rule.
+// A rule "*.example.com" matches any subdomain of example.com, but not example.com itself.
+func (rules *RuleManager) Match(host string) bool {
+	rules.lock.RLock()
+	defer rules.lock.RUnlock()
+
+	if rules.index(host) != -1 {
+		return true
+	}
+
+	// wildcard rules are placed together in the sorted list
+	for i := sort.SearchStrings(rules.items, "*."); i < len(rules.items); i++ {
+		rule := rules.items[i]
+		if !strings.HasPrefix(rule, "*.") {
+			break
+		}
+		if strings.HasSuffix(host, rule[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchIP checks whether ip is in the list or belongs to a subnet from the list.
+// The rules which are neither addresses nor subnets in CIDR notation are ignored.
+func (rules *RuleManager) MatchIP(ip net.IP) bool {
+	rules.lock.RLock()
+	defer rules.lock.RUnlock()
+
+	for _, n := range rules.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRuleNets returns the addresses and the subnets from the rules.
+// An address is returned as a subnet with the full mask.
+func parseRuleNets(items []string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, rule := range items {
+		if strings.Contains(rule, "/") {
+			_, n, err := net.ParseCIDR(rule)
+			if err == nil {
+				nets = append(nets, n)
+			}
+			continue
+		}
+
+		ip := net.ParseIP(rule)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets
 }
 
 // Append append a rule
 func (rules *RuleManager) Append(item string) bool {
-	if rules.Has(item) {
+	rules.lock.Lock()
+	defer rules.lock.Unlock()
+
+	if rules.index(item) != -1 {
 		return false
 	}
 
-	rules.lock.Lock()
-
 	rules.items = append(rules.items, item)
 	sort.Strings(rules.items)
-
-	rules.lock.Unlock()
+	rules.nets = append(rules.nets, parseRuleNets([]string{item})...)
 	return true
 }
 
 // Remove remove a rule
 func (rules *RuleManager) Remove(item string) bool {
-	index := sort.SearchStrings(rules.items, item)
-	if index == rules.size {
+	rules.lock.Lock()
+	defer rules.lock.Unlock()
+
+	index := rules.index(item)
+	if index == -1 {
 		return false
 	}
 
-	rules.lock.Lock()
-
 	rules.items = append(rules.items[:index], rules.items[index+1:]...)
 	// sort.Strings(rules.items) order no change
+	rules.nets = parseRuleNets(rules.items)
+	return true
+}
+
+// List returns a copy of the rules
+func (rules *RuleManager) List() []string {
+	rules.lock.RLock()
+	defer rules.lock.RUnlock()
+
+	items := make([]string, len(rules.items))
+	copy(items, rules.items)
+	return items
+}
+
+// Save writes the rules to a file, one per line
+func (rules *RuleManager) Save(path string) error {
+	rules.lock.RLock()
+	data := strings.Join(rules.items, "\n")
+	rules.lock.RUnlock()
 
+	if len(data) != 0 {
+		data += "\n"
+	}
+	return file.SafeWrite(path, []byte(data))
+}
+
+// Load replaces the rules with the ones from a file written by Save
+func (rules *RuleManager) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	items := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) != 0 {
+			items = append(items, line)
+		}
+	}
+	sort.Strings(items)
+
+	// remove duplicates
+	n := 0
+	for i, item := range items {
+		if i == 0 || item != items[n-1] {
+			items[n] = item
+			n++
+		}
+	}
+
+	nets := parseRuleNets(items[:n])
+
+	rules.lock.Lock()
+	rules.items = items[:n]
+	rules.nets = nets
 	rules.lock.Unlock()
-	return true
+	return nil
 }
@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleManagerHas(t *testing.T) {
+	rules := RuleManager{}
+	for _, s := range []string{"c.com", "a.com", "e.com"} {
+		assert.True(t, rules.Append(s))
+	}
+
+	testCases := []struct {
+		name string
+		item string
+		has  bool
+	}{
+		{"first", "a.com", true},
+		{"middle", "c.com", true},
+		{"last", "e.com", true},
+		{"absent_before_first", "0.com", false},
+		{"absent_middle", "b.com", false},
+		{"absent_after_last", "f.com", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.has, rules.Has(tc.item))
+		})
+	}
+
+	assert.False(t, rules.Append("a.com"))
+	assert.False(t, (&RuleManager{}).Has("a.com"))
+}
+
+func TestRuleManagerConcurrent(t *testing.T) {
+	rules := RuleManager{}
+	items := []string{"a.com", "b.com", "c.com", "d.com"}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i != 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j != 100; j++ {
+				item := items[(i+j)%len(items)]
+				rules.Append(item)
+				rules.Has(item)
+				rules.Remove(item)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// no duplicates are possible
+	for _, item := range items {
+		rules.Append(item)
+		rules.Append(item)
+	}
+	assert.Equal(t, len(items), len(rules.items))
+}
+
+func TestRuleManagerRemove(t *testing.T) {
+	// empty list
+	rules := RuleManager{}
+	assert.False(t, rules.Remove("a.com"))
+	assert.Equal(t, 0, len(rules.items))
+
+	// the only item
+	assert.True(t, rules.Append("a.com"))
+	assert.True(t, rules.Remove("a.com"))
+	assert.Equal(t, 0, len(rules.items))
+	assert.False(t, rules.Remove("a.com"))
+
+	// missing item: the list stays unmodified
+	for _, s := range []string{"a.com", "c.com", "e.com"} {
+		assert.True(t, rules.Append(s))
+	}
+	assert.False(t, rules.Remove("b.com"))
+	assert.False(t, rules.Remove("0.com"))
+	assert.False(t, rules.Remove("f.com"))
+	assert.Equal(t, []string{"a.com", "c.com", "e.com"}, rules.items)
+
+	assert.True(t, rules.Remove("c.com"))
+	assert.Equal(t, []string{"a.com", "e.com"}, rules.items)
+}
+
+func TestRuleManagerSaveLoad(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "rules.txt")
+
+	rules := RuleManager{}
+	for _, s := range []string{"c.com", "a.com", "b.com"} {
+		assert.True(t, rules.Append(s))
+	}
+	assert.Nil(t, rules.Save(fn))
+
+	rules2 := RuleManager{}
+	assert.Nil(t, rules2.Load(fn))
+	assert.Equal(t, []string{"a.com", "b.com", "c.com"}, rules2.items)
+	assert.True(t, rules2.Has("b.com"))
+
+	// unsorted file with duplicates and empty lines
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("z.com\n\na.com\r\nz.com\n"), 0644))
+	assert.Nil(t, rules2.Load(fn))
+	assert.Equal(t, []string{"a.com", "z.com"}, rules2.items)
+
+	assert.NotNil(t, rules2.Load(filepath.Join(dir, "missing.txt")))
+}
+
+func prepareTestDir() string {
+	const dir = "./agh-test"
+	_ = os.RemoveAll(dir)
+	_ = os.MkdirAll(dir, 0755)
+	return dir
+}
+
+func TestRuleManagerMatch(t *testing.T) {
+	rules := RuleManager{}
+	for _, s := range []string{"exact.com", "*.example.com", "*.b.org", "a.net"} {
+		assert.True(t, rules.Append(s))
+	}
+
+	assert.True(t, rules.Match("exact.com"))
+	assert.False(t, rules.Match("sub.exact.com"))
+
+	assert.True(t, rules.Match("www.example.com"))
+	assert.True(t, rules.Match("a.b.example.com"))
+	assert.False(t, rules.Match("example.com"))
+	assert.False(t, rules.Match("badexample.com"))
+
+	assert.True(t, rules.Match("x.b.org"))
+	assert.True(t, rules.Match("a.net"))
+	assert.False(t, rules.Match("b.net"))
+}
+
+func TestRuleManagerMatchIP(t *testing.T) {
+	rules := RuleManager{}
+	for _, s := range []string{"1.2.3.4", "5.6.7.0/24", "2001:db8::/32", "example.com"} {
+		assert.True(t, rules.Append(s))
+	}
+
+	assert.True(t, rules.MatchIP(net.IP{1, 2, 3, 4}))
+	assert.True(t, rules.MatchIP(net.IP{5, 6, 7, 8}))
+	assert.True(t, rules.MatchIP(net.ParseIP("2001:db8::1")))
+	assert.False(t, rules.MatchIP(net.IP{1, 2, 3, 5}))
+	assert.False(t, rules.MatchIP(net.IP{5, 6, 8, 1}))
+	assert.False(t, rules.MatchIP(net.ParseIP("2001:db9::1")))
+	assert.False(t, (&RuleManager{}).MatchIP(net.IP{1, 2, 3, 4}))
+
+	assert.True(t, rules.Remove("5.6.7.0/24"))
+	assert.False(t, rules.MatchIP(net.IP{5, 6, 7, 8}))
+	assert.True(t, rules.MatchIP(net.IP{1, 2, 3, 4}))
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	fn := filepath.Join(dir, "ips.txt")
+	assert.Nil(t, ioutil.WriteFile(fn, []byte("10.0.0.0/8\n::1\n"), 0644))
+	assert.Nil(t, rules.Load(fn))
+	assert.True(t, rules.MatchIP(net.IP{10, 1, 2, 3}))
+	assert.True(t, rules.MatchIP(net.ParseIP("::1")))
+	assert.False(t, rules.MatchIP(net.IP{1, 2, 3, 4}))
+}
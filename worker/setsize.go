@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Default min. time between the queries of the set size
+const defaultSetSizeInterval = time.Minute
+
+// setSize is the number of elements in the default nftables set of an address family
+type setSize struct {
+	family string // "ip" or "ip6"
+	n      int
+}
+
+// setSizeCache keeps the result of the last "nft list set" commands,
+// so that the metrics requests don't run "nft" every time
+type setSizeCache struct {
+	lock    sync.Mutex
+	sizes   []setSize
+	updated time.Time
+}
+
+var setSizes setSizeCache
+
+// nftListSet runs "nft list set" and returns its output.  It's replaced in tests.
+var nftListSet = func(family, table, set string) ([]byte, error) {
+	return exec.Command("nft", "list", "set", family, table, set).Output()
+}
+
+// get returns the number of elements in the default set of each address family.
+// The sets are queried at most once per interval.
+// The families with no set (or which couldn't be queried) are omitted.
+func (c *setSizeCache) get(nc *NFTConfig, interval time.Duration, now time.Time) []setSize {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.updated.IsZero() && now.Sub(c.updated) < interval {
+		return c.sizes
+	}
+
+	c.sizes = nil
+	for _, family := range []string{"ip", "ip6"} {
+		out, err := nftListSet(family, nc.Table, nc.Set)
+		if err != nil {
+			log.Debug("worker: nft list set %s %s %s: %s", family, nc.Table, nc.Set, err)
+			continue
+		}
+		n, err := parseNFTSetSize(out)
+		if err != nil {
+			log.Debug("worker: nft list set %s %s %s: %s", family, nc.Table, nc.Set, err)
+			continue
+		}
+		c.sizes = append(c.sizes, setSize{family: family, n: n})
+	}
+	c.updated = now
+	return c.sizes
+}
+
+// parseNFTSetSize returns the number of elements from the output of "nft list set":
+// the elements are listed as "elements = { 1.2.3.4 timeout 1h expires 59m58s, ... }",
+// possibly on several lines.  The set with no elements has no "elements" line.
+func parseNFTSetSize(out []byte) (int, error) {
+	if !bytes.Contains(out, []byte("set ")) {
+		return 0, fmt.Errorf("no set in nft output")
+	}
+
+	i := bytes.Index(out, []byte("elements = {"))
+	if i < 0 {
+		return 0, nil
+	}
+	out = out[i+len("elements = {"):]
+	end := bytes.IndexByte(out, '}')
+	if end < 0 {
+		return 0, fmt.Errorf("unterminated list of elements in nft output")
+	}
+
+	n := 0
+	for _, e := range bytes.Split(out[:end], []byte(",")) {
+		if len(bytes.TrimSpace(e)) != 0 {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testNFTSet = `table ip gfw {
+	set temp {
+		type ipv4_addr
+		flags timeout
+		elements = { 1.2.3.4 timeout 1h expires 59m58s, 5.6.7.8 timeout 1h expires 30m,
+			     9.9.9.9 timeout 1d expires 23h59m }
+	}
+}
+`
+
+func TestParseNFTSetSize(t *testing.T) {
+	n, err := parseNFTSetSize([]byte(testNFTSet))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = parseNFTSetSize([]byte("table ip gfw {\n\tset temp {\n\t\ttype ipv4_addr\n\t\tflags timeout\n\t}\n}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = parseNFTSetSize([]byte("table ip gfw {\n\tset temp {\n\t\telements = { 10.0.0.0/8 }\n\t}\n}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = parseNFTSetSize([]byte(""))
+	assert.NotNil(t, err)
+
+	_, err = parseNFTSetSize([]byte("table ip gfw {\n\tset temp {\n\t\telements = { 1.2.3.4,"))
+	assert.NotNil(t, err)
+}
+
+func TestSetSizeCache(t *testing.T) {
+	calls := 0
+	prev := nftListSet
+	nftListSet = func(family, table, set string) ([]byte, error) {
+		calls++
+		if family == "ip6" {
+			return nil, errors.New("no such file or directory")
+		}
+		return []byte(testNFTSet), nil
+	}
+	defer func() { nftListSet = prev }()
+
+	c := setSizeCache{}
+	nc := &NFTConfig{Table: "gfw", Set: "temp"}
+	now := time.Now()
+	assert.Equal(t, []setSize{{family: "ip", n: 3}}, c.get(nc, time.Minute, now))
+	assert.Equal(t, 2, calls)
+
+	// the cached result is used
+	assert.Equal(t, []setSize{{family: "ip", n: 3}}, c.get(nc, time.Minute, now.Add(30*time.Second)))
+	assert.Equal(t, 2, calls)
+
+	c.get(nc, time.Minute, now.Add(time.Minute))
+	assert.Equal(t, 4, calls)
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Counters - statistics of the routing pipeline
+type Counters struct {
+	Routed    uint64 `json:"routed"`     // addresses added to the firewall set
+	Skipped   uint64 `json:"skipped"`    // addresses not routed because of their location (see RouteMode)
+	GeoErrors uint64 `json:"geo_errors"` // failed geo lookups
+	CmdErrors uint64 `json:"cmd_errors"` // failed firewall commands
+}
+
+// counters is updated atomically
+var counters Counters
+
+// Stats returns the current values of the counters
+func Stats() Counters {
+	return Counters{
+		Routed:    atomic.LoadUint64(&counters.Routed),
+		Skipped:   atomic.LoadUint64(&counters.Skipped),
+		GeoErrors: atomic.LoadUint64(&counters.GeoErrors),
+		CmdErrors: atomic.LoadUint64(&counters.CmdErrors),
+	}
+}
+
+// WriteMetrics writes the counters in Prometheus text exposition format
+func WriteMetrics(w io.Writer) error {
+	c := Stats()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_worker_routed_total Number of addresses added to the firewall set.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_worker_routed_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_worker_routed_total %d\n", c.Routed)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_worker_skipped_total Number of addresses not routed because of their country.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_worker_skipped_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_worker_skipped_total %d\n", c.Skipped)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_worker_geo_errors_total Number of failed geo lookups.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_worker_geo_errors_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_worker_geo_errors_total %d\n", c.GeoErrors)
+
+	fmt.Fprintf(bw, "# HELP adguardhome_worker_cmd_errors_total Number of failed firewall commands.\n")
+	fmt.Fprintf(bw, "# TYPE adguardhome_worker_cmd_errors_total counter\n")
+	fmt.Fprintf(bw, "adguardhome_worker_cmd_errors_total %d\n", c.CmdErrors)
+
+	// the size of nftables set is known only if routing is enabled
+	st := loadState()
+	if st.router != nil && st.conf.Backend != "ipset" {
+		fmt.Fprintf(bw, "# HELP adguardhome_worker_set_elements Current number of elements in the firewall set.\n")
+		fmt.Fprintf(bw, "# TYPE adguardhome_worker_set_elements gauge\n")
+		for _, s := range setSizes.get(&st.conf.NFT, st.conf.SetSizeInterval, time.Now()) {
+			fmt.Fprintf(bw, "adguardhome_worker_set_elements{family=%q,set=%q} %d\n", s.family, st.conf.NFT.Set, s.n)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// errGeo fails every lookup
+type errGeo struct{}
+
+func (errGeo) Country(ip net.IP) (string, error) {
+	return "", errors.New("lookup failed")
+}
+
+func TestStats(t *testing.T) {
+	counters = Counters{}
+	defer func() { counters = Counters{} }()
+
+	_ = prepareTestWorker(t, Config{})
+	geo = testGeo{"1.1.1.1": "US", "2.2.2.2": "CN"}
+	defer func() { geo = nil }()
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+
+	a := func(ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+	processResult(dnsResult{qname: "example.org", answers: []dns.RR{a(net.IP{1, 1, 1, 1}), a(net.IP{2, 2, 2, 2})}})
+	queue.close()
+
+	geo = errGeo{}
+	processResult(dnsResult{qname: "example.org", answers: []dns.RR{a(net.IP{3, 3, 3, 3})}})
+
+	assert.Equal(t, Counters{Routed: 1, Skipped: 1, GeoErrors: 1}, Stats())
+
+	buf := bytes.Buffer{}
+	assert.Nil(t, WriteMetrics(&buf))
+	m := buf.String()
+	assert.Contains(t, m, "adguardhome_worker_routed_total 1\n")
+	assert.Contains(t, m, "adguardhome_worker_skipped_total 1\n")
+	assert.Contains(t, m, "adguardhome_worker_geo_errors_total 1\n")
+	assert.Contains(t, m, "adguardhome_worker_cmd_errors_total 0\n")
+}
@@ -1,75 +1,668 @@
 package worker
 
 import (
-	"os/exec"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/AdguardTeam/AdGuardHome/util"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/lionsoul2014/ip2region/binding/golang/ip2region"
 	"github.com/miekg/dns"
 )
 
-var region *ip2region.Ip2Region
+// Config - module configuration
+type Config struct {
+	GeoDBPath string      `yaml:"geo_db_path"` // path to the geo database file
+	Backend   string      `yaml:"backend"`     // firewall backend: "nft" (default), "netlink" or "ipset"
+	NFT       NFTConfig   `yaml:"nft"`
+	IPSet     IPSetConfig `yaml:"ipset"`
 
-func _nftCmd(ip string) error {
-	cmd := exec.Command("nft", "add", "element", "gfw", "temp", "{", ip, "timeout", "24h", "}")
-	return cmd.Run()
+	// Command which adds an address instead of the backend, e.g. ["/usr/local/bin/route-add", "{ip}", "{ttl}"].
+	// The placeholders {ip}, {domain}, {country}, {set} and {ttl} (in seconds) are replaced in every argument.
+	// The command is run without a shell.  The addresses are still removed by the backend.
+	AddCommand []string `yaml:"add_command"`
+
+	// Geo database format: "ip2region" (default) or "maxmind" (GeoIP2/GeoLite2 .mmdb file)
+	GeoBackend string `yaml:"geo_backend"`
+
+	BatchSize     int           `yaml:"batch_size"`     // max. number of addresses added by one command (default: 64)
+	BatchInterval time.Duration `yaml:"batch_interval"` // max. time an address waits in the queue (default: 100ms)
+
+	// A failed command which adds addresses is retried up to AddAttempts times in total (default: 3).
+	// The delay before a retry starts at AddRetryDelay (default: 50ms) and is doubled after each attempt.
+	AddAttempts   int           `yaml:"add_attempts"`
+	AddRetryDelay time.Duration `yaml:"add_retry_delay"`
+
+	// Max. number of DNS answers waiting for processing (default: 1024).
+	// If the queue is full, the new answers aren't routed.
+	QueueSize int `yaml:"queue_size"`
+
+	// An address isn't routed again during this time after it was routed.
+	// If 0, the element timeout of the firewall set is used.
+	DedupTTL time.Duration `yaml:"dedup_ttl"`
+
+	// The element timeout is taken from the TTL of the DNS answer and clamped to this range.
+	// TTLMin default: 1m.  TTLMax default: the element timeout of the firewall set.
+	TTLMin time.Duration `yaml:"ttl_min"`
+	TTLMax time.Duration `yaml:"ttl_max"`
+
+	// Addresses located in these countries aren't routed (case-insensitive).
+	// The names must match the geo database: ip2region uses country names, MaxMind uses ISO codes.
+	// If all of SkipCountries, SkipProvinces and SkipCities are empty, China is used.
+	SkipCountries []string `yaml:"skip_countries"`
+
+	// Addresses located in these provinces (states) or cities aren't routed either (case-insensitive),
+	//  e.g. list the provinces of mainland China instead of the whole country to route Hong Kong.
+	// ip2region uses province and city names, MaxMind uses subdivision ISO codes and English city names
+	//  (a City database is required).
+	SkipProvinces []string `yaml:"skip_provinces"`
+	SkipCities    []string `yaml:"skip_cities"`
+
+	// Which addresses are routed:
+	//  "bypass" (default): the addresses located outside of SkipCountries (e.g. foreign addresses to a proxy)
+	//  "direct": only the addresses located in SkipCountries (e.g. domestic addresses to a direct route)
+	RouteMode string `yaml:"route_mode"`
+
+	// If true, only the domains from the domain list are routed.
+	// The domain list doesn't override the other checks:
+	//  the query must still be whitelisted by a routable filter list.
+	DomainAllowlist bool   `yaml:"domain_allowlist"`
+	DomainsFile     string `yaml:"domains_file"` // file where the domain list is stored
+
+	// The addresses from the IP list (addresses or subnets in CIDR notation) are always routed:
+	//  their location isn't looked up, so SkipCountries and RouteMode don't apply to them
+	IPsFile string `yaml:"ips_file"` // file where the IP list is stored
+
+	// Only the queries whitelisted by a rule from these filter lists are routed.
+	// If empty, the lists with ID >= MinFilterID are used.
+	RoutableFilterIDs []int64 `yaml:"routable_filter_ids"`
+
+	// The smallest ID of a routable filter list (default: 10).
+	// It's ignored if RoutableFilterIDs is set.
+	MinFilterID int64 `yaml:"min_filter_id"`
+
+	// Format of the routing log: "kv" (default, "key=value" pairs) or "text"
+	LogFormat string `yaml:"log_format"`
+
+	// The number of elements in the nftables set reported in the metrics is queried at most once per this interval
+	// (default: 1m)
+	SetSizeInterval time.Duration `yaml:"set_size_interval"`
+
+	// Addresses of the matching domains are added to the specified sets instead of the default one.
+	// The first matching entry is used.
+	DomainSets []DomainSet `yaml:"domain_sets"`
+
+	// Register an HTTP handler
+	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request)) `yaml:"-"`
+
+	skipCountries map[string]bool // normalized SkipCountries
+	skipProvinces map[string]bool // normalized SkipProvinces
+	skipCities    map[string]bool // normalized SkipCities
 }
 
-// ProcessDNSResult process the result
-func ProcessDNSResult(params querylog.AddParams) {
+// DomainSet maps domains to a firewall set
+type DomainSet struct {
+	// "example.com" matches the domain itself,
+	//  "*.example.com" matches its subdomains
+	Domains []string `yaml:"domains"`
+	Set     string   `yaml:"set"`
+}
+
+var defaultSkipCountries = []string{"中国", "China", "CN"}
+
+// Values of RouteMode
+const (
+	routeModeBypass = "bypass"
+	routeModeDirect = "direct"
+)
+
+// The objects set up by Init.
+// Init replaces them under stateLock while DNS results and HTTP requests are processed,
+// so the other code gets them via loadState().
+var conf Config
+var geo GeoLookup
+var router Router
+var queue *batcher
+var results *resultQueue
+var routed *routedCache
+var stateLock sync.RWMutex
+
+var domains RuleManager
+var allowedIPs RuleManager
+
+// state is a consistent snapshot of the objects set up by Init
+type state struct {
+	conf    *Config
+	geo     GeoLookup
+	router  Router
+	queue   *batcher
+	results *resultQueue
+	routed  *routedCache
+}
+
+// loadState returns the current objects.
+// conf is a copy, so it's not affected by the next Init.
+func loadState() state {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	c := conf
+	return state{
+		conf:    &c,
+		geo:     geo,
+		router:  router,
+		queue:   queue,
+		results: results,
+		routed:  routed,
+	}
+}
+
+// disabledOnce makes sure the "routing is disabled" warning is printed just once
+var disabledOnce sync.Once
+
+// ProcessDNSResult passes the result to the background goroutine
+// It never blocks:  if the queue is full, the result is dropped.
+// The responses served from the DNS cache (cached is true) are skipped:
+// their addresses have been routed when the response was received from upstream.
+func ProcessDNSResult(params querylog.AddParams, cached bool) {
+	if cached {
+		return
+	}
+	st := loadState()
+	if st.geo == nil || st.results == nil {
+		disabledOnce.Do(func() {
+			log.Info("worker: geo database isn't loaded, routing is disabled")
+		})
+		return
+	}
+
 	result := params.Result
 
 	if result.IsFiltered || result.Reason != dnsfilter.NotFilteredWhiteList {
 		return
 	}
 
-	if result.FilterID < 10 {
+	if !st.conf.isRoutableFilter(result.FilterID) {
 		return
 	}
 
-	var domain, ip string
-	for _, answer := range params.Answer.Answer {
-		domain = strings.ToLower(answer.Header().Name)
-		domain = domain[:len(domain)-1] // remove last "."
+	if len(params.Question.Question) == 0 {
+		return
+	}
+	if params.Answer == nil || len(params.Answer.Answer) == 0 {
+		return
+	}
+
+	r := dnsResult{
+		qname: strings.ToLower(strings.TrimSuffix(params.Question.Question[0].Name, ".")),
+		// the response may be modified after the request is processed
+		answers:  append([]dns.RR(nil), params.Answer.Answer...),
+		filterID: result.FilterID,
+		client:   params.ClientIP,
+	}
+	_ = st.results.push(r)
+}
+
+// processResult adds the addresses from the DNS answer to the firewall set
+func processResult(r dnsResult) {
+	st := loadState()
+	if !st.conf.isRoutableDomain(r.qname) {
+		return
+	}
 
+	// all addresses are associated with the name the client asked for,
+	//  even if they belong to a CNAME target
+	domain := r.qname
+	set := st.conf.setFor(domain)
+	chain := util.CNAMEChain(r.answers, dns.Fqdn(r.qname))
+	ttls := answerTTLs(r.answers)
+	current := map[string]bool{}
+	local := false
+	for _, answer := range r.answers {
+		var ip net.IP
 		switch answer.Header().Rrtype {
 		case dns.TypeA:
-			ip = answer.(*dns.A).A.String()
+			ip = answer.(*dns.A).A
+		case dns.TypeAAAA:
+			ip = answer.(*dns.AAAA).AAAA
+		}
+
+		if ip == nil {
+			continue
+		}
+
+		if !isGlobalIP(ip) {
+			continue
 		}
 
-		if ip == "" {
+		current[ip.String()] = true
+		now := time.Now()
+		if st.routed.has(ip.String(), now) {
 			continue
 		}
 
-		info, err := region.MemorySearch(ip)
+		loc := Location{}
+		if !allowedIPs.MatchIP(ip) {
+			var err error
+			loc, err = lookupLocation(st.geo, ip)
+			if err != nil {
+				atomic.AddUint64(&counters.GeoErrors, 1)
+				logEvent(routeEvent{action: actionGeoError, domain: domain, ip: ip, filterID: r.filterID, client: r.client, err: err})
+				continue
+			}
+
+			if !st.conf.isRoutableLocation(loc) {
+				atomic.AddUint64(&counters.Skipped, 1)
+				local = true
+				continue
+			}
+		}
+
+		country := loc.Country
+		ttl := clampTTL(ttls[answer.Header().Name], st.conf.TTLMin, st.conf.TTLMax)
+		if st.queue.enqueue(entry{ip: ip, ttl: ttl, domain: domain, country: country, set: set, filterID: r.filterID, client: r.client}) {
+			dedup := st.conf.DedupTTL
+			if ttl < dedup {
+				dedup = ttl
+			}
+			st.routed.set(&routedEntry{
+				IP:         ip.String(),
+				Domain:     domain,
+				Country:    country,
+				Set:        set,
+				Chain:      chain,
+				Client:     clientString(r.client),
+				AddedAt:    now,
+				ExpiresAt:  now.Add(ttl),
+				dedupUntil: now.Add(dedup),
+			}, now)
+		}
+	}
+
+	if local {
+		withdrawStale(st, domain, current, r.filterID, r.client)
+	}
+}
+
+// withdrawStale removes the addresses which were routed for domain
+// but aren't in its current answer any more:
+// the domain now resolves to an address which mustn't be routed (e.g. a local one in "bypass" mode),
+// so the old ones are stale
+func withdrawStale(st state, domain string, current map[string]bool, filterID int64, client net.IP) {
+	for _, s := range st.routed.domainIPs(domain, time.Now()) {
+		if current[s] {
+			continue
+		}
+
+		e, ok := st.routed.get(s)
+		if !ok {
+			continue
+		}
+		ip := net.ParseIP(s)
+		err := st.router.Remove(ip, e.Set)
+		logEvent(routeEvent{action: actionRemove, domain: domain, ip: ip, country: e.Country, set: e.Set, filterID: filterID, client: client, err: err})
 		if err != nil {
-			log.Error("ip2region error:%s", err.Error())
+			atomic.AddUint64(&counters.CmdErrors, 1)
 			continue
 		}
+		st.routed.remove(s)
+	}
+}
 
-		// ignore chinese ip
-		if info.Country == "中国" || info.Country == "China" || info.Country == "CN" {
+// Private and reserved address ranges which are never routed:
+// RFC 1918, shared address space (RFC 6598), "this network", reserved (RFC 1112), unique local (RFC 4193)
+var nonGlobalNets = parseNets("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"0.0.0.0/8", "240.0.0.0/4", "fc00::/7")
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isGlobalIP returns TRUE if ip is a public unicast address
+func isGlobalIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, n := range nonGlobalNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRoutableDomain returns TRUE if addresses of this domain may be routed
+func (c *Config) isRoutableDomain(host string) bool {
+	return !c.DomainAllowlist || domains.Match(host)
+}
+
+// answerTTLs returns the smallest TTL of A and AAAA records for each name
+func answerTTLs(answers []dns.RR) map[string]uint32 {
+	ttls := map[string]uint32{}
+	for _, a := range answers {
+		h := a.Header()
+		if h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA {
 			continue
 		}
+		ttl, ok := ttls[h.Name]
+		if !ok || h.Ttl < ttl {
+			ttls[h.Name] = h.Ttl
+		}
+	}
+	return ttls
+}
+
+// clampTTL converts DNS TTL value (in seconds) to duration within [min..max] range
+func clampTTL(ttl uint32, min, max time.Duration) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < min {
+		return min
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// routeEntries adds the queued addresses to the firewall set
+func routeEntries(entries []entry) {
+	st := loadState()
+	if er, ok := st.router.(entryRouter); ok {
+		for _, e := range entries {
+			e := e
+			logRouted(e, st.conf.withRetry(func() error { return er.addEntry(e) }))
+		}
+		return
+	}
 
-		if err := _nftCmd(ip); err != nil {
-			log.Error("cmd error:%d %s=>%s do %s", result.FilterID, domain, ip, err.Error())
-		} else {
-			// cache.Set(ip, true, 30*time.Second)
-			// log.Info("cmd:%d %s=>%s", result.FilterID, domain, ip)
-			log.Info("setup %s=>%s location %s/%s/%s", domain, ip, info.Country, info.Province, info.City)
+	br, ok := st.router.(batchRouter)
+	if ok && len(entries) > 1 {
+		err := st.conf.withRetry(func() error { return br.AddBatch(entries) })
+		for _, e := range entries {
+			logRouted(e, err)
 		}
+		return
+	}
+
+	for _, e := range entries {
+		e := e
+		logRouted(e, st.conf.withRetry(func() error { return st.router.Add(e.ip, e.set, e.ttl) }))
 	}
 }
 
-func init() {
+// withRetry calls f until it succeeds or AddAttempts attempts fail.
+// The delay between the attempts is doubled every time.
+// Returns the error of the last attempt.
+func (c *Config) withRetry(f func() error) error {
+	delay := c.AddRetryDelay
 	var err error
+	for i := 0; i != c.AddAttempts; i++ {
+		if i != 0 {
+			log.Debug("worker: retrying in %s: %s", delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = f()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// logRouted logs the result of the firewall command and updates the counters
+func logRouted(e entry, err error) {
+	if err != nil {
+		atomic.AddUint64(&counters.CmdErrors, 1)
+	} else {
+		atomic.AddUint64(&counters.Routed, 1)
+	}
+	logEvent(routeEvent{action: actionRoute, domain: e.domain, ip: e.ip, country: e.country, set: e.set, filterID: e.filterID, client: e.client, err: err})
+}
+
+// clientString returns the client address as a string or "" if it's unknown
+func clientString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Init loads the geo database and enables routing.
+// If an error is returned, ProcessDNSResult does nothing.
+func Init(c *Config) error {
+	registerHandlers(c.HTTPRegister)
+
+	cc := *c
+	err := cc.prepare()
+	if err != nil {
+		return err
+	}
+
+	rt, err := newRouter(&cc)
+	if err != nil {
+		return err
+	}
 
-	region, err = ip2region.New("/data/data/ip2region.db")
+	g, err := newGeoLookup(&cc)
 	if err != nil {
-		log.Fatalf("ip2region error:%s", err.Error())
+		return err
+	}
+
+	if len(cc.DomainsFile) != 0 {
+		err = domains.Load(cc.DomainsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't load the domain list: %s", err)
+		}
+	}
+
+	if len(cc.IPsFile) != 0 {
+		err = allowedIPs.Load(cc.IPsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't load the IP list: %s", err)
+		}
+	}
+
+	rc := newRoutedCache()
+	bq := newBatcher(cc.BatchSize, cc.BatchInterval, routeEntries)
+	rq := newResultQueue(cc.QueueSize, processResult)
+
+	stateLock.Lock()
+	conf = cc
+	geo = g
+	router = rt
+	routed = rc
+	queue = bq
+	results = rq
+	stateLock.Unlock()
+	return nil
+}
+
+// prepare sets default values and validates the configuration
+func (c *Config) prepare() error {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 64
+	}
+	if c.BatchInterval <= 0 {
+		c.BatchInterval = 100 * time.Millisecond
+	}
+	if c.AddAttempts <= 0 {
+		c.AddAttempts = 3
+	}
+	if c.AddRetryDelay <= 0 {
+		c.AddRetryDelay = 50 * time.Millisecond
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1024
+	}
+	if c.MinFilterID <= 0 {
+		c.MinFilterID = 10
+	}
+	if c.DedupTTL <= 0 {
+		c.DedupTTL = c.timeout()
+	}
+	if c.TTLMin <= 0 {
+		c.TTLMin = time.Minute
+	}
+	if c.TTLMax <= 0 {
+		c.TTLMax = c.timeout()
+	}
+	if c.SetSizeInterval <= 0 {
+		c.SetSizeInterval = defaultSetSizeInterval
+	}
+	if c.TTLMin > c.TTLMax {
+		return fmt.Errorf("ttl_min must be less or equal than ttl_max")
+	}
+
+	countries := c.SkipCountries
+	if len(countries) == 0 && len(c.SkipProvinces) == 0 && len(c.SkipCities) == 0 {
+		countries = defaultSkipCountries
+	}
+	c.skipCountries = normalizeNames(countries)
+	c.skipProvinces = normalizeNames(c.SkipProvinces)
+	c.skipCities = normalizeNames(c.SkipCities)
+
+	switch c.RouteMode {
+	case "":
+		c.RouteMode = routeModeBypass
+	case routeModeBypass, routeModeDirect:
+	default:
+		return fmt.Errorf("unknown route mode: %s", c.RouteMode)
+	}
+
+	if c.LogFormat != "" && c.LogFormat != "kv" && c.LogFormat != "text" {
+		return fmt.Errorf("unknown log format: %s", c.LogFormat)
+	}
+
+	for i, ds := range c.DomainSets {
+		if len(ds.Set) == 0 {
+			return fmt.Errorf("domain_sets: entry #%d: set name is empty", i+1)
+		}
+		if len(ds.Domains) == 0 {
+			return fmt.Errorf("domain_sets: entry #%d: no domains", i+1)
+		}
+	}
+	return nil
+}
+
+// isRoutableFilter returns TRUE if the queries whitelisted by this filter list may be routed
+func (c *Config) isRoutableFilter(id int64) bool {
+	if len(c.RoutableFilterIDs) == 0 {
+		return id >= c.MinFilterID
+	}
+	for _, rid := range c.RoutableFilterIDs {
+		if rid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// setFor returns the name of the set for the addresses of host.
+// Returns an empty string if the default set must be used.
+func (c *Config) setFor(host string) string {
+	for _, ds := range c.DomainSets {
+		for _, d := range ds.Domains {
+			if matchDomain(host, strings.ToLower(d)) {
+				return ds.Set
+			}
+		}
+	}
+	return ""
+}
+
+// matchDomain checks whether host matches the pattern:
+// either the same name or a wildcard "*.example.com" for its subdomains
+func matchDomain(host, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func normalizeCountry(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// normalizeNames returns the set of the normalized location names
+func normalizeNames(names []string) map[string]bool {
+	m := map[string]bool{}
+	for _, s := range names {
+		m[normalizeCountry(s)] = true
+	}
+	return m
+}
+
+// isSkipCountry returns TRUE if this country is in SkipCountries
+func (c *Config) isSkipCountry(country string) bool {
+	return c.skipCountries[normalizeCountry(country)]
+}
+
+// isSkipLocation returns TRUE if the country, the province or the city is in the skip lists
+func (c *Config) isSkipLocation(loc Location) bool {
+	return c.isSkipCountry(loc.Country) ||
+		(len(loc.Province) != 0 && c.skipProvinces[normalizeCountry(loc.Province)]) ||
+		(len(loc.City) != 0 && c.skipCities[normalizeCountry(loc.City)])
+}
+
+// isRoutableLocation returns TRUE if addresses from this location must be routed in the configured mode
+func (c *Config) isRoutableLocation(loc Location) bool {
+	if c.RouteMode == routeModeDirect {
+		return c.isSkipLocation(loc)
+	}
+	return !c.isSkipLocation(loc)
+}
+
+// Stop stops accepting new DNS answers, processes the pending ones,
+// adds the pending addresses to the firewall set and closes the geo database.
+// If the pending work isn't done before ctx is done, an error is returned
+// and the geo database is left open because it's still in use.
+func Stop(ctx context.Context) error {
+	st := loadState()
+	rq, bq, g := st.results, st.queue, st.geo
+	if rq != nil {
+		rq.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if rq != nil {
+			rq.close()
+		}
+		if bq != nil {
+			bq.close()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("worker: pending work isn't done: %s", ctx.Err())
+	}
+
+	if c, ok := g.(io.Closer); ok {
+		err := c.Close()
+		if err != nil {
+			return fmt.Errorf("worker: closing geo database: %s", err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,478 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/querylog"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRouter records the addresses instead of running a command
+type testRouter struct {
+	lock    sync.Mutex
+	added   []string
+	removed []string
+	sets    map[string]string // IP -> set
+}
+
+func (r *testRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	r.lock.Lock()
+	r.added = append(r.added, ip.String())
+	if r.sets == nil {
+		r.sets = map[string]string{}
+	}
+	r.sets[ip.String()] = set
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *testRouter) Remove(ip net.IP, set string) error {
+	r.lock.Lock()
+	r.removed = append(r.removed, ip.String())
+	r.lock.Unlock()
+	return nil
+}
+
+// prepareTestWorker sets up the module state without loading the geo database
+func prepareTestWorker(t *testing.T, c Config) *testRouter {
+	if c.NFT.Timeout == 0 {
+		c.NFT.Timeout = time.Hour
+	}
+	assert.Nil(t, c.prepare())
+
+	r := &testRouter{}
+	conf = c
+	router = r
+	routed = newRoutedCache()
+	return r
+}
+
+func TestAnswerTTLs(t *testing.T) {
+	answers := []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Ttl: 10}},
+		&dns.A{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Ttl: 300}, A: net.IP{1, 1, 1, 1}},
+		&dns.A{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Ttl: 120}, A: net.IP{2, 2, 2, 2}},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "v6.example.net.", Rrtype: dns.TypeAAAA, Ttl: 600}, AAAA: net.ParseIP("::1")},
+	}
+
+	ttls := answerTTLs(answers)
+	assert.Equal(t, 2, len(ttls))
+	assert.Equal(t, uint32(120), ttls["cdn.example.net."])
+	assert.Equal(t, uint32(600), ttls["v6.example.net."])
+}
+
+func TestClampTTL(t *testing.T) {
+	assert.Equal(t, time.Minute, clampTTL(5, time.Minute, time.Hour))
+	assert.Equal(t, 5*time.Minute, clampTTL(300, time.Minute, time.Hour))
+	assert.Equal(t, time.Hour, clampTTL(86400, time.Minute, time.Hour))
+}
+
+func TestConfigPrepare(t *testing.T) {
+	c := Config{NFT: NFTConfig{Timeout: 24 * time.Hour}}
+	assert.Nil(t, c.prepare())
+	assert.Equal(t, time.Minute, c.TTLMin)
+	assert.Equal(t, 24*time.Hour, c.TTLMax)
+	assert.Equal(t, 24*time.Hour, c.DedupTTL)
+	assert.Equal(t, int64(10), c.MinFilterID)
+
+	c.LogFormat = "json"
+	assert.NotNil(t, c.prepare())
+	c.LogFormat = "text"
+	assert.Nil(t, c.prepare())
+
+	c.TTLMin = 48 * time.Hour
+	assert.NotNil(t, c.prepare())
+}
+
+func TestSkipCountries(t *testing.T) {
+	c := Config{NFT: NFTConfig{Timeout: time.Hour}}
+	assert.Nil(t, c.prepare())
+	assert.True(t, c.isSkipCountry("中国"))
+	assert.True(t, c.isSkipCountry("china"))
+	assert.True(t, c.isSkipCountry("CN"))
+	assert.False(t, c.isSkipCountry("美国"))
+
+	c.SkipCountries = []string{" Germany ", "DE"}
+	assert.Nil(t, c.prepare())
+	assert.True(t, c.isSkipCountry("GERMANY"))
+	assert.True(t, c.isSkipCountry("de"))
+	assert.False(t, c.isSkipCountry("China"))
+}
+
+func TestSkipProvinces(t *testing.T) {
+	c := Config{NFT: NFTConfig{Timeout: time.Hour}, SkipProvinces: []string{"广东省", " Beijing "}}
+	assert.Nil(t, c.prepare())
+	// China isn't skipped by default if provinces are set
+	assert.False(t, c.isSkipCountry("中国"))
+	assert.True(t, c.isSkipLocation(Location{Country: "中国", Province: "广东省", City: "深圳市"}))
+	assert.True(t, c.isSkipLocation(Location{Country: "CN", Province: "BEIJING"}))
+	assert.False(t, c.isSkipLocation(Location{Country: "中国", Province: "香港"}))
+	assert.False(t, c.isSkipLocation(Location{Country: "中国"}))
+
+	c = Config{NFT: NFTConfig{Timeout: time.Hour}, SkipCountries: []string{"US"}, SkipCities: []string{"Shanghai"}}
+	assert.Nil(t, c.prepare())
+	assert.True(t, c.isSkipLocation(Location{Country: "US", Province: "CA"}))
+	assert.True(t, c.isSkipLocation(Location{Country: "CN", Province: "SH", City: "shanghai"}))
+	assert.False(t, c.isSkipLocation(Location{Country: "CN", Province: "SH"}))
+}
+
+// testLocationGeo returns locations from the map
+type testLocationGeo map[string]Location
+
+func (g testLocationGeo) Country(ip net.IP) (string, error) {
+	return g[ip.String()].Country, nil
+}
+
+func (g testLocationGeo) Location(ip net.IP) (Location, error) {
+	return g[ip.String()], nil
+}
+
+func TestRouteProvinces(t *testing.T) {
+	a := func(ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+	answers := []dns.RR{a(net.IP{1, 1, 1, 1}), a(net.IP{2, 2, 2, 2}), a(net.IP{3, 3, 3, 3})}
+	geo = testLocationGeo{
+		"1.1.1.1": {Country: "中国", Province: "香港"},
+		"2.2.2.2": {Country: "中国", Province: "广东省", City: "深圳市"},
+		"3.3.3.3": {Country: "美国"},
+	}
+	defer func() { geo = nil }()
+
+	// the whole country is skipped
+	r := prepareTestWorker(t, Config{})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"3.3.3.3"}, r.added)
+
+	// only the listed province is skipped
+	r = prepareTestWorker(t, Config{SkipProvinces: []string{"广东省"}})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1", "3.3.3.3"}, r.added)
+
+	// only the listed province is routed
+	r = prepareTestWorker(t, Config{SkipProvinces: []string{"广东省"}, RouteMode: "direct"})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"2.2.2.2"}, r.added)
+}
+
+func TestRouteAllowedIPs(t *testing.T) {
+	a := func(ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+	answers := []dns.RR{a(net.IP{1, 1, 1, 1}), a(net.IP{2, 2, 2, 2})}
+	geo = testGeo{"1.1.1.1": "CN", "2.2.2.2": "CN"}
+	defer func() { geo = nil }()
+	allowedIPs = RuleManager{}
+	defer func() { allowedIPs = RuleManager{} }()
+	assert.True(t, allowedIPs.Append("1.1.1.0/24"))
+
+	r := prepareTestWorker(t, Config{})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1"}, r.added)
+
+	// the allowlisted addresses are routed in "direct" mode too
+	geo = testGeo{"1.1.1.1": "US", "2.2.2.2": "CN"}
+	r = prepareTestWorker(t, Config{RouteMode: "direct"})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, r.added)
+}
+
+func TestRouteMode(t *testing.T) {
+	a := func(ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+	answers := []dns.RR{a(net.IP{1, 1, 1, 1}), a(net.IP{2, 2, 2, 2})}
+	geo = testGeo{"1.1.1.1": "US", "2.2.2.2": "CN"}
+	defer func() { geo = nil }()
+
+	// foreign addresses are routed
+	r := prepareTestWorker(t, Config{})
+	assert.Equal(t, routeModeBypass, conf.RouteMode)
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1"}, r.added)
+
+	// domestic addresses are routed
+	r = prepareTestWorker(t, Config{RouteMode: "direct"})
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "example.org", answers: answers})
+	queue.close()
+	assert.Equal(t, []string{"2.2.2.2"}, r.added)
+
+	c := Config{NFT: NFTConfig{Timeout: time.Hour}, RouteMode: "proxy"}
+	assert.NotNil(t, c.prepare())
+}
+
+// testGeo returns countries from the map
+type testGeo map[string]string
+
+func (g testGeo) Country(ip net.IP) (string, error) {
+	return g[ip.String()], nil
+}
+
+func TestProcessResultReclassified(t *testing.T) {
+	r := prepareTestWorker(t, Config{})
+	geo = testGeo{"1.1.1.1": "US", "2.2.2.2": "US", "3.3.3.3": "CN"}
+	defer func() { geo = nil }()
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+
+	a := func(ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "cdn.example.org.", Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+
+	processResult(dnsResult{qname: "cdn.example.org", answers: []dns.RR{a(net.IP{1, 1, 1, 1})}})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1"}, r.added)
+	assert.Equal(t, []string{"1.1.1.1"}, routed.domainIPs("cdn.example.org", time.Now()))
+
+	// the domain resolves to a local address now: the old one is removed,
+	//  the foreign address from the same answer is kept
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+	processResult(dnsResult{qname: "cdn.example.org", answers: []dns.RR{a(net.IP{3, 3, 3, 3}), a(net.IP{2, 2, 2, 2})}})
+	queue.close()
+	assert.Equal(t, []string{"1.1.1.1"}, r.removed)
+	assert.Equal(t, []string{"2.2.2.2"}, routed.domainIPs("cdn.example.org", time.Now()))
+
+	// a foreign answer doesn't remove anything
+	processResult(dnsResult{qname: "cdn.example.org", answers: []dns.RR{a(net.IP{1, 1, 1, 1})}})
+	assert.Equal(t, []string{"1.1.1.1"}, r.removed)
+}
+
+func TestDomainSets(t *testing.T) {
+	r := prepareTestWorker(t, Config{
+		DomainSets: []DomainSet{
+			{Domains: []string{"video.example.org", "*.Video.example.org"}, Set: "streaming"},
+			{Domains: []string{"*.example.org"}, Set: "general"},
+		},
+	})
+	geo = testGeo{"1.1.1.1": "US", "2.2.2.2": "US", "3.3.3.3": "US"}
+	defer func() { geo = nil }()
+	queue = newBatcher(conf.BatchSize, conf.BatchInterval, routeEntries)
+
+	a := func(name string, ip net.IP) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Ttl: 300}, A: ip}
+	}
+	processResult(dnsResult{qname: "cdn.video.example.org", answers: []dns.RR{a("cdn.video.example.org.", net.IP{1, 1, 1, 1})}, client: net.IP{192, 168, 1, 2}})
+	processResult(dnsResult{qname: "www.example.org", answers: []dns.RR{a("www.example.org.", net.IP{2, 2, 2, 2})}})
+	processResult(dnsResult{qname: "example.com", answers: []dns.RR{a("example.com.", net.IP{3, 3, 3, 3})}})
+	queue.close()
+
+	assert.Equal(t, map[string]string{"1.1.1.1": "streaming", "2.2.2.2": "general", "3.3.3.3": ""}, r.sets)
+	e, ok := routed.get("1.1.1.1")
+	assert.True(t, ok)
+	assert.Equal(t, "streaming", e.Set)
+	assert.Equal(t, "192.168.1.2", e.Client)
+	e, _ = routed.get("2.2.2.2")
+	assert.Equal(t, "", e.Client)
+
+	assert.Equal(t, "", conf.setFor("example.org"))
+	assert.Equal(t, "streaming", conf.setFor("video.example.org"))
+
+	c := Config{DomainSets: []DomainSet{{Set: "x"}}}
+	assert.NotNil(t, c.prepare())
+}
+
+func TestRoutableFilters(t *testing.T) {
+	_ = prepareTestWorker(t, Config{})
+	geo = testGeo{}
+	defer func() { geo = nil }()
+
+	var processed []string
+	results = newResultQueue(10, func(r dnsResult) {
+		processed = append(processed, r.qname)
+	})
+
+	send := func(host string, filterID int64, cached bool) {
+		req := &dns.Msg{}
+		req.SetQuestion(host+".", dns.TypeA)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: host + ".", Rrtype: dns.TypeA}, A: net.IP{1, 1, 1, 1}}}
+		ProcessDNSResult(querylog.AddParams{
+			Question: req,
+			Answer:   resp,
+			Result:   &dnsfilter.Result{Reason: dnsfilter.NotFilteredWhiteList, FilterID: filterID},
+		}, cached)
+	}
+
+	// default: lists with ID >= 10
+	send("a.com", 9, false)
+	send("b.com", 10, false)
+
+	// the explicit list
+	conf.RoutableFilterIDs = []int64{0, 5}
+	send("c.com", 10, false)
+	send("d.com", 5, false)
+	send("e.com", 0, false)
+
+	// the cached responses aren't routed
+	send("f.com", 5, true)
+
+	results.close()
+	assert.Equal(t, []string{"b.com", "d.com", "e.com"}, processed)
+}
+
+func TestIsGlobalIP(t *testing.T) {
+	testCases := []struct {
+		ip     string
+		global bool
+	}{
+		{"1.1.1.1", true},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"10.1.2.3", false},        // private
+		{"172.16.0.1", false},      // private
+		{"172.32.0.1", true},       // outside of 172.16.0.0/12
+		{"192.168.1.1", false},     // private
+		{"100.64.0.1", false},      // shared address space
+		{"127.0.0.1", false},       // loopback
+		{"::1", false},             // loopback
+		{"169.254.1.1", false},     // link-local
+		{"fe80::1", false},         // link-local
+		{"224.0.0.251", false},     // multicast
+		{"ff02::fb", false},        // multicast
+		{"0.0.0.0", false},         // unspecified
+		{"::", false},              // unspecified
+		{"255.255.255.255", false}, // broadcast
+		{"fd00::1", false},         // unique local
+		{"::ffff:192.168.1.1", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.global, isGlobalIP(net.ParseIP(tc.ip)), tc.ip)
+	}
+
+	// the address isn't even looked up
+	r := prepareTestWorker(t, Config{})
+	geo = errGeo{}
+	defer func() { geo = nil }()
+	counters = Counters{}
+	defer func() { counters = Counters{} }()
+	processResult(dnsResult{qname: "example.org", answers: []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA}, A: net.IP{192, 168, 1, 1}},
+	}})
+	assert.Equal(t, uint64(0), Stats().GeoErrors)
+	assert.Equal(t, 0, len(r.added))
+}
+
+// flakyRouter fails the first fails calls of Add
+type flakyRouter struct {
+	testRouter
+	fails int
+	calls int
+}
+
+func (r *flakyRouter) Add(ip net.IP, set string, ttl time.Duration) error {
+	r.calls++
+	if r.calls <= r.fails {
+		return errors.New("nft: resource busy")
+	}
+	return r.testRouter.Add(ip, set, ttl)
+}
+
+func TestRouteRetry(t *testing.T) {
+	counters = Counters{}
+	defer func() { counters = Counters{} }()
+
+	_ = prepareTestWorker(t, Config{AddRetryDelay: time.Millisecond})
+	assert.Equal(t, 3, conf.AddAttempts)
+	r := &flakyRouter{fails: 2}
+	router = r
+
+	routeEntries([]entry{{ip: net.IP{1, 2, 3, 4}, ttl: time.Hour}})
+	assert.Equal(t, 3, r.calls)
+	assert.Equal(t, []string{"1.2.3.4"}, r.added)
+	assert.Equal(t, Counters{Routed: 1}, Stats())
+
+	// all attempts have failed
+	r = &flakyRouter{fails: 3}
+	router = r
+	routeEntries([]entry{{ip: net.IP{1, 2, 3, 4}, ttl: time.Hour}})
+	assert.Equal(t, 3, r.calls)
+	assert.Equal(t, 0, len(r.added))
+	assert.Equal(t, Counters{Routed: 1, CmdErrors: 1}, Stats())
+
+	conf.AddAttempts = 1
+	r = &flakyRouter{fails: 1}
+	router = r
+	routeEntries([]entry{{ip: net.IP{1, 2, 3, 4}, ttl: time.Hour}})
+	assert.Equal(t, 1, r.calls)
+	assert.Equal(t, Counters{Routed: 1, CmdErrors: 2}, Stats())
+}
+
+// closingGeo records whether the database has been closed
+type closingGeo struct {
+	testGeo
+	closed bool
+}
+
+func (g *closingGeo) Close() error {
+	g.closed = true
+	return nil
+}
+
+func TestStop(t *testing.T) {
+	r := prepareTestWorker(t, Config{})
+	g := &closingGeo{testGeo: testGeo{}}
+	geo = g
+	defer func() { geo = nil }()
+	queue = newBatcher(conf.BatchSize, time.Hour, routeEntries)
+	results = newResultQueue(10, processResult)
+
+	send := func(host string, ip net.IP) {
+		req := &dns.Msg{}
+		req.SetQuestion(host+".", dns.TypeA)
+		resp := &dns.Msg{}
+		resp.SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: host + ".", Rrtype: dns.TypeA, Ttl: 300}, A: ip}}
+		ProcessDNSResult(querylog.AddParams{
+			Question: req,
+			Answer:   resp,
+			Result:   &dnsfilter.Result{Reason: dnsfilter.NotFilteredWhiteList, FilterID: 10},
+		}, false)
+	}
+
+	// the pending addresses are routed before Stop returns
+	send("a.com", net.IP{1, 1, 1, 1})
+	send("b.com", net.IP{2, 2, 2, 2})
+	assert.Nil(t, Stop(context.Background()))
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, r.added)
+	assert.True(t, g.closed)
+
+	// the new answers are rejected
+	send("c.com", net.IP{3, 3, 3, 3})
+	assert.False(t, results.push(dnsResult{qname: "c.com"}))
+	assert.False(t, queue.enqueue(entry{ip: net.IP{3, 3, 3, 3}}))
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, r.added)
+
+	// the pending work isn't done in time
+	block := make(chan struct{})
+	g = &closingGeo{testGeo: testGeo{}}
+	geo = g
+	queue = newBatcher(conf.BatchSize, time.Hour, routeEntries)
+	results = newResultQueue(10, func(dnsResult) { <-block })
+	assert.True(t, results.push(dnsResult{qname: "d.com"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, Stop(ctx))
+	assert.False(t, g.closed)
+	assert.False(t, results.push(dnsResult{qname: "e.com"}))
+	close(block)
+}